@@ -0,0 +1,45 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
+
+// authenticate resolves the caller of the routes mounted here from their
+// access token and sets "user_id" as the handlers expect. Browsers can't set
+// headers on WebSocket requests, so the token may also come as ?token=.
+func authenticate(secret string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if tokenString == "" {
+            tokenString = c.Query("token")
+        }
+        if tokenString == "" {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
+            return
+        }
+        claims := jwt.MapClaims{}
+        _, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+            return []byte(secret), nil
+        }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+            return
+        }
+        subject, _ := claims["user_id"].(string)
+        if subject == "" {
+            subject, _ = claims.GetSubject()
+        }
+        userID, err := uuid.Parse(subject)
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token subject"})
+            return
+        }
+        c.Set("user_id", userID)
+        c.Next()
+    }
+}
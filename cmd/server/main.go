@@ -13,12 +13,19 @@ import (
     "github.com/joho/godotenv"
     "github.com/rs/zerolog"
     
+    "github.com/D43M0N18/qilin_core/internal/api/handlers"
     "github.com/D43M0N18/qilin_core/internal/api/routes"
     "github.com/D43M0N18/qilin_core/internal/config"
     "github.com/D43M0N18/qilin_core/internal/database"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
     "github.com/D43M0N18/qilin_core/internal/services/websocket"
     "github.com/D43M0N18/qilin_core/internal/services/ai"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/cleanup"
+    "github.com/D43M0N18/qilin_core/internal/services/media"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
     "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/upload"
 )
 
 func main() {
@@ -50,19 +57,154 @@ func main() {
     if err := database.RunMigrations(db); err != nil {
         logger.Fatal().Err(err).Msg("Failed to run migrations")
     }
+    assetRepo := repository.NewAssetRepository(db.DB)
+    if err := assetRepo.Migrate(); err != nil {
+        logger.Fatal().Err(err).Msg("Failed to migrate asset library")
+    }
 
     // 6. Initialize Redis connection
     redisClient := database.NewRedisClient(cfg.Redis)
     defer redisClient.Close()
 
-    // 7. Initialize services
-    storageService := storage.NewS3Service(cfg.Storage)
-    aiService := ai.NewClaudeClient(cfg.AI.AnthropicAPIKey)
-    
-    // 8. Initialize WebSocket hub
-    wsHub := websocket.NewHub()
+    // 7. Initialize WebSocket hub, whose broadcasts reach every replica
+    backplane, err := websocket.NewBackplane(cfg.WebSocket, redisClient)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid WebSocket backplane")
+    }
+    replay, err := websocket.NewReplayBuffer(cfg.WebSocket, redisClient)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid WebSocket replay buffer")
+    }
+    inbox, err := websocket.NewInbox(cfg.WebSocket, redisClient)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid WebSocket inbox")
+    }
+    presence, err := websocket.NewPresenceStore(cfg.WebSocket, redisClient)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid WebSocket presence store")
+    }
+    wsHub := websocket.NewHubWithOptions(websocket.HubOptions{
+        NodeID:      cfg.WebSocket.NodeID,
+        Backplane:   backplane,
+        Replay:      replay,
+        Inbox:       inbox,
+        MaxAttempts: cfg.WebSocket.MaxAttempts,
+        Presence:    presence,
+        IdleAfter:   cfg.WebSocket.IdleAfter,
+    })
     go wsHub.Run()
 
+    // 8. Initialize services
+    attachmentRepo := repository.NewAttachmentRepository(db.DB)
+    videoRepo := repository.NewVideoRepository(db.DB)
+    conversationRepo := repository.NewConversationRepository(db.DB)
+
+    storageService, err := storage.NewStorageService(cfg)
+    if err != nil {
+        logger.Fatal().Err(err).Str("provider", cfg.Storage.Provider).Msg("Failed to initialize storage")
+    }
+    replicas, err := storage.NewReplicaServices(cfg)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Failed to initialize storage replicas")
+    }
+    if len(replicas) > 0 {
+        storageService, err = storage.NewReplicatedStorageService(storageService, replicas, cfg.Storage.ReplicationMode)
+        if err != nil {
+            logger.Fatal().Err(err).Msg("Failed to initialize storage replication")
+        }
+    }
+    if cfg.Storage.Versioning {
+        // Buckets with versioning enabled keep versions themselves
+        if s3Storage, ok := storage.Backend[*storage.S3Service](storageService); !ok || !s3Storage.VersioningEnabled() {
+            storageService = storage.NewVersionedStorageService(storageService, cfg.Storage.MaxVersions)
+        }
+    }
+    if cfg.Storage.EncryptionKeys != "" || cfg.Storage.EncryptionKeyFile != "" {
+        keys, err := storage.LoadKeyRing(cfg.Storage.EncryptionKeys, cfg.Storage.EncryptionKeyFile, cfg.Storage.EncryptionActiveKey)
+        if err != nil {
+            logger.Fatal().Err(err).Msg("Failed to load storage encryption keys")
+        }
+        if cfg.Storage.SigningKey == "" {
+            logger.Fatal().Err(storage.ErrSigningKeyRequired).Msg("Storage encryption needs a signing key for decrypt URLs")
+        }
+        storageService = storage.NewEncryptedStorageService(storageService, keys, cfg.Server.BaseURL, cfg.Storage.SigningKey)
+    }
+    if cfg.Storage.Dedup {
+        storageService = storage.NewDedupStorageService(storageService, redisClient, cfg.Upload.TempDir)
+    }
+    quotaPlans, err := storage.ParseQuotaPlans(cfg.Storage.QuotaPlans)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid storage quota plans")
+    }
+    storageService = storage.NewQuotaStorageService(storageService, redisClient, quotaPlans, cfg.Storage.DefaultPlan)
+    storageEvents := storage.NewEventStorageService(storageService)
+    if cfg.Storage.EventsStream != "" {
+        storageEvents.Subscribe("redis-stream", storage.NewRedisStreamSubscriber(redisClient, cfg.Storage.EventsStream, cfg.Storage.EventsStreamMaxLen))
+    }
+    var eventsWebhook *storage.WebhookSubscriber
+    if cfg.Storage.EventsWebhookURL != "" {
+        eventsWebhook = storage.NewWebhookSubscriber(cfg.Storage.EventsWebhookURL, cfg.Storage.EventsWebhookSecret)
+        storageEvents.Subscribe("webhook", eventsWebhook)
+    }
+    // Contents of an indexed image changed, so its perceptual hash is stale
+    storageService = storageEvents
+    imageHasher := assets.NewImageHasher(assetRepo, storageService)
+    scanner, err := scan.NewScanner(cfg.Upload)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Failed to initialize malware scanner")
+    }
+    if scanner != nil {
+        videos := media.NewAnalyzer(storageService, cfg.Upload)
+        storageService = scan.NewQuarantine(storageService, scanner, redisClient, wsHub.NodeID(), attachmentRepo, wsHub, storage.LoadDerivativeProfiles(cfg.Upload.Derivatives), videos, imageHasher)
+    }
+    urlSigningKeys, err := storage.ParseSigningKeys(cfg.Storage.URLSigningKeys, cfg.Storage.URLSigningSecret)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid storage URL signing keys")
+    }
+    urlTTLs, err := storage.ParseURLTTLs(cfg.Storage.URLTTLs)
+    if err != nil {
+        logger.Fatal().Err(err).Msg("Invalid signed URL TTLs")
+    }
+    mediaBaseURL := cfg.Storage.CDNBaseURL
+    if mediaBaseURL == "" {
+        mediaBaseURL = cfg.Server.BaseURL
+    }
+    signedURLs := storage.NewSignedURLStorageService(storageService, redisClient, urlSigningKeys, mediaBaseURL, cfg.Storage.URLTTL, urlTTLs)
+    storageService = signedURLs
+    aiService := ai.NewClaudeClient(cfg.AI.AnthropicAPIKey)
+    characterSelector := ai.NewCharacterSelector(cfg.AI.AnthropicAPIKey, cfg.AI.MaxTokens, cfg.AI.Temperature)
+
+    // Background workers stop when the server shuts down
+    workerCtx, stopWorkers := context.WithCancel(context.Background())
+    defer stopWorkers()
+
+    // Abort resumable uploads that clients abandoned
+    uploadSessions, err := upload.NewSessionManager(storageService, redisClient, cfg.Upload)
+    if err == nil {
+        go uploadSessions.Run(workerCtx)
+    } else {
+        logger.Warn().Err(err).Msg("Resumable uploads disabled")
+    }
+
+    // Delete objects no attachment or video references
+    orphanCollector := cleanup.NewOrphanCollector(storageService, cleanup.NewDatabaseIndex(attachmentRepo, videoRepo, storageService), redisClient, cfg.Storage.GCGracePeriod, cfg.Storage.GCDryRun)
+    go orphanCollector.Run(workerCtx, cfg.Storage.GCInterval)
+
+    // Deliver storage events to the outbound webhook
+    if eventsWebhook != nil {
+        go eventsWebhook.Run(workerCtx)
+    }
+
+    // Scan quarantined uploads and promote the clean ones
+    if quarantine, ok := storage.Backend[*scan.Quarantine](storageService); ok {
+        go quarantine.Run(workerCtx)
+    }
+
+    // Mirror writes to the storage replicas and repair the ones they missed
+    if replicated, ok := storage.Backend[*storage.ReplicatedStorageService](storageService); ok {
+        go replicated.Run(workerCtx, cfg.Storage.RepairInterval)
+    }
+
     // 9. Set Gin mode based on environment
     if cfg.Server.Environment == "production" {
         gin.SetMode(gin.ReleaseMode)
@@ -74,6 +216,73 @@ func main() {
     
     // 11. Setup routes
     routes.SetupRoutes(router, cfg, db, redisClient, storageService, aiService, wsHub)
+    if localStorage, ok := storage.Backend[*storage.LocalStorageService](storageService); ok {
+        storageHandler := handlers.NewStorageHandler(localStorage)
+        router.GET(storage.LocalFileRoute+"/*key", storageHandler.ServeLocalFile)
+        router.PUT(storage.LocalUploadRoute+"/*key", storageHandler.ReceiveLocalUpload)
+        router.POST(storage.LocalUploadRoute+"/*key", storageHandler.ReceiveLocalUpload)
+    }
+    if encrypted, ok := storage.Backend[*storage.EncryptedStorageService](storageService); ok {
+        router.GET(storage.DecryptRoute+"/*key", handlers.NewDecryptHandler(encrypted).ServeDecrypted)
+    }
+    mediaHandler := handlers.NewMediaHandler(signedURLs)
+    router.GET(storage.MediaRoute+"/*key", mediaHandler.VerifySignedURL, mediaHandler.ServeMedia)
+    router.HEAD(storage.MediaRoute+"/*key", mediaHandler.VerifySignedURL, mediaHandler.ServeMedia)
+
+    // Storage and realtime endpoints, for signed-in users
+    api := router.Group("/api/v1", authenticate(cfg.JWT.Secret))
+    uploadHandler := handlers.NewUploadHandler(attachmentRepo, storageService, imageHasher, cfg)
+    api.GET("/upload/blobs/:sha256", uploadHandler.FindBlob)
+    api.POST("/upload/blobs/:sha256", uploadHandler.AttachBlob)
+    api.GET("/attachments/:id/derivatives/:profile", uploadHandler.GetDerivative)
+    api.GET("/storage/usage", uploadHandler.GetStorageUsage)
+    directUploadHandler := handlers.NewDirectUploadHandler(attachmentRepo, storageService, imageHasher, upload.NewDirectUploads(redisClient, cfg.Upload), cfg)
+    api.POST("/upload/presign", directUploadHandler.PresignUpload)
+    api.POST("/upload/confirm", directUploadHandler.ConfirmUpload)
+    api.PUT("/attachments/:id", uploadHandler.ReplaceAttachment)
+    versionHandler := handlers.NewVersionHandler(attachmentRepo, videoRepo, storageService, imageHasher, cfg)
+    api.GET("/attachments/:id/versions", versionHandler.ListAttachmentVersions)
+    api.GET("/attachments/:id/versions/:version_id", versionHandler.DownloadAttachmentVersion)
+    api.POST("/attachments/:id/versions/:version_id/restore", versionHandler.RestoreAttachmentVersion)
+    api.GET("/videos/:id/versions", versionHandler.ListVideoVersions)
+    api.GET("/videos/:id/versions/:version_id", versionHandler.DownloadVideoVersion)
+    api.POST("/videos/:id/versions/:version_id/restore", versionHandler.RestoreVideoVersion)
+    videoGenerator := ai.NewVideoGenerator(cfg.AI.VideoGenAPIKey, cfg.AI.VideoGenAPIURL, storageService, characterSelector)
+    videoHandler := handlers.NewVideoHandler(videoRepo, conversationRepo, videoGenerator, wsHub)
+    api.POST("/videos/:id/regenerate", videoHandler.RegenerateVideo)
+    streamHandler := handlers.NewStreamHandler(attachmentRepo, videoRepo, storageService)
+    api.GET("/attachments/:id/stream", streamHandler.StreamAttachment)
+    api.HEAD("/attachments/:id/stream", streamHandler.StreamAttachment)
+    api.GET("/videos/:id/stream", streamHandler.StreamVideo)
+    api.HEAD("/videos/:id/stream", streamHandler.StreamVideo)
+    api.POST("/attachments/:id/links/revoke", streamHandler.RevokeAttachmentLinks)
+    api.POST("/videos/:id/links/revoke", streamHandler.RevokeVideoLinks)
+    assetHandler := handlers.NewAssetHandler(assets.NewLibrary(assetRepo, storageService), storageService)
+    api.GET("/assets", assetHandler.ListAssets)
+    api.GET("/assets/tags", assetHandler.ListAssetTags)
+    api.PUT("/assets/:id/tags", assetHandler.SetAssetTags)
+    api.GET("/assets/:id/similar", assetHandler.FindSimilarAssets)
+    chatHandler := handlers.NewChatHandler(conversationRepo, repository.NewMessageRepository(db.DB), wsHub, characterSelector)
+    api.GET("/ws", chatHandler.HandleUserWebSocket)
+    api.GET("/conversations/:id/viewers", chatHandler.GetConversationViewers)
+    inboxHandler := handlers.NewInboxHandler(wsHub)
+    api.GET("/inbox", inboxHandler.ListInbox)
+    api.POST("/inbox/:id/ack", inboxHandler.AckInboxMessage)
+    adminHandler := handlers.NewAdminHandler(orphanCollector, storageService, cfg)
+    api.POST("/admin/storage/gc", adminHandler.RunStorageCollection)
+    api.GET("/admin/storage/gc", adminHandler.GetStorageCollectionReport)
+    api.GET("/admin/storage/objects", adminHandler.ListStorageObjects)
+    api.POST("/admin/storage/rotate-keys", adminHandler.RotateEncryptionKeys)
+    api.POST("/admin/storage/repair", adminHandler.RepairStorageReplicas)
+    api.PUT("/admin/users/:id/storage-plan", adminHandler.SetUserStoragePlan)
+    if uploadSessions != nil {
+        sessionHandler := handlers.NewUploadSessionHandler(attachmentRepo, storageService, imageHasher, uploadSessions, cfg)
+        api.POST("/upload/sessions", sessionHandler.InitUpload)
+        api.GET("/upload/sessions/:id", sessionHandler.GetUploadStatus)
+        api.PUT("/upload/sessions/:id/parts", sessionHandler.UploadChunk)
+        api.POST("/upload/sessions/:id/complete", sessionHandler.CompleteUpload)
+        api.DELETE("/upload/sessions/:id", sessionHandler.AbortUpload)
+    }
 
     // 12. Create HTTP server with timeouts
     srv := &http.Server{
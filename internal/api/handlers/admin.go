@@ -0,0 +1,201 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/services/cleanup"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// AdminHandler handles operator endpoints
+type AdminHandler struct {
+    collector *cleanup.OrphanCollector
+    storage   storage.StorageService
+    config    *config.Config
+}
+
+func NewAdminHandler(collector *cleanup.OrphanCollector, storageService storage.StorageService, cfg *config.Config) *AdminHandler {
+    return &AdminHandler{
+        collector: collector,
+        storage:   storageService,
+        config:    cfg,
+    }
+}
+
+// RunStorageCollection reconciles storage against the database now. Orphans
+// are only reported when dry_run is set.
+// POST /api/v1/admin/storage/gc?dry_run=true
+func (h *AdminHandler) RunStorageCollection(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    dryRun := c.Query("dry_run") == "true"
+    report, err := h.collector.Collect(c.Request.Context(), dryRun)
+    if err != nil {
+        if errors.Is(err, cleanup.ErrCollectionRunning) {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Msg("Storage collection failed")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage collection failed"})
+        return
+    }
+    log.Info().Str("user_id", c.MustGet("user_id").(uuid.UUID).String()).Bool("dry_run", dryRun).Msg("Storage collection triggered")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": report})
+}
+
+// GetStorageCollectionReport returns the report of the last collection
+// GET /api/v1/admin/storage/gc
+func (h *AdminHandler) GetStorageCollectionReport(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    report, err := h.collector.LastReport(c.Request.Context())
+    if err != nil {
+        if errors.Is(err, cleanup.ErrNoReport) {
+            c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Msg("Failed to load storage collection report")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load report"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": report})
+}
+
+// ListStorageObjects lists one page of the stored objects under prefix
+// GET /api/v1/admin/storage/objects?prefix=uploads/&limit=100&continuation_token=
+func (h *AdminHandler) ListStorageObjects(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    limit, _ := strconv.Atoi(c.Query("limit"))
+    page, err := h.storage.ListFilesPage(c.Request.Context(), c.Query("prefix"), storage.ListOptions{
+        Limit:             limit,
+        ContinuationToken: c.Query("continuation_token"),
+    })
+    if err != nil {
+        if errors.Is(err, storage.ErrInvalidListToken) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Msg("Failed to list storage objects")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list objects"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+        "objects":            page.Files,
+        "continuation_token": page.NextContinuationToken,
+    }})
+}
+
+// RotateEncryptionKeys re-wraps the data keys of objects under prefix with
+// the active master key. Run it after changing STORAGE_ENCRYPTION_ACTIVE_KEY
+// and before removing the retired key.
+// POST /api/v1/admin/storage/rotate-keys?prefix=uploads/
+func (h *AdminHandler) RotateEncryptionKeys(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    encrypted, ok := storage.Backend[*storage.EncryptedStorageService](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Storage encryption is disabled"})
+        return
+    }
+    rotated, err := encrypted.RotateKeys(c.Request.Context(), c.Query("prefix"))
+    if err != nil {
+        if errors.Is(err, storage.ErrRotationUnsupported) {
+            c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Int("rotated", rotated).Msg("Key rotation failed")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Key rotation failed", "rotated": rotated})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"key_id": encrypted.ActiveKeyID(), "rotated": rotated}})
+}
+
+// RepairStorageReplicas copies objects under prefix that are missing or
+// incomplete on a storage replica from the primary now
+// POST /api/v1/admin/storage/repair?prefix=uploads/
+func (h *AdminHandler) RepairStorageReplicas(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    replicated, ok := storage.Backend[*storage.ReplicatedStorageService](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Storage replication is disabled"})
+        return
+    }
+    report, err := replicated.Repair(c.Request.Context(), c.Query("prefix"))
+    if err != nil {
+        log.Error().Err(err).Msg("Replica repair failed")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Replica repair failed"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": report})
+}
+
+// SetStoragePlanInput assigns a quota plan
+type SetStoragePlanInput struct {
+    Plan string `json:"plan" binding:"required"`
+}
+
+// SetUserStoragePlan assigns one of the STORAGE_QUOTA_PLANS to a user
+// PUT /api/v1/admin/users/:id/storage-plan
+func (h *AdminHandler) SetUserStoragePlan(c *gin.Context) {
+    if !h.requireAdmin(c) {
+        return
+    }
+    userID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+        return
+    }
+    var input SetStoragePlanInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    quota, ok := storage.Backend[*storage.QuotaStorageService](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Storage quotas are disabled"})
+        return
+    }
+    if err := quota.SetUserPlan(c.Request.Context(), userID, input.Plan); err != nil {
+        if errors.Is(err, storage.ErrUnknownPlan) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Msg("Failed to assign storage plan")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign storage plan"})
+        return
+    }
+    usage, err := quota.UserUsage(c.Request.Context(), userID)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to load storage usage")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load storage usage"})
+        return
+    }
+    log.Info().Str("user_id", userID.String()).Str("plan", input.Plan).Msg("Storage plan assigned")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": usage})
+}
+
+// requireAdmin only lets through users listed in ADMIN_USER_IDS
+func (h *AdminHandler) requireAdmin(c *gin.Context) bool {
+    userID := c.MustGet("user_id").(uuid.UUID).String()
+    for _, adminID := range h.config.Server.AdminUserIDs {
+        if adminID == userID {
+            return true
+        }
+    }
+    c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+    return false
+}
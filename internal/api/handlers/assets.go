@@ -0,0 +1,220 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// AssetHandler lets users browse, tag and search their past uploads, so they
+// can be reused when starting a new video
+type AssetHandler struct {
+    library *assets.Library
+    storage storage.StorageService
+}
+
+// TagAssetInput is the body of a tag request
+type TagAssetInput struct {
+    Tags []string `json:"tags"`
+}
+
+func NewAssetHandler(library *assets.Library, storageService storage.StorageService) *AssetHandler {
+    return &AssetHandler{
+        library: library,
+        storage: storageService,
+    }
+}
+
+// ListAssets returns a page of the caller's uploads, newest first unless
+// sort or order say otherwise. Pass next_cursor back as cursor for the next
+// page; filters and sort must stay the same.
+// GET /api/v1/assets?type=image|video&conversation_id=&from=&to=&tag=&sort=recent|size&order=asc|desc&limit=&cursor=
+func (h *AssetHandler) ListAssets(c *gin.Context) {
+    query := assets.Query{
+        UserID:    c.MustGet("user_id").(uuid.UUID),
+        Type:      c.Query("type"),
+        Sort:      c.Query("sort"),
+        Ascending: c.Query("order") == "asc",
+        Cursor:    c.Query("cursor"),
+    }
+    if order := c.Query("order"); order != "" && order != "asc" && order != "desc" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+        return
+    }
+    if limit := c.Query("limit"); limit != "" {
+        n, err := strconv.Atoi(limit)
+        if err != nil || n <= 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+            return
+        }
+        query.Limit = n
+    }
+    if convID := c.Query("conversation_id"); convID != "" {
+        id, err := uuid.Parse(convID)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+            return
+        }
+        query.ConversationID = id
+    }
+    var ok bool
+    if query.From, ok = parseDateParam(c, "from"); !ok {
+        return
+    }
+    if query.To, ok = parseDateParam(c, "to"); !ok {
+        return
+    }
+    for _, tag := range c.QueryArray("tag") {
+        query.Tags = append(query.Tags, strings.Split(tag, ",")...)
+    }
+
+    page, err := h.library.List(c.Request.Context(), query)
+    if err != nil {
+        if errors.Is(err, assets.ErrInvalidQuery) || errors.Is(err, assets.ErrInvalidCursor) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        log.Error().Err(err).Msg("Failed to list assets")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list assets"})
+        return
+    }
+    for _, asset := range page.Assets {
+        asset.URL = storage.SignURL(h.storage, asset.URL)
+        asset.ThumbnailURL = storage.SignURL(h.storage, asset.ThumbnailURL)
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": page})
+}
+
+// ListAssetTags returns the tags the caller has used
+// GET /api/v1/assets/tags
+func (h *AssetHandler) ListAssetTags(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    tags, err := h.library.Tags(c.Request.Context(), userID)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to list asset tags")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tags"})
+        return
+    }
+    if tags == nil {
+        tags = []string{}
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": tags})
+}
+
+// SetAssetTags replaces the tags of one of the caller's attachments
+// PUT /api/v1/assets/:id/tags
+func (h *AssetHandler) SetAssetTags(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    var input TagAssetInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    tags, err := h.library.SetTags(c.Request.Context(), userID, attachmentID, input.Tags)
+    if err != nil {
+        switch {
+        case errors.Is(err, assets.ErrNotFound):
+            c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        case errors.Is(err, assets.ErrInvalidQuery):
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        default:
+            log.Error().Err(err).Msg("Failed to tag attachment")
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to tag attachment"})
+        }
+        return
+    }
+    if tags == nil {
+        tags = []string{}
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"id": attachmentID, "tags": tags}})
+}
+
+// similarAsset is an asset that looks like the one searched for, with the
+// videos made in the conversation it was used in
+type similarAsset struct {
+    *assets.Asset
+    Distance int                     `json:"distance"`
+    Videos   []*models.VideoResponse `json:"videos"`
+}
+
+// FindSimilarAssets returns the caller's images that look like an image
+// attachment, such as re-shot or cropped photos of the same product, with
+// the videos made from them. max_distance is the largest Hamming distance
+// between perceptual hashes, out of 64 bits.
+// GET /api/v1/assets/:id/similar?max_distance=10&limit=20
+func (h *AssetHandler) FindSimilarAssets(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    maxDistance := assets.DefaultMaxDistance
+    if value := c.Query("max_distance"); value != "" {
+        if maxDistance, err = strconv.Atoi(value); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_distance"})
+            return
+        }
+    }
+    limit, _ := strconv.Atoi(c.Query("limit"))
+
+    matches, err := h.library.Similar(c.Request.Context(), userID, attachmentID, maxDistance, limit)
+    if err != nil {
+        switch {
+        case errors.Is(err, assets.ErrNotFound):
+            c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        case errors.Is(err, assets.ErrInvalidQuery):
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        case errors.Is(err, assets.ErrNotHashable):
+            c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image could not be decoded"})
+        default:
+            log.Error().Err(err).Str("attachment_id", attachmentID.String()).Msg("Failed to find similar assets")
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar assets"})
+        }
+        return
+    }
+    response := make([]similarAsset, len(matches))
+    for n, match := range matches {
+        match.Asset.URL = storage.SignURL(h.storage, match.Asset.URL)
+        match.Asset.ThumbnailURL = storage.SignURL(h.storage, match.Asset.ThumbnailURL)
+        videos := make([]*models.VideoResponse, len(match.Videos))
+        for i, video := range match.Videos {
+            videos[i] = video.ToResponse(false)
+            videos[i].URL = storage.SignURL(h.storage, videos[i].URL)
+            videos[i].ThumbnailURL = storage.SignURL(h.storage, videos[i].ThumbnailURL)
+        }
+        response[n] = similarAsset{Asset: match.Asset, Distance: match.Distance, Videos: videos}
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": response, "count": len(response)})
+}
+
+// parseDateParam reads an RFC 3339 time or a YYYY-MM-DD date from the query
+func parseDateParam(c *gin.Context, name string) (time.Time, bool) {
+    value := c.Query(name)
+    if value == "" {
+        return time.Time{}, true
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, true
+    }
+    if t, err := time.Parse(time.DateOnly, value); err == nil {
+        return t, true
+    }
+    c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " date, use YYYY-MM-DD or RFC 3339"})
+    return time.Time{}, false
+}
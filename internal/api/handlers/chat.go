@@ -5,6 +5,7 @@ import (
     "encoding/json"
     "fmt"
     "net/http"
+    "strconv"
     "strings"
     "time"
 
@@ -162,6 +163,41 @@ func (h *ChatHandler) DeleteConversation(c *gin.Context) {
     })
 }
 
+// GetConversationViewers returns who is viewing a conversation right now,
+// on any replica, and whether each viewer is active or idle. Sockets in the
+// conversation are sent "presence" events as this changes.
+// GET /api/v1/conversations/:id/viewers
+func (h *ChatHandler) GetConversationViewers(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    conversationID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+        return
+    }
+    conversation, err := h.conversationRepo.FindByID(c.Request.Context(), conversationID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+        return
+    }
+    if conversation.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    viewers, err := h.hub.ConversationViewers(c.Request.Context(), conversationID)
+    if err != nil {
+        log.Error().Err(err).Str("conversation_id", conversationID.String()).Msg("Failed to load viewers")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load viewers"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "success": true,
+        "data":    viewers,
+    })
+}
+
+// HandleWebSocket opens a conversation socket. Pass last_seq when
+// reconnecting to be sent the frames missed since.
+// GET /api/v1/ws/conversations/:id?last_seq=
 func (h *ChatHandler) HandleWebSocket(c *gin.Context) {
     userID := c.MustGet("user_id").(uuid.UUID)
     conversationID, err := uuid.Parse(c.Param("id"))
@@ -184,14 +220,52 @@ func (h *ChatHandler) HandleWebSocket(c *gin.Context) {
         return
     }
     client := wsservice.NewClient(h.hub, conn, userID, conversationID, h)
-    h.hub.register <- client
+    // Clients reconnecting after a drop pass the last seq they received
+    if lastSeq, err := strconv.ParseInt(c.Query("last_seq"), 10, 64); err == nil && lastSeq >= 0 {
+        h.hub.Resume(client, lastSeq)
+    } else {
+        h.hub.Register(client)
+    }
     go client.WritePump()
     go client.ReadPump()
     log.Info().Str("user_id", userID.String()).Str("conversation_id", conversationID.String()).Str("client_id", client.GetID()).Msg("WebSocket connection established")
 }
 
+// HandleUserWebSocket opens a user socket, which follows any number of the
+// user's conversations over one connection. Send {"type":"subscribe",
+// "conversation_id":...} to follow one and "unsubscribe" to stop; messages
+// and typing name the conversation they're for.
+// GET /api/v1/ws
+func (h *ChatHandler) HandleUserWebSocket(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to upgrade connection")
+        return
+    }
+    client := wsservice.NewClient(h.hub, conn, userID, uuid.Nil, h)
+    h.hub.Register(client)
+    go client.WritePump()
+    go client.ReadPump()
+    log.Info().Str("user_id", userID.String()).Str("client_id", client.GetID()).Msg("User WebSocket connection established")
+}
+
+// AuthorizeSubscription lets a socket follow only its user's conversations.
+// It runs on every subscribe, so conversations deleted or moved since are
+// refused.
+func (h *ChatHandler) AuthorizeSubscription(ctx context.Context, client *wsservice.Client, conversationID uuid.UUID) error {
+    conversation, err := h.conversationRepo.FindByID(ctx, conversationID)
+    if err != nil || conversation == nil {
+        return fmt.Errorf("conversation not found")
+    }
+    if conversation.UserID != client.GetUserID() {
+        return fmt.Errorf("access denied")
+    }
+    return nil
+}
+
 func (h *ChatHandler) HandleMessage(ctx context.Context, client *wsservice.Client, incomingMsg *wsservice.IncomingMessage) error {
-    conversationID := client.GetConversationID()
+    conversationID := incomingMsg.ConversationID
     userID := client.GetUserID()
     log.Info().Str("conversation_id", conversationID.String()).Str("user_id", userID.String()).Str("content_preview", truncate(incomingMsg.Content, 50)).Msg("Handling incoming message")
     userMessage := &models.Message{
@@ -205,7 +279,7 @@ func (h *ChatHandler) HandleMessage(ctx context.Context, client *wsservice.Clien
     wsMsg := models.NewWebSocketMessage(models.MessageTypeComplete, conversationID, userMessage.ID)
     wsMsg.Role = "user"
     wsMsg.Content = userMessage.Content
-    client.BroadcastToConversationExceptSelf(wsMsg)
+    h.hub.BroadcastToConversation(conversationID, wsMsg, client)
     conversation, _ := h.conversationRepo.FindByID(ctx, conversationID)
     if conversation != nil {
         if conversation.Title == "New Conversation" {
@@ -227,18 +301,18 @@ func (h *ChatHandler) generateAIResponse(ctx context.Context, client *wsservice.
     }
     if err := h.messageRepo.Create(ctx, assistantMessage); err != nil {
         log.Error().Err(err).Msg("Failed to create assistant message")
-        client.SendError("Failed to create response")
+        client.SendConversationError(conversationID, "Failed to create response")
         return
     }
     startMsg := models.NewWebSocketMessage(models.MessageTypeStart, conversationID, assistantMessage.ID)
     startMsg.Role = "assistant"
-    client.BroadcastToConversation(startMsg)
+    h.hub.BroadcastToConversation(conversationID, startMsg, nil)
     responseText := h.generateMockResponse(userMessage.Content)
     words := splitIntoWords(responseText)
     for _, word := range words {
         deltaMsg := models.NewWebSocketMessage(models.MessageTypeDelta, conversationID, assistantMessage.ID)
         deltaMsg.Delta = word + " "
-        client.BroadcastToConversation(deltaMsg)
+        h.hub.BroadcastToConversation(conversationID, deltaMsg, nil)
         assistantMessage.AppendContent(word + " ")
         time.Sleep(50 * time.Millisecond)
     }
@@ -249,12 +323,12 @@ func (h *ChatHandler) generateAIResponse(ctx context.Context, client *wsservice.
     completeMsg := models.NewWebSocketMessage(models.MessageTypeComplete, conversationID, assistantMessage.ID)
     completeMsg.Content = assistantMessage.Content
     completeMsg.Role = "assistant"
-    client.BroadcastToConversation(completeMsg)
+    h.hub.BroadcastCritical(client.GetUserID(), conversationID, completeMsg)
     log.Info().Str("message_id", assistantMessage.ID.String()).Int("content_length", len(assistantMessage.Content)).Msg("AI response completed")
 }
 
-func (h *ChatHandler) HandleTyping(ctx context.Context, client *wsservice.Client) error {
-    client.SendTypingIndicator(true)
+func (h *ChatHandler) HandleTyping(ctx context.Context, client *wsservice.Client, incomingMsg *wsservice.IncomingMessage) error {
+    client.SendTypingIndicatorTo(incomingMsg.ConversationID, true)
     return nil
 }
 
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    wsservice "github.com/D43M0N18/qilin_core/internal/services/websocket"
+)
+
+// InboxHandler serves the critical WebSocket messages a user hasn't acked,
+// for clients that were offline while they were retried
+type InboxHandler struct {
+    hub *wsservice.Hub
+}
+
+func NewInboxHandler(hub *wsservice.Hub) *InboxHandler {
+    return &InboxHandler{
+        hub: hub,
+    }
+}
+
+// ListInbox returns the caller's unacknowledged messages, oldest first. Each
+// payload is the message as it was sent over the WebSocket.
+// GET /api/v1/inbox
+func (h *InboxHandler) ListInbox(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    deliveries, err := h.hub.Pending(c.Request.Context(), userID)
+    if errors.Is(err, wsservice.ErrInboxDisabled) {
+        c.JSON(http.StatusOK, gin.H{"success": true, "data": []*wsservice.Delivery{}})
+        return
+    }
+    if err != nil {
+        log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to read inbox")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read inbox"})
+        return
+    }
+    if deliveries == nil {
+        deliveries = []*wsservice.Delivery{}
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "success": true,
+        "data":    deliveries,
+    })
+}
+
+// AckInboxMessage confirms a message, as an ack over the WebSocket would
+// POST /api/v1/inbox/:id/ack
+func (h *InboxHandler) AckInboxMessage(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    deliveryID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+        return
+    }
+    acked, err := h.hub.Ack(c.Request.Context(), userID, deliveryID)
+    if err != nil && !errors.Is(err, wsservice.ErrInboxDisabled) {
+        log.Error().Err(err).Str("delivery_id", deliveryID.String()).Msg("Failed to ack message")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to ack message"})
+        return
+    }
+    if !acked {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true})
+}
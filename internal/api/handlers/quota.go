@@ -0,0 +1,85 @@
+package handlers
+
+import (
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// respondQuotaExceeded writes a 413 with the quota details if err is a quota
+// rejection and reports whether it did
+func respondQuotaExceeded(c *gin.Context, err error) bool {
+    quotaErr, ok := storage.IsQuotaExceeded(err)
+    if !ok {
+        return false
+    }
+    c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+        "error": "Storage quota exceeded",
+        "code":  "quota_exceeded",
+        "quota": quotaErr,
+    })
+    return true
+}
+
+// checkQuota rejects an upload of size bytes that the user has no room for
+// before it starts. It is used by uploads that bypass StorageService.Upload,
+// which are charged by chargeUpload once they are stored.
+func checkQuota(c *gin.Context, svc storage.StorageService, userID uuid.UUID, size int64) bool {
+    quota, ok := storage.Backend[*storage.QuotaStorageService](svc)
+    if !ok {
+        return true
+    }
+    if err := quota.Check(c.Request.Context(), userID, size); err != nil {
+        if !respondQuotaExceeded(c, err) {
+            log.Error().Err(err).Msg("Failed to check storage quota")
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+        }
+        return false
+    }
+    return true
+}
+
+// chargeUpload charges an upload that was written straight to the backend.
+// An upload the user has no room for is deleted and answered with a 413.
+func chargeUpload(c *gin.Context, svc storage.StorageService, storageKey string, userID uuid.UUID, size int64) bool {
+    quota, ok := storage.Backend[*storage.QuotaStorageService](svc)
+    if !ok {
+        return true
+    }
+    err := quota.Charge(c.Request.Context(), storageKey, userID, storage.UsageUploads, size)
+    if err == nil {
+        return true
+    }
+    if !respondQuotaExceeded(c, err) {
+        // The upload is kept even though the ledger misses it
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to record storage usage")
+        return true
+    }
+    if err := svc.Delete(c.Request.Context(), storageKey); err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to delete rejected upload")
+    }
+    return false
+}
+
+// GetStorageUsage returns the caller's storage usage by category and the
+// limit of their plan
+// GET /api/v1/storage/usage
+func (h *UploadHandler) GetStorageUsage(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    quota, ok := storage.Backend[*storage.QuotaStorageService](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Storage quotas are disabled"})
+        return
+    }
+    usage, err := quota.UserUsage(c.Request.Context(), userID)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to load storage usage")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load storage usage"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": usage})
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+func newQuotaStorage(t *testing.T, limit int64) (storage.StorageService, *storage.QuotaStorageService) {
+    client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+    t.Cleanup(func() { client.Close() })
+    quota := storage.NewQuotaStorageService(storage.NewMemoryStorageService(""), client, map[string]int64{"free": limit}, "free")
+    return storage.NewEventStorageService(quota), quota
+}
+
+func newTestContext() (*gin.Context, *httptest.ResponseRecorder) {
+    gin.SetMode(gin.TestMode)
+    recorder := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(recorder)
+    c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+    return c, recorder
+}
+
+func TestRespondQuotaExceeded(t *testing.T) {
+    c, recorder := newTestContext()
+    assert.False(t, respondQuotaExceeded(c, assert.AnError))
+    assert.False(t, c.Writer.Written())
+
+    err := &storage.QuotaExceededError{Plan: "free", Limit: 100, Used: 90, Requested: 20}
+    require.True(t, respondQuotaExceeded(c, err))
+    assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+    assert.JSONEq(t, `{
+        "error": "Storage quota exceeded",
+        "code": "quota_exceeded",
+        "quota": {"plan": "free", "limit": 100, "used": 90, "requested": 20}
+    }`, recorder.Body.String())
+}
+
+func TestChargeUpload(t *testing.T) {
+    ctx := context.Background()
+    svc, quota := newQuotaStorage(t, 16)
+    userID := uuid.New()
+    store := func(content string) string {
+        result, err := storage.Base(svc).UploadFromReader(ctx, strings.NewReader(content), "direct.txt", "text/plain", int64(len(content)), storage.NewUploadOptions())
+        require.NoError(t, err)
+        return result.StorageKey
+    }
+
+    first := store("0123456789")
+    c, _ := newTestContext()
+    require.True(t, chargeUpload(c, svc, first, userID, 10))
+    usage, err := quota.UserUsage(ctx, userID)
+    require.NoError(t, err)
+    assert.Equal(t, int64(10), usage.Used)
+
+    // An upload past the quota is deleted and answered with a 413
+    second := store("0123456789")
+    c, recorder := newTestContext()
+    require.False(t, chargeUpload(c, svc, second, userID, 10))
+    assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+    var body struct {
+        Code  string                     `json:"code"`
+        Quota storage.QuotaExceededError `json:"quota"`
+    }
+    require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+    assert.Equal(t, "quota_exceeded", body.Code)
+    assert.Equal(t, int64(10), body.Quota.Used)
+    exists, err := svc.Exists(ctx, second)
+    require.NoError(t, err)
+    assert.False(t, exists)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// StorageHandler serves files stored by the local storage backend
+type StorageHandler struct {
+    local *storage.LocalStorageService
+}
+
+func NewStorageHandler(local *storage.LocalStorageService) *StorageHandler {
+    return &StorageHandler{
+        local: local,
+    }
+}
+
+// ServeLocalFile serves a stored file when the request carries a valid
+// signature or the file is public-read
+// GET /storage/files/*key
+func (h *StorageHandler) ServeLocalFile(c *gin.Context) {
+    storageKey := strings.TrimPrefix(c.Param("key"), "/")
+    if err := h.local.VerifyAccess(storageKey, c.Query("expires"), c.Query("signature")); err != nil {
+        status := http.StatusForbidden
+        if errors.Is(err, storage.ErrSignatureExpired) {
+            status = http.StatusGone
+        }
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    metadata, err := h.local.GetMetadata(c.Request.Context(), storageKey)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+        return
+    }
+    file, err := h.local.Open(storageKey)
+    if err != nil {
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to open stored file")
+        c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+        return
+    }
+    defer file.Close()
+    c.Header("Content-Type", metadata.ContentType)
+    if metadata.ETag != "" {
+        c.Header("ETag", "\""+metadata.ETag+"\"")
+    }
+    http.ServeContent(c.Writer, c.Request, metadata.FileName, metadata.LastModified, file)
+}
+
+// ReceiveLocalUpload accepts a direct upload presigned by the local backend,
+// either as a raw PUT body or as a multipart POST form
+// PUT /storage/uploads/*key
+// POST /storage/uploads/*key
+func (h *StorageHandler) ReceiveLocalUpload(c *gin.Context) {
+    storageKey := strings.TrimPrefix(c.Param("key"), "/")
+    var (
+        result *storage.UploadResult
+        err    error
+    )
+    if c.Request.Method == http.MethodPost {
+        file, _, formErr := c.Request.FormFile("file")
+        if formErr != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+            return
+        }
+        defer file.Close()
+        result, err = h.local.AcceptUpload(storageKey, c.PostForm("Content-Type"), c.PostForm("max_size"), c.PostForm("expires"), c.PostForm("signature"), file)
+    } else {
+        result, err = h.local.AcceptUpload(storageKey, c.GetHeader("Content-Type"), c.Query("max_size"), c.Query("expires"), c.Query("signature"), c.Request.Body)
+    }
+    if err != nil {
+        switch {
+        case errors.Is(err, storage.ErrSignatureExpired):
+            c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+        case errors.Is(err, storage.ErrSignatureInvalid):
+            c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        case errors.Is(err, storage.ErrUploadRejected):
+            c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+        default:
+            log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to store direct upload")
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+        }
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"storage_key": result.StorageKey, "size": result.FileSize}})
+}
+
+// DecryptHandler serves encrypted objects decrypted to holders of a signed URL
+type DecryptHandler struct {
+    storage *storage.EncryptedStorageService
+}
+
+func NewDecryptHandler(encrypted *storage.EncryptedStorageService) *DecryptHandler {
+    return &DecryptHandler{
+        storage: encrypted,
+    }
+}
+
+// ServeDecrypted streams an object, decrypting it on the way
+// GET /storage/decrypt/*key
+func (h *DecryptHandler) ServeDecrypted(c *gin.Context) {
+    storageKey := strings.TrimPrefix(c.Param("key"), "/")
+    if err := h.storage.VerifyAccess(storageKey, c.Query("expires"), c.Query("signature")); err != nil {
+        status := http.StatusForbidden
+        if errors.Is(err, storage.ErrSignatureExpired) {
+            status = http.StatusGone
+        }
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    metadata, err := h.storage.GetMetadata(c.Request.Context(), storageKey)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+        return
+    }
+    c.Header("Content-Type", metadata.ContentType)
+    c.Header("Content-Length", strconv.FormatInt(metadata.FileSize, 10))
+    c.Header("Cache-Control", "private, no-store")
+    c.Status(http.StatusOK)
+    if err := h.storage.DownloadToWriter(c.Request.Context(), storageKey, c.Writer); err != nil {
+        // Headers are already sent, so the client sees a truncated body
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to serve decrypted file")
+    }
+}
+
+// mediaCacheMaxAge caps how long shared caches keep signed media, which is
+// how long a revoked link can still be served from a CDN
+const mediaCacheMaxAge = 5 * time.Minute
+
+// MediaHandler serves objects to holders of a URL signed by
+// SignedURLStorageService, directly or through a CDN
+type MediaHandler struct {
+    signed *storage.SignedURLStorageService
+}
+
+func NewMediaHandler(signed *storage.SignedURLStorageService) *MediaHandler {
+    return &MediaHandler{
+        signed: signed,
+    }
+}
+
+// VerifySignedURL aborts requests without a valid, unexpired and unrevoked
+// token for the requested object
+func (h *MediaHandler) VerifySignedURL(c *gin.Context) {
+    storageKey := strings.TrimPrefix(c.Param("key"), "/")
+    err := h.signed.VerifyURL(c.Request.Context(), storageKey, c.Request.URL.Query())
+    switch {
+    case err == nil:
+        c.Next()
+    case errors.Is(err, storage.ErrSignatureExpired), errors.Is(err, storage.ErrLinkRevoked):
+        c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": err.Error()})
+    case errors.Is(err, storage.ErrSignatureInvalid):
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+    default:
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to verify signed URL")
+        c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify signed URL"})
+    }
+}
+
+// ServeMedia streams an object with range support. Shared caches may keep it
+// until the URL expires, but no longer than mediaCacheMaxAge.
+// GET /media/*key
+// HEAD /media/*key
+func (h *MediaHandler) ServeMedia(c *gin.Context) {
+    maxAge := mediaCacheMaxAge
+    if unix, err := strconv.ParseInt(c.Query("expires"), 10, 64); err == nil {
+        maxAge = min(maxAge, time.Until(time.Unix(unix, 0)))
+    }
+    cacheControl := fmt.Sprintf("public, max-age=%d", int(max(maxAge, 0).Seconds()))
+    serveObject(c, h.signed, strings.TrimPrefix(c.Param("key"), "/"), cacheControl)
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// errRangeNotSatisfiable is returned by parseRange for ranges outside the object
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// privateCacheControl keeps authenticated responses out of shared caches
+const privateCacheControl = "private, max-age=0, must-revalidate"
+
+// StreamHandler streams stored media to their owners with HTTP range
+// support, so players can seek in objects that aren't public
+type StreamHandler struct {
+    attachmentRepo *repository.AttachmentRepository
+    videoRepo      *repository.VideoRepository
+    storage        storage.StorageService
+}
+
+func NewStreamHandler(attachmentRepo *repository.AttachmentRepository, videoRepo *repository.VideoRepository, storageService storage.StorageService) *StreamHandler {
+    return &StreamHandler{
+        attachmentRepo: attachmentRepo,
+        videoRepo:      videoRepo,
+        storage:        storageService,
+    }
+}
+
+// StreamAttachment streams an attachment
+// GET /api/v1/attachments/:id/stream
+// HEAD /api/v1/attachments/:id/stream
+func (h *StreamHandler) StreamAttachment(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    attachment, err := h.attachmentRepo.FindByID(c.Request.Context(), attachmentID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return
+    }
+    if attachment.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    switch attachment.Status {
+    case scan.StatusScanning:
+        c.JSON(http.StatusConflict, gin.H{"error": "File is being scanned"})
+        return
+    case scan.StatusInfected:
+        c.JSON(http.StatusGone, gin.H{"error": "File was removed because it contains malware"})
+        return
+    case scan.StatusScanFailed:
+        c.JSON(http.StatusGone, gin.H{"error": "File was removed because it could not be scanned"})
+        return
+    }
+    serveObject(c, h.storage, attachment.StorageKey, privateCacheControl)
+}
+
+// StreamVideo streams a generated video
+// GET /api/v1/videos/:id/stream
+// HEAD /api/v1/videos/:id/stream
+func (h *StreamHandler) StreamVideo(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    videoID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid video ID"})
+        return
+    }
+    video, err := h.videoRepo.FindByID(c.Request.Context(), videoID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+        return
+    }
+    if video.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    if video.StorageKey == "" {
+        c.JSON(http.StatusConflict, gin.H{"error": "Video is not ready"})
+        return
+    }
+    serveObject(c, h.storage, video.StorageKey, privateCacheControl)
+}
+
+// RevokeAttachmentLinks invalidates every signed URL handed out so far for an
+// attachment, its thumbnail and derivatives
+// POST /api/v1/attachments/:id/links/revoke
+func (h *StreamHandler) RevokeAttachmentLinks(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    attachment, err := h.attachmentRepo.FindByID(c.Request.Context(), attachmentID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return
+    }
+    if attachment.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    h.revokeLinks(c, attachment.StorageKey)
+}
+
+// RevokeVideoLinks invalidates every signed URL handed out so far for a
+// generated video and its thumbnail
+// POST /api/v1/videos/:id/links/revoke
+func (h *StreamHandler) RevokeVideoLinks(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    videoID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid video ID"})
+        return
+    }
+    video, err := h.videoRepo.FindByID(c.Request.Context(), videoID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+        return
+    }
+    if video.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    if video.StorageKey == "" {
+        c.JSON(http.StatusConflict, gin.H{"error": "Video is not ready"})
+        return
+    }
+    keys := []string{video.StorageKey}
+    if thumbnailKey, ok := storage.KeyFromURL(h.storage, video.ThumbnailURL); ok {
+        keys = append(keys, thumbnailKey)
+    }
+    h.revokeLinks(c, keys...)
+}
+
+func (h *StreamHandler) revokeLinks(c *gin.Context, storageKeys ...string) {
+    signed, ok := storage.Backend[*storage.SignedURLStorageService](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Signed URLs are disabled"})
+        return
+    }
+    if err := signed.RevokeURLs(c.Request.Context(), storageKeys...); err != nil {
+        log.Error().Err(err).Strs("storage_keys", storageKeys).Msg("Failed to revoke links")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke links"})
+        return
+    }
+    log.Info().Strs("storage_keys", storageKeys).Msg("Signed links revoked")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"revoked": storageKeys}})
+}
+
+// serveObject writes an object honoring Range, If-Range, If-None-Match and
+// If-Modified-Since. Only single ranges are served; a multi-range request
+// gets the whole object.
+func serveObject(c *gin.Context, svc storage.StorageService, storageKey, cacheControl string) {
+    ctx := c.Request.Context()
+    metadata, err := svc.GetMetadata(ctx, storageKey)
+    if err != nil {
+        if errors.Is(err, storage.ErrObjectNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+            return
+        }
+        if errors.Is(err, scan.ErrQuarantined) {
+            c.JSON(http.StatusConflict, gin.H{"error": "File is being scanned"})
+            return
+        }
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to read object metadata")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stream file"})
+        return
+    }
+    etag := ""
+    if metadata.ETag != "" {
+        etag = "\"" + metadata.ETag + "\""
+        c.Header("ETag", etag)
+    }
+    lastModified := metadata.LastModified.UTC().Truncate(time.Second)
+    if !lastModified.IsZero() {
+        c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+    }
+    c.Header("Accept-Ranges", "bytes")
+    c.Header("Cache-Control", cacheControl)
+    if notModified(c.Request, etag, lastModified) {
+        c.Status(http.StatusNotModified)
+        return
+    }
+
+    size := metadata.FileSize
+    offset, length, status := int64(0), size, http.StatusOK
+    if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && rangeApplies(c.GetHeader("If-Range"), etag, lastModified) {
+        start, n, ok, err := parseRange(rangeHeader, size)
+        if err != nil {
+            c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+            c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": err.Error()})
+            return
+        }
+        if ok {
+            offset, length, status = start, n, http.StatusPartialContent
+            c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+        }
+    }
+    c.Header("Content-Type", metadata.ContentType)
+    c.Header("Content-Length", strconv.FormatInt(length, 10))
+    c.Status(status)
+    if c.Request.Method == http.MethodHead || length == 0 {
+        return
+    }
+    // The server's WriteTimeout would cut off any download that takes longer,
+    // so a stream is only bounded by the client going away
+    if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+        log.Warn().Err(err).Msg("Failed to clear the write deadline")
+    }
+    if err := svc.DownloadRange(ctx, storageKey, offset, length, c.Writer); err != nil {
+        // Headers are already sent, so the client sees a truncated body
+        log.Error().Err(err).Str("storage_key", storageKey).Int64("offset", offset).Int64("length", length).Msg("Failed to stream file")
+    }
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+    if inm := r.Header.Get("If-None-Match"); inm != "" {
+        for _, candidate := range strings.Split(inm, ",") {
+            candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+            if candidate == "*" || (etag != "" && candidate == etag) {
+                return true
+            }
+        }
+        return false
+    }
+    if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+        if t, err := http.ParseTime(ims); err == nil {
+            return !lastModified.After(t)
+        }
+    }
+    return false
+}
+
+// rangeApplies evaluates If-Range: the range is only served if the client's
+// copy is still current, judged by a strong ETag or an exact date
+func rangeApplies(ifRange, etag string, lastModified time.Time) bool {
+    if ifRange == "" {
+        return true
+    }
+    if strings.HasPrefix(ifRange, "\"") {
+        return etag != "" && ifRange == etag
+    }
+    t, err := http.ParseTime(ifRange)
+    return err == nil && !lastModified.IsZero() && t.Equal(lastModified)
+}
+
+// parseRange parses a single "bytes=" range against an object of size
+// bytes. ok is false when the header should be ignored and the whole object
+// served.
+func parseRange(header string, size int64) (int64, int64, bool, error) {
+    spec, found := strings.CutPrefix(header, "bytes=")
+    if !found || strings.Contains(spec, ",") {
+        return 0, 0, false, nil
+    }
+    first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+    if !found {
+        return 0, 0, false, nil
+    }
+    if first == "" {
+        // Suffix range: the last n bytes
+        n, err := strconv.ParseInt(last, 10, 64)
+        if err != nil || n < 0 {
+            return 0, 0, false, nil
+        }
+        if n == 0 || size == 0 {
+            return 0, 0, false, errRangeNotSatisfiable
+        }
+        n = min(n, size)
+        return size - n, n, true, nil
+    }
+    start, err := strconv.ParseInt(first, 10, 64)
+    if err != nil || start < 0 {
+        return 0, 0, false, nil
+    }
+    if start >= size {
+        return 0, 0, false, errRangeNotSatisfiable
+    }
+    end := size - 1
+    if last != "" {
+        requested, err := strconv.ParseInt(last, 10, 64)
+        if err != nil || requested < start {
+            return 0, 0, false, nil
+        }
+        end = min(requested, end)
+    }
+    return start, end - start + 1, true, nil
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+func TestParseRange(t *testing.T) {
+    tests := []struct {
+        header        string
+        offset        int64
+        length        int64
+        ok            bool
+        unsatisfiable bool
+    }{
+        {"bytes=0-9", 0, 10, true, false},
+        {"bytes=90-", 90, 10, true, false},
+        {"bytes=-5", 95, 5, true, false},
+        {"bytes=-500", 0, 100, true, false},
+        {"bytes=95-200", 95, 5, true, false},
+        {"bytes= 10-19", 10, 10, true, false},
+        {"bytes=100-", 0, 0, false, true},
+        {"bytes=-0", 0, 0, false, true},
+        {"bytes=0-1,5-6", 0, 0, false, false},
+        {"bytes=9-3", 0, 0, false, false},
+        {"bytes=a-b", 0, 0, false, false},
+        {"bytes=5", 0, 0, false, false},
+        {"items=0-1", 0, 0, false, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.header, func(t *testing.T) {
+            offset, length, ok, err := parseRange(tt.header, 100)
+            assert.Equal(t, tt.offset, offset)
+            assert.Equal(t, tt.length, length)
+            assert.Equal(t, tt.ok, ok)
+            if tt.unsatisfiable {
+                assert.ErrorIs(t, err, errRangeNotSatisfiable)
+            } else {
+                assert.NoError(t, err)
+            }
+        })
+    }
+
+    _, _, _, err := parseRange("bytes=-5", 0)
+    assert.ErrorIs(t, err, errRangeNotSatisfiable, "an empty object has no suffix")
+}
+
+func TestRangeApplies(t *testing.T) {
+    modified := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name         string
+        ifRange      string
+        etag         string
+        lastModified time.Time
+        want         bool
+    }{
+        {"no condition", "", `"abc"`, modified, true},
+        {"matching etag", `"abc"`, `"abc"`, modified, true},
+        {"changed etag", `"abc"`, `"def"`, modified, false},
+        {"weak etag", `W/"abc"`, `"abc"`, modified, false},
+        {"etag without one stored", `"abc"`, "", modified, false},
+        {"exact date", modified.Format(http.TimeFormat), `"abc"`, modified, true},
+        {"older date", modified.Add(-time.Hour).Format(http.TimeFormat), `"abc"`, modified, false},
+        {"date without one stored", modified.Format(http.TimeFormat), `"abc"`, time.Time{}, false},
+        {"malformed date", "yesterday", `"abc"`, modified, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, tt.want, rangeApplies(tt.ifRange, tt.etag, tt.lastModified))
+        })
+    }
+}
+
+func TestNotModified(t *testing.T) {
+    modified := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name    string
+        headers map[string]string
+        etag    string
+        want    bool
+    }{
+        {"no conditions", nil, `"abc"`, false},
+        {"matching etag", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, true},
+        {"one of several etags", map[string]string{"If-None-Match": `"xyz", "abc"`}, `"abc"`, true},
+        {"weak etag", map[string]string{"If-None-Match": `W/"abc"`}, `"abc"`, true},
+        {"wildcard", map[string]string{"If-None-Match": "*"}, "", true},
+        {"changed etag", map[string]string{"If-None-Match": `"xyz"`}, `"abc"`, false},
+        {"etag takes precedence over date", map[string]string{
+            "If-None-Match":     `"xyz"`,
+            "If-Modified-Since": modified.Format(http.TimeFormat),
+        }, `"abc"`, false},
+        {"unmodified since", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, `"abc"`, true},
+        {"modified since", map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}, `"abc"`, false},
+        {"malformed date", map[string]string{"If-Modified-Since": "yesterday"}, `"abc"`, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/", nil)
+            for name, value := range tt.headers {
+                r.Header.Set(name, value)
+            }
+            assert.Equal(t, tt.want, notModified(r, tt.etag, modified))
+        })
+    }
+}
+
+// slowStorage streams an object in chunks, pausing between them
+type slowStorage struct {
+    storage.StorageService
+    pause time.Duration
+}
+
+func (s *slowStorage) DownloadRange(ctx context.Context, storageKey string, offset, length int64, w io.Writer) error {
+    data, err := s.StorageService.Download(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    for _, b := range data[offset : offset+length] {
+        time.Sleep(s.pause)
+        if _, err := w.Write([]byte{b}); err != nil {
+            return err
+        }
+        if flusher, ok := w.(http.Flusher); ok {
+            flusher.Flush()
+        }
+    }
+    return nil
+}
+
+func TestServeObjectOutlivesWriteTimeout(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    backend := storage.NewMemoryStorageService("")
+    opts := storage.NewUploadOptions()
+    opts.StorageKey = "videos/clip.mp4"
+    _, err := backend.UploadFromReader(context.Background(), strings.NewReader("0123456789"), "clip.mp4", "video/mp4", 10, opts)
+    require.NoError(t, err)
+    svc := &slowStorage{StorageService: backend, pause: 30 * time.Millisecond}
+
+    router := gin.New()
+    router.GET("/stream", func(c *gin.Context) {
+        serveObject(c, svc, "videos/clip.mp4", privateCacheControl)
+    })
+    server := httptest.NewUnstartedServer(router)
+    server.Config.WriteTimeout = 100 * time.Millisecond
+    server.Start()
+    defer server.Close()
+
+    resp, err := http.Get(server.URL + "/stream")
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "0123456789", string(body))
+}
@@ -1,11 +1,11 @@
 package handlers
 
 import (
+    "context"
+    "encoding/hex"
+    "errors"
     "fmt"
-    "image"
-    _ "image/gif"
-    _ "image/jpeg"
-    _ "image/png"
+    "io"
     "net/http"
     "path/filepath"
     "strings"
@@ -16,10 +16,13 @@ import (
     "github.com/google/uuid"
     "github.com/rs/zerolog/log"
     
-    "ugc-platform/internal/config"
-    "ugc-platform/internal/database/repository"
-    "ugc-platform/internal/models"
-    "ugc-platform/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/media"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
 )
 
 // UploadHandler handles file upload operations
@@ -27,13 +30,35 @@ import (
 type UploadHandler struct {
     attachmentRepo *repository.AttachmentRepository
     storage        storage.StorageService
+    derivatives    *storage.DerivativeService
+    videos         *media.Analyzer
+    images         *assets.ImageHasher
     config         *config.Config
 }
 
-func NewUploadHandler(attachmentRepo *repository.AttachmentRepository, storage storage.StorageService, cfg *config.Config) *UploadHandler {
+// attachmentWithDerivatives adds the image derivatives, or the video
+// properties, to an attachment response
+type attachmentWithDerivatives struct {
+    *models.AttachmentResponse
+    Derivatives []storage.Derivative `json:"derivatives,omitempty"`
+    Media       *media.Info          `json:"media,omitempty"`
+}
+
+// attachmentResponse is the response for an attachment, with its URLs signed
+func attachmentResponse(svc storage.StorageService, attachment *models.Attachment) *models.AttachmentResponse {
+    response := attachment.ToResponse()
+    response.URL = storage.SignURL(svc, response.URL)
+    response.ThumbnailURL = storage.SignURL(svc, response.ThumbnailURL)
+    return response
+}
+
+func NewUploadHandler(attachmentRepo *repository.AttachmentRepository, storageService storage.StorageService, images *assets.ImageHasher, cfg *config.Config) *UploadHandler {
     return &UploadHandler{
         attachmentRepo: attachmentRepo,
-        storage:        storage,
+        storage:        storageService,
+        derivatives:    storage.NewDerivativeService(storageService, storage.LoadDerivativeProfiles(cfg.Upload.Derivatives)),
+        videos:         media.NewAnalyzer(storageService, cfg.Upload),
+        images:         images,
         config:         cfg,
     }
 }
@@ -63,14 +88,16 @@ func (h *UploadHandler) UploadFile(c *gin.Context) {
         }
     }
     log.Info().Str("user_id", userID.String()).Str("filename", header.Filename).Int64("size", header.Size).Msg("File upload started")
-    if err := h.validateFile(header); err != nil {
+    fileType, err := h.validateFile(header)
+    if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
-    fileType := h.determineFileType(header.Filename)
     opts := storage.NewUploadOptions()
     opts.Folder = "uploads"
     opts.UserID = userID
+    opts.ContentType = fileType
+    opts.KeepColorProfile = c.PostForm("keep_color_profile") == "true"
     opts.Metadata = map[string]string{
         "user_id":      userID.String(),
         "original_name": header.Filename,
@@ -82,46 +109,54 @@ func (h *UploadHandler) UploadFile(c *gin.Context) {
         opts.GenerateThumbnail = true
         opts.ThumbnailWidth = 300
         opts.ThumbnailHeight = 300
+        opts.Derivatives = h.derivatives.Profiles()
+    }
+    quarantine, scanning := storage.Backend[*scan.Quarantine](h.storage)
+    var thumbnail bool
+    if scanning {
+        thumbnail = quarantine.Prepare(opts, header.Filename)
     }
     result, err := h.storage.Upload(c.Request.Context(), file, header, opts)
     if err != nil {
+        if respondQuotaExceeded(c, err) {
+            return
+        }
         log.Error().Err(err).Msg("Failed to upload file")
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
         return
     }
-    var width, height int
-    if strings.HasPrefix(fileType, "image/") {
-        if _, err := file.Seek(0, 0); err == nil {
-            if img, _, err := image.DecodeConfig(file); err == nil {
-                width = img.Width
-                height = img.Height
-            }
-        }
-    }
     attachment := &models.Attachment{
         UserID:       userID,
         FileName:     result.FileName,
         OriginalName: header.Filename,
         FileType:     fileType,
-        FileSize:     header.Size,
-        Width:        width,
-        Height:       height,
+        FileSize:     result.FileSize,
+        Width:        result.Width,
+        Height:       result.Height,
         StorageKey:   result.StorageKey,
         StoragePath:  result.StoragePath,
         URL:          result.URL,
         ThumbnailURL: result.ThumbnailURL,
-        Status:       "uploaded",
+        Status:       initialStatus(scanning),
     }
     if messageID != nil {
         attachment.MessageID = *messageID
     } else {
         attachment.MessageID = uuid.New()
     }
+    var video *media.Info
+    if media.IsVideo(fileType) && !scanning {
+        video = h.analyzeVideo(c.Request.Context(), attachment)
+    }
     if err := h.attachmentRepo.Create(c.Request.Context(), attachment); err != nil {
         log.Error().Err(err).Msg("Failed to save attachment")
+    } else if scanning {
+        submitScan(c, quarantine, attachment, conversationID, thumbnail)
+    } else if strings.HasPrefix(fileType, "image/") {
+        h.hashImage(c.Request.Context(), header, attachment)
     }
-    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", result.StorageKey).Int64("size", header.Size).Msg("File uploaded successfully")
-    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachment.ToResponse()})
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", result.StorageKey).Int64("size", result.FileSize).Msg("File uploaded successfully")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment), Derivatives: result.Derivatives, Media: video}})
 }
 
 func (h *UploadHandler) UploadMultiple(c *gin.Context) {
@@ -146,7 +181,8 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
             conversationID = &id
         }
     }
-    var uploadedFiles []models.AttachmentResponse
+    quarantine, scanning := storage.Backend[*scan.Quarantine](h.storage)
+    var uploadedFiles []attachmentWithDerivatives
     var errors []string
     for _, fileHeader := range files {
         file, err := fileHeader.Open()
@@ -154,7 +190,8 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
             errors = append(errors, fmt.Sprintf("%s: failed to open", fileHeader.Filename))
             continue
         }
-        if err := h.validateFile(fileHeader); err != nil {
+        fileType, err := h.validateFile(fileHeader)
+        if err != nil {
             file.Close()
             errors = append(errors, fmt.Sprintf("%s: %v", fileHeader.Filename, err))
             continue
@@ -162,9 +199,27 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
         opts := storage.NewUploadOptions()
         opts.Folder = "uploads"
         opts.UserID = userID
+        opts.ContentType = fileType
+        opts.KeepColorProfile = c.PostForm("keep_color_profile") == "true"
         opts.GenerateThumbnail = true
+        if strings.HasPrefix(fileType, "image/") {
+            opts.Derivatives = h.derivatives.Profiles()
+        }
+        opts.Metadata["user_id"] = userID.String()
+        opts.Metadata["original_name"] = fileHeader.Filename
+        if conversationID != nil {
+            opts.Metadata["conversation_id"] = conversationID.String()
+        }
+        var thumbnail bool
+        if scanning {
+            thumbnail = quarantine.Prepare(opts, fileHeader.Filename)
+        }
         result, err := h.storage.Upload(c.Request.Context(), file, fileHeader, opts)
         file.Close()
+        if quotaErr, ok := storage.IsQuotaExceeded(err); ok {
+            errors = append(errors, fmt.Sprintf("%s: %v", fileHeader.Filename, quotaErr))
+            continue
+        }
         if err != nil {
             errors = append(errors, fmt.Sprintf("%s: upload failed", fileHeader.Filename))
             continue
@@ -174,16 +229,25 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
             UserID:       userID,
             FileName:     result.FileName,
             OriginalName: fileHeader.Filename,
-            FileType:     h.determineFileType(fileHeader.Filename),
-            FileSize:     fileHeader.Size,
+            FileType:     fileType,
+            FileSize:     result.FileSize,
             StorageKey:   result.StorageKey,
             StoragePath:  result.StoragePath,
             URL:          result.URL,
             ThumbnailURL: result.ThumbnailURL,
-            Status:       "uploaded",
+            Status:       initialStatus(scanning),
+        }
+        var video *media.Info
+        if media.IsVideo(fileType) && !scanning {
+            video = h.analyzeVideo(c.Request.Context(), attachment)
         }
         if err := h.attachmentRepo.Create(c.Request.Context(), attachment); err == nil {
-            uploadedFiles = append(uploadedFiles, *attachment.ToResponse())
+            if scanning {
+                submitScan(c, quarantine, attachment, conversationID, thumbnail)
+            } else if strings.HasPrefix(fileType, "image/") {
+                h.hashImage(c.Request.Context(), fileHeader, attachment)
+            }
+            uploadedFiles = append(uploadedFiles, attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment), Derivatives: result.Derivatives, Media: video})
         }
     }
     response := gin.H{"success": len(uploadedFiles) > 0, "data": uploadedFiles, "count": len(uploadedFiles)}
@@ -209,7 +273,165 @@ func (h *UploadHandler) GetAttachment(c *gin.Context) {
         c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachment.ToResponse()})
+    response := attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment)}
+    if strings.HasPrefix(attachment.FileType, "image/") {
+        response.Derivatives = h.derivatives.List(c.Request.Context(), attachment.StorageKey)
+    }
+    if media.IsVideo(attachment.FileType) {
+        if metadata, err := h.storage.GetMetadata(c.Request.Context(), attachment.StorageKey); err == nil {
+            response.Media = media.InfoFromMetadata(metadata.Metadata)
+        }
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": response})
+}
+
+// GetDerivative returns one derivative of an image attachment, rendering it
+// on first request for lazy profiles
+// GET /api/v1/attachments/:id/derivatives/:profile
+func (h *UploadHandler) GetDerivative(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    attachment, err := h.attachmentRepo.FindByID(c.Request.Context(), attachmentID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return
+    }
+    if attachment.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    if !strings.HasPrefix(attachment.FileType, "image/") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment is not an image"})
+        return
+    }
+    derivative, err := h.derivatives.Get(c.Request.Context(), attachment.StorageKey, c.Param("profile"))
+    if err != nil {
+        if errors.Is(err, storage.ErrUnknownProfile) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Unknown derivative profile"})
+            return
+        }
+        log.Error().Err(err).Str("attachment_id", attachmentID.String()).Msg("Failed to get derivative")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate derivative"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": derivative})
+}
+
+// ReplaceAttachment uploads new contents for an attachment under its
+// existing storage key, so the contents it replaces are kept as a version.
+// An attachment that shares a deduplicated blob gets a key of its own first.
+// PUT /api/v1/attachments/:id
+func (h *UploadHandler) ReplaceAttachment(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return
+    }
+    ctx := c.Request.Context()
+    attachment, err := h.attachmentRepo.FindByID(ctx, attachmentID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return
+    }
+    if attachment.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return
+    }
+    if err := c.Request.ParseMultipartForm(h.config.Upload.MaxFileSize); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "File too large or invalid form data"})
+        return
+    }
+    file, header, err := c.Request.FormFile("file")
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+        return
+    }
+    defer file.Close()
+    fileType, err := h.validateFile(header)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    opts.ContentType = fileType
+    opts.KeepColorProfile = c.PostForm("keep_color_profile") == "true"
+    opts.Metadata = map[string]string{
+        "user_id":       userID.String(),
+        "original_name": header.Filename,
+    }
+    if strings.HasPrefix(fileType, "image/") {
+        opts.GenerateThumbnail = true
+        opts.ThumbnailWidth = 300
+        opts.ThumbnailHeight = 300
+        opts.Derivatives = h.derivatives.Profiles()
+    }
+    sharedBlob := strings.HasPrefix(attachment.StorageKey, storage.BlobFolder+"/")
+    if sharedBlob {
+        // Other attachments may reference the blob, so the history starts
+        // from a private copy of it
+        opts.StorageKey = storage.NewStorageKey(opts, header.Filename)
+        if err := h.storage.Copy(ctx, attachment.StorageKey, opts.StorageKey); err != nil {
+            log.Error().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to copy shared blob")
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace attachment"})
+            return
+        }
+    } else {
+        opts.StorageKey = attachment.StorageKey
+    }
+    result, err := h.storage.Upload(ctx, file, header, opts)
+    if err != nil {
+        if sharedBlob {
+            h.storage.Delete(ctx, opts.StorageKey)
+        }
+        if respondQuotaExceeded(c, err) {
+            return
+        }
+        log.Error().Err(err).Str("attachment_id", attachmentID.String()).Msg("Failed to replace attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace attachment"})
+        return
+    }
+    if err := h.derivatives.ExpireLazy(ctx, result.StorageKey); err != nil {
+        log.Warn().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to expire lazy derivatives")
+    }
+    previousKey := attachment.StorageKey
+    attachment.FileName = result.FileName
+    attachment.OriginalName = header.Filename
+    attachment.FileType = fileType
+    attachment.FileSize = result.FileSize
+    attachment.Width = result.Width
+    attachment.Height = result.Height
+    attachment.StorageKey = result.StorageKey
+    attachment.StoragePath = result.StoragePath
+    attachment.URL = result.URL
+    attachment.ThumbnailURL = result.ThumbnailURL
+    var video *media.Info
+    if media.IsVideo(fileType) {
+        video = h.analyzeVideo(ctx, attachment)
+    }
+    if err := h.attachmentRepo.Update(ctx, attachment); err != nil {
+        log.Error().Err(err).Msg("Failed to update attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update attachment"})
+        return
+    }
+    if strings.HasPrefix(fileType, "image/") {
+        h.hashImage(ctx, header, attachment)
+    } else if err := h.images.Clear(ctx, attachment.ID); err != nil {
+        log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to clear image hash")
+    }
+    if sharedBlob {
+        if err := h.derivatives.DeleteWithDerivatives(ctx, previousKey); err != nil {
+            log.Warn().Err(err).Str("storage_key", previousKey).Msg("Failed to release shared blob")
+        }
+    }
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", result.StorageKey).Int64("size", result.FileSize).Msg("Attachment replaced")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment), Derivatives: result.Derivatives, Media: video}})
 }
 
 func (h *UploadHandler) DeleteAttachment(c *gin.Context) {
@@ -228,13 +450,9 @@ func (h *UploadHandler) DeleteAttachment(c *gin.Context) {
         c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
         return
     }
-    if err := h.storage.Delete(c.Request.Context(), attachment.StorageKey); err != nil {
+    if err := h.derivatives.DeleteWithDerivatives(c.Request.Context(), attachment.StorageKey); err != nil {
         log.Warn().Err(err).Msg("Failed to delete from storage")
     }
-    if attachment.ThumbnailURL != "" {
-        thumbnailKey := strings.Replace(attachment.StorageKey, filepath.Ext(attachment.StorageKey), "_thumb"+filepath.Ext(attachment.StorageKey), 1)
-        h.storage.Delete(c.Request.Context(), thumbnailKey)
-    }
     if err := h.attachmentRepo.Delete(c.Request.Context(), attachmentID); err != nil {
         log.Error().Err(err).Msg("Failed to delete attachment")
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
@@ -269,12 +487,48 @@ func (h *UploadHandler) GeneratePresignedURL(c *gin.Context) {
     c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"url": url, "expires_in": 3600}})
 }
 
-func (h *UploadHandler) validateFile(header *multipart.FileHeader) error {
+// analyzeVideo probes an uploaded video and renders its poster frame, which
+// becomes the attachment's thumbnail. Failures are logged, since a video
+// that can't be probed is still a valid upload.
+func (h *UploadHandler) analyzeVideo(ctx context.Context, attachment *models.Attachment) *media.Info {
+    video, err := h.videos.Analyze(ctx, attachment.StorageKey)
+    if err != nil {
+        log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to analyze video")
+        return nil
+    }
+    if video.Info != nil && video.Info.Width > 0 {
+        attachment.Width, attachment.Height = video.Info.Width, video.Info.Height
+    }
+    if video.Poster != nil {
+        attachment.ThumbnailURL = video.Poster.URL
+    }
+    return video.Info
+}
+
+// hashImage records the perceptual hash of an uploaded image on its
+// attachment, for the asset library's similarity search. The upload is
+// hashed rather than the stored object to save a download; EXIF orientation
+// is applied to both, so the hashes agree.
+func (h *UploadHandler) hashImage(ctx context.Context, header *multipart.FileHeader, attachment *models.Attachment) {
+    file, err := header.Open()
+    if err != nil {
+        log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to reopen image for hashing")
+        return
+    }
+    defer file.Close()
+    if err := h.images.Record(ctx, attachment.ID, file); err != nil {
+        log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to record image hash")
+    }
+}
+
+// validateFile checks the size and extension of an upload and sniffs its
+// content, returning the detected content type
+func (h *UploadHandler) validateFile(header *multipart.FileHeader) (string, error) {
     if header.Size > h.config.Upload.MaxFileSize {
-        return fmt.Errorf("file size exceeds maximum allowed size of %d bytes", h.config.Upload.MaxFileSize)
+        return "", fmt.Errorf("file size exceeds maximum allowed size of %d bytes", h.config.Upload.MaxFileSize)
     }
     if header.Size == 0 {
-        return fmt.Errorf("file is empty")
+        return "", fmt.Errorf("file is empty")
     }
     ext := strings.ToLower(filepath.Ext(header.Filename))
     allowedExts := append(h.config.Upload.AllowedImageExts, h.config.Upload.AllowedVideoExts...)
@@ -286,27 +540,159 @@ func (h *UploadHandler) validateFile(header *multipart.FileHeader) error {
         }
     }
     if !isAllowed {
-        return fmt.Errorf("file type %s is not allowed", ext)
+        return "", fmt.Errorf("file type %s is not allowed", ext)
+    }
+    file, err := header.Open()
+    if err != nil {
+        return "", fmt.Errorf("failed to read file")
+    }
+    defer file.Close()
+    head := make([]byte, storage.SniffLength)
+    n, err := io.ReadFull(file, head)
+    if err != nil && err != io.ErrUnexpectedEOF {
+        return "", fmt.Errorf("failed to read file")
     }
-    return nil
+    return checkFileContent(head[:n], header.Filename)
+}
+
+var fileMimeTypes = map[string]string{
+    ".jpg":  "image/jpeg",
+    ".jpeg": "image/jpeg",
+    ".png":  "image/png",
+    ".gif":  "image/gif",
+    ".webp": "image/webp",
+    ".mp4":  "video/mp4",
+    ".mov":  "video/quicktime",
+    ".avi":  "video/x-msvideo",
+    ".webm": "video/webm",
+    ".pdf":  "application/pdf",
 }
 
-func (h *UploadHandler) determineFileType(filename string) string {
+func fileTypeFromName(filename string) string {
     ext := strings.ToLower(filepath.Ext(filename))
-    mimeTypes := map[string]string{
-        ".jpg":  "image/jpeg",
-        ".jpeg": "image/jpeg",
-        ".png":  "image/png",
-        ".gif":  "image/gif",
-        ".webp": "image/webp",
-        ".mp4":  "video/mp4",
-        ".mov":  "video/quicktime",
-        ".avi":  "video/x-msvideo",
-        ".webm": "video/webm",
-        ".pdf":  "application/pdf",
-    }
-    if mimeType, ok := mimeTypes[ext]; ok {
+    if mimeType, ok := fileMimeTypes[ext]; ok {
         return mimeType
     }
     return "application/octet-stream"
 }
+
+// checkFileContent compares the content type sniffed from the leading bytes
+// of a file with the one its extension claims, and returns the sniffed type.
+// MP4 and QuickTime share a container and are used interchangeably by
+// cameras, so either extension is accepted for either.
+func checkFileContent(head []byte, filename string) (string, error) {
+    detected := storage.SniffContentType(head)
+    expected := fileTypeFromName(filename)
+    if detected == expected || (isISOVideo(detected) && isISOVideo(expected)) {
+        return detected, nil
+    }
+    return detected, fmt.Errorf("file content is %s, which does not match the %s extension", detected, strings.ToLower(filepath.Ext(filename)))
+}
+
+func isISOVideo(contentType string) bool {
+    return contentType == "video/mp4" || contentType == "video/quicktime"
+}
+
+// AttachBlobInput is the body of a request to reuse already uploaded content
+type AttachBlobInput struct {
+    FileName       string     `json:"file_name" binding:"required"`
+    ConversationID *uuid.UUID `json:"conversation_id"`
+    MessageID      *uuid.UUID `json:"message_id"`
+}
+
+// FindBlob reports whether the caller already uploaded content with this
+// SHA-256, so the client can attach it instead of uploading again
+// GET /api/v1/upload/blobs/:sha256?file_name=photo.jpg
+func (h *UploadHandler) FindBlob(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    storageKey, ok := h.blobKey(c, userID, c.Query("file_name"))
+    if !ok {
+        return
+    }
+    metadata, err := h.storage.GetMetadata(c.Request.Context(), storageKey)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Blob not found"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+        "storage_key":  storageKey,
+        "sha256":       metadata.SHA256,
+        "file_size":    metadata.FileSize,
+        "content_type": metadata.ContentType,
+    }})
+}
+
+// AttachBlob creates an attachment that references content the caller
+// already uploaded, without uploading it again
+// POST /api/v1/upload/blobs/:sha256
+func (h *UploadHandler) AttachBlob(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    var input AttachBlobInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    storageKey, ok := h.blobKey(c, userID, input.FileName)
+    if !ok {
+        return
+    }
+    counter, ok := storage.Backend[storage.ReferenceCounter](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Deduplication is disabled"})
+        return
+    }
+    ctx := c.Request.Context()
+    metadata, err := h.storage.GetMetadata(ctx, storageKey)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Blob not found"})
+        return
+    }
+    if _, err := counter.Retain(ctx, storageKey); err != nil {
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to reference blob")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to attach file"})
+        return
+    }
+    attachment := &models.Attachment{
+        UserID:       userID,
+        FileName:     metadata.FileName,
+        OriginalName: input.FileName,
+        FileType:     metadata.ContentType,
+        FileSize:     metadata.FileSize,
+        StorageKey:   storageKey,
+        StoragePath:  storageKey,
+        URL:          storage.ObjectURL(h.storage, storageKey),
+        Status:       "uploaded",
+    }
+    if input.MessageID != nil {
+        attachment.MessageID = *input.MessageID
+    } else {
+        attachment.MessageID = uuid.New()
+    }
+    var derivatives []storage.Derivative
+    if strings.HasPrefix(metadata.ContentType, "image/") {
+        derivatives = h.derivatives.List(ctx, storageKey)
+    }
+    if err := h.attachmentRepo.Create(ctx, attachment); err != nil {
+        counter.Release(ctx, storageKey)
+        log.Error().Err(err).Msg("Failed to save attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+        return
+    }
+    hashStoredImage(ctx, h.images, attachment)
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", storageKey).Msg("Existing blob attached")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment), Derivatives: derivatives}})
+}
+
+// blobKey validates the :sha256 parameter and returns the caller's blob key
+func (h *UploadHandler) blobKey(c *gin.Context, userID uuid.UUID, filename string) (string, bool) {
+    sum := strings.ToLower(c.Param("sha256"))
+    if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SHA-256"})
+        return "", false
+    }
+    if filename == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "file_name is required"})
+        return "", false
+    }
+    return storage.BlobKey(userID, sum, filename), true
+}
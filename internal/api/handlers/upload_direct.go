@@ -0,0 +1,320 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "path"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/upload"
+)
+
+// DirectUploadHandler hands out presigned upload URLs so clients upload
+// straight to storage, and records the attachment once they confirm
+type DirectUploadHandler struct {
+    attachmentRepo *repository.AttachmentRepository
+    storage        storage.StorageService
+    images         *assets.ImageHasher
+    uploads        *upload.DirectUploads
+    config         *config.Config
+}
+
+// PresignUploadInput is the body of a presigned upload request
+type PresignUploadInput struct {
+    FileName string `json:"file_name" binding:"required"`
+    FileSize int64  `json:"file_size" binding:"required,gt=0"`
+    Method   string `json:"method"` // PUT (default) or POST
+}
+
+// PresignUploadResponse is a presigned upload and the ID to confirm it with
+type PresignUploadResponse struct {
+    UploadID uuid.UUID `json:"upload_id"`
+    *storage.PresignedUpload
+}
+
+// ConfirmUploadInput is the body of a direct upload confirmation
+type ConfirmUploadInput struct {
+    UploadID       uuid.UUID  `json:"upload_id" binding:"required"`
+    ConversationID *uuid.UUID `json:"conversation_id"`
+    MessageID      *uuid.UUID `json:"message_id"`
+}
+
+func NewDirectUploadHandler(attachmentRepo *repository.AttachmentRepository, storage storage.StorageService, images *assets.ImageHasher, uploads *upload.DirectUploads, cfg *config.Config) *DirectUploadHandler {
+    return &DirectUploadHandler{
+        attachmentRepo: attachmentRepo,
+        storage:        storage,
+        images:         images,
+        uploads:        uploads,
+        config:         cfg,
+    }
+}
+
+// PresignUpload returns a URL the client uploads the file to directly. The
+// URL only accepts the declared content type and size.
+// POST /api/v1/upload/presign
+func (h *DirectUploadHandler) PresignUpload(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    var input PresignUploadInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateDeclaredUpload(h.config, input.FileName, input.FileSize); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if !checkQuota(c, h.storage, userID, input.FileSize) {
+        return
+    }
+    uploader, ok := storage.Backend[storage.PresignedUploader](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Direct uploads are not supported by this storage backend"})
+        return
+    }
+    policy := storage.UploadPolicy{
+        Method:      strings.ToUpper(input.Method),
+        ContentType: fileTypeFromName(input.FileName),
+        MaxSize:     input.FileSize,
+        Expiry:      h.config.Upload.PresignExpiry,
+    }
+    switch policy.Method {
+    case "":
+        policy.Method = storage.PresignMethodPut
+    case storage.PresignMethodPut:
+    case storage.PresignMethodPost:
+        // POST policies carry a size range, so allow up to the configured limit
+        policy.MaxSize = h.config.Storage.MaxUploadSize
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Method must be PUT or POST"})
+        return
+    }
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    presigned, err := uploader.PresignUpload(c.Request.Context(), storage.NewStorageKey(opts, input.FileName), policy)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to presign upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+        return
+    }
+    issued, err := h.uploads.Issue(c.Request.Context(), userID, input.FileName, presigned.StorageKey)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to record presigned upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+        return
+    }
+    log.Info().Str("user_id", userID.String()).Str("upload_id", issued.ID.String()).Str("storage_key", presigned.StorageKey).Str("method", presigned.Method).Msg("Presigned direct upload")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": PresignUploadResponse{UploadID: issued.ID, PresignedUpload: presigned}})
+}
+
+// ConfirmUpload verifies a direct upload landed in storage, checks its actual
+// content type and creates the attachment. Each presigned upload can be
+// confirmed once.
+// POST /api/v1/upload/confirm
+func (h *DirectUploadHandler) ConfirmUpload(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    var input ConfirmUploadInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    ctx := c.Request.Context()
+    issued, err := h.uploads.Get(ctx, userID, input.UploadID)
+    if err != nil {
+        if errors.Is(err, upload.ErrDirectUploadNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+            return
+        }
+        log.Error().Err(err).Str("upload_id", input.UploadID.String()).Msg("Failed to load direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    metadata, err := h.storage.GetMetadata(ctx, issued.StorageKey)
+    if err != nil {
+        if errors.Is(err, storage.ErrObjectNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+            return
+        }
+        log.Error().Err(err).Str("storage_key", issued.StorageKey).Msg("Failed to check direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    if err := h.uploads.Claim(ctx, issued.ID); err != nil {
+        if errors.Is(err, upload.ErrDirectUploadNotFound) {
+            c.JSON(http.StatusConflict, gin.H{"error": "Upload was already confirmed"})
+            return
+        }
+        log.Error().Err(err).Str("upload_id", issued.ID.String()).Msg("Failed to claim direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    // The presigned URL stays valid until it expires, so the upload moves to
+    // a key the client can't write to before its content is checked
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    storageKey := storage.NewStorageKey(opts, issued.FileName)
+    if err := storage.Base(h.storage).Move(ctx, issued.StorageKey, storageKey); err != nil {
+        log.Error().Err(err).Str("storage_key", issued.StorageKey).Msg("Failed to move direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    if metadata.FileSize > h.config.Storage.MaxUploadSize {
+        h.rejectUpload(c, storageKey, http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed size")
+        return
+    }
+    head, err := storage.ReadHead(ctx, h.storage, storageKey, storage.SniffLength)
+    if err != nil {
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to read direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    fileType, err := checkFileContent(head, storageKey)
+    if err != nil {
+        h.rejectUpload(c, storageKey, http.StatusUnsupportedMediaType, err.Error())
+        return
+    }
+    if err := encryptUpload(ctx, h.storage, storageKey); err != nil {
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to encrypt direct upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm upload"})
+        return
+    }
+    deduped, err := dedupUpload(ctx, h.storage, storageKey, userID)
+    if err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to deduplicate direct upload")
+    }
+    if deduped != nil {
+        storageKey = deduped.StorageKey
+    } else if err := replicateUpload(ctx, h.storage, storageKey); err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to replicate direct upload")
+    }
+    // The declared size was checked at presign time, the stored size is charged here
+    if !chargeUpload(c, h.storage, storageKey, userID, metadata.FileSize) {
+        return
+    }
+    announceUpload(c, h.storage, storageKey, userID, fileType, metadata.FileSize)
+    attachment := &models.Attachment{
+        UserID:       userID,
+        FileName:     path.Base(storageKey),
+        OriginalName: issued.FileName,
+        FileType:     fileType,
+        FileSize:     metadata.FileSize,
+        StorageKey:   storageKey,
+        StoragePath:  storageKey,
+        URL:          storage.ObjectURL(h.storage, storageKey),
+    }
+    quarantine, scanning := storage.Backend[*scan.Quarantine](h.storage)
+    attachment.Status = initialStatus(scanning)
+    if input.MessageID != nil {
+        attachment.MessageID = *input.MessageID
+    } else {
+        attachment.MessageID = uuid.New()
+    }
+    if err := h.attachmentRepo.Create(ctx, attachment); err != nil {
+        log.Error().Err(err).Msg("Failed to save attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+        return
+    }
+    if scanning {
+        submitScan(c, quarantine, attachment, input.ConversationID, false)
+    } else {
+        hashStoredImage(ctx, h.images, attachment)
+    }
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", storageKey).Int64("size", metadata.FileSize).Msg("Direct upload confirmed")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentResponse(h.storage, attachment)})
+}
+
+// announceUpload emits object.created for an upload that was written straight
+// to the backend
+func announceUpload(c *gin.Context, svc storage.StorageService, storageKey string, userID uuid.UUID, contentType string, size int64) {
+    events, ok := storage.Backend[*storage.EventStorageService](svc)
+    if !ok {
+        return
+    }
+    events.Publish(c.Request.Context(), storage.Event{
+        Type:        storage.EventObjectCreated,
+        StorageKey:  storageKey,
+        Size:        size,
+        ContentType: contentType,
+        UserID:      userID,
+    })
+}
+
+// initialStatus is the status new attachments are created with
+func initialStatus(scanning bool) string {
+    if scanning {
+        return scan.StatusScanning
+    }
+    return scan.StatusUploaded
+}
+
+// submitScan queues the malware scan of a new attachment. Its status stays
+// "scanning" until the scan finishes.
+func submitScan(c *gin.Context, quarantine *scan.Quarantine, attachment *models.Attachment, conversationID *uuid.UUID, thumbnail bool) {
+    job := scan.Job{
+        AttachmentID: attachment.ID,
+        StorageKey:   attachment.StorageKey,
+        UserID:       attachment.UserID,
+        Thumbnail:    thumbnail,
+    }
+    if conversationID != nil {
+        job.ConversationID = *conversationID
+    }
+    if err := quarantine.Submit(c.Request.Context(), job); err != nil {
+        log.Error().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to queue malware scan")
+    }
+}
+
+// hashStoredImage records the perceptual hash of an image that was uploaded
+// straight to the backend on its attachment
+func hashStoredImage(ctx context.Context, images *assets.ImageHasher, attachment *models.Attachment) {
+    if !strings.HasPrefix(attachment.FileType, "image/") {
+        return
+    }
+    if err := images.RecordObject(ctx, attachment.ID, attachment.StorageKey); err != nil {
+        log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to record image hash")
+    }
+}
+
+// encryptUpload encrypts an upload that bypassed the storage service when
+// encryption at rest is enabled
+func encryptUpload(ctx context.Context, svc storage.StorageService, storageKey string) error {
+    encrypted, ok := storage.Backend[*storage.EncryptedStorageService](svc)
+    if !ok {
+        return nil
+    }
+    return encrypted.Encrypt(ctx, storageKey)
+}
+
+// replicateUpload mirrors an upload that bypassed the storage service to the
+// replicas. Encrypted uploads were already rewritten through the replicated
+// backend.
+func replicateUpload(ctx context.Context, svc storage.StorageService, storageKey string) error {
+    replicated, ok := storage.Backend[*storage.ReplicatedStorageService](svc)
+    if !ok {
+        return nil
+    }
+    if _, encrypted := storage.Backend[*storage.EncryptedStorageService](svc); encrypted {
+        return nil
+    }
+    return replicated.Replicate(ctx, storageKey)
+}
+
+// rejectUpload deletes an upload that failed confirmation so it doesn't linger
+func (h *DirectUploadHandler) rejectUpload(c *gin.Context, storageKey string, status int, message string) {
+    if err := h.storage.Delete(c.Request.Context(), storageKey); err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to delete rejected upload")
+    }
+    c.JSON(status, gin.H{"error": message})
+}
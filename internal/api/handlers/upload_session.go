@@ -0,0 +1,329 @@
+package handlers
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/upload"
+)
+
+// UploadSessionHandler handles resumable chunked uploads
+type UploadSessionHandler struct {
+    attachmentRepo *repository.AttachmentRepository
+    storage        storage.StorageService
+    images         *assets.ImageHasher
+    sessions       *upload.SessionManager
+    config         *config.Config
+}
+
+// InitUploadInput is the body of an upload session init request
+type InitUploadInput struct {
+    FileName       string     `json:"file_name" binding:"required"`
+    FileSize       int64      `json:"file_size" binding:"required,gt=0"`
+    ConversationID *uuid.UUID `json:"conversation_id"`
+    MessageID      *uuid.UUID `json:"message_id"`
+}
+
+func NewUploadSessionHandler(attachmentRepo *repository.AttachmentRepository, storage storage.StorageService, images *assets.ImageHasher, sessions *upload.SessionManager, cfg *config.Config) *UploadSessionHandler {
+    return &UploadSessionHandler{
+        attachmentRepo: attachmentRepo,
+        storage:        storage,
+        images:         images,
+        sessions:       sessions,
+        config:         cfg,
+    }
+}
+
+// InitUpload starts a resumable upload
+// POST /api/v1/upload/sessions
+func (h *UploadSessionHandler) InitUpload(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    var input InitUploadInput
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateDeclaredUpload(h.config, input.FileName, input.FileSize); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if !checkQuota(c, h.storage, userID, input.FileSize) {
+        return
+    }
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    opts.Metadata = map[string]string{
+        "user_id":       userID.String(),
+        "original_name": input.FileName,
+    }
+    if input.ConversationID != nil {
+        opts.Metadata["conversation_id"] = input.ConversationID.String()
+    }
+    if input.MessageID != nil {
+        opts.Metadata["message_id"] = input.MessageID.String()
+    }
+    session, err := h.sessions.Init(c.Request.Context(), userID, input.FileName, fileTypeFromName(input.FileName), input.FileSize, opts)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to start upload session")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"success": true, "data": sessionResponse(session)})
+}
+
+// GetUploadStatus returns the progress of a resumable upload so a client
+// can resume from next_offset after a dropped connection
+// GET /api/v1/upload/sessions/:id
+func (h *UploadSessionHandler) GetUploadStatus(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    sessionID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session ID"})
+        return
+    }
+    session, err := h.sessions.Get(c.Request.Context(), userID, sessionID)
+    if err != nil {
+        h.respondSessionError(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": sessionResponse(session)})
+}
+
+// UploadChunk stores one chunk. The offset is taken from the offset query
+// parameter or a Content-Range header.
+// PUT /api/v1/upload/sessions/:id/parts?offset=N
+func (h *UploadSessionHandler) UploadChunk(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    sessionID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session ID"})
+        return
+    }
+    offset, err := chunkOffset(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if c.Request.ContentLength <= 0 {
+        c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length is required"})
+        return
+    }
+    var body io.Reader = http.MaxBytesReader(c.Writer, c.Request.Body, c.Request.ContentLength)
+    if offset == 0 {
+        // Reject a mislabelled file on its first chunk rather than after the whole upload
+        session, err := h.sessions.Get(c.Request.Context(), userID, sessionID)
+        if err != nil {
+            h.respondSessionError(c, err)
+            return
+        }
+        buffered := bufio.NewReaderSize(body, storage.SniffLength)
+        head, _ := buffered.Peek(storage.SniffLength)
+        if _, err := checkFileContent(head, session.FileName); err != nil {
+            c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+            return
+        }
+        body = buffered
+    }
+    session, err := h.sessions.WriteChunk(c.Request.Context(), userID, sessionID, offset, body, c.Request.ContentLength)
+    if err != nil {
+        h.respondSessionError(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": sessionResponse(session)})
+}
+
+// CompleteUpload assembles the chunks and creates the attachment
+// POST /api/v1/upload/sessions/:id/complete
+func (h *UploadSessionHandler) CompleteUpload(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    sessionID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session ID"})
+        return
+    }
+    session, err := h.sessions.Get(c.Request.Context(), userID, sessionID)
+    if err != nil {
+        h.respondSessionError(c, err)
+        return
+    }
+    result, err := h.sessions.Complete(c.Request.Context(), userID, sessionID)
+    if err != nil {
+        h.respondSessionError(c, err)
+        return
+    }
+    head, err := storage.ReadHead(c.Request.Context(), h.storage, result.StorageKey, storage.SniffLength)
+    if err != nil {
+        log.Error().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to read completed upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+        return
+    }
+    fileType, err := checkFileContent(head, session.FileName)
+    if err != nil {
+        if err := h.storage.Delete(c.Request.Context(), result.StorageKey); err != nil {
+            log.Warn().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to delete rejected upload")
+        }
+        c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+        return
+    }
+    if err := encryptUpload(c.Request.Context(), h.storage, result.StorageKey); err != nil {
+        log.Error().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to encrypt completed upload")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+        return
+    }
+    // Parts were assembled under a key of their own; identical contents share a blob
+    if deduped, err := dedupUpload(c.Request.Context(), h.storage, result.StorageKey, userID); err != nil {
+        log.Warn().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to deduplicate completed upload")
+    } else if deduped != nil {
+        result.StorageKey = deduped.StorageKey
+        result.StoragePath = deduped.StoragePath
+        result.URL = deduped.URL
+    }
+    if !chargeUpload(c, h.storage, result.StorageKey, userID, result.FileSize) {
+        return
+    }
+    announceUpload(c, h.storage, result.StorageKey, userID, fileType, result.FileSize)
+    attachment := &models.Attachment{
+        UserID:       userID,
+        FileName:     result.FileName,
+        OriginalName: session.FileName,
+        FileType:     fileType,
+        FileSize:     result.FileSize,
+        StorageKey:   result.StorageKey,
+        StoragePath:  result.StoragePath,
+        URL:          result.URL,
+    }
+    quarantine, scanning := storage.Backend[*scan.Quarantine](h.storage)
+    attachment.Status = initialStatus(scanning)
+    if id, err := uuid.Parse(session.Metadata["message_id"]); err == nil {
+        attachment.MessageID = id
+    } else {
+        attachment.MessageID = uuid.New()
+    }
+    if err := h.attachmentRepo.Create(c.Request.Context(), attachment); err != nil {
+        log.Error().Err(err).Msg("Failed to save attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+        return
+    }
+    if scanning {
+        var conversationID *uuid.UUID
+        if id, err := uuid.Parse(session.Metadata["conversation_id"]); err == nil {
+            conversationID = &id
+        }
+        submitScan(c, quarantine, attachment, conversationID, false)
+    } else {
+        hashStoredImage(c.Request.Context(), h.images, attachment)
+    }
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("storage_key", result.StorageKey).Int64("size", result.FileSize).Msg("Resumable upload completed")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentResponse(h.storage, attachment)})
+}
+
+// AbortUpload cancels a resumable upload and discards its chunks
+// DELETE /api/v1/upload/sessions/:id
+func (h *UploadSessionHandler) AbortUpload(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    sessionID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session ID"})
+        return
+    }
+    if err := h.sessions.Abort(c.Request.Context(), userID, sessionID); err != nil {
+        h.respondSessionError(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "message": "Upload aborted"})
+}
+
+// dedupUpload moves an upload that was assembled around the storage
+// decorators into the deduplicated blob store. It returns nil when
+// deduplication is disabled.
+func dedupUpload(ctx context.Context, svc storage.StorageService, storageKey string, userID uuid.UUID) (*storage.UploadResult, error) {
+    dedup, ok := storage.Backend[*storage.DedupStorageService](svc)
+    if !ok {
+        return nil, nil
+    }
+    return dedup.Adopt(ctx, storageKey, userID)
+}
+
+// validateDeclaredUpload checks the name and size a client announces before
+// uploading without going through the API
+func validateDeclaredUpload(cfg *config.Config, filename string, size int64) error {
+    if size > cfg.Storage.MaxUploadSize {
+        return fmt.Errorf("file size exceeds maximum allowed size of %d bytes", cfg.Storage.MaxUploadSize)
+    }
+    ext := strings.ToLower(filepath.Ext(filename))
+    allowedExts := append(append([]string{}, cfg.Upload.AllowedImageExts...), cfg.Upload.AllowedVideoExts...)
+    for _, allowedExt := range allowedExts {
+        if ext == allowedExt {
+            return nil
+        }
+    }
+    return fmt.Errorf("file type %s is not allowed", ext)
+}
+
+func (h *UploadSessionHandler) respondSessionError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, upload.ErrSessionNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+    case errors.Is(err, upload.ErrInvalidChunk):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    case errors.Is(err, upload.ErrUploadIncomplete):
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+    default:
+        log.Error().Err(err).Msg("Upload session operation failed")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Upload failed"})
+    }
+}
+
+// chunkOffset reads the chunk offset from ?offset= or "Content-Range: bytes start-end/total"
+func chunkOffset(c *gin.Context) (int64, error) {
+    if raw := c.Query("offset"); raw != "" {
+        offset, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+            return 0, fmt.Errorf("invalid offset")
+        }
+        return offset, nil
+    }
+    contentRange := c.GetHeader("Content-Range")
+    if !strings.HasPrefix(contentRange, "bytes ") {
+        return 0, fmt.Errorf("offset query parameter or Content-Range header is required")
+    }
+    start := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "-", 2)[0]
+    offset, err := strconv.ParseInt(start, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid Content-Range header")
+    }
+    return offset, nil
+}
+
+func sessionResponse(session *upload.Session) gin.H {
+    return gin.H{
+        "id":             session.ID,
+        "file_name":      session.FileName,
+        "content_type":   session.ContentType,
+        "total_size":     session.TotalSize,
+        "chunk_size":     session.ChunkSize,
+        "part_count":     session.PartCount(),
+        "received_bytes": session.ReceivedBytes(),
+        "next_offset":    session.NextOffset(),
+        "complete":       session.IsComplete(),
+        "expires_at":     session.ExpiresAt,
+    }
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+    "bytes"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/assets"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// VersionHandler exposes the version history storage keeps for the objects
+// behind attachments and videos
+type VersionHandler struct {
+    attachmentRepo *repository.AttachmentRepository
+    videoRepo      *repository.VideoRepository
+    storage        storage.StorageService
+    derivatives    *storage.DerivativeService
+    images         *assets.ImageHasher
+}
+
+func NewVersionHandler(attachmentRepo *repository.AttachmentRepository, videoRepo *repository.VideoRepository, storageService storage.StorageService, images *assets.ImageHasher, cfg *config.Config) *VersionHandler {
+    return &VersionHandler{
+        attachmentRepo: attachmentRepo,
+        videoRepo:      videoRepo,
+        storage:        storageService,
+        derivatives:    storage.NewDerivativeService(storageService, storage.LoadDerivativeProfiles(cfg.Upload.Derivatives)),
+        images:         images,
+    }
+}
+
+// ListAttachmentVersions lists the versions of an attachment, newest first
+// GET /api/v1/attachments/:id/versions
+func (h *VersionHandler) ListAttachmentVersions(c *gin.Context) {
+    attachment, ok := h.attachment(c)
+    if !ok {
+        return
+    }
+    h.listVersions(c, attachment.StorageKey)
+}
+
+// DownloadAttachmentVersion streams one version of an attachment
+// GET /api/v1/attachments/:id/versions/:version_id
+func (h *VersionHandler) DownloadAttachmentVersion(c *gin.Context) {
+    attachment, ok := h.attachment(c)
+    if !ok {
+        return
+    }
+    h.serveVersion(c, attachment.StorageKey)
+}
+
+// RestoreAttachmentVersion makes a version of an attachment current again.
+// The thumbnail, derivatives and hash of an image are made from it again.
+// POST /api/v1/attachments/:id/versions/:version_id/restore
+func (h *VersionHandler) RestoreAttachmentVersion(c *gin.Context) {
+    attachment, ok := h.attachment(c)
+    if !ok {
+        return
+    }
+    metadata, ok := h.restoreVersion(c, attachment.StorageKey)
+    if !ok {
+        return
+    }
+    ctx := c.Request.Context()
+    attachment.FileType = metadata.ContentType
+    attachment.FileSize = metadata.FileSize
+    if name := metadata.Metadata["original_name"]; name != "" {
+        attachment.OriginalName = name
+    }
+    var derivatives []storage.Derivative
+    var data []byte
+    var err error
+    if strings.HasPrefix(metadata.ContentType, "image/") {
+        data, err = h.storage.Download(ctx, attachment.StorageKey)
+        if err != nil {
+            log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to read restored image")
+        } else {
+            derivatives = h.derivatives.Generate(ctx, attachment.StorageKey, data)
+            if err := h.derivatives.ExpireLazy(ctx, attachment.StorageKey); err != nil {
+                log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to expire lazy derivatives")
+            }
+            if attachment.ThumbnailURL != "" {
+                if _, err := h.storage.GenerateThumbnail(ctx, attachment.StorageKey, storage.DefaultThumbnailWidth, storage.DefaultThumbnailHeight); err != nil {
+                    log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to regenerate thumbnail")
+                }
+            }
+        }
+    }
+    if err := h.attachmentRepo.Update(ctx, attachment); err != nil {
+        log.Error().Err(err).Msg("Failed to update attachment")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update attachment"})
+        return
+    }
+    if data != nil {
+        err = h.images.Record(ctx, attachment.ID, bytes.NewReader(data))
+    } else {
+        err = h.images.Clear(ctx, attachment.ID)
+    }
+    if err != nil {
+        log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to record image hash")
+    }
+    log.Info().Str("attachment_id", attachment.ID.String()).Str("version_id", c.Param("version_id")).Msg("Attachment version restored")
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": attachmentWithDerivatives{AttachmentResponse: attachmentResponse(h.storage, attachment), Derivatives: derivatives}})
+}
+
+// ListVideoVersions lists the versions of a generated video, newest first
+// GET /api/v1/videos/:id/versions
+func (h *VersionHandler) ListVideoVersions(c *gin.Context) {
+    video, ok := h.video(c)
+    if !ok {
+        return
+    }
+    h.listVersions(c, video.StorageKey)
+}
+
+// DownloadVideoVersion streams one version of a generated video
+// GET /api/v1/videos/:id/versions/:version_id
+func (h *VersionHandler) DownloadVideoVersion(c *gin.Context) {
+    video, ok := h.video(c)
+    if !ok {
+        return
+    }
+    h.serveVersion(c, video.StorageKey)
+}
+
+// RestoreVideoVersion makes a version of a generated video current again
+// POST /api/v1/videos/:id/versions/:version_id/restore
+func (h *VersionHandler) RestoreVideoVersion(c *gin.Context) {
+    video, ok := h.video(c)
+    if !ok {
+        return
+    }
+    metadata, ok := h.restoreVersion(c, video.StorageKey)
+    if !ok {
+        return
+    }
+    video.FileSize = metadata.FileSize
+    if err := h.videoRepo.Update(c.Request.Context(), video); err != nil {
+        log.Error().Err(err).Msg("Failed to update video")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update video"})
+        return
+    }
+    log.Info().Str("video_id", video.ID.String()).Str("version_id", c.Param("version_id")).Msg("Video version restored")
+    response := video.ToResponse(false)
+    response.URL = storage.SignURL(h.storage, response.URL)
+    response.ThumbnailURL = storage.SignURL(h.storage, response.ThumbnailURL)
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": response})
+}
+
+// attachment loads the caller's attachment named by :id
+func (h *VersionHandler) attachment(c *gin.Context) (*models.Attachment, bool) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    attachmentID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+        return nil, false
+    }
+    attachment, err := h.attachmentRepo.FindByID(c.Request.Context(), attachmentID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return nil, false
+    }
+    if attachment.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return nil, false
+    }
+    return attachment, true
+}
+
+// video loads the caller's video named by :id, once it has been stored
+func (h *VersionHandler) video(c *gin.Context) (*models.Video, bool) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    videoID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid video ID"})
+        return nil, false
+    }
+    video, err := h.videoRepo.FindByID(c.Request.Context(), videoID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+        return nil, false
+    }
+    if video.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return nil, false
+    }
+    if video.StorageKey == "" {
+        c.JSON(http.StatusConflict, gin.H{"error": "Video is not ready"})
+        return nil, false
+    }
+    return video, true
+}
+
+// versioner returns the storage version history, answering 501 when the
+// backend keeps none
+func (h *VersionHandler) versioner(c *gin.Context) (storage.Versioner, bool) {
+    versioner, ok := storage.Backend[storage.Versioner](h.storage)
+    if !ok {
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Versioning is not enabled for this storage backend"})
+        return nil, false
+    }
+    return versioner, true
+}
+
+// respondVersionError maps version lookup failures to a response
+func respondVersionError(c *gin.Context, storageKey string, err error) {
+    switch {
+    case errors.Is(err, storage.ErrVersionNotFound), errors.Is(err, storage.ErrObjectNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+    case errors.Is(err, storage.ErrVersioningUnsupported):
+        c.JSON(http.StatusNotImplemented, gin.H{"error": "Versioning is not enabled for this storage backend"})
+    default:
+        log.Error().Err(err).Str("storage_key", storageKey).Str("version_id", c.Param("version_id")).Msg("Failed to read object version")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read version"})
+    }
+}
+
+func (h *VersionHandler) listVersions(c *gin.Context, storageKey string) {
+    versioner, ok := h.versioner(c)
+    if !ok {
+        return
+    }
+    versions, err := versioner.ListVersions(c.Request.Context(), storageKey)
+    if err != nil {
+        respondVersionError(c, storageKey, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true, "data": versions})
+}
+
+func (h *VersionHandler) serveVersion(c *gin.Context, storageKey string) {
+    versioner, ok := h.versioner(c)
+    if !ok {
+        return
+    }
+    ctx := c.Request.Context()
+    versionID := c.Param("version_id")
+    metadata, err := versioner.GetVersionMetadata(ctx, storageKey, versionID)
+    if err != nil {
+        respondVersionError(c, storageKey, err)
+        return
+    }
+    c.Header("Content-Type", metadata.ContentType)
+    c.Header("Content-Length", strconv.FormatInt(metadata.FileSize, 10))
+    c.Header("Cache-Control", "private, max-age=0")
+    c.Status(http.StatusOK)
+    if err := versioner.DownloadVersion(ctx, storageKey, versionID, c.Writer); err != nil {
+        // Headers are already sent, so the client sees a truncated body
+        log.Error().Err(err).Str("storage_key", storageKey).Str("version_id", versionID).Msg("Failed to stream object version")
+    }
+}
+
+// restoreVersion restores :version_id and returns the metadata of the
+// restored object
+func (h *VersionHandler) restoreVersion(c *gin.Context, storageKey string) (*storage.FileMetadata, bool) {
+    versioner, ok := h.versioner(c)
+    if !ok {
+        return nil, false
+    }
+    ctx := c.Request.Context()
+    if err := versioner.RestoreVersion(ctx, storageKey, c.Param("version_id")); err != nil {
+        respondVersionError(c, storageKey, err)
+        return nil, false
+    }
+    metadata, err := h.storage.GetMetadata(ctx, storageKey)
+    if err != nil {
+        log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to read restored object")
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+        return nil, false
+    }
+    return metadata, true
+}
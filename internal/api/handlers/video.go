@@ -10,10 +10,10 @@ import (
     "github.com/google/uuid"
     "github.com/rs/zerolog/log"
     
-    "ugc-platform/internal/database/repository"
-    "ugc-platform/internal/models"
-    "ugc-platform/internal/services/ai"
-    "ugc-platform/internal/services/websocket"
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/ai"
+    "github.com/D43M0N18/qilin_core/internal/services/websocket"
 )
 
 // VideoHandler handles video generation requests
@@ -108,7 +108,7 @@ func (h *VideoHandler) GenerateVideo(c *gin.Context) {
 
     c.JSON(http.StatusAccepted, gin.H{
         "success": true,
-        "data":    video.ToResponse(false),
+        "data":    h.videoGenerator.SignURLs(video.ToResponse(false)),
         "message": "Video generation started",
     })
 }
@@ -166,16 +166,21 @@ func (h *VideoHandler) processVideoGeneration(ctx context.Context, video *models
         Msg("Video generation completed")
 }
 
-// sendProgressUpdate sends video progress update via WebSocket
+// sendProgressUpdate sends video progress update via WebSocket. The final
+// update of a video must be acked, so it's sent again until it is.
 func (h *VideoHandler) sendProgressUpdate(video *models.Video) {
     message := models.NewWebSocketMessage("video_progress", video.ConversationID, uuid.Nil)
     message.Metadata = map[string]interface{}{
         "video_id":  video.ID.String(),
         "status":    video.Status,
         "progress":  video.Progress,
-        "video":     video.ToResponse(false),
+        "video":     h.videoGenerator.SignURLs(video.ToResponse(false)),
     }
 
+    if video.Status == models.VideoStatusCompleted || video.Status == models.VideoStatusFailed {
+        h.hub.BroadcastCritical(video.UserID, video.ConversationID, message)
+        return
+    }
     h.hub.BroadcastToConversation(video.ConversationID, message, nil)
 }
 
@@ -209,7 +214,7 @@ func (h *VideoHandler) GetVideo(c *gin.Context) {
 
     c.JSON(http.StatusOK, gin.H{
         "success": true,
-        "data":    video.ToResponse(true),
+        "data":    h.videoGenerator.SignURLs(video.ToResponse(true)),
     })
 }
 
@@ -288,7 +293,7 @@ func (h *VideoHandler) ListUserVideos(c *gin.Context) {
 
     response := make([]models.VideoResponse, len(videos))
     for i, video := range videos {
-        response[i] = *video.ToResponse(false)
+        response[i] = *h.videoGenerator.SignURLs(video.ToResponse(false))
     }
 
     c.JSON(http.StatusOK, gin.H{
@@ -342,6 +347,11 @@ func (h *VideoHandler) DeleteVideo(c *gin.Context) {
         return
     }
 
+    // Delete stored files; anything left behind is picked up by the storage collector
+    if err := h.videoGenerator.DeleteVideoFiles(c.Request.Context(), video); err != nil {
+        log.Warn().Err(err).Str("video_id", videoID.String()).Msg("Failed to delete video files")
+    }
+
     log.Info().
         Str("video_id", videoID.String()).
         Str("user_id", userID.String()).
@@ -420,7 +430,80 @@ func (h *VideoHandler) RetryVideoGeneration(c *gin.Context) {
 
     c.JSON(http.StatusAccepted, gin.H{
         "success": true,
-        "data":    video.ToResponse(false),
+        "data":    h.videoGenerator.SignURLs(video.ToResponse(false)),
         "message": "Video generation retry started",
     })
 }
+
+// RegenerateVideo renders a finished video again. The new render replaces
+// the stored video under the same key, so the previous one stays available
+// as a version.
+// POST /api/v1/videos/:id/regenerate
+func (h *VideoHandler) RegenerateVideo(c *gin.Context) {
+    userID := c.MustGet("user_id").(uuid.UUID)
+    videoID, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{
+            "error": "Invalid video ID",
+        })
+        return
+    }
+
+    video, err := h.videoRepo.FindByID(c.Request.Context(), videoID)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{
+            "error": "Video not found",
+        })
+        return
+    }
+
+    // Check ownership
+    if video.UserID != userID {
+        c.JSON(http.StatusForbidden, gin.H{
+            "error": "Access denied",
+        })
+        return
+    }
+
+    // A video can't be regenerated while it is still being generated
+    if video.IsProcessing() || video.Status == models.VideoStatusQueued {
+        c.JSON(http.StatusConflict, gin.H{
+            "error": "Video generation is in progress",
+        })
+        return
+    }
+
+    // Reset video status, keeping the storage key for the new render
+    video.Status = models.VideoStatusQueued
+    video.Progress = 0
+    video.ErrorMessage = ""
+    video.ExternalJobID = ""
+
+    if err := h.videoRepo.Update(c.Request.Context(), video); err != nil {
+        log.Error().Err(err).Msg("Failed to update video")
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "error": "Failed to regenerate video",
+        })
+        return
+    }
+
+    input := &models.GenerateVideoInput{
+        ConversationID:  video.ConversationID,
+        ProductName:     video.ProductName,
+        ProductDesc:     video.ProductDesc,
+        CharacterType:   video.CharacterType,
+        Duration:        int(video.Duration),
+    }
+
+    go h.processVideoGeneration(context.Background(), video, input)
+
+    log.Info().
+        Str("video_id", videoID.String()).
+        Msg("Video regeneration initiated")
+
+    c.JSON(http.StatusAccepted, gin.H{
+        "success": true,
+        "data":    h.videoGenerator.SignURLs(video.ToResponse(false)),
+        "message": "Video regeneration started",
+    })
+}
@@ -4,23 +4,26 @@ import (
     "fmt"
     "os"
     "strconv"
+    "strings"
     "time"
 )
 
 type Config struct {
-    Server   ServerConfig
-    Database DatabaseConfig
-    Redis    RedisConfig
-    Storage  StorageConfig
-    AI       AIConfig
-    JWT      JWTConfig
-    Upload   UploadConfig
+    Server    ServerConfig
+    Database  DatabaseConfig
+    Redis     RedisConfig
+    Storage   StorageConfig
+    AI        AIConfig
+    JWT       JWTConfig
+    Upload    UploadConfig
+    WebSocket WebSocketConfig
 }
 
 type ServerConfig struct {
-    Port        string
-    Environment string // development, staging, production
-    BaseURL     string
+    Port         string
+    Environment  string   // development, staging, production
+    BaseURL      string
+    AdminUserIDs []string // Users allowed to call admin endpoints
 }
 
 type DatabaseConfig struct {
@@ -43,13 +46,38 @@ type RedisConfig struct {
 }
 
 type StorageConfig struct {
-    Provider      string // s3, minio, local
-    Bucket        string
-    Region        string
-    Endpoint      string // For MinIO
-    AccessKey     string
-    SecretKey     string
-    MaxUploadSize int64 // in bytes
+    Provider            string        // s3, minio, local
+    Bucket              string
+    Region              string
+    Endpoint            string        // For MinIO
+    AccessKey           string
+    SecretKey           string
+    MaxUploadSize       int64         // in bytes
+    LocalRoot           string        // For local, defaults to Upload.TempDir
+    SigningKey          string        // Signs local download URLs, required by local backends and encryption
+    Dedup               bool          // Store identical uploads once, reference counted in Redis
+    QuotaPlans          string        // plan:bytes pairs, 0 bytes is unlimited
+    DefaultPlan         string        // Plan of users without one assigned
+    GCInterval          time.Duration // How often orphaned objects are collected
+    GCGracePeriod       time.Duration // Orphans younger than this are left alone
+    GCDryRun            bool          // Report orphans without deleting them
+    EncryptionKeys      string        // id:base64key master keys, enables encryption at rest
+    EncryptionKeyFile   string        // File of master keys, one id:base64key per line
+    EncryptionActiveKey string        // Master key new data keys are wrapped with, defaults to the first
+    Versioning          bool          // Keep previous contents of overwritten objects
+    MaxVersions         int           // Versions kept per object when emulated, 0 keeps all
+    Replicas            string        // Secondary backends every write is mirrored to, see storage.NewReplicaServices
+    ReplicationMode     string        // sync or async
+    RepairInterval      time.Duration // How often objects missing on a replica are copied again
+    URLSigningKeys      string        // id:secret keys media URLs are signed with
+    URLSigningSecret    string        // Single media URL signing key "default", used when URLSigningKeys is empty
+    CDNBaseURL          string        // Host signed media URLs point at, defaults to Server.BaseURL
+    URLTTL              time.Duration // How long signed media URLs stay valid
+    URLTTLs             string        // folder:minutes pairs overriding URLTTL
+    EventsStream        string        // Redis stream storage events are added to, empty disables it
+    EventsStreamMaxLen  int64         // Approximate number of events kept in the stream, 0 keeps all
+    EventsWebhookURL    string        // Endpoint storage events are posted to, empty disables it
+    EventsWebhookSecret string        // Key the webhook signature is computed with
 }
 
 type AIConfig struct {
@@ -71,14 +99,42 @@ type UploadConfig struct {
     AllowedImageExts []string
     AllowedVideoExts []string
     TempDir          string
+    ChunkSize        int64         // in bytes, for resumable uploads
+    SessionTTL       time.Duration // abandoned resumable uploads expire after this
+    PresignExpiry    time.Duration // direct upload URLs stay valid this long
+    Derivatives      string        // image derivative profiles, see storage.ParseDerivativeProfiles
+    Scanner          string        // malware scanner uploads are quarantined for: clamd, signatures or empty
+    ClamdAddress     string        // tcp://host:port or unix:///path/to/clamd.sock
+    ScanSignatures   string        // file of name:hexpattern signatures for the signatures scanner
+    ScanTimeout      time.Duration // longest a single scan may take
+    ScanOversized    string        // reject or allow files larger than clamd's StreamMaxLength
+    MediaProber      string        // native or ffprobe, reads duration, dimensions and codecs of videos
+    FFprobePath      string
+    FFmpegPath       string        // renders video poster frames, empty disables them
+    PosterOffset     time.Duration // where in a video the poster frame is taken
+}
+
+type WebSocketConfig struct {
+    Backplane   string        // redis fans broadcasts out to every replica, empty keeps them in process
+    Channel     string        // Redis pub/sub channel of the backplane
+    NodeID      string        // identifies this replica on the backplane, defaults to the host name
+    Replay      string        // redis or memory numbers conversation frames for resuming, empty disables it
+    ReplaySize  int           // frames kept per conversation
+    ReplayTTL   time.Duration // frames are dropped this long after a conversation's last one
+    Inbox       string        // redis or memory keeps critical messages until they're acked, empty sends them once
+    InboxTTL    time.Duration // unacked messages are dropped this long after a user's latest one
+    MaxAttempts int           // sends of a critical message before it's only kept in the inbox
+    Presence    string        // redis shares who is viewing each conversation between replicas, empty keeps it per replica
+    IdleAfter   time.Duration // viewers who send nothing for this long show as idle
 }
 
 func Load() (*Config, error) {
     cfg := &Config{
         Server: ServerConfig{
-            Port:        getEnv("SERVER_PORT", "8080"),
-            Environment: getEnv("ENVIRONMENT", "development"),
-            BaseURL:     getEnv("BASE_URL", "http://localhost:8080"),
+            Port:         getEnv("SERVER_PORT", "8080"),
+            Environment:  getEnv("ENVIRONMENT", "development"),
+            BaseURL:      getEnv("BASE_URL", "http://localhost:8080"),
+            AdminUserIDs: getEnvList("ADMIN_USER_IDS"),
         },
         Database: DatabaseConfig{
             Host:            getEnv("DB_HOST", "localhost"),
@@ -98,13 +154,38 @@ func Load() (*Config, error) {
             DB:       getEnvInt("REDIS_DB", 0),
         },
         Storage: StorageConfig{
-            Provider:      getEnv("STORAGE_PROVIDER", "local"),
-            Bucket:        getEnv("STORAGE_BUCKET", "qilin-uploads"),
-            Region:        getEnv("STORAGE_REGION", "us-east-1"),
-            Endpoint:      getEnv("STORAGE_ENDPOINT", ""),
-            AccessKey:     getEnv("STORAGE_ACCESS_KEY", ""),
-            SecretKey:     getEnv("STORAGE_SECRET_KEY", ""),
-            MaxUploadSize: int64(getEnvInt("MAX_UPLOAD_SIZE", 100*1024*1024)), // 100MB default
+            Provider:            getEnv("STORAGE_PROVIDER", "local"),
+            Bucket:              getEnv("STORAGE_BUCKET", "qilin-uploads"),
+            Region:              getEnv("STORAGE_REGION", "us-east-1"),
+            Endpoint:            getEnv("STORAGE_ENDPOINT", ""),
+            AccessKey:           getEnv("STORAGE_ACCESS_KEY", ""),
+            SecretKey:           getEnv("STORAGE_SECRET_KEY", ""),
+            MaxUploadSize:       int64(getEnvInt("MAX_UPLOAD_SIZE", 100*1024*1024)), // 100MB default
+            LocalRoot:           getEnv("STORAGE_LOCAL_ROOT", ""),
+            SigningKey:          getEnv("STORAGE_SIGNING_KEY", ""),
+            Dedup:               getEnv("STORAGE_DEDUP", "true") == "true",
+            QuotaPlans:          getEnv("STORAGE_QUOTA_PLANS", "free:5368709120,pro:107374182400,enterprise:0"),
+            DefaultPlan:         getEnv("STORAGE_DEFAULT_PLAN", "free"),
+            GCInterval:          time.Duration(getEnvInt("STORAGE_GC_INTERVAL", 6)) * time.Hour,
+            GCGracePeriod:       time.Duration(getEnvInt("STORAGE_GC_GRACE_PERIOD", 24)) * time.Hour,
+            GCDryRun:            getEnv("STORAGE_GC_DRY_RUN", "false") == "true",
+            EncryptionKeys:      getEnv("STORAGE_ENCRYPTION_KEYS", ""),
+            EncryptionKeyFile:   getEnv("STORAGE_ENCRYPTION_KEY_FILE", ""),
+            EncryptionActiveKey: getEnv("STORAGE_ENCRYPTION_ACTIVE_KEY", ""),
+            Versioning:          getEnv("STORAGE_VERSIONING", "true") == "true",
+            MaxVersions:         getEnvInt("STORAGE_MAX_VERSIONS", 10),
+            Replicas:            getEnv("STORAGE_REPLICAS", ""),
+            ReplicationMode:     getEnv("STORAGE_REPLICATION_MODE", "async"),
+            RepairInterval:      time.Duration(getEnvInt("STORAGE_REPAIR_INTERVAL", 24)) * time.Hour,
+            URLSigningKeys:      getEnv("STORAGE_URL_SIGNING_KEYS", ""),
+            URLSigningSecret:    getEnv("STORAGE_URL_SIGNING_SECRET", ""),
+            CDNBaseURL:          getEnv("STORAGE_CDN_BASE_URL", ""),
+            URLTTL:              time.Duration(getEnvInt("STORAGE_URL_TTL", 60)) * time.Minute,
+            URLTTLs:             getEnv("STORAGE_URL_TTLS", "videos:1440,thumbnails:1440"),
+            EventsStream:        getEnv("STORAGE_EVENTS_STREAM", "storage_events"),
+            EventsStreamMaxLen:  int64(getEnvInt("STORAGE_EVENTS_STREAM_MAXLEN", 100000)),
+            EventsWebhookURL:    getEnv("STORAGE_EVENTS_WEBHOOK_URL", ""),
+            EventsWebhookSecret: getEnv("STORAGE_EVENTS_WEBHOOK_SECRET", ""),
         },
         AI: AIConfig{
             AnthropicAPIKey: getEnv("ANTHROPIC_API_KEY", ""),
@@ -123,6 +204,32 @@ func Load() (*Config, error) {
             AllowedImageExts: []string{".jpg", ".jpeg", ".png", ".gif", ".webp"},
             AllowedVideoExts: []string{".mp4", ".mov", ".avi", ".webm"},
             TempDir:          getEnv("TEMP_DIR", "/tmp/qilin-uploads"),
+            ChunkSize:        int64(getEnvInt("UPLOAD_CHUNK_SIZE", 8*1024*1024)), // 8MB
+            SessionTTL:       time.Duration(getEnvInt("UPLOAD_SESSION_TTL", 24)) * time.Hour,
+            PresignExpiry:    time.Duration(getEnvInt("UPLOAD_PRESIGN_EXPIRY", 15)) * time.Minute,
+            Derivatives:      getEnv("IMAGE_DERIVATIVES", ""),
+            Scanner:          getEnv("UPLOAD_SCANNER", ""),
+            ClamdAddress:     getEnv("CLAMD_ADDRESS", "tcp://localhost:3310"),
+            ScanSignatures:   getEnv("UPLOAD_SCAN_SIGNATURES", ""),
+            ScanTimeout:      time.Duration(getEnvInt("UPLOAD_SCAN_TIMEOUT", 60)) * time.Second,
+            ScanOversized:    getEnv("UPLOAD_SCAN_OVERSIZED", "reject"),
+            MediaProber:      getEnv("MEDIA_PROBER", "native"),
+            FFprobePath:      getEnv("FFPROBE_PATH", "ffprobe"),
+            FFmpegPath:       getEnv("FFMPEG_PATH", "ffmpeg"),
+            PosterOffset:     time.Duration(getEnvInt("VIDEO_POSTER_OFFSET", 1000)) * time.Millisecond,
+        },
+        WebSocket: WebSocketConfig{
+            Backplane:   getEnv("WS_BACKPLANE", "redis"),
+            Channel:     getEnv("WS_BACKPLANE_CHANNEL", "ws:broadcast"),
+            NodeID:      getEnv("WS_NODE_ID", ""),
+            Replay:      getEnv("WS_REPLAY", "redis"),
+            ReplaySize:  getEnvInt("WS_REPLAY_SIZE", 1000),
+            ReplayTTL:   time.Duration(getEnvInt("WS_REPLAY_TTL", 60)) * time.Minute,
+            Inbox:       getEnv("WS_INBOX", "redis"),
+            InboxTTL:    time.Duration(getEnvInt("WS_INBOX_TTL", 168)) * time.Hour,
+            MaxAttempts: getEnvInt("WS_ACK_MAX_ATTEMPTS", 8),
+            Presence:    getEnv("WS_PRESENCE", "redis"),
+            IdleAfter:   time.Duration(getEnvInt("WS_IDLE_AFTER", 120)) * time.Second,
         },
     }
 
@@ -139,6 +246,27 @@ func (c *Config) Validate() error {
         return fmt.Errorf("JWT secret must be changed in production")
     }
 
+    if c.Storage.SigningKey == "storage-signing-key-change-in-production" && c.Server.Environment == "production" {
+        return fmt.Errorf("storage signing key must be changed in production")
+    }
+
+    // Download URLs and access tokens must not be forgeable with each other's key
+    if c.Storage.SigningKey != "" && c.Storage.SigningKey == c.JWT.Secret {
+        return fmt.Errorf("storage signing key must differ from the JWT secret")
+    }
+
+    if c.Storage.URLSigningSecret == "url-signing-secret-change-in-production" && c.Server.Environment == "production" {
+        return fmt.Errorf("storage URL signing secret must be changed in production")
+    }
+
+    if c.Storage.URLSigningKeys == "" && c.Storage.URLSigningSecret == "" {
+        return fmt.Errorf("storage URL signing secret is required")
+    }
+
+    if c.Storage.URLSigningSecret != "" && (c.Storage.URLSigningSecret == c.JWT.Secret || c.Storage.URLSigningSecret == c.Storage.SigningKey) {
+        return fmt.Errorf("storage URL signing secret must differ from the JWT secret and storage signing key")
+    }
+
     if c.AI.AnthropicAPIKey == "" {
         return fmt.Errorf("Anthropic API key is required")
     }
@@ -157,6 +285,16 @@ func getEnv(key, defaultValue string) string {
     return defaultValue
 }
 
+func getEnvList(key string) []string {
+    var values []string
+    for _, value := range strings.Split(os.Getenv(key), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            values = append(values, value)
+        }
+    }
+    return values
+}
+
 func getEnvInt(key string, defaultValue int) int {
     if value := os.Getenv(key); value != "" {
         if intValue, err := strconv.Atoi(value); err == nil {
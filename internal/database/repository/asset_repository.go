@@ -0,0 +1,204 @@
+package repository
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    "github.com/google/uuid"
+    "gorm.io/gorm"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+)
+
+// AssetRepository queries the asset library: a user's attachments, their
+// tags and the perceptual hashes of their images
+type AssetRepository struct {
+    db *gorm.DB
+}
+
+func NewAssetRepository(db *gorm.DB) *AssetRepository {
+    return &AssetRepository{db: db}
+}
+
+// Migrate creates the tables of the asset library
+func (r *AssetRepository) Migrate() error {
+    if err := r.db.AutoMigrate(&models.AttachmentTag{}); err != nil {
+        return fmt.Errorf("failed to migrate attachment tags: %w", err)
+    }
+    if !r.db.Migrator().HasColumn(&models.AttachmentHash{}, "PerceptualHash") {
+        if err := r.db.Migrator().AddColumn(&models.AttachmentHash{}, "PerceptualHash"); err != nil {
+            return fmt.Errorf("failed to add image hashes: %w", err)
+        }
+    }
+    return nil
+}
+
+// AssetQuery selects a page of a user's attachments. Zero values don't filter.
+type AssetQuery struct {
+    UserID         uuid.UUID
+    Status         string
+    FileTypePrefix string // e.g. "image/"
+    ConversationID uuid.UUID
+    From           time.Time // uploaded at or after
+    To             time.Time // uploaded before
+    Tags           []string  // attachments carrying every one of these tags
+    BySize         bool      // order by size instead of upload time
+    Ascending      bool
+    Limit          int
+    After          interface{} // sort value of the last attachment of the previous page
+    AfterID        uuid.UUID   // ID of that attachment, which breaks ties
+}
+
+// ListAssets returns the attachments matching q in the order it asks for
+func (r *AssetRepository) ListAssets(ctx context.Context, q AssetQuery) ([]*models.Attachment, error) {
+    column := "attachments.created_at"
+    if q.BySize {
+        column = "attachments.file_size"
+    }
+    direction, comparison := "DESC", "<"
+    if q.Ascending {
+        direction, comparison = "ASC", ">"
+    }
+    tx := r.db.WithContext(ctx).Model(&models.Attachment{}).
+        Where("attachments.user_id = ? AND attachments.status = ?", q.UserID, q.Status)
+    if q.FileTypePrefix != "" {
+        tx = tx.Where("attachments.file_type LIKE ?", q.FileTypePrefix+"%")
+    }
+    if q.ConversationID != uuid.Nil {
+        tx = tx.Where("attachments.message_id IN (?)", r.db.Table("messages").Select("id").Where("conversation_id = ?", q.ConversationID))
+    }
+    if !q.From.IsZero() {
+        tx = tx.Where("attachments.created_at >= ?", q.From)
+    }
+    if !q.To.IsZero() {
+        tx = tx.Where("attachments.created_at < ?", q.To)
+    }
+    for _, tag := range q.Tags {
+        tx = tx.Where("attachments.id IN (?)", r.db.Model(&models.AttachmentTag{}).Select("attachment_id").Where("user_id = ? AND name = ?", q.UserID, tag))
+    }
+    if q.AfterID != uuid.Nil {
+        tx = tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND attachments.id %s ?))", column, comparison, column, comparison), q.After, q.After, q.AfterID)
+    }
+    var attachments []*models.Attachment
+    err := tx.Order(column + " " + direction).Order("attachments.id " + direction).Limit(q.Limit).Find(&attachments).Error
+    return attachments, err
+}
+
+// FindAsset returns one of a user's attachments in the given status
+func (r *AssetRepository) FindAsset(ctx context.Context, userID, attachmentID uuid.UUID, status string) (*models.Attachment, error) {
+    var attachment models.Attachment
+    err := r.db.WithContext(ctx).Where("id = ? AND user_id = ? AND status = ?", attachmentID, userID, status).First(&attachment).Error
+    if err != nil {
+        return nil, err
+    }
+    return &attachment, nil
+}
+
+// FindAssets returns the attachments with the given IDs
+func (r *AssetRepository) FindAssets(ctx context.Context, ids []uuid.UUID) ([]*models.Attachment, error) {
+    var attachments []*models.Attachment
+    err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&attachments).Error
+    return attachments, err
+}
+
+// ConversationsOfMessages maps message IDs to their conversation
+func (r *AssetRepository) ConversationsOfMessages(ctx context.Context, messageIDs []uuid.UUID) (map[uuid.UUID]uuid.UUID, error) {
+    var rows []struct {
+        ID             uuid.UUID
+        ConversationID uuid.UUID
+    }
+    err := r.db.WithContext(ctx).Table("messages").Select("id, conversation_id").Where("id IN ?", messageIDs).Scan(&rows).Error
+    if err != nil {
+        return nil, err
+    }
+    conversations := make(map[uuid.UUID]uuid.UUID, len(rows))
+    for _, row := range rows {
+        conversations[row.ID] = row.ConversationID
+    }
+    return conversations, nil
+}
+
+// VideosOfConversations returns a user's videos in the given conversations,
+// newest first
+func (r *AssetRepository) VideosOfConversations(ctx context.Context, userID uuid.UUID, conversationIDs []uuid.UUID) ([]*models.Video, error) {
+    var videos []*models.Video
+    err := r.db.WithContext(ctx).Where("user_id = ? AND conversation_id IN ?", userID, conversationIDs).Order("created_at DESC").Find(&videos).Error
+    return videos, err
+}
+
+// TagNames returns the distinct tags a user has used, by name
+func (r *AssetRepository) TagNames(ctx context.Context, userID uuid.UUID) ([]string, error) {
+    var names []string
+    err := r.db.WithContext(ctx).Model(&models.AttachmentTag{}).Where("user_id = ?", userID).Distinct().Order("name").Pluck("name", &names).Error
+    return names, err
+}
+
+// TagsOf returns the tags of each attachment, sorted
+func (r *AssetRepository) TagsOf(ctx context.Context, attachmentIDs []uuid.UUID) (map[uuid.UUID][]string, error) {
+    var rows []models.AttachmentTag
+    if err := r.db.WithContext(ctx).Where("attachment_id IN ?", attachmentIDs).Order("name").Find(&rows).Error; err != nil {
+        return nil, err
+    }
+    tags := make(map[uuid.UUID][]string)
+    for _, row := range rows {
+        tags[row.AttachmentID] = append(tags[row.AttachmentID], row.Name)
+    }
+    return tags, nil
+}
+
+// ReplaceTags replaces the tags of one of a user's attachments. It returns
+// gorm.ErrRecordNotFound when the user has no such attachment.
+func (r *AssetRepository) ReplaceTags(ctx context.Context, userID, attachmentID uuid.UUID, names []string) error {
+    return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        var count int64
+        if err := tx.Model(&models.Attachment{}).Where("id = ? AND user_id = ?", attachmentID, userID).Count(&count).Error; err != nil {
+            return err
+        }
+        if count == 0 {
+            return gorm.ErrRecordNotFound
+        }
+        if err := tx.Where("attachment_id = ?", attachmentID).Delete(&models.AttachmentTag{}).Error; err != nil {
+            return err
+        }
+        if len(names) == 0 {
+            return nil
+        }
+        tags := make([]models.AttachmentTag, len(names))
+        for n, name := range names {
+            tags[n] = models.AttachmentTag{AttachmentID: attachmentID, Name: name, UserID: userID}
+        }
+        return tx.Create(&tags).Error
+    })
+}
+
+// ImageHashes returns the hashes of a user's images in the given status by
+// attachment ID, leaving out excludeID and images without a hash
+func (r *AssetRepository) ImageHashes(ctx context.Context, userID uuid.UUID, status string, excludeID uuid.UUID) (map[uuid.UUID]int64, error) {
+    var rows []models.AttachmentHash
+    err := r.db.WithContext(ctx).Select("id, perceptual_hash").
+        Where("user_id = ? AND status = ? AND id <> ? AND perceptual_hash IS NOT NULL", userID, status, excludeID).
+        Find(&rows).Error
+    if err != nil {
+        return nil, err
+    }
+    hashes := make(map[uuid.UUID]int64, len(rows))
+    for _, row := range rows {
+        hashes[row.ID] = *row.PerceptualHash
+    }
+    return hashes, nil
+}
+
+// ImageHash returns the hash of an attachment, nil when it has none
+func (r *AssetRepository) ImageHash(ctx context.Context, attachmentID uuid.UUID) (*int64, error) {
+    var row models.AttachmentHash
+    if err := r.db.WithContext(ctx).Select("id, perceptual_hash").Where("id = ?", attachmentID).Take(&row).Error; err != nil {
+        return nil, err
+    }
+    return row.PerceptualHash, nil
+}
+
+// SetImageHash records the hash of an attachment, or clears it when hash is nil
+func (r *AssetRepository) SetImageHash(ctx context.Context, attachmentID uuid.UUID, hash *int64) error {
+    return r.db.WithContext(ctx).Model(&models.AttachmentHash{ID: attachmentID}).UpdateColumn("perceptual_hash", hash).Error
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+    "context"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+)
+
+// ReferencedStorageKeys returns the subset of keys an attachment is stored under
+func (r *AttachmentRepository) ReferencedStorageKeys(ctx context.Context, keys []string) ([]string, error) {
+    var found []string
+    err := r.db.WithContext(ctx).Model(&models.Attachment{}).Where("storage_key IN ?", keys).Pluck("storage_key", &found).Error
+    return found, err
+}
+
+// ReferencedStorageKeys returns the subset of keys a video is stored under
+func (r *VideoRepository) ReferencedStorageKeys(ctx context.Context, keys []string) ([]string, error) {
+    var found []string
+    err := r.db.WithContext(ctx).Model(&models.Video{}).Where("storage_key IN ?", keys).Pluck("storage_key", &found).Error
+    return found, err
+}
+
+// ReferencedThumbnailURLs returns the subset of urls a video uses as its thumbnail
+func (r *VideoRepository) ReferencedThumbnailURLs(ctx context.Context, urls []string) ([]string, error) {
+    var found []string
+    err := r.db.WithContext(ctx).Model(&models.Video{}).Where("thumbnail_url IN ?", urls).Pluck("thumbnail_url", &found).Error
+    return found, err
+}
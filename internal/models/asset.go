@@ -0,0 +1,31 @@
+package models
+
+import (
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// AttachmentTag labels one of a user's attachments in the asset library
+type AttachmentTag struct {
+    AttachmentID uuid.UUID `gorm:"type:uuid;primaryKey"`
+    Name         string    `gorm:"primaryKey;size:64;index:idx_attachment_tags_user_name,priority:2"`
+    UserID       uuid.UUID `gorm:"type:uuid;index:idx_attachment_tags_user_name,priority:1"`
+    CreatedAt    time.Time
+}
+
+func (AttachmentTag) TableName() string {
+    return "attachment_tags"
+}
+
+// AttachmentHash is the perceptual hash the asset library keeps on an image
+// attachment, in a column of the attachments table. PerceptualHash is nil for
+// images that couldn't be decoded.
+type AttachmentHash struct {
+    ID             uuid.UUID `gorm:"type:uuid;primaryKey"`
+    PerceptualHash *int64
+}
+
+func (AttachmentHash) TableName() string {
+    return "attachments"
+}
@@ -9,7 +9,7 @@ import (
 
     anthropic "github.com/liushuangls/go-anthropic/v2"
     "github.com/rs/zerolog/log"
-    "ugc-platform/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/models"
 )
 
 // CharacterSelector handles AI-powered character selection
@@ -258,7 +258,9 @@ func (vg *VideoGenerator) downloadAndStoreVideo(ctx context.Context, video *mode
     opts.Folder = "videos"
     opts.UserID = video.UserID
     opts.ContentType = "video/mp4"
-    opts.ACL = "public-read"
+    // A regenerated video replaces the previous render, which storage keeps
+    // as a version
+    opts.StorageKey = video.StorageKey
     result, err := vg.storage.UploadFromReader(ctx, videoResp.Body, filename, "video/mp4", videoResp.ContentLength, opts)
     if err != nil {
         return fmt.Errorf("failed to upload video: %w", err)
@@ -287,7 +289,6 @@ func (vg *VideoGenerator) downloadAndStoreThumbnail(ctx context.Context, video *
     opts.Folder = "thumbnails"
     opts.UserID = video.UserID
     opts.ContentType = "image/jpeg"
-    opts.ACL = "public-read"
     result, err := vg.storage.UploadFromReader(ctx, thumbResp.Body, filename, "image/jpeg", thumbResp.ContentLength, opts)
     if err != nil {
         return err
@@ -296,6 +297,32 @@ func (vg *VideoGenerator) downloadAndStoreThumbnail(ctx context.Context, video *
     return nil
 }
 
+// SignURLs replaces the stored URLs of a video response with signed,
+// expiring ones, since videos and thumbnails are stored private
+func (vg *VideoGenerator) SignURLs(response *models.VideoResponse) *models.VideoResponse {
+    response.URL = storage.SignURL(vg.storage, response.URL)
+    response.ThumbnailURL = storage.SignURL(vg.storage, response.ThumbnailURL)
+    return response
+}
+
+// DeleteVideoFiles removes a video's stored file and thumbnail
+func (vg *VideoGenerator) DeleteVideoFiles(ctx context.Context, video *models.Video) error {
+    var keys []string
+    if video.StorageKey != "" {
+        keys = append(keys, video.StorageKey)
+    }
+    if key, ok := storage.KeyFromURL(vg.storage, video.ThumbnailURL); ok {
+        keys = append(keys, key)
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    if err := vg.storage.DeleteMultiple(ctx, keys); err != nil {
+        return fmt.Errorf("failed to delete video files: %w", err)
+    }
+    return nil
+}
+
 func (vg *VideoGenerator) CancelVideoGeneration(ctx context.Context, jobID string) error {
     httpReq, err := http.NewRequestWithContext(ctx, "DELETE", vg.apiURL+"/cancel/"+jobID, nil)
     if err != nil {
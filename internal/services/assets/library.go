@@ -0,0 +1,314 @@
+package assets
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "gorm.io/gorm"
+
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+const (
+    DefaultPageSize = 50
+    MaxPageSize     = 200
+    MaxTags         = 20
+    MaxTagLength    = 64
+)
+
+// Sort orders of a listing
+const (
+    SortRecent = "recent"
+    SortSize   = "size"
+)
+
+// Asset types a listing can be filtered by
+const (
+    TypeImage = "image"
+    TypeVideo = "video"
+)
+
+var (
+    ErrInvalidCursor = errors.New("invalid cursor")
+    ErrInvalidQuery  = errors.New("invalid asset query")
+    ErrNotFound      = errors.New("asset not found")
+)
+
+// Query selects a page of a user's assets. Zero values don't filter.
+type Query struct {
+    UserID         uuid.UUID
+    Type           string // image or video
+    ConversationID uuid.UUID
+    From           time.Time // uploaded at or after
+    To             time.Time // uploaded before
+    Tags           []string  // assets carrying every one of these tags
+    Sort           string    // recent or size
+    Ascending      bool
+    Limit          int
+    Cursor         string // NextCursor of the previous page
+}
+
+// Asset is an attachment as the asset browser shows it
+type Asset struct {
+    ID             uuid.UUID  `json:"id"`
+    MessageID      uuid.UUID  `json:"message_id"`
+    ConversationID *uuid.UUID `json:"conversation_id,omitempty"`
+    FileName       string     `json:"file_name"`
+    FileType       string     `json:"file_type"`
+    FileSize       int64      `json:"file_size"`
+    Width          int        `json:"width,omitempty"`
+    Height         int        `json:"height,omitempty"`
+    URL            string     `json:"url"`
+    ThumbnailURL   string     `json:"thumbnail_url,omitempty"`
+    Tags           []string   `json:"tags"`
+    CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Page is one page of assets
+type Page struct {
+    Assets     []*Asset `json:"assets"`
+    NextCursor string   `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// cursor is the position after the last asset of a page: its sort value and
+// its ID, which breaks ties between equal values
+type cursor struct {
+    Sort  string    `json:"s"`
+    Value string    `json:"v"`
+    ID    uuid.UUID `json:"id"`
+}
+
+// Library lists, tags and searches a user's uploaded attachments, so they
+// can be reused in later conversations
+type Library struct {
+    assetRepo *repository.AssetRepository
+    storage   storage.StorageService
+}
+
+// NewLibrary creates a library over the attachments table and the objects
+// they're stored in
+func NewLibrary(assetRepo *repository.AssetRepository, storageService storage.StorageService) *Library {
+    return &Library{
+        assetRepo: assetRepo,
+        storage:   storageService,
+    }
+}
+
+// List returns one page of the assets matching q
+func (l *Library) List(ctx context.Context, q Query) (*Page, error) {
+    if q.Sort == "" {
+        q.Sort = SortRecent
+    }
+    if q.Sort != SortRecent && q.Sort != SortSize {
+        return nil, fmt.Errorf("%w: unknown sort %q", ErrInvalidQuery, q.Sort)
+    }
+    if q.Limit <= 0 {
+        q.Limit = DefaultPageSize
+    }
+    q.Limit = min(q.Limit, MaxPageSize)
+
+    query := repository.AssetQuery{
+        UserID:         q.UserID,
+        Status:         scan.StatusUploaded,
+        ConversationID: q.ConversationID,
+        From:           q.From,
+        To:             q.To,
+        Tags:           normalizeTags(q.Tags),
+        BySize:         q.Sort == SortSize,
+        Ascending:      q.Ascending,
+        Limit:          q.Limit + 1,
+    }
+    switch q.Type {
+    case "":
+    case TypeImage, TypeVideo:
+        query.FileTypePrefix = q.Type + "/"
+    default:
+        return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidQuery, q.Type)
+    }
+    if q.Cursor != "" {
+        after, err := decodeCursor(q.Cursor, q.Sort)
+        if err != nil {
+            return nil, err
+        }
+        query.After, query.AfterID = after.value, after.ID
+    }
+
+    attachments, err := l.assetRepo.ListAssets(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list assets: %w", err)
+    }
+    page := &Page{Assets: []*Asset{}}
+    if len(attachments) > q.Limit {
+        attachments = attachments[:q.Limit]
+        page.NextCursor = encodeCursor(q.Sort, attachments[len(attachments)-1])
+    }
+    if page.Assets, err = l.assets(ctx, attachments); err != nil {
+        return nil, err
+    }
+    return page, nil
+}
+
+// assets turns attachments into assets, with their conversation and tags
+func (l *Library) assets(ctx context.Context, attachments []*models.Attachment) ([]*Asset, error) {
+    assets := []*Asset{}
+    if len(attachments) == 0 {
+        return assets, nil
+    }
+    conversations, err := l.conversations(ctx, attachments)
+    if err != nil {
+        return nil, err
+    }
+    tags, err := l.tags(ctx, attachments)
+    if err != nil {
+        return nil, err
+    }
+    for _, attachment := range attachments {
+        asset := &Asset{
+            ID:           attachment.ID,
+            MessageID:    attachment.MessageID,
+            FileName:     attachment.OriginalName,
+            FileType:     attachment.FileType,
+            FileSize:     attachment.FileSize,
+            Width:        attachment.Width,
+            Height:       attachment.Height,
+            URL:          attachment.URL,
+            ThumbnailURL: attachment.ThumbnailURL,
+            Tags:         tags[attachment.ID],
+            CreatedAt:    attachment.CreatedAt,
+        }
+        if conversationID, ok := conversations[attachment.MessageID]; ok {
+            asset.ConversationID = &conversationID
+        }
+        if asset.Tags == nil {
+            asset.Tags = []string{}
+        }
+        assets = append(assets, asset)
+    }
+    return assets, nil
+}
+
+// Tags returns the tags a user has used, by name
+func (l *Library) Tags(ctx context.Context, userID uuid.UUID) ([]string, error) {
+    names, err := l.assetRepo.TagNames(ctx, userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list tags: %w", err)
+    }
+    return names, nil
+}
+
+// SetTags replaces the tags of one of a user's attachments. Tags are
+// lowercased and trimmed.
+func (l *Library) SetTags(ctx context.Context, userID, attachmentID uuid.UUID, names []string) ([]string, error) {
+    names = normalizeTags(names)
+    if len(names) > MaxTags {
+        return nil, fmt.Errorf("%w: at most %d tags", ErrInvalidQuery, MaxTags)
+    }
+    for _, name := range names {
+        if len(name) > MaxTagLength {
+            return nil, fmt.Errorf("%w: tags are at most %d characters", ErrInvalidQuery, MaxTagLength)
+        }
+    }
+    err := l.assetRepo.ReplaceTags(ctx, userID, attachmentID, names)
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to tag attachment: %w", err)
+    }
+    return names, nil
+}
+
+// conversations maps the message IDs of attachments to their conversation
+func (l *Library) conversations(ctx context.Context, attachments []*models.Attachment) (map[uuid.UUID]uuid.UUID, error) {
+    messageIDs := make([]uuid.UUID, len(attachments))
+    for n, attachment := range attachments {
+        messageIDs[n] = attachment.MessageID
+    }
+    conversations, err := l.assetRepo.ConversationsOfMessages(ctx, messageIDs)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up conversations: %w", err)
+    }
+    return conversations, nil
+}
+
+// tags returns the tags of each attachment, sorted
+func (l *Library) tags(ctx context.Context, attachments []*models.Attachment) (map[uuid.UUID][]string, error) {
+    ids := make([]uuid.UUID, len(attachments))
+    for n, attachment := range attachments {
+        ids[n] = attachment.ID
+    }
+    tags, err := l.assetRepo.TagsOf(ctx, ids)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up tags: %w", err)
+    }
+    return tags, nil
+}
+
+// normalizeTags lowercases, trims and deduplicates tag names
+func normalizeTags(names []string) []string {
+    seen := make(map[string]bool, len(names))
+    var normalized []string
+    for _, name := range names {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if name == "" || seen[name] {
+            continue
+        }
+        seen[name] = true
+        normalized = append(normalized, name)
+    }
+    sort.Strings(normalized)
+    return normalized
+}
+
+// decodedCursor is a cursor with its sort value parsed
+type decodedCursor struct {
+    cursor
+    value interface{}
+}
+
+func encodeCursor(sortBy string, last *models.Attachment) string {
+    c := cursor{Sort: sortBy, ID: last.ID}
+    if sortBy == SortSize {
+        c.Value = fmt.Sprint(last.FileSize)
+    } else {
+        c.Value = last.CreatedAt.UTC().Format(time.RFC3339Nano)
+    }
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded, sortBy string) (*decodedCursor, error) {
+    data, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    var c decodedCursor
+    if err := json.Unmarshal(data, &c.cursor); err != nil || c.Sort != sortBy || c.ID == uuid.Nil {
+        // A cursor only continues the listing order it came from
+        return nil, ErrInvalidCursor
+    }
+    if sortBy == SortSize {
+        var size int64
+        if _, err := fmt.Sscan(c.Value, &size); err != nil {
+            return nil, ErrInvalidCursor
+        }
+        c.value = size
+    } else {
+        createdAt, err := time.Parse(time.RFC3339Nano, c.Value)
+        if err != nil {
+            return nil, ErrInvalidCursor
+        }
+        c.value = createdAt
+    }
+    return &c, nil
+}
@@ -0,0 +1,92 @@
+package assets
+
+import (
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "math/bits"
+    "sort"
+
+    "github.com/disintegration/imaging"
+)
+
+const (
+    // hashSampleSize is the side of the grayscale image the DCT runs over
+    hashSampleSize = 32
+    // hashBlockSize is the side of the block of low frequencies kept
+    hashBlockSize = 8
+)
+
+// dctCosines holds cos((2x+1)uπ/2N) for the low frequencies u of the DCT
+var dctCosines = func() [hashBlockSize][hashSampleSize]float64 {
+    var table [hashBlockSize][hashSampleSize]float64
+    for u := range table {
+        for x := range table[u] {
+            table[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * hashSampleSize))
+        }
+    }
+    return table
+}()
+
+// PerceptualHash returns the 64-bit pHash of img: the signs, relative to
+// their median, of the lowest frequencies of the image's DCT. Re-encoding,
+// resizing, recoloring and small crops change few bits, so photos of the same
+// subject have hashes a short Hamming distance apart.
+func PerceptualHash(img image.Image) uint64 {
+    gray := imaging.Grayscale(imaging.Resize(img, hashSampleSize, hashSampleSize, imaging.Box))
+    var pixels [hashSampleSize][hashSampleSize]float64
+    for y := 0; y < hashSampleSize; y++ {
+        for x := 0; x < hashSampleSize; x++ {
+            pixels[y][x] = float64(gray.Pix[y*gray.Stride+x*4])
+        }
+    }
+    // The DCT is separable: transform the rows, then the columns of the
+    // frequencies that are kept
+    var rows [hashSampleSize][hashBlockSize]float64
+    for y := range pixels {
+        for u := 0; u < hashBlockSize; u++ {
+            var sum float64
+            for x, p := range pixels[y] {
+                sum += p * dctCosines[u][x]
+            }
+            rows[y][u] = sum
+        }
+    }
+    var coefficients [hashBlockSize * hashBlockSize]float64
+    for v := 0; v < hashBlockSize; v++ {
+        for u := 0; u < hashBlockSize; u++ {
+            var sum float64
+            for y := range rows {
+                sum += rows[y][u] * dctCosines[v][y]
+            }
+            coefficients[v*hashBlockSize+u] = sum
+        }
+    }
+    // The DC term is the mean brightness and would skew the median
+    ac := append([]float64(nil), coefficients[1:]...)
+    sort.Float64s(ac)
+    median := ac[len(ac)/2]
+    var hash uint64
+    for n, c := range coefficients {
+        if c > median {
+            hash |= 1 << uint(n)
+        }
+    }
+    return hash
+}
+
+// HashImage decodes an image, applying its EXIF orientation as uploads are,
+// and returns its perceptual hash
+func HashImage(r io.Reader) (uint64, error) {
+    img, err := imaging.Decode(r, imaging.AutoOrientation(true))
+    if err != nil {
+        return 0, fmt.Errorf("failed to decode image: %w", err)
+    }
+    return PerceptualHash(img), nil
+}
+
+// HashDistance returns the number of bits two perceptual hashes differ in
+func HashDistance(a, b uint64) int {
+    return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,106 @@
+package assets
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "math/rand"
+    "strings"
+    "testing"
+
+    "github.com/disintegration/imaging"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// scene draws a product-shot-like image of overlapping colored blocks,
+// different for each seed
+func scene(seed int64) image.Image {
+    r := rand.New(rand.NewSource(seed))
+    img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+    for n := 0; n < 12; n++ {
+        c := color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255}
+        x0, y0 := r.Intn(400), r.Intn(300)
+        width, height := 40+r.Intn(160), 40+r.Intn(120)
+        for y := y0; y < min(y0+height, 300); y++ {
+            for x := x0; x < min(x0+width, 400); x++ {
+                img.Set(x, y, c)
+            }
+        }
+    }
+    return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image, quality int) *bytes.Buffer {
+    var buf bytes.Buffer
+    require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}))
+    return &buf
+}
+
+func TestPerceptualHashMatchesCopies(t *testing.T) {
+    original := scene(1)
+    hash := PerceptualHash(original)
+    assert.Equal(t, hash, PerceptualHash(original), "hashing is deterministic")
+
+    copies := map[string]image.Image{
+        "resized":   imaging.Resize(original, 200, 0, imaging.Lanczos),
+        "enlarged":  imaging.Resize(original, 1200, 0, imaging.Linear),
+        "cropped":   imaging.Crop(original, image.Rect(8, 6, 392, 294)),
+        "brighter":  imaging.AdjustBrightness(original, 15),
+        "grayscale": imaging.Grayscale(original),
+        "blurred":   imaging.Blur(original, 1),
+    }
+    for name, img := range copies {
+        t.Run(name, func(t *testing.T) {
+            assert.LessOrEqual(t, HashDistance(hash, PerceptualHash(img)), DefaultMaxDistance)
+        })
+    }
+
+    t.Run("re-encoded", func(t *testing.T) {
+        reencoded, err := HashImage(encodeJPEG(t, imaging.Resize(original, 300, 0, imaging.Lanczos), 40))
+        require.NoError(t, err)
+        assert.LessOrEqual(t, HashDistance(hash, reencoded), DefaultMaxDistance)
+    })
+}
+
+func TestPerceptualHashSeparatesImages(t *testing.T) {
+    hashes := make([]uint64, 5)
+    for n := range hashes {
+        hashes[n] = PerceptualHash(scene(int64(n + 1)))
+    }
+    for i := range hashes {
+        for j := i + 1; j < len(hashes); j++ {
+            assert.Greater(t, HashDistance(hashes[i], hashes[j]), DefaultMaxDistance, "scenes %d and %d", i+1, j+1)
+        }
+    }
+    assert.Greater(t, HashDistance(PerceptualHash(scene(1)), PerceptualHash(imaging.FlipH(scene(1)))), DefaultMaxDistance, "a mirrored image is a different picture")
+}
+
+func TestHashImage(t *testing.T) {
+    img := scene(7)
+    hash, err := HashImage(encodeJPEG(t, img, 95))
+    require.NoError(t, err)
+    assert.LessOrEqual(t, HashDistance(PerceptualHash(img), hash), 4)
+
+    _, err = HashImage(strings.NewReader("not an image"))
+    assert.Error(t, err)
+}
+
+func TestHashDistance(t *testing.T) {
+    tests := []struct {
+        a, b uint64
+        want int
+    }{
+        {0, 0, 0},
+        {0xdeadbeef, 0xdeadbeef, 0},
+        {0, 1, 1},
+        {0b1011, 0b0110, 3},
+        {0, ^uint64(0), 64},
+        {1 << 63, 0, 1},
+    }
+    for _, tt := range tests {
+        assert.Equal(t, tt.want, HashDistance(tt.a, tt.b), "%x %x", tt.a, tt.b)
+        assert.Equal(t, tt.want, HashDistance(tt.b, tt.a), "%x %x", tt.b, tt.a)
+    }
+}
@@ -0,0 +1,198 @@
+package assets
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+    "gorm.io/gorm"
+
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/scan"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+const (
+    // DefaultMaxDistance is the Hamming distance below which two images are
+    // taken for the same product
+    DefaultMaxDistance = 10
+    // MaxDistance bounds the threshold; at half the bits hashes are unrelated
+    MaxDistance = 32
+    // DefaultSimilarLimit is how many matches Similar returns by default
+    DefaultSimilarLimit = 20
+)
+
+// ErrNotHashable is returned for images without a perceptual hash, which
+// couldn't be decoded when they were uploaded
+var ErrNotHashable = errors.New("image can't be hashed")
+
+// Match is an asset that looks like the one searched for, with the videos
+// generated in its conversation
+type Match struct {
+    Asset    *Asset          `json:"asset"`
+    Distance int             `json:"distance"`
+    Videos   []*models.Video `json:"-"`
+}
+
+// ImageHasher records the perceptual hashes of image attachments as they
+// are created, which is what Similar searches
+type ImageHasher struct {
+    assetRepo *repository.AssetRepository
+    storage   storage.StorageService
+}
+
+func NewImageHasher(assetRepo *repository.AssetRepository, storageService storage.StorageService) *ImageHasher {
+    return &ImageHasher{assetRepo: assetRepo, storage: storageService}
+}
+
+// Record hashes an image and records the hash on its attachment. An image
+// that can't be decoded is recorded without a hash.
+func (h *ImageHasher) Record(ctx context.Context, attachmentID uuid.UUID, r io.Reader) error {
+    var hash *int64
+    value, err := HashImage(r)
+    if err == nil {
+        signed := int64(value)
+        hash = &signed
+    } else {
+        log.Warn().Err(err).Str("attachment_id", attachmentID.String()).Msg("Failed to hash image")
+    }
+    if err := h.assetRepo.SetImageHash(ctx, attachmentID, hash); err != nil {
+        return fmt.Errorf("failed to record image hash: %w", err)
+    }
+    return nil
+}
+
+// RecordObject hashes a stored image and records the hash on its attachment
+func (h *ImageHasher) RecordObject(ctx context.Context, attachmentID uuid.UUID, storageKey string) error {
+    data, err := h.storage.Download(ctx, storageKey)
+    if err != nil {
+        return fmt.Errorf("failed to read image: %w", err)
+    }
+    return h.Record(ctx, attachmentID, bytes.NewReader(data))
+}
+
+// Clear drops the hash of an attachment whose file is no longer an image
+func (h *ImageHasher) Clear(ctx context.Context, attachmentID uuid.UUID) error {
+    return h.assetRepo.SetImageHash(ctx, attachmentID, nil)
+}
+
+// Similar returns the user's images whose perceptual hash is within
+// maxDistance of the image attachment's, closest first
+func (l *Library) Similar(ctx context.Context, userID, attachmentID uuid.UUID, maxDistance, limit int) ([]*Match, error) {
+    if maxDistance < 0 || maxDistance > MaxDistance {
+        return nil, fmt.Errorf("%w: max distance must be between 0 and %d", ErrInvalidQuery, MaxDistance)
+    }
+    if limit <= 0 {
+        limit = DefaultSimilarLimit
+    }
+    limit = min(limit, MaxPageSize)
+
+    target, err := l.assetRepo.FindAsset(ctx, userID, attachmentID, scan.StatusUploaded)
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to find attachment: %w", err)
+    }
+    if !strings.HasPrefix(target.FileType, TypeImage+"/") {
+        return nil, fmt.Errorf("%w: attachment is not an image", ErrInvalidQuery)
+    }
+    targetHash, err := l.assetRepo.ImageHash(ctx, attachmentID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load image hash: %w", err)
+    }
+    if targetHash == nil {
+        return nil, ErrNotHashable
+    }
+
+    hashes, err := l.assetRepo.ImageHashes(ctx, userID, scan.StatusUploaded, attachmentID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load image hashes: %w", err)
+    }
+    distances := withinDistance(uint64(*targetHash), hashes, maxDistance)
+    if len(distances) == 0 {
+        return []*Match{}, nil
+    }
+    ids := make([]uuid.UUID, 0, len(distances))
+    for id := range distances {
+        ids = append(ids, id)
+    }
+
+    attachments, err := l.assetRepo.FindAssets(ctx, ids)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load similar assets: %w", err)
+    }
+    sortByDistance(attachments, distances)
+    if len(attachments) > limit {
+        attachments = attachments[:limit]
+    }
+    assets, err := l.assets(ctx, attachments)
+    if err != nil {
+        return nil, err
+    }
+    videos, err := l.videos(ctx, userID, assets)
+    if err != nil {
+        return nil, err
+    }
+    matches := make([]*Match, len(assets))
+    for n, asset := range assets {
+        matches[n] = &Match{Asset: asset, Distance: distances[asset.ID]}
+        if asset.ConversationID != nil {
+            matches[n].Videos = videos[*asset.ConversationID]
+        }
+    }
+    return matches, nil
+}
+
+// videos returns the videos of the conversations the assets were used in,
+// newest first
+func (l *Library) videos(ctx context.Context, userID uuid.UUID, assets []*Asset) (map[uuid.UUID][]*models.Video, error) {
+    var conversationIDs []uuid.UUID
+    for _, asset := range assets {
+        if asset.ConversationID != nil {
+            conversationIDs = append(conversationIDs, *asset.ConversationID)
+        }
+    }
+    byConversation := make(map[uuid.UUID][]*models.Video)
+    if len(conversationIDs) == 0 {
+        return byConversation, nil
+    }
+    videos, err := l.assetRepo.VideosOfConversations(ctx, userID, conversationIDs)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up videos: %w", err)
+    }
+    for _, video := range videos {
+        byConversation[video.ConversationID] = append(byConversation[video.ConversationID], video)
+    }
+    return byConversation, nil
+}
+
+// withinDistance returns the Hamming distance to target of the hashes that
+// are at most maxDistance from it
+func withinDistance(target uint64, hashes map[uuid.UUID]int64, maxDistance int) map[uuid.UUID]int {
+    distances := make(map[uuid.UUID]int)
+    for id, hash := range hashes {
+        if d := HashDistance(target, uint64(hash)); d <= maxDistance {
+            distances[id] = d
+        }
+    }
+    return distances
+}
+
+// sortByDistance orders attachments closest first, then newest first
+func sortByDistance(attachments []*models.Attachment, distances map[uuid.UUID]int) {
+    sort.Slice(attachments, func(i, j int) bool {
+        di, dj := distances[attachments[i].ID], distances[attachments[j].ID]
+        if di != dj {
+            return di < dj
+        }
+        return attachments[i].CreatedAt.After(attachments[j].CreatedAt)
+    })
+}
@@ -0,0 +1,61 @@
+package assets
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+)
+
+func TestWithinDistance(t *testing.T) {
+    target := uint64(0xf0f0f0f0f0f0f0f0)
+    same, near, edge, beyond, inverted := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+    hashes := map[uuid.UUID]int64{
+        same:     int64(target),
+        near:     int64(target ^ 0b111),
+        edge:     int64(target ^ 0x3ff),
+        beyond:   int64(target ^ 0x7ff),
+        inverted: int64(^target),
+    }
+
+    assert.Equal(t, map[uuid.UUID]int{same: 0, near: 3, edge: 10}, withinDistance(target, hashes, DefaultMaxDistance))
+    assert.Equal(t, map[uuid.UUID]int{same: 0}, withinDistance(target, hashes, 0))
+    assert.Len(t, withinDistance(target, hashes, 64), 5)
+    assert.Empty(t, withinDistance(target, nil, DefaultMaxDistance))
+}
+
+func TestWithinDistanceOfNegativeHashes(t *testing.T) {
+    // Hashes with the top bit set are stored as negative integers
+    target := uint64(1<<63 | 1)
+    id := uuid.New()
+    stored := int64(target ^ 0b10)
+    assert.Negative(t, stored)
+    assert.Equal(t, map[uuid.UUID]int{id: 1}, withinDistance(target, map[uuid.UUID]int64{id: stored}, 1))
+}
+
+func TestSortByDistance(t *testing.T) {
+    now := time.Now()
+    attachment := func(age time.Duration) *models.Attachment {
+        a := &models.Attachment{ID: uuid.New()}
+        a.CreatedAt = now.Add(-age)
+        return a
+    }
+    far, close, closeOlder, exact := attachment(0), attachment(time.Hour), attachment(2*time.Hour), attachment(3*time.Hour)
+    distances := map[uuid.UUID]int{far.ID: 9, close.ID: 2, closeOlder.ID: 2, exact.ID: 0}
+
+    attachments := []*models.Attachment{closeOlder, far, exact, close}
+    sortByDistance(attachments, distances)
+    assert.Equal(t, []*models.Attachment{exact, close, closeOlder, far}, attachments, "closest first, then newest")
+}
+
+func TestSimilarRejectsDistances(t *testing.T) {
+    library := NewLibrary(nil, nil)
+    for _, distance := range []int{-1, MaxDistance + 1} {
+        _, err := library.Similar(context.Background(), uuid.New(), uuid.New(), distance, 0)
+        assert.ErrorIs(t, err, ErrInvalidQuery, "distance %d", distance)
+    }
+}
@@ -0,0 +1,71 @@
+package cleanup
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/D43M0N18/qilin_core/internal/database/repository"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// lookupBatchSize bounds the IN lists sent to the database
+const lookupBatchSize = 500
+
+// ReferenceIndex reports which storage keys are still referenced by a record
+type ReferenceIndex interface {
+    Referenced(ctx context.Context, keys []string) (map[string]bool, error)
+}
+
+// DatabaseIndex looks storage keys up in the attachments and videos tables.
+// Video thumbnails are only recorded by URL, so they are matched on the URL
+// the storage service serves each key under.
+type DatabaseIndex struct {
+    attachmentRepo *repository.AttachmentRepository
+    videoRepo      *repository.VideoRepository
+    storage        storage.StorageService
+}
+
+// NewDatabaseIndex creates an index over the attachments and videos tables
+func NewDatabaseIndex(attachmentRepo *repository.AttachmentRepository, videoRepo *repository.VideoRepository, storageService storage.StorageService) *DatabaseIndex {
+    return &DatabaseIndex{
+        attachmentRepo: attachmentRepo,
+        videoRepo:      videoRepo,
+        storage:        storageService,
+    }
+}
+
+// Referenced returns the subset of keys that an attachment or video points at
+func (i *DatabaseIndex) Referenced(ctx context.Context, keys []string) (map[string]bool, error) {
+    referenced := make(map[string]bool)
+    for start := 0; start < len(keys); start += lookupBatchSize {
+        batch := keys[start:min(start+lookupBatchSize, len(keys))]
+        urls := make([]string, len(batch))
+        keyByURL := make(map[string]string, len(batch))
+        for n, key := range batch {
+            urls[n] = storage.ObjectURL(i.storage, key)
+            keyByURL[urls[n]] = key
+        }
+        found, err := i.attachmentRepo.ReferencedStorageKeys(ctx, batch)
+        if err != nil {
+            return nil, fmt.Errorf("failed to look up attachments: %w", err)
+        }
+        for _, key := range found {
+            referenced[key] = true
+        }
+        found, err = i.videoRepo.ReferencedStorageKeys(ctx, batch)
+        if err != nil {
+            return nil, fmt.Errorf("failed to look up videos: %w", err)
+        }
+        for _, key := range found {
+            referenced[key] = true
+        }
+        found, err = i.videoRepo.ReferencedThumbnailURLs(ctx, urls)
+        if err != nil {
+            return nil, fmt.Errorf("failed to look up video thumbnails: %w", err)
+        }
+        for _, url := range found {
+            referenced[keyByURL[url]] = true
+        }
+    }
+    return referenced, nil
+}
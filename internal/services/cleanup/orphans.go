@@ -0,0 +1,215 @@
+package cleanup
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+const (
+    collectorLockKey   = "storage_gc:lock"
+    collectorReportKey = "storage_gc:last_report"
+    collectorLockTTL   = time.Hour
+)
+
+var (
+    ErrCollectionRunning = errors.New("a storage collection is already running")
+    ErrNoReport          = errors.New("no storage collection has run yet")
+)
+
+// Orphan is a stored object that no record references
+type Orphan struct {
+    StorageKey   string    `json:"storage_key"`
+    FileSize     int64     `json:"file_size"`
+    LastModified time.Time `json:"last_modified"`
+}
+
+// Report describes one collection run
+type Report struct {
+    StartedAt   time.Time `json:"started_at"`
+    FinishedAt  time.Time `json:"finished_at"`
+    DryRun      bool      `json:"dry_run"`
+    GracePeriod string    `json:"grace_period"`
+    Scanned     int       `json:"scanned"`
+    Orphans     []Orphan  `json:"orphans"`
+    OrphanBytes int64     `json:"orphan_bytes"`
+    Deleted     int       `json:"deleted"`
+}
+
+// OrphanCollector reconciles the objects in storage against the records
+// that reference them. Objects nothing references, such as uploads whose
+// attachment failed to save, are reported and, unless in dry-run mode,
+// deleted once they are older than the grace period. Thumbnails,
+// derivatives and versions live as long as the object they belong to.
+type OrphanCollector struct {
+    storage     storage.StorageService
+    index       ReferenceIndex
+    redis       *redis.Client
+    gracePeriod time.Duration
+    dryRun      bool
+}
+
+// NewOrphanCollector creates a collector. dryRun only applies to scheduled
+// runs; Collect takes its own flag.
+func NewOrphanCollector(storageService storage.StorageService, index ReferenceIndex, redisClient *redis.Client, gracePeriod time.Duration, dryRun bool) *OrphanCollector {
+    return &OrphanCollector{
+        storage:     storageService,
+        index:       index,
+        redis:       redisClient,
+        gracePeriod: gracePeriod,
+        dryRun:      dryRun,
+    }
+}
+
+// Run collects orphans every interval until ctx is cancelled
+func (c *OrphanCollector) Run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if _, err := c.Collect(ctx, c.dryRun); err != nil && !errors.Is(err, ErrCollectionRunning) {
+                log.Error().Err(err).Msg("Storage collection failed")
+            }
+        }
+    }
+}
+
+// Collect finds orphaned objects and deletes them unless dryRun is set.
+// Only one instance collects at a time.
+func (c *OrphanCollector) Collect(ctx context.Context, dryRun bool) (*Report, error) {
+    acquired, err := c.redis.SetNX(ctx, collectorLockKey, time.Now().Unix(), collectorLockTTL).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to acquire collection lock: %w", err)
+    }
+    if !acquired {
+        return nil, ErrCollectionRunning
+    }
+    defer c.redis.Del(context.WithoutCancel(ctx), collectorLockKey)
+
+    report := &Report{StartedAt: time.Now().UTC(), DryRun: dryRun, GracePeriod: c.gracePeriod.String()}
+    orphans, scanned, err := c.findOrphans(ctx, report.StartedAt.Add(-c.gracePeriod))
+    if err != nil {
+        return nil, err
+    }
+    report.Scanned = scanned
+    report.Orphans = orphans
+    keys := make([]string, len(orphans))
+    for n, orphan := range orphans {
+        keys[n] = orphan.StorageKey
+        report.OrphanBytes += orphan.FileSize
+    }
+    if !dryRun && len(keys) > 0 {
+        // Deleting through the service keeps dedup references and quota usage in step
+        if err := c.storage.DeleteMultiple(ctx, keys); err != nil {
+            return nil, fmt.Errorf("failed to delete orphans: %w", err)
+        }
+        report.Deleted = len(keys)
+    }
+    report.FinishedAt = time.Now().UTC()
+    if data, err := json.Marshal(report); err == nil {
+        c.redis.Set(ctx, collectorReportKey, data, 0)
+    }
+    log.Info().Bool("dry_run", dryRun).Int("scanned", report.Scanned).Int("orphans", len(orphans)).Int64("orphan_bytes", report.OrphanBytes).Int("deleted", report.Deleted).Msg("Storage collection finished")
+    return report, nil
+}
+
+// LastReport returns the report of the most recent run on any instance
+func (c *OrphanCollector) LastReport(ctx context.Context) (*Report, error) {
+    data, err := c.redis.Get(ctx, collectorReportKey).Bytes()
+    if err == redis.Nil {
+        return nil, ErrNoReport
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to load collection report: %w", err)
+    }
+    var report Report
+    if err := json.Unmarshal(data, &report); err != nil {
+        return nil, fmt.Errorf("failed to decode collection report: %w", err)
+    }
+    return &report, nil
+}
+
+// findOrphans lists the objects last modified before cutoff that neither a
+// record nor a referenced source object accounts for. Objects are listed and
+// looked up a page at a time. The bottom backend is listed, since decorators
+// hide objects such as versions from listings.
+func (c *OrphanCollector) findOrphans(ctx context.Context, cutoff time.Time) ([]Orphan, int, error) {
+    var orphans []Orphan
+    scanned := 0
+    err := storage.ListAll(ctx, storage.Base(c.storage), "", func(files []*storage.FileInfo) error {
+        found, err := c.pageOrphans(ctx, files, cutoff)
+        if err != nil {
+            return err
+        }
+        orphans = append(orphans, found...)
+        scanned += len(files)
+        return nil
+    })
+    if err != nil {
+        return nil, 0, fmt.Errorf("failed to list objects: %w", err)
+    }
+    return orphans, scanned, nil
+}
+
+// pageOrphans finds the orphans among one page of objects
+func (c *OrphanCollector) pageOrphans(ctx context.Context, files []*storage.FileInfo, cutoff time.Time) ([]Orphan, error) {
+    var candidates []*storage.FileInfo
+    var keys []string
+    for _, file := range files {
+        if file.IsDirectory || !file.LastModified.Before(cutoff) {
+            continue
+        }
+        candidates = append(candidates, file)
+        keys = append(keys, file.StorageKey)
+    }
+    if len(candidates) == 0 {
+        return nil, nil
+    }
+    referenced, err := c.index.Referenced(ctx, keys)
+    if err != nil {
+        return nil, err
+    }
+    sources := make(map[string]string)
+    var sourceKeys []string
+    for _, file := range candidates {
+        if referenced[file.StorageKey] {
+            continue
+        }
+        if source, ok := storage.VersionOf(file.StorageKey); ok {
+            sources[file.StorageKey] = source
+            sourceKeys = append(sourceKeys, source)
+        } else if source, ok := storage.SourceKey(ctx, c.storage, file.StorageKey); ok {
+            sources[file.StorageKey] = source
+            sourceKeys = append(sourceKeys, source)
+        }
+    }
+    sourceReferenced, err := c.index.Referenced(ctx, sourceKeys)
+    if err != nil {
+        return nil, err
+    }
+    var orphans []Orphan
+    for _, file := range candidates {
+        if referenced[file.StorageKey] {
+            continue
+        }
+        if source, ok := sources[file.StorageKey]; ok && sourceReferenced[source] {
+            continue
+        }
+        orphans = append(orphans, Orphan{
+            StorageKey:   file.StorageKey,
+            FileSize:     file.FileSize,
+            LastModified: file.LastModified,
+        })
+    }
+    return orphans, nil
+}
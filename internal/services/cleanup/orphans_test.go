@@ -0,0 +1,87 @@
+package cleanup
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+// staticIndex references a fixed set of keys
+type staticIndex map[string]bool
+
+func (i staticIndex) Referenced(ctx context.Context, keys []string) (map[string]bool, error) {
+    referenced := make(map[string]bool)
+    for _, key := range keys {
+        if i[key] {
+            referenced[key] = true
+        }
+    }
+    return referenced, nil
+}
+
+func orphanKeys(orphans []Orphan) []string {
+    keys := make([]string, len(orphans))
+    for n, orphan := range orphans {
+        keys[n] = orphan.StorageKey
+    }
+    return keys
+}
+
+func TestFindOrphansKeepsThumbnailsOfReferencedObjects(t *testing.T) {
+    ctx := context.Background()
+    svc := storage.NewMemoryStorageService("")
+    upload := func(name string) *storage.UploadResult {
+        data := storagetest.NewPNG(t, 40, 40)
+        opts := storage.NewUploadOptions()
+        opts.Folder = "uploads"
+        opts.GenerateThumbnail = true
+        result, err := svc.UploadFromReader(ctx, strings.NewReader(string(data)), name, "image/png", int64(len(data)), opts)
+        require.NoError(t, err)
+        return result
+    }
+    kept := upload("kept.png")
+    lost := upload("lost.png")
+
+    collector := NewOrphanCollector(svc, staticIndex{kept.StorageKey: true}, nil, 0, false)
+    orphans, scanned, err := collector.findOrphans(ctx, time.Now().Add(time.Second))
+    require.NoError(t, err)
+    assert.Equal(t, 4, scanned)
+    assert.ElementsMatch(t, []string{lost.StorageKey, strings.TrimSuffix(lost.StorageKey, ".png") + "_thumb.png"}, orphanKeys(orphans))
+
+    // Nothing is older than the grace period
+    orphans, _, err = collector.findOrphans(ctx, time.Now().Add(-time.Hour))
+    require.NoError(t, err)
+    assert.Empty(t, orphans)
+}
+
+func TestFindOrphansSeesVersionsOfDeletedObjects(t *testing.T) {
+    ctx := context.Background()
+    backend := storage.NewMemoryStorageService("")
+    svc := storage.NewVersionedStorageService(backend, 0)
+    write := func(key, contents string) {
+        opts := storage.NewUploadOptions()
+        opts.StorageKey = key
+        _, err := svc.UploadFromReader(ctx, strings.NewReader(contents), "notes.txt", "text/plain", int64(len(contents)), opts)
+        require.NoError(t, err)
+    }
+    write("uploads/kept.txt", "one")
+    write("uploads/kept.txt", "two")
+    write("uploads/lost.txt", "one")
+    write("uploads/lost.txt", "two")
+    // The object went without its history, as it did before versioning was enabled
+    require.NoError(t, backend.Delete(ctx, "uploads/lost.txt"))
+
+    collector := NewOrphanCollector(svc, staticIndex{"uploads/kept.txt": true}, nil, 0, false)
+    orphans, scanned, err := collector.findOrphans(ctx, time.Now().Add(time.Second))
+    require.NoError(t, err)
+    assert.Equal(t, 3, scanned)
+    require.Len(t, orphans, 1)
+    assert.True(t, strings.HasPrefix(orphans[0].StorageKey, storage.VersionFolder+"/uploads/lost.txt/"))
+}
@@ -0,0 +1,172 @@
+package media
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "image"
+    _ "image/jpeg"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/rs/zerolog/log"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// posterMaxSize bounds the longer side of poster frames
+const posterMaxSize = 640
+
+// Result is what Analyze learned about a stored video
+type Result struct {
+    Info   *Info                 // nil when the format couldn't be probed
+    Poster *storage.UploadResult // nil when no poster frame was rendered
+}
+
+// Analyzer probes stored videos and renders their poster frame. Results are
+// kept in the object's metadata, so analyzing a video twice is cheap.
+type Analyzer struct {
+    storage  storage.StorageService
+    prober   Prober
+    ffmpeg   string // empty when poster frames are disabled
+    posterAt time.Duration
+    tempDir  string
+}
+
+// NewAnalyzer creates an analyzer over svc. Poster frames need ffmpeg; they
+// are skipped when cfg.FFmpegPath can't be found.
+func NewAnalyzer(svc storage.StorageService, cfg appconfig.UploadConfig) *Analyzer {
+    a := &Analyzer{
+        storage:  svc,
+        prober:   NewProber(cfg),
+        posterAt: cfg.PosterOffset,
+        tempDir:  cfg.TempDir,
+    }
+    if cfg.FFmpegPath != "" {
+        ffmpeg, err := exec.LookPath(cfg.FFmpegPath)
+        if err != nil {
+            log.Warn().Err(err).Msg("ffmpeg not found, video poster frames disabled")
+        } else {
+            a.ffmpeg = ffmpeg
+        }
+    }
+    return a
+}
+
+// PosterKey returns the key of the poster frame of a video
+func PosterKey(storageKey string) string {
+    return strings.TrimSuffix(storageKey, filepath.Ext(storageKey)) + "_poster.jpg"
+}
+
+// Analyze probes the video at storageKey, stores its poster frame next to it
+// and records both in the video's metadata
+func (a *Analyzer) Analyze(ctx context.Context, storageKey string) (*Result, error) {
+    metadata, err := a.storage.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    if info := InfoFromMetadata(metadata.Metadata); info != nil {
+        // Deduplicated uploads share the blob, and its analysis
+        return a.cached(ctx, info, metadata.Metadata[MetaPoster]), nil
+    }
+
+    file, err := os.CreateTemp(a.tempDir, "probe-*"+filepath.Ext(storageKey))
+    if err != nil {
+        return nil, fmt.Errorf("failed to create temp file: %w", err)
+    }
+    defer os.Remove(file.Name())
+    err = a.storage.DownloadToWriter(ctx, storageKey, file)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to download video: %w", err)
+    }
+
+    result := &Result{}
+    result.Info, err = a.prober.Probe(ctx, file.Name())
+    if err != nil && !errors.Is(err, ErrUnsupportedFormat) {
+        return nil, err
+    }
+    if a.ffmpeg != "" {
+        result.Poster, err = a.storePoster(ctx, storageKey, file.Name(), result.Info)
+        if err != nil {
+            log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to render video poster frame")
+        }
+    }
+    if result.Info == nil {
+        return result, nil
+    }
+    values := result.Info.Metadata()
+    if result.Poster != nil {
+        values[MetaPoster] = result.Poster.StorageKey
+    }
+    if err := storage.MergeMetadata(ctx, a.storage, storageKey, values); err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to record video metadata")
+    }
+    return result, nil
+}
+
+// storePoster renders the poster frame and stores it as a derivative of the
+// video, so it's charged, collected and deleted along with it
+func (a *Analyzer) storePoster(ctx context.Context, storageKey, path string, info *Info) (*storage.UploadResult, error) {
+    offset := a.posterAt
+    if info != nil && info.Duration > 0 {
+        // Short clips get the frame from their middle
+        offset = min(offset, time.Duration(info.Duration*float64(time.Second)/2))
+    }
+    data, err := PosterFrame(ctx, a.ffmpeg, path, offset, posterMaxSize)
+    if err != nil {
+        return nil, err
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("ffmpeg returned an invalid poster frame: %w", err)
+    }
+    opts := storage.NewUploadOptions()
+    opts.StorageKey = PosterKey(storageKey)
+    opts.StripMetadata = false
+    opts.Metadata = map[string]string{
+        storage.MetaDerivativeOf: storageKey,
+        storage.MetaWidth:        strconv.Itoa(cfg.Width),
+        storage.MetaHeight:       strconv.Itoa(cfg.Height),
+    }
+    result, err := a.storage.UploadFromReader(ctx, bytes.NewReader(data), opts.StorageKey, "image/jpeg", int64(len(data)), opts)
+    if err != nil {
+        return nil, fmt.Errorf("failed to store poster frame: %w", err)
+    }
+    result.Width, result.Height = cfg.Width, cfg.Height
+    return result, nil
+}
+
+// cached returns an earlier analysis, with the poster it rendered if that
+// still exists
+func (a *Analyzer) cached(ctx context.Context, info *Info, posterKey string) *Result {
+    result := &Result{Info: info}
+    if posterKey == "" {
+        return result
+    }
+    poster, err := a.storage.GetMetadata(ctx, posterKey)
+    if err != nil {
+        return result
+    }
+    width, _ := strconv.Atoi(poster.Metadata[storage.MetaWidth])
+    height, _ := strconv.Atoi(poster.Metadata[storage.MetaHeight])
+    result.Poster = &storage.UploadResult{
+        StorageKey:  posterKey,
+        StoragePath: posterKey,
+        URL:         storage.ObjectURL(a.storage, posterKey),
+        FileName:    filepath.Base(posterKey),
+        FileSize:    poster.FileSize,
+        ContentType: poster.ContentType,
+        Width:       width,
+        Height:      height,
+    }
+    return result
+}
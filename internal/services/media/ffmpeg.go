@@ -0,0 +1,139 @@
+package media
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// FFprobe probes videos with ffprobe, which understands every container and
+// codec ffmpeg does
+type FFprobe struct {
+    path string
+}
+
+// NewFFprobe runs the ffprobe binary at path
+func NewFFprobe(path string) *FFprobe {
+    return &FFprobe{path: path}
+}
+
+type ffprobeOutput struct {
+    Streams []struct {
+        CodecType string            `json:"codec_type"`
+        CodecName string            `json:"codec_name"`
+        Width     int               `json:"width"`
+        Height    int               `json:"height"`
+        Tags      map[string]string `json:"tags"`
+        // Cover art shows up as a video stream with attached_pic set
+        Disposition struct {
+            AttachedPic int `json:"attached_pic"`
+        } `json:"disposition"`
+        SideData []struct {
+            Type     string  `json:"side_data_type"`
+            Rotation float64 `json:"rotation"`
+        } `json:"side_data_list"`
+    } `json:"streams"`
+    Format struct {
+        FormatName string            `json:"format_name"`
+        Duration   string            `json:"duration"`
+        Size       string            `json:"size"`
+        BitRate    string            `json:"bit_rate"`
+        Tags       map[string]string `json:"tags"`
+    } `json:"format"`
+}
+
+// Probe runs ffprobe on the file at path
+func (f *FFprobe) Probe(ctx context.Context, path string) (*Info, error) {
+    cmd := exec.CommandContext(ctx, f.path, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return nil, probeError(path, fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String())))
+    }
+    var probed ffprobeOutput
+    if err := json.Unmarshal(out, &probed); err != nil {
+        return nil, probeError(path, fmt.Errorf("invalid ffprobe output: %w", err))
+    }
+    info := &Info{Container: containerName(probed.Format.FormatName, probed.Format.Tags["major_brand"])}
+    info.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+    info.Bitrate, _ = strconv.ParseInt(probed.Format.BitRate, 10, 64)
+    for _, stream := range probed.Streams {
+        switch stream.CodecType {
+        case "video":
+            if info.VideoCodec != "" || stream.Disposition.AttachedPic == 1 {
+                continue
+            }
+            info.VideoCodec = stream.CodecName
+            if rotate, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+                info.Rotation = normalizeRotation(rotate)
+            }
+            for _, side := range stream.SideData {
+                // The display matrix rotation is counterclockwise
+                if side.Type == "Display Matrix" {
+                    info.Rotation = normalizeRotation(-int(side.Rotation))
+                }
+            }
+            info.Width, info.Height = displaySize(stream.Width, stream.Height, info.Rotation)
+        case "audio":
+            if info.AudioCodec == "" {
+                info.AudioCodec = stream.CodecName
+            }
+        }
+    }
+    if info.Bitrate == 0 {
+        size, _ := strconv.ParseInt(probed.Format.Size, 10, 64)
+        info.Bitrate = bitrate(size, info.Duration)
+    }
+    return info, nil
+}
+
+// containerName shortens ffprobe's format names, which list every format
+// sharing a demuxer
+func containerName(formatName, majorBrand string) string {
+    switch {
+    case strings.Contains(formatName, "mp4"):
+        if strings.TrimSpace(majorBrand) == "qt" {
+            return "mov"
+        }
+        return "mp4"
+    case strings.Contains(formatName, "webm"):
+        return "webm"
+    default:
+        name, _, _ := strings.Cut(formatName, ",")
+        return name
+    }
+}
+
+// PosterFrame decodes the frame at offset of the video at path with ffmpeg
+// and returns it as a JPEG no larger than maxSize on either side. ffmpeg
+// applies the video's rotation, so the poster is shown upright.
+func PosterFrame(ctx context.Context, ffmpeg, path string, offset time.Duration, maxSize int) ([]byte, error) {
+    scale := fmt.Sprintf("scale=w=%d:h=%d:force_original_aspect_ratio=decrease", maxSize, maxSize)
+    cmd := exec.CommandContext(ctx, ffmpeg,
+        "-v", "error",
+        "-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64),
+        "-i", path,
+        "-frames:v", "1",
+        "-vf", scale,
+        "-q:v", "3",
+        "-f", "image2",
+        "-c:v", "mjpeg",
+        "pipe:1",
+    )
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+    }
+    if len(out) == 0 {
+        return nil, fmt.Errorf("ffmpeg decoded no frame at %s", offset)
+    }
+    return out, nil
+}
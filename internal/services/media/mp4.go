@@ -0,0 +1,387 @@
+package media
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+const (
+    // maxBoxPayload bounds how much of a header box is read into memory
+    maxBoxPayload = 64 * 1024
+    // maxBoxes bounds the work done on files with absurd box trees
+    maxBoxes = 10000
+)
+
+var errMalformedBox = errors.New("malformed MP4 box")
+
+// topLevelBoxes are the boxes an MP4 or QuickTime file can start with
+var topLevelBoxes = map[string]bool{
+    "ftyp": true,
+    "moov": true,
+    "mdat": true,
+    "free": true,
+    "skip": true,
+    "wide": true,
+    "pnot": true,
+}
+
+// codecNames maps sample entry types to the codec names ffprobe reports
+var codecNames = map[string]string{
+    "avc1": "h264",
+    "avc3": "h264",
+    "hvc1": "hevc",
+    "hev1": "hevc",
+    "av01": "av1",
+    "vp08": "vp8",
+    "vp09": "vp9",
+    "mp4v": "mpeg4",
+    "jpeg": "mjpeg",
+    "apch": "prores",
+    "apcn": "prores",
+    "apcs": "prores",
+    "apco": "prores",
+    "ap4h": "prores",
+    "mp4a": "aac",
+    "ac-3": "ac3",
+    "ec-3": "eac3",
+    "Opus": "opus",
+    "fLaC": "flac",
+    ".mp3": "mp3",
+    "alac": "alac",
+    "lpcm": "pcm",
+    "sowt": "pcm",
+    "twos": "pcm",
+}
+
+// MP4Prober reads MP4 and QuickTime files by walking their box structure.
+// Only the movie header boxes are read, so probing doesn't depend on the
+// size of the media data.
+type MP4Prober struct{}
+
+// Probe reads the movie and track headers of the file at path
+func (MP4Prober) Probe(ctx context.Context, path string) (*Info, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    stat, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    info, err := ParseMP4(file, stat.Size())
+    if err != nil {
+        return nil, probeError(path, err)
+    }
+    return info, nil
+}
+
+// box is one box header, with the offset and size of its payload
+type box struct {
+    kind   string
+    offset int64
+    size   int64
+}
+
+type mp4Parser struct {
+    r     io.ReaderAt
+    boxes int
+}
+
+// track collects what the parser learns about one trak box
+type track struct {
+    handler  string
+    codec    string
+    width    int
+    height   int
+    rotation int
+}
+
+// ParseMP4 parses an MP4 or QuickTime file of the given size
+func ParseMP4(r io.ReaderAt, size int64) (*Info, error) {
+    var head [8]byte
+    if _, err := r.ReadAt(head[:], 0); err != nil || !topLevelBoxes[string(head[4:8])] {
+        return nil, ErrUnsupportedFormat
+    }
+    p := &mp4Parser{r: r}
+    top, err := p.children(0, size)
+    if err != nil {
+        return nil, err
+    }
+    info := &Info{Container: "mp4"}
+    var moov *box
+    for n, b := range top {
+        switch b.kind {
+        case "ftyp":
+            payload, err := p.payload(b)
+            if err != nil {
+                return nil, err
+            }
+            if len(payload) >= 4 && string(payload[:4]) == "qt  " {
+                info.Container = "mov"
+            }
+        case "moov":
+            moov = &top[n]
+        }
+    }
+    if moov == nil {
+        return nil, fmt.Errorf("%w: no moov box", errMalformedBox)
+    }
+    if top[0].kind != "ftyp" {
+        // Old QuickTime files have no ftyp box
+        info.Container = "mov"
+    }
+    children, err := p.children(moov.offset, moov.size)
+    if err != nil {
+        return nil, err
+    }
+    var video *track
+    for _, b := range children {
+        switch b.kind {
+        case "mvhd":
+            payload, err := p.payload(b)
+            if err != nil {
+                return nil, err
+            }
+            timescale, duration, err := parseTimes(payload)
+            if err != nil {
+                return nil, err
+            }
+            if timescale > 0 {
+                info.Duration = float64(duration) / float64(timescale)
+            }
+        case "trak":
+            t, err := p.track(b)
+            if err != nil {
+                return nil, err
+            }
+            switch t.handler {
+            case "vide":
+                if video == nil {
+                    video = t
+                }
+            case "soun":
+                if info.AudioCodec == "" {
+                    info.AudioCodec = t.codec
+                }
+            }
+        }
+    }
+    if video != nil {
+        info.VideoCodec = video.codec
+        info.Rotation = video.rotation
+        info.Width, info.Height = displaySize(video.width, video.height, video.rotation)
+    }
+    info.Bitrate = bitrate(size, info.Duration)
+    return info, nil
+}
+
+// track reads the handler, codec, dimensions and rotation of a trak box
+func (p *mp4Parser) track(trak box) (*track, error) {
+    t := &track{}
+    children, err := p.children(trak.offset, trak.size)
+    if err != nil {
+        return nil, err
+    }
+    for _, b := range children {
+        switch b.kind {
+        case "tkhd":
+            payload, err := p.payload(b)
+            if err != nil {
+                return nil, err
+            }
+            if err := t.parseHeader(payload); err != nil {
+                return nil, err
+            }
+        case "mdia":
+            if err := p.media(b, t); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return t, nil
+}
+
+// media reads the handler type and the first sample description of an mdia box
+func (p *mp4Parser) media(mdia box, t *track) error {
+    children, err := p.children(mdia.offset, mdia.size)
+    if err != nil {
+        return err
+    }
+    for _, b := range children {
+        switch b.kind {
+        case "hdlr":
+            payload, err := p.payload(b)
+            if err != nil {
+                return err
+            }
+            if len(payload) < 12 {
+                return fmt.Errorf("%w: short hdlr", errMalformedBox)
+            }
+            t.handler = string(payload[8:12])
+        case "minf":
+            stsd, ok, err := p.find(b, "stbl", "stsd")
+            if err != nil || !ok {
+                return err
+            }
+            payload, err := p.payload(stsd)
+            if err != nil {
+                return err
+            }
+            t.parseSampleDescription(payload)
+        }
+    }
+    return nil
+}
+
+// find follows a path of box types below parent
+func (p *mp4Parser) find(parent box, path ...string) (box, bool, error) {
+    current := parent
+    for _, kind := range path {
+        children, err := p.children(current.offset, current.size)
+        if err != nil {
+            return box{}, false, err
+        }
+        found := false
+        for _, b := range children {
+            if b.kind == kind {
+                current, found = b, true
+                break
+            }
+        }
+        if !found {
+            return box{}, false, nil
+        }
+    }
+    return current, true, nil
+}
+
+// children lists the boxes in the payload at offset
+func (p *mp4Parser) children(offset, size int64) ([]box, error) {
+    var boxes []box
+    end := offset + size
+    var header [16]byte
+    for offset+8 <= end {
+        if p.boxes++; p.boxes > maxBoxes {
+            return nil, fmt.Errorf("%w: too many boxes", errMalformedBox)
+        }
+        if _, err := p.r.ReadAt(header[:8], offset); err != nil {
+            return nil, fmt.Errorf("%w: %v", errMalformedBox, err)
+        }
+        boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+        kind := string(header[4:8])
+        headerSize := int64(8)
+        switch boxSize {
+        case 0:
+            // The last box extends to the end of its parent
+            boxSize = end - offset
+        case 1:
+            if _, err := p.r.ReadAt(header[8:16], offset+8); err != nil {
+                return nil, fmt.Errorf("%w: %v", errMalformedBox, err)
+            }
+            boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+            headerSize = 16
+        }
+        if boxSize < headerSize || offset+boxSize > end {
+            return nil, fmt.Errorf("%w: %q overruns its parent", errMalformedBox, kind)
+        }
+        boxes = append(boxes, box{kind: kind, offset: offset + headerSize, size: boxSize - headerSize})
+        offset += boxSize
+    }
+    return boxes, nil
+}
+
+// payload reads a header box into memory
+func (p *mp4Parser) payload(b box) ([]byte, error) {
+    if b.size > maxBoxPayload {
+        return nil, fmt.Errorf("%w: %s box of %d bytes", errMalformedBox, b.kind, b.size)
+    }
+    data := make([]byte, b.size)
+    if _, err := p.r.ReadAt(data, b.offset); err != nil {
+        return nil, fmt.Errorf("%w: %v", errMalformedBox, err)
+    }
+    return data, nil
+}
+
+// parseTimes reads the timescale and duration of an mvhd or mdhd box
+func parseTimes(payload []byte) (uint32, uint64, error) {
+    if len(payload) < 4 {
+        return 0, 0, fmt.Errorf("%w: short header", errMalformedBox)
+    }
+    if payload[0] == 1 {
+        // version, flags, 64-bit creation and modification times
+        if len(payload) < 32 {
+            return 0, 0, fmt.Errorf("%w: short header", errMalformedBox)
+        }
+        return binary.BigEndian.Uint32(payload[20:24]), binary.BigEndian.Uint64(payload[24:32]), nil
+    }
+    if len(payload) < 20 {
+        return 0, 0, fmt.Errorf("%w: short header", errMalformedBox)
+    }
+    return binary.BigEndian.Uint32(payload[12:16]), uint64(binary.BigEndian.Uint32(payload[16:20])), nil
+}
+
+// parseHeader reads the presentation size and transformation matrix of a
+// tkhd box
+func (t *track) parseHeader(payload []byte) error {
+    // version 0 has 32-bit times and duration, version 1 64-bit ones
+    matrix := 40
+    if len(payload) > 0 && payload[0] == 1 {
+        matrix = 52
+    }
+    if len(payload) < matrix+44 {
+        return fmt.Errorf("%w: short tkhd", errMalformedBox)
+    }
+    var m [4]int32
+    for n := range m {
+        // a, b, c, d of the matrix are 16.16 fixed point
+        index := []int{0, 1, 3, 4}[n]
+        m[n] = int32(binary.BigEndian.Uint32(payload[matrix+index*4:]))
+    }
+    t.rotation = matrixRotation(m[0], m[1], m[2], m[3])
+    t.width = int(binary.BigEndian.Uint32(payload[matrix+36:]) >> 16)
+    t.height = int(binary.BigEndian.Uint32(payload[matrix+40:]) >> 16)
+    return nil
+}
+
+// parseSampleDescription reads the codec, and the coded size when tkhd left
+// it empty, from the first entry of an stsd box
+func (t *track) parseSampleDescription(payload []byte) {
+    // version, flags and entry count, then the entry's size and type
+    if len(payload) < 16 {
+        return
+    }
+    format := string(payload[12:16])
+    if name, ok := codecNames[format]; ok {
+        t.codec = name
+    } else {
+        t.codec = strings.TrimSpace(format)
+    }
+    // Visual sample entries carry the size after 24 bytes of reserved and
+    // predefined fields
+    if t.handler == "vide" && t.width == 0 && len(payload) >= 16+28 {
+        t.width = int(binary.BigEndian.Uint16(payload[16+24:]))
+        t.height = int(binary.BigEndian.Uint16(payload[16+26:]))
+    }
+}
+
+// matrixRotation reads the clockwise rotation from the a, b, c and d entries
+// of a track matrix
+func matrixRotation(a, b, c, d int32) int {
+    const one = 1 << 16
+    switch {
+    case a == 0 && b == one && c == -one && d == 0:
+        return 90
+    case a == -one && b == 0 && c == 0 && d == -one:
+        return 180
+    case a == 0 && b == -one && c == one && d == 0:
+        return 270
+    default:
+        return 0
+    }
+}
@@ -0,0 +1,236 @@
+package media
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+const fixedOne = 1 << 16
+
+// Track matrices as written by cameras and editors, a b u c d v x y w
+var (
+    identityMatrix  = [9]int32{fixedOne, 0, 0, 0, fixedOne, 0, 0, 0, 1 << 30}
+    rotate90Matrix  = [9]int32{0, fixedOne, 0, -fixedOne, 0, 0, 0, 0, 1 << 30}
+    rotate180Matrix = [9]int32{-fixedOne, 0, 0, 0, -fixedOne, 0, 0, 0, 1 << 30}
+    rotate270Matrix = [9]int32{0, -fixedOne, 0, fixedOne, 0, 0, 0, 0, 1 << 30}
+)
+
+func be32(v uint32) []byte {
+    return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// mp4Box builds a box with a 32-bit size
+func mp4Box(kind string, parts ...[]byte) []byte {
+    payload := bytes.Join(parts, nil)
+    return append(append(be32(uint32(8+len(payload))), kind...), payload...)
+}
+
+// largeBox builds a box with a 64-bit size
+func largeBox(kind string, payload []byte) []byte {
+    data := append(be32(1), kind...)
+    data = binary.BigEndian.AppendUint64(data, uint64(16+len(payload)))
+    return append(data, payload...)
+}
+
+func ftypBox(brand string) []byte {
+    return mp4Box("ftyp", []byte(brand), be32(0), []byte("isom"))
+}
+
+// mvhdBox builds a version 0 movie header
+func mvhdBox(timescale, duration uint32) []byte {
+    return mp4Box("mvhd", make([]byte, 12), be32(timescale), be32(duration), make([]byte, 80))
+}
+
+// tkhdBox builds a track header of the given version
+func tkhdBox(version byte, width, height int, matrix [9]int32) []byte {
+    header := make([]byte, 40)
+    if version == 1 {
+        header = make([]byte, 52)
+    }
+    header[0] = version
+    for _, v := range matrix {
+        header = append(header, be32(uint32(v))...)
+    }
+    return mp4Box("tkhd", header, be32(uint32(width<<16)), be32(uint32(height<<16)))
+}
+
+// mdiaBox builds the media box of a track with one sample description
+// carrying the coded size
+func mdiaBox(handler, codec string, width, height int) []byte {
+    hdlr := mp4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 12))
+    entry := mp4Box(codec, make([]byte, 24), []byte{byte(width >> 8), byte(width), byte(height >> 8), byte(height)}, make([]byte, 50))
+    stsd := mp4Box("stsd", make([]byte, 4), be32(1), entry)
+    return mp4Box("mdia", hdlr, mp4Box("minf", mp4Box("stbl", stsd)))
+}
+
+func trakBox(handler, codec string, width, height int, matrix [9]int32) []byte {
+    return mp4Box("trak", tkhdBox(0, width, height, matrix), mdiaBox(handler, codec, width, height))
+}
+
+func parse(t *testing.T, file []byte) (*Info, error) {
+    t.Helper()
+    return ParseMP4(bytes.NewReader(file), int64(len(file)))
+}
+
+func TestParseMP4(t *testing.T) {
+    file := bytes.Join([][]byte{
+        ftypBox("isom"),
+        mp4Box("mdat", make([]byte, 100000)),
+        mp4Box("moov",
+            mvhdBox(1000, 12500),
+            trakBox("vide", "avc1", 1920, 1080, identityMatrix),
+            trakBox("soun", "mp4a", 0, 0, identityMatrix),
+        ),
+    }, nil)
+    info, err := parse(t, file)
+    require.NoError(t, err)
+    assert.Equal(t, &Info{
+        Container:  "mp4",
+        Duration:   12.5,
+        Width:      1920,
+        Height:     1080,
+        VideoCodec: "h264",
+        AudioCodec: "aac",
+        Bitrate:    int64(len(file)) * 8 * 1000 / 12500,
+    }, info)
+    assert.Equal(t, info, InfoFromMetadata(info.Metadata()))
+}
+
+func TestParseMP4Rotation(t *testing.T) {
+    tests := []struct {
+        name     string
+        matrix   [9]int32
+        rotation int
+        width    int
+        height   int
+    }{
+        {"identity", identityMatrix, 0, 1920, 1080},
+        {"90 degrees", rotate90Matrix, 90, 1080, 1920},
+        {"180 degrees", rotate180Matrix, 180, 1920, 1080},
+        {"270 degrees", rotate270Matrix, 270, 1080, 1920},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, version := range []byte{0, 1} {
+                trak := mp4Box("trak", tkhdBox(version, 1920, 1080, tt.matrix), mdiaBox("vide", "hvc1", 1920, 1080))
+                info, err := parse(t, bytes.Join([][]byte{ftypBox("isom"), mp4Box("moov", mvhdBox(600, 600), trak)}, nil))
+                require.NoError(t, err, "tkhd version %d", version)
+                assert.Equal(t, tt.rotation, info.Rotation, "tkhd version %d", version)
+                assert.Equal(t, tt.width, info.Width, "displayed width, tkhd version %d", version)
+                assert.Equal(t, tt.height, info.Height, "displayed height, tkhd version %d", version)
+            }
+        })
+    }
+}
+
+func TestParseMP4CodedSize(t *testing.T) {
+    // tkhd without a presentation size falls back to the sample entry
+    trak := mp4Box("trak", tkhdBox(0, 0, 0, rotate90Matrix), mdiaBox("vide", "vp09", 640, 480))
+    info, err := parse(t, bytes.Join([][]byte{ftypBox("isom"), mp4Box("moov", mvhdBox(1000, 1000), trak)}, nil))
+    require.NoError(t, err)
+    assert.Equal(t, "vp9", info.VideoCodec)
+    assert.Equal(t, 480, info.Width)
+    assert.Equal(t, 640, info.Height)
+}
+
+func TestParseMP4BoxSizes(t *testing.T) {
+    moov := mp4Box("moov", mvhdBox(1000, 4000), trakBox("vide", "avc1", 320, 240, identityMatrix))
+
+    t.Run("64-bit size", func(t *testing.T) {
+        file := bytes.Join([][]byte{ftypBox("isom"), largeBox("mdat", make([]byte, 4096)), moov}, nil)
+        info, err := parse(t, file)
+        require.NoError(t, err)
+        assert.Equal(t, 4.0, info.Duration)
+        assert.Equal(t, 320, info.Width)
+    })
+
+    t.Run("zero size extends to the end", func(t *testing.T) {
+        mdat := append(be32(0), "mdat"...)
+        file := bytes.Join([][]byte{ftypBox("isom"), moov, mdat, make([]byte, 4096)}, nil)
+        info, err := parse(t, file)
+        require.NoError(t, err)
+        assert.Equal(t, 4.0, info.Duration)
+        assert.Equal(t, int64(len(file))*8/4, info.Bitrate)
+    })
+
+    t.Run("zero size moov", func(t *testing.T) {
+        last := append(be32(0), moov[4:]...)
+        info, err := parse(t, bytes.Join([][]byte{ftypBox("isom"), last}, nil))
+        require.NoError(t, err)
+        assert.Equal(t, "h264", info.VideoCodec)
+    })
+}
+
+func TestParseMP4QuickTime(t *testing.T) {
+    moov := mp4Box("moov", mvhdBox(600, 1200), trakBox("vide", "apch", 1280, 720, identityMatrix))
+
+    info, err := parse(t, bytes.Join([][]byte{ftypBox("qt  "), moov}, nil))
+    require.NoError(t, err)
+    assert.Equal(t, "mov", info.Container)
+    assert.Equal(t, "prores", info.VideoCodec)
+
+    // Files from before ftyp existed start with wide, mdat or moov
+    for _, file := range [][]byte{
+        bytes.Join([][]byte{mp4Box("wide"), mp4Box("mdat", make([]byte, 64)), moov}, nil),
+        moov,
+    } {
+        info, err := parse(t, file)
+        require.NoError(t, err)
+        assert.Equal(t, "mov", info.Container)
+        assert.Equal(t, 2.0, info.Duration)
+        assert.Equal(t, 1280, info.Width)
+    }
+}
+
+func TestParseMP4Malformed(t *testing.T) {
+    moov := mp4Box("moov", mvhdBox(1000, 1000), trakBox("vide", "avc1", 320, 240, identityMatrix))
+    file := bytes.Join([][]byte{ftypBox("isom"), moov}, nil)
+
+    _, err := parse(t, []byte("\x1aE\xdf\xa3\x9fB\x86\x81\x01webm"))
+    assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+    _, err = parse(t, bytes.Join([][]byte{ftypBox("isom"), mp4Box("mdat", make([]byte, 64))}, nil))
+    assert.ErrorIs(t, err, errMalformedBox, "no moov box")
+
+    // The file ends inside moov
+    _, err = parse(t, file[:len(file)-20])
+    assert.ErrorIs(t, err, errMalformedBox)
+
+    // The reader ends before the size the file claims
+    _, err = ParseMP4(bytes.NewReader(file[:len(file)-20]), int64(len(file)))
+    assert.ErrorIs(t, err, errMalformedBox)
+
+    // A child of moov claims more than moov holds
+    overrun := append([]byte(nil), file...)
+    mvhd := len(ftypBox("isom")) + 8
+    binary.BigEndian.PutUint32(overrun[mvhd:], uint32(len(moov)))
+    _, err = parse(t, overrun)
+    assert.ErrorIs(t, err, errMalformedBox)
+
+    // A box smaller than its own header
+    tiny := append([]byte(nil), file...)
+    binary.BigEndian.PutUint32(tiny[mvhd:], 4)
+    _, err = parse(t, tiny)
+    assert.ErrorIs(t, err, errMalformedBox)
+
+    // A 64-bit size past the end of the file
+    huge := bytes.Join([][]byte{ftypBox("isom"), moov, largeBox("mdat", make([]byte, 16))}, nil)
+    binary.BigEndian.PutUint64(huge[len(huge)-24:], 1<<40)
+    _, err = parse(t, huge)
+    assert.ErrorIs(t, err, errMalformedBox)
+
+    // A truncated track header
+    short := mp4Box("moov", mvhdBox(1000, 1000), mp4Box("trak", mp4Box("tkhd", make([]byte, 20))))
+    _, err = parse(t, bytes.Join([][]byte{ftypBox("isom"), short}, nil))
+    assert.ErrorIs(t, err, errMalformedBox)
+}
+
+func TestNormalizeRotation(t *testing.T) {
+    for degrees, want := range map[int]int{0: 0, 90: 90, -90: 270, 180: 180, -180: 180, 270: 270, -270: 90, 360: 0, 450: 90, 89: 90, 44: 0} {
+        assert.Equal(t, want, normalizeRotation(degrees), degrees)
+    }
+}
@@ -0,0 +1,138 @@
+package media
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+
+    "github.com/rs/zerolog/log"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// Object metadata keys probe results are stored under. Dimensions use the
+// same keys as image derivatives.
+const (
+    MetaContainer  = "media-container"
+    MetaDuration   = "media-duration"
+    MetaVideoCodec = "media-video-codec"
+    MetaAudioCodec = "media-audio-codec"
+    MetaBitrate    = "media-bitrate"
+    MetaRotation   = "media-rotation"
+    MetaPoster     = "media-poster"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported media format")
+
+// Info describes a video file
+type Info struct {
+    Container  string  `json:"container"`
+    Duration   float64 `json:"duration"` // seconds
+    Width      int     `json:"width,omitempty"`  // as displayed, after rotation
+    Height     int     `json:"height,omitempty"` // as displayed, after rotation
+    VideoCodec string  `json:"video_codec,omitempty"`
+    AudioCodec string  `json:"audio_codec,omitempty"`
+    Bitrate    int64   `json:"bitrate,omitempty"`  // bits per second
+    Rotation   int     `json:"rotation,omitempty"` // degrees clockwise
+}
+
+// Prober reads the properties of the video at path
+type Prober interface {
+    Probe(ctx context.Context, path string) (*Info, error)
+}
+
+// NewProber creates the prober selected by cfg.MediaProber: native parses
+// MP4 and MOV files itself, ffprobe handles every format ffmpeg knows. When
+// ffprobe isn't installed the native prober is used instead.
+func NewProber(cfg appconfig.UploadConfig) Prober {
+    switch strings.ToLower(cfg.MediaProber) {
+    case "ffprobe":
+        ffprobe, err := exec.LookPath(cfg.FFprobePath)
+        if err == nil {
+            return NewFFprobe(ffprobe)
+        }
+        log.Warn().Err(err).Msg("ffprobe not found, probing MP4 and MOV files natively")
+    case "", "native":
+    default:
+        log.Warn().Str("prober", cfg.MediaProber).Msg("Unknown media prober, probing natively")
+    }
+    return MP4Prober{}
+}
+
+// IsVideo reports whether contentType is probed
+func IsVideo(contentType string) bool {
+    return strings.HasPrefix(contentType, "video/")
+}
+
+// Metadata encodes the info as object metadata
+func (i *Info) Metadata() map[string]string {
+    metadata := map[string]string{
+        MetaContainer: i.Container,
+        MetaDuration:  strconv.FormatFloat(i.Duration, 'f', 3, 64),
+    }
+    if i.Width > 0 && i.Height > 0 {
+        metadata[storage.MetaWidth] = strconv.Itoa(i.Width)
+        metadata[storage.MetaHeight] = strconv.Itoa(i.Height)
+    }
+    if i.VideoCodec != "" {
+        metadata[MetaVideoCodec] = i.VideoCodec
+    }
+    if i.AudioCodec != "" {
+        metadata[MetaAudioCodec] = i.AudioCodec
+    }
+    if i.Bitrate > 0 {
+        metadata[MetaBitrate] = strconv.FormatInt(i.Bitrate, 10)
+    }
+    if i.Rotation != 0 {
+        metadata[MetaRotation] = strconv.Itoa(i.Rotation)
+    }
+    return metadata
+}
+
+// InfoFromMetadata decodes the info stored by Metadata. It returns nil for
+// objects that were never probed.
+func InfoFromMetadata(metadata map[string]string) *Info {
+    if metadata[MetaContainer] == "" {
+        return nil
+    }
+    info := &Info{
+        Container:  metadata[MetaContainer],
+        VideoCodec: metadata[MetaVideoCodec],
+        AudioCodec: metadata[MetaAudioCodec],
+    }
+    info.Duration, _ = strconv.ParseFloat(metadata[MetaDuration], 64)
+    info.Width, _ = strconv.Atoi(metadata[storage.MetaWidth])
+    info.Height, _ = strconv.Atoi(metadata[storage.MetaHeight])
+    info.Bitrate, _ = strconv.ParseInt(metadata[MetaBitrate], 10, 64)
+    info.Rotation, _ = strconv.Atoi(metadata[MetaRotation])
+    return info
+}
+
+// displaySize swaps the coded dimensions of videos shown rotated sideways
+func displaySize(width, height, rotation int) (int, int) {
+    if rotation == 90 || rotation == 270 {
+        return height, width
+    }
+    return width, height
+}
+
+// normalizeRotation maps any angle to 0, 90, 180 or 270 degrees clockwise
+func normalizeRotation(degrees int) int {
+    degrees = ((degrees % 360) + 360) % 360
+    return (degrees + 45) / 90 * 90 % 360
+}
+
+func bitrate(size int64, duration float64) int64 {
+    if duration <= 0 {
+        return 0
+    }
+    return int64(float64(size*8) / duration)
+}
+
+func probeError(path string, err error) error {
+    return fmt.Errorf("failed to probe %s: %w", path, err)
+}
@@ -0,0 +1,182 @@
+package scan
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "time"
+)
+
+// clamdChunkSize stays well under clamd's default StreamMaxLength chunking
+const clamdChunkSize = 64 * 1024
+
+// OversizedSignature is reported for files larger than clamd's
+// StreamMaxLength when oversized files are rejected
+const OversizedSignature = "Clamd.Oversized"
+
+// Policies for files larger than clamd's StreamMaxLength
+const (
+    OversizedReject = "reject"
+    OversizedAllow  = "allow"
+)
+
+// errStreamTooLong is clamd's reply to a stream over StreamMaxLength
+var errStreamTooLong = errors.New("clamd: INSTREAM size limit exceeded")
+
+// ClamdScanner streams files to a ClamAV daemon with the INSTREAM command
+type ClamdScanner struct {
+    network        string
+    address        string
+    timeout        time.Duration
+    allowOversized bool
+}
+
+// NewClamdScanner connects to clamd at address, given as tcp://host:port,
+// unix:///path/to/clamd.sock or a bare host:port. Each scan is bounded by
+// timeout unless its context ends sooner. Files clamd won't scan because
+// they exceed its StreamMaxLength are rejected as infected, or passed as
+// clean when oversized is OversizedAllow.
+func NewClamdScanner(address string, timeout time.Duration, oversized string) (*ClamdScanner, error) {
+    network, addr := "tcp", address
+    switch {
+    case strings.HasPrefix(address, "unix://"):
+        network, addr = "unix", strings.TrimPrefix(address, "unix://")
+    case strings.HasPrefix(address, "tcp://"):
+        addr = strings.TrimPrefix(address, "tcp://")
+    }
+    if addr == "" {
+        return nil, fmt.Errorf("invalid clamd address %q", address)
+    }
+    if oversized != OversizedReject && oversized != OversizedAllow {
+        return nil, fmt.Errorf("invalid oversized file policy %q", oversized)
+    }
+    return &ClamdScanner{
+        network:        network,
+        address:        addr,
+        timeout:        timeout,
+        allowOversized: oversized == OversizedAllow,
+    }, nil
+}
+
+// Ping checks that the daemon is reachable
+func (s *ClamdScanner) Ping(ctx context.Context) error {
+    conn, err := s.dial(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+        return fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+    }
+    reply, err := readReply(conn)
+    if err != nil {
+        return err
+    }
+    if reply != "PONG" {
+        return fmt.Errorf("%w: unexpected reply %q", ErrScannerUnavailable, reply)
+    }
+    return nil
+}
+
+// Scan streams reader to clamd and reports whether it matched a signature
+func (s *ClamdScanner) Scan(ctx context.Context, reader io.Reader) (*Verdict, error) {
+    conn, err := s.dial(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    streamErr := s.stream(conn, reader)
+    // clamd closes the stream early when it exceeds StreamMaxLength and
+    // says why in its reply
+    reply, err := readReply(conn)
+    if err != nil {
+        if streamErr != nil {
+            return nil, streamErr
+        }
+        return nil, err
+    }
+    verdict, err := parseReply(reply)
+    if errors.Is(err, errStreamTooLong) {
+        // Retrying would only hit the limit again
+        if s.allowOversized {
+            return &Verdict{}, nil
+        }
+        return &Verdict{Infected: true, Signature: OversizedSignature}, nil
+    }
+    return verdict, err
+}
+
+func (s *ClamdScanner) dial(ctx context.Context) (net.Conn, error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, s.network, s.address)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+    }
+    var deadline time.Time
+    if s.timeout > 0 {
+        deadline = time.Now().Add(s.timeout)
+    }
+    if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+        deadline = d
+    }
+    conn.SetDeadline(deadline)
+    return conn, nil
+}
+
+// stream sends reader as INSTREAM chunks, each prefixed with its length as
+// a 4-byte big-endian integer and terminated by a zero-length chunk
+func (s *ClamdScanner) stream(conn net.Conn, reader io.Reader) error {
+    if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+        return fmt.Errorf("failed to start clamd stream: %w", err)
+    }
+    buf := make([]byte, 4+clamdChunkSize)
+    for {
+        n, readErr := io.ReadFull(reader, buf[4:])
+        if n > 0 {
+            binary.BigEndian.PutUint32(buf[:4], uint32(n))
+            if _, err := conn.Write(buf[:4+n]); err != nil {
+                return fmt.Errorf("failed to stream to clamd: %w", err)
+            }
+        }
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+            break
+        }
+        if readErr != nil {
+            return fmt.Errorf("failed to read file: %w", readErr)
+        }
+    }
+    if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+        return fmt.Errorf("failed to end clamd stream: %w", err)
+    }
+    return nil
+}
+
+// readReply reads one null-terminated reply
+func readReply(conn net.Conn) (string, error) {
+    reply, err := bufio.NewReader(conn).ReadString(0)
+    if err != nil && (err != io.EOF || reply == "") {
+        return "", fmt.Errorf("%w: failed to read reply: %v", ErrScannerUnavailable, err)
+    }
+    return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseReply interprets "stream: OK", "stream: <signature> FOUND" and
+// "<message> ERROR"
+func parseReply(reply string) (*Verdict, error) {
+    result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+    switch {
+    case result == "OK":
+        return &Verdict{}, nil
+    case strings.HasSuffix(result, " FOUND"):
+        return &Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+    case strings.HasPrefix(result, "INSTREAM size limit exceeded"):
+        return nil, errStreamTooLong
+    default:
+        return nil, fmt.Errorf("clamd: %s", result)
+    }
+}
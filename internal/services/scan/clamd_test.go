@@ -0,0 +1,113 @@
+package scan
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// fakeClamd answers INSTREAM scans: streams containing "evil" are infected
+// and streams longer than maxLength are refused as clamd does
+func fakeClamd(t *testing.T, maxLength int) string {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    t.Cleanup(func() { listener.Close() })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                command := make([]byte, len("zINSTREAM\x00"))
+                io.ReadFull(conn, command)
+                var body []byte
+                for {
+                    var n uint32
+                    if binary.Read(conn, binary.BigEndian, &n) != nil || n == 0 {
+                        break
+                    }
+                    chunk := make([]byte, n)
+                    io.ReadFull(conn, chunk)
+                    body = append(body, chunk...)
+                    if len(body) > maxLength {
+                        conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+                        return
+                    }
+                }
+                if bytes.Contains(body, []byte("evil")) {
+                    conn.Write([]byte("stream: Evil.Test FOUND\x00"))
+                } else {
+                    conn.Write([]byte("stream: OK\x00"))
+                }
+            }(conn)
+        }
+    }()
+    return "tcp://" + listener.Addr().String()
+}
+
+func TestParseReply(t *testing.T) {
+    verdict, err := parseReply("stream: OK")
+    require.NoError(t, err)
+    assert.Equal(t, &Verdict{}, verdict)
+
+    verdict, err = parseReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+    require.NoError(t, err)
+    assert.Equal(t, &Verdict{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, verdict)
+
+    _, err = parseReply("INSTREAM size limit exceeded. ERROR")
+    assert.ErrorIs(t, err, errStreamTooLong)
+
+    _, err = parseReply("Can't allocate memory ERROR")
+    assert.EqualError(t, err, "clamd: Can't allocate memory ERROR")
+}
+
+func TestClamdScanner(t *testing.T) {
+    ctx := context.Background()
+    address := fakeClamd(t, 1<<20)
+    scanner, err := NewClamdScanner(address, time.Second, OversizedReject)
+    require.NoError(t, err)
+
+    verdict, err := scanner.Scan(ctx, strings.NewReader(strings.Repeat("z", 200000)+"evil"))
+    require.NoError(t, err)
+    assert.Equal(t, &Verdict{Infected: true, Signature: "Evil.Test"}, verdict)
+
+    verdict, err = scanner.Scan(ctx, strings.NewReader("fine"))
+    require.NoError(t, err)
+    assert.False(t, verdict.Infected)
+
+    unreachable, err := NewClamdScanner("127.0.0.1:1", time.Second, OversizedReject)
+    require.NoError(t, err)
+    _, err = unreachable.Scan(ctx, strings.NewReader("x"))
+    assert.ErrorIs(t, err, ErrScannerUnavailable)
+
+    _, err = NewClamdScanner(address, time.Second, "ignore")
+    assert.Error(t, err)
+}
+
+func TestClamdScannerOversized(t *testing.T) {
+    ctx := context.Background()
+    address := fakeClamd(t, 100*1024)
+    large := strings.Repeat("z", 300*1024)
+
+    scanner, err := NewClamdScanner(address, time.Second, OversizedReject)
+    require.NoError(t, err)
+    verdict, err := scanner.Scan(ctx, strings.NewReader(large))
+    require.NoError(t, err, "an oversized file gets a verdict rather than being retried")
+    assert.Equal(t, &Verdict{Infected: true, Signature: OversizedSignature}, verdict)
+
+    scanner, err = NewClamdScanner(address, time.Second, OversizedAllow)
+    require.NoError(t, err)
+    verdict, err = scanner.Scan(ctx, strings.NewReader(large))
+    require.NoError(t, err)
+    assert.False(t, verdict.Infected)
+}
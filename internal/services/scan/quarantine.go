@@ -0,0 +1,528 @@
+package scan
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "path"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+    "gorm.io/gorm"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/media"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/websocket"
+)
+
+// QuarantineFolder holds uploads until they have been scanned
+const QuarantineFolder = "quarantine"
+
+// Attachment statuses of the scanning workflow
+const (
+    StatusScanning   = "scanning"
+    StatusUploaded   = "uploaded"
+    StatusInfected   = "infected"
+    StatusScanFailed = "scan_failed"
+)
+
+// MessageTypeScanned is sent over WebSocket when a scan finishes
+const MessageTypeScanned = "attachment_scanned"
+
+const (
+    scanQueueKey         = "scan_queue"
+    scanProcessingPrefix = "scan_queue:processing:" // + node ID, the jobs a replica took
+    scanLeasePrefix      = "scan_queue:lease:"      // + node ID, held while the replica runs
+    scanLeaseTTL         = 30 * time.Second
+    scanPollTimeout      = 5 * time.Second
+    scanRetryDelay       = 10 * time.Second
+    scanMaxAttempts      = 5
+)
+
+var ErrQuarantined = errors.New("file is quarantined until it has been scanned")
+
+// Job asks for one quarantined attachment to be scanned
+type Job struct {
+    AttachmentID   uuid.UUID `json:"attachment_id"`
+    StorageKey     string    `json:"storage_key"`
+    UserID         uuid.UUID `json:"user_id"`
+    ConversationID uuid.UUID `json:"conversation_id,omitempty"`
+    Thumbnail      bool      `json:"thumbnail"`
+    Attempts       int       `json:"attempts,omitempty"` // failed scans so far
+}
+
+// AttachmentStore loads and saves the attachments being scanned
+type AttachmentStore interface {
+    FindByID(ctx context.Context, id uuid.UUID) (*models.Attachment, error)
+    Update(ctx context.Context, attachment *models.Attachment) error
+}
+
+// Notifier tells users about finished scans
+type Notifier interface {
+    BroadcastToConversation(conversationID uuid.UUID, message interface{}, excludeClient *websocket.Client)
+    BroadcastToUser(userID uuid.UUID, message interface{})
+}
+
+// ImageHasher records the perceptual hash of a promoted image on its attachment
+type ImageHasher interface {
+    Record(ctx context.Context, attachmentID uuid.UUID, r io.Reader) error
+}
+
+// Quarantine keeps new uploads under QuarantineFolder, where they can't be
+// read through the storage service, until a Scanner has checked them. Jobs
+// are queued in Redis and survive restarts. Clean files are copied into
+// uploads/ through the wrapped decorators, so they are deduplicated and
+// replicated like any other upload, and get their thumbnail and derivatives,
+// or their poster frame for videos; infected files are deleted and their
+// attachment flagged. Either way the conversation, or the uploader
+// when there is none, is notified over WebSocket.
+//
+// Each replica moves the jobs it takes onto a processing list of its own and
+// holds a lease on it while it runs. Jobs on the list of a replica whose
+// lease expired are queued again. A job that keeps failing is given up after
+// scanMaxAttempts: its upload is deleted and its attachment marked as failed.
+type Quarantine struct {
+    storage.StorageService
+    scanner     Scanner
+    redis       *redis.Client
+    nodeID      string
+    attachments AttachmentStore
+    notifier    Notifier
+    derivatives []storage.DerivativeProfile
+    videos      *media.Analyzer
+    images      ImageHasher
+}
+
+// NewQuarantine wraps backend with the quarantine. nodeID names this
+// replica's processing list and must be unique among running replicas.
+// Images are promoted with the given derivative profiles and hashed by
+// images, and videos are analyzed by videos, which must read from backend.
+func NewQuarantine(backend storage.StorageService, scanner Scanner, redisClient *redis.Client, nodeID string, attachments AttachmentStore, notifier Notifier, derivatives []storage.DerivativeProfile, videos *media.Analyzer, images ImageHasher) *Quarantine {
+    return &Quarantine{
+        StorageService: backend,
+        scanner:        scanner,
+        redis:          redisClient,
+        nodeID:         nodeID,
+        attachments:    attachments,
+        notifier:       notifier,
+        derivatives:    derivatives,
+        videos:         videos,
+        images:         images,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (q *Quarantine) Unwrap() storage.StorageService {
+    return q.StorageService
+}
+
+// IsQuarantined reports whether storageKey is waiting for a scan
+func IsQuarantined(storageKey string) bool {
+    return strings.HasPrefix(storageKey, QuarantineFolder+"/")
+}
+
+// Prepare redirects an upload into quarantine. Thumbnails and derivatives
+// are rendered on promotion instead, so Prepare reports whether a thumbnail
+// was asked for.
+func (q *Quarantine) Prepare(opts *storage.UploadOptions, filename string) bool {
+    thumbnail := opts.GenerateThumbnail
+    keyOpts := *opts
+    keyOpts.Folder = QuarantineFolder
+    opts.StorageKey = storage.NewStorageKey(&keyOpts, filename)
+    opts.GenerateThumbnail = false
+    opts.Derivatives = nil
+    return thumbnail
+}
+
+// Submit queues a scan
+func (q *Quarantine) Submit(ctx context.Context, job Job) error {
+    data, err := json.Marshal(job)
+    if err != nil {
+        return err
+    }
+    if err := q.redis.LPush(ctx, scanQueueKey, data).Err(); err != nil {
+        return fmt.Errorf("failed to queue scan: %w", err)
+    }
+    return nil
+}
+
+// GetMetadata refuses quarantined objects
+func (q *Quarantine) GetMetadata(ctx context.Context, storageKey string) (*storage.FileMetadata, error) {
+    if IsQuarantined(storageKey) {
+        return nil, fmt.Errorf("%w: %s", ErrQuarantined, storageKey)
+    }
+    return q.StorageService.GetMetadata(ctx, storageKey)
+}
+
+// Download refuses quarantined objects
+func (q *Quarantine) Download(ctx context.Context, storageKey string) ([]byte, error) {
+    if IsQuarantined(storageKey) {
+        return nil, fmt.Errorf("%w: %s", ErrQuarantined, storageKey)
+    }
+    return q.StorageService.Download(ctx, storageKey)
+}
+
+// DownloadToWriter refuses quarantined objects
+func (q *Quarantine) DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error {
+    if IsQuarantined(storageKey) {
+        return fmt.Errorf("%w: %s", ErrQuarantined, storageKey)
+    }
+    return q.StorageService.DownloadToWriter(ctx, storageKey, writer)
+}
+
+// DownloadRange refuses quarantined objects
+func (q *Quarantine) DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error {
+    if IsQuarantined(storageKey) {
+        return fmt.Errorf("%w: %s", ErrQuarantined, storageKey)
+    }
+    return q.StorageService.DownloadRange(ctx, storageKey, offset, length, writer)
+}
+
+// GeneratePresignedURL refuses quarantined objects
+func (q *Quarantine) GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error) {
+    if IsQuarantined(storageKey) {
+        return "", fmt.Errorf("%w: %s", ErrQuarantined, storageKey)
+    }
+    return q.StorageService.GeneratePresignedURL(ctx, storageKey, expiry)
+}
+
+// Run scans queued uploads until ctx is cancelled. Jobs this node was
+// working on when it last stopped, and those of stopped nodes, are queued
+// again first.
+func (q *Quarantine) Run(ctx context.Context) {
+    processing := scanProcessingPrefix + q.nodeID
+    q.renewLease(ctx)
+    q.requeue(ctx, processing)
+    q.reclaim(ctx)
+    go q.keepLease(ctx)
+    for {
+        data, err := q.redis.BLMove(ctx, scanQueueKey, processing, "RIGHT", "LEFT", scanPollTimeout).Result()
+        if ctx.Err() != nil {
+            return
+        }
+        if err == redis.Nil {
+            continue
+        }
+        if err != nil {
+            log.Error().Err(err).Msg("Failed to take scan job")
+            q.wait(ctx, scanRetryDelay)
+            continue
+        }
+        if !q.handle(ctx, processing, data) {
+            q.wait(ctx, scanRetryDelay)
+        }
+    }
+}
+
+// handle processes one job taken onto processing and reports whether it
+// is done with. A failed job goes back on the queue with its attempt
+// counted, until it is given up.
+func (q *Quarantine) handle(ctx context.Context, processing, data string) bool {
+    var job Job
+    if err := json.Unmarshal([]byte(data), &job); err != nil {
+        log.Error().Err(err).Str("job", data).Msg("Dropping malformed scan job")
+        q.redis.LRem(ctx, processing, 1, data)
+        return true
+    }
+    err := q.process(ctx, job)
+    if ctx.Err() != nil {
+        // Left on the processing list for the next run
+        return true
+    }
+    if err == nil {
+        q.redis.LRem(ctx, processing, 1, data)
+        return true
+    }
+    job.Attempts++
+    logger := log.With().Err(err).Str("attachment_id", job.AttachmentID.String()).Str("storage_key", job.StorageKey).Int("attempts", job.Attempts).Logger()
+    if job.Attempts >= scanMaxAttempts {
+        logger.Error().Msg("Scan failed too often, giving up")
+        q.abandon(ctx, job)
+        q.redis.LRem(ctx, processing, 1, data)
+        return true
+    }
+    // Usually the scanner comes back by the next attempt
+    logger.Error().Msg("Scan failed, retrying")
+    retry, err := json.Marshal(job)
+    if err != nil {
+        return false
+    }
+    _, err = q.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.LRem(ctx, processing, 1, data)
+        pipe.LPush(ctx, scanQueueKey, retry)
+        return nil
+    })
+    if err != nil {
+        logger.Error().Err(err).Msg("Failed to requeue scan")
+    }
+    return false
+}
+
+// renewLease marks this node as alive
+func (q *Quarantine) renewLease(ctx context.Context) {
+    if err := q.redis.Set(ctx, scanLeasePrefix+q.nodeID, time.Now().Unix(), scanLeaseTTL).Err(); err != nil && ctx.Err() == nil {
+        log.Error().Err(err).Msg("Failed to renew scan lease")
+    }
+}
+
+// keepLease renews this node's lease and requeues the jobs of nodes whose
+// lease expired, until ctx is cancelled
+func (q *Quarantine) keepLease(ctx context.Context) {
+    ticker := time.NewTicker(scanLeaseTTL / 3)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            q.redis.Del(context.Background(), scanLeasePrefix+q.nodeID)
+            return
+        case <-ticker.C:
+            q.renewLease(ctx)
+            q.reclaim(ctx)
+        }
+    }
+}
+
+// reclaim queues again the jobs of nodes that stopped without finishing them
+func (q *Quarantine) reclaim(ctx context.Context) {
+    iter := q.redis.Scan(ctx, 0, scanProcessingPrefix+"*", 100).Iterator()
+    for iter.Next(ctx) {
+        processing := iter.Val()
+        nodeID := strings.TrimPrefix(processing, scanProcessingPrefix)
+        if nodeID == q.nodeID {
+            continue
+        }
+        alive, err := q.redis.Exists(ctx, scanLeasePrefix+nodeID).Result()
+        if err != nil || alive > 0 {
+            continue
+        }
+        if moved := q.requeue(ctx, processing); moved > 0 {
+            log.Warn().Str("node_id", nodeID).Int("jobs", moved).Msg("Requeued scans of a stopped node")
+        }
+    }
+    if err := iter.Err(); err != nil && ctx.Err() == nil {
+        log.Error().Err(err).Msg("Failed to look for interrupted scans")
+    }
+}
+
+// requeue moves the jobs on a processing list back to the front of the
+// queue, oldest first
+func (q *Quarantine) requeue(ctx context.Context, processing string) int {
+    moved := 0
+    for {
+        err := q.redis.LMove(ctx, processing, scanQueueKey, "LEFT", "RIGHT").Err()
+        if err != nil {
+            if err != redis.Nil && ctx.Err() == nil {
+                log.Error().Err(err).Str("list", processing).Msg("Failed to requeue interrupted scans")
+            }
+            return moved
+        }
+        moved++
+    }
+}
+
+// abandon gives up on a job that kept failing. The upload was never found
+// clean, so it is deleted and its attachment marked as failed.
+func (q *Quarantine) abandon(ctx context.Context, job Job) {
+    if IsQuarantined(job.StorageKey) {
+        if err := q.discard(ctx, job.StorageKey); err != nil {
+            log.Warn().Err(err).Str("storage_key", job.StorageKey).Msg("Failed to delete unscanned upload")
+        }
+    }
+    attachment, err := q.attachments.FindByID(ctx, job.AttachmentID)
+    if err != nil {
+        if !errors.Is(err, gorm.ErrRecordNotFound) {
+            log.Error().Err(err).Str("attachment_id", job.AttachmentID.String()).Msg("Failed to load attachment of abandoned scan")
+        }
+        return
+    }
+    if attachment.StorageKey != job.StorageKey || attachment.Status != StatusScanning {
+        return
+    }
+    attachment.Status = StatusScanFailed
+    attachment.URL = ""
+    attachment.ThumbnailURL = ""
+    if err := q.attachments.Update(ctx, attachment); err != nil {
+        log.Error().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to update attachment of abandoned scan")
+        return
+    }
+    q.notify(job, attachment, &Verdict{})
+}
+
+func (q *Quarantine) wait(ctx context.Context, delay time.Duration) {
+    select {
+    case <-ctx.Done():
+    case <-time.After(delay):
+    }
+}
+
+// process scans one upload and promotes or deletes it
+func (q *Quarantine) process(ctx context.Context, job Job) error {
+    attachment, err := q.attachments.FindByID(ctx, job.AttachmentID)
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        // Deleted while waiting for its scan
+        return q.discard(ctx, job.StorageKey)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to load attachment: %w", err)
+    }
+    if attachment.StorageKey != job.StorageKey || attachment.Status != StatusScanning {
+        return nil
+    }
+    verdict, err := q.scan(ctx, job.StorageKey)
+    if err != nil {
+        return err
+    }
+    if verdict.Infected {
+        log.Warn().Str("attachment_id", attachment.ID.String()).Str("storage_key", job.StorageKey).Str("signature", verdict.Signature).Msg("Malware detected in upload")
+        if err := q.discard(ctx, job.StorageKey); err != nil {
+            return err
+        }
+        attachment.Status = StatusInfected
+        attachment.URL = ""
+        attachment.ThumbnailURL = ""
+    } else if err := q.promote(ctx, job, attachment); err != nil {
+        return err
+    }
+    if err := q.attachments.Update(ctx, attachment); err != nil {
+        return fmt.Errorf("failed to update attachment: %w", err)
+    }
+    if !verdict.Infected && IsQuarantined(job.StorageKey) {
+        if err := q.discard(ctx, job.StorageKey); err != nil {
+            log.Warn().Err(err).Str("storage_key", job.StorageKey).Msg("Failed to delete promoted upload from quarantine")
+        }
+    }
+    q.notify(job, attachment, verdict)
+    return nil
+}
+
+// scan streams an object to the scanner
+func (q *Quarantine) scan(ctx context.Context, storageKey string) (*Verdict, error) {
+    reader, writer := io.Pipe()
+    go func() {
+        writer.CloseWithError(q.StorageService.DownloadToWriter(ctx, storageKey, writer))
+    }()
+    verdict, err := q.scanner.Scan(ctx, reader)
+    reader.CloseWithError(io.ErrClosedPipe)
+    if err != nil {
+        return nil, fmt.Errorf("failed to scan %s: %w", storageKey, err)
+    }
+    return verdict, nil
+}
+
+// promote copies a clean upload under uploads/, hands it to deduplication
+// and charges it like a regular upload, renders its thumbnail and
+// derivatives, and points the attachment at it. The quarantined object is
+// deleted once the attachment has been saved.
+func (q *Quarantine) promote(ctx context.Context, job Job, attachment *models.Attachment) error {
+    if !IsQuarantined(job.StorageKey) {
+        attachment.Status = StatusUploaded
+        return nil
+    }
+    metadata, err := q.StorageService.GetMetadata(ctx, job.StorageKey)
+    if err != nil {
+        return fmt.Errorf("failed to read quarantined upload: %w", err)
+    }
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = job.UserID
+    storageKey := storage.NewStorageKey(opts, path.Base(job.StorageKey))
+    if err := q.StorageService.Copy(ctx, job.StorageKey, storageKey); err != nil {
+        return fmt.Errorf("failed to promote upload: %w", err)
+    }
+    if dedup, ok := storage.Backend[*storage.DedupStorageService](q.StorageService); ok {
+        if blob, err := dedup.Adopt(ctx, storageKey, job.UserID); err != nil {
+            log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to deduplicate promoted upload")
+        } else {
+            storageKey = blob.StorageKey
+        }
+    }
+    if quota, ok := storage.Backend[*storage.QuotaStorageService](q.StorageService); ok {
+        if err := quota.Track(ctx, storageKey, job.UserID, storage.UsageUploads, metadata.FileSize); err != nil {
+            log.Error().Err(err).Str("storage_key", storageKey).Msg("Failed to record storage usage")
+        }
+    }
+    attachment.Status = StatusUploaded
+    attachment.FileName = path.Base(storageKey)
+    attachment.FileSize = metadata.FileSize
+    attachment.StorageKey = storageKey
+    attachment.StoragePath = storageKey
+    attachment.URL = storage.ObjectURL(q.StorageService, storageKey)
+    attachment.ThumbnailURL = ""
+    if strings.HasPrefix(metadata.ContentType, "image/") {
+        q.renderImage(ctx, job, attachment)
+    }
+    if media.IsVideo(metadata.ContentType) && q.videos != nil {
+        video, err := q.videos.Analyze(ctx, storageKey)
+        if err != nil {
+            log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to analyze promoted video")
+            return nil
+        }
+        if video.Info != nil && video.Info.Width > 0 {
+            attachment.Width, attachment.Height = video.Info.Width, video.Info.Height
+        }
+        if video.Poster != nil {
+            attachment.ThumbnailURL = video.Poster.URL
+        }
+    }
+    return nil
+}
+
+// renderImage reads the dimensions and hash of a promoted image and renders
+// the thumbnail and derivatives that were held back by Prepare. Failures
+// leave the attachment without them.
+func (q *Quarantine) renderImage(ctx context.Context, job Job, attachment *models.Attachment) {
+    data, err := q.StorageService.Download(ctx, attachment.StorageKey)
+    if err != nil {
+        log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to read promoted image")
+        return
+    }
+    if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+        attachment.Width, attachment.Height = config.Width, config.Height
+    }
+    if q.images != nil {
+        if err := q.images.Record(ctx, attachment.ID, bytes.NewReader(data)); err != nil {
+            log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to hash promoted image")
+        }
+    }
+    if job.Thumbnail {
+        thumbnail, err := q.StorageService.GenerateThumbnail(ctx, attachment.StorageKey, storage.DefaultThumbnailWidth, storage.DefaultThumbnailHeight)
+        if err != nil {
+            log.Warn().Err(err).Str("storage_key", attachment.StorageKey).Msg("Failed to generate thumbnail")
+        } else {
+            attachment.ThumbnailURL = thumbnail.URL
+        }
+    }
+    storage.NewDerivativeService(q.StorageService, q.derivatives).Generate(ctx, attachment.StorageKey, data)
+}
+
+func (q *Quarantine) discard(ctx context.Context, storageKey string) error {
+    if err := q.StorageService.Delete(ctx, storageKey); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+        return fmt.Errorf("failed to delete %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+func (q *Quarantine) notify(job Job, attachment *models.Attachment, verdict *Verdict) {
+    message := models.NewWebSocketMessage(MessageTypeScanned, job.ConversationID, uuid.Nil)
+    message.Metadata = map[string]interface{}{
+        "attachment_id": attachment.ID.String(),
+        "status":        attachment.Status,
+        "infected":      verdict.Infected,
+    }
+    if verdict.Infected {
+        message.Metadata["signature"] = verdict.Signature
+    }
+    if job.ConversationID != uuid.Nil {
+        q.notifier.BroadcastToConversation(job.ConversationID, message, nil)
+        return
+    }
+    q.notifier.BroadcastToUser(job.UserID, message)
+}
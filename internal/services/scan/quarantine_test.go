@@ -0,0 +1,285 @@
+package scan
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+    "gorm.io/gorm"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/websocket"
+)
+
+type memoryAttachments struct {
+    mu          sync.Mutex
+    attachments map[uuid.UUID]models.Attachment
+}
+
+func (m *memoryAttachments) FindByID(ctx context.Context, id uuid.UUID) (*models.Attachment, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    attachment, ok := m.attachments[id]
+    if !ok {
+        return nil, gorm.ErrRecordNotFound
+    }
+    return &attachment, nil
+}
+
+func (m *memoryAttachments) Update(ctx context.Context, attachment *models.Attachment) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.attachments[attachment.ID] = *attachment
+    return nil
+}
+
+type recordingNotifier struct {
+    mu       sync.Mutex
+    messages []*models.WebSocketMessage
+}
+
+func (r *recordingNotifier) BroadcastToConversation(conversationID uuid.UUID, message interface{}, excludeClient *websocket.Client) {
+    r.BroadcastToUser(uuid.Nil, message)
+}
+
+func (r *recordingNotifier) BroadcastToUser(userID uuid.UUID, message interface{}) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.messages = append(r.messages, message.(*models.WebSocketMessage))
+}
+
+// failingScanner stands in for a scanner that is down
+type failingScanner struct{}
+
+func (failingScanner) Scan(ctx context.Context, reader io.Reader) (*Verdict, error) {
+    return nil, ErrScannerUnavailable
+}
+
+type quarantineTest struct {
+    *Quarantine
+    backend     storage.StorageService
+    redis       *redis.Client
+    attachments *memoryAttachments
+    notifier    *recordingNotifier
+}
+
+func newQuarantineTest(t *testing.T, scanner Scanner) *quarantineTest {
+    client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+    t.Cleanup(func() { client.Close() })
+    test := &quarantineTest{
+        backend:     storage.NewMemoryStorageService(""),
+        redis:       client,
+        attachments: &memoryAttachments{attachments: make(map[uuid.UUID]models.Attachment)},
+        notifier:    &recordingNotifier{},
+    }
+    test.Quarantine = NewQuarantine(test.backend, scanner, client, "node-a", test.attachments, test.notifier, nil, nil, nil)
+    return test
+}
+
+// upload stores content in quarantine the way the upload handlers do and
+// returns its scan job
+func (q *quarantineTest) upload(t *testing.T, content string) Job {
+    ctx := context.Background()
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = uuid.New()
+    thumbnail := q.Prepare(opts, "notes.txt")
+    result, err := q.UploadFromReader(ctx, strings.NewReader(content), "notes.txt", "text/plain", int64(len(content)), opts)
+    require.NoError(t, err)
+    require.True(t, IsQuarantined(result.StorageKey))
+    attachment := models.Attachment{
+        ID:         uuid.New(),
+        UserID:     opts.UserID,
+        StorageKey: result.StorageKey,
+        Status:     StatusScanning,
+    }
+    require.NoError(t, q.attachments.Update(ctx, &attachment))
+    return Job{AttachmentID: attachment.ID, StorageKey: result.StorageKey, UserID: opts.UserID, Thumbnail: thumbnail}
+}
+
+func (q *quarantineTest) attachment(t *testing.T, id uuid.UUID) *models.Attachment {
+    attachment, err := q.attachments.FindByID(context.Background(), id)
+    require.NoError(t, err)
+    return attachment
+}
+
+func (q *quarantineTest) assertExists(t *testing.T, storageKey string, want bool) {
+    t.Helper()
+    exists, err := q.backend.Exists(context.Background(), storageKey)
+    require.NoError(t, err)
+    assert.Equal(t, want, exists, storageKey)
+}
+
+func TestQuarantineRefusesReads(t *testing.T) {
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    job := q.upload(t, "hello")
+    _, err := q.Download(context.Background(), job.StorageKey)
+    assert.ErrorIs(t, err, ErrQuarantined)
+    _, err = q.GetMetadata(context.Background(), job.StorageKey)
+    assert.ErrorIs(t, err, ErrQuarantined)
+}
+
+func TestQuarantinePromotesCleanUploads(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    job := q.upload(t, "hello")
+
+    require.NoError(t, q.process(ctx, job))
+    attachment := q.attachment(t, job.AttachmentID)
+    assert.Equal(t, StatusUploaded, attachment.Status)
+    assert.True(t, strings.HasPrefix(attachment.StorageKey, "uploads/"+job.UserID.String()+"/"), attachment.StorageKey)
+    assert.Equal(t, int64(5), attachment.FileSize)
+    assert.NotEmpty(t, attachment.URL)
+    data, err := q.Download(ctx, attachment.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, "hello", string(data))
+    q.assertExists(t, job.StorageKey, false)
+
+    require.Len(t, q.notifier.messages, 1)
+    assert.Equal(t, MessageTypeScanned, q.notifier.messages[0].Type)
+    assert.Equal(t, StatusUploaded, q.notifier.messages[0].Metadata["status"])
+    assert.Equal(t, false, q.notifier.messages[0].Metadata["infected"])
+}
+
+func TestQuarantineDeletesInfectedUploads(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    job := q.upload(t, "prefix "+string(eicarPattern)+" suffix")
+
+    require.NoError(t, q.process(ctx, job))
+    attachment := q.attachment(t, job.AttachmentID)
+    assert.Equal(t, StatusInfected, attachment.Status)
+    assert.Empty(t, attachment.URL)
+    q.assertExists(t, job.StorageKey, false)
+    files, err := q.backend.ListFiles(ctx, "uploads/", 0)
+    require.NoError(t, err)
+    assert.Empty(t, files, "nothing is promoted")
+
+    require.Len(t, q.notifier.messages, 1)
+    assert.Equal(t, StatusInfected, q.notifier.messages[0].Metadata["status"])
+    assert.Equal(t, EICARSignature, q.notifier.messages[0].Metadata["signature"])
+}
+
+func TestQuarantineKeepsUploadsOnScannerErrors(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, failingScanner{})
+    job := q.upload(t, "hello")
+
+    assert.ErrorIs(t, q.process(ctx, job), ErrScannerUnavailable)
+    assert.Equal(t, StatusScanning, q.attachment(t, job.AttachmentID).Status)
+    q.assertExists(t, job.StorageKey, true)
+    assert.Empty(t, q.notifier.messages)
+}
+
+func TestQuarantineDiscardsUploadsOfDeletedAttachments(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    job := q.upload(t, "hello")
+    job.AttachmentID = uuid.New()
+
+    require.NoError(t, q.process(ctx, job))
+    q.assertExists(t, job.StorageKey, false)
+}
+
+func TestQuarantineRetriesFailedScans(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, failingScanner{})
+    processing := scanProcessingPrefix + "node-a"
+    job := q.upload(t, "hello")
+    other := q.upload(t, "other")
+    otherData, err := json.Marshal(other)
+    require.NoError(t, err)
+    data, err := json.Marshal(job)
+    require.NoError(t, err)
+    // The failed job isn't the head of the processing list
+    require.NoError(t, q.redis.LPush(ctx, processing, data, otherData).Err())
+
+    assert.False(t, q.handle(ctx, processing, string(data)), "a failed scan waits before the next")
+    remaining, err := q.redis.LRange(ctx, processing, 0, -1).Result()
+    require.NoError(t, err)
+    assert.Equal(t, []string{string(otherData)}, remaining)
+    queued, err := q.redis.LRange(ctx, scanQueueKey, 0, -1).Result()
+    require.NoError(t, err)
+    require.Len(t, queued, 1)
+    var retry Job
+    require.NoError(t, json.Unmarshal([]byte(queued[0]), &retry))
+    assert.Equal(t, job.AttachmentID, retry.AttachmentID)
+    assert.Equal(t, 1, retry.Attempts)
+}
+
+func TestQuarantineGivesUpAfterMaxAttempts(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, failingScanner{})
+    processing := scanProcessingPrefix + "node-a"
+    job := q.upload(t, "hello")
+    job.Attempts = scanMaxAttempts - 1
+    data, err := json.Marshal(job)
+    require.NoError(t, err)
+    require.NoError(t, q.redis.LPush(ctx, processing, data).Err())
+
+    assert.True(t, q.handle(ctx, processing, string(data)))
+    for _, key := range []string{processing, scanQueueKey} {
+        length, err := q.redis.LLen(ctx, key).Result()
+        require.NoError(t, err)
+        assert.Zero(t, length, key)
+    }
+    attachment := q.attachment(t, job.AttachmentID)
+    assert.Equal(t, StatusScanFailed, attachment.Status)
+    assert.Empty(t, attachment.URL)
+    q.assertExists(t, job.StorageKey, false)
+    require.Len(t, q.notifier.messages, 1)
+    assert.Equal(t, StatusScanFailed, q.notifier.messages[0].Metadata["status"])
+}
+
+func TestQuarantineReclaimsJobsOfStoppedNodes(t *testing.T) {
+    ctx := context.Background()
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    require.NoError(t, q.redis.LPush(ctx, scanProcessingPrefix+"node-a", "own").Err())
+    require.NoError(t, q.redis.LPush(ctx, scanProcessingPrefix+"node-b", "alive").Err())
+    require.NoError(t, q.redis.Set(ctx, scanLeasePrefix+"node-b", 1, scanLeaseTTL).Err())
+    require.NoError(t, q.redis.LPush(ctx, scanProcessingPrefix+"node-c", "first", "second").Err())
+
+    q.reclaim(ctx)
+    queued, err := q.redis.LRange(ctx, scanQueueKey, 0, -1).Result()
+    require.NoError(t, err)
+    assert.Equal(t, []string{"second", "first"}, queued, "the oldest job is taken next")
+    for list, want := range map[string]int64{"node-a": 1, "node-b": 1, "node-c": 0} {
+        length, err := q.redis.LLen(ctx, scanProcessingPrefix+list).Result()
+        require.NoError(t, err)
+        assert.Equal(t, want, length, list)
+    }
+}
+
+func TestQuarantineRun(t *testing.T) {
+    q := newQuarantineTest(t, NewSignatureScanner(nil))
+    job := q.upload(t, "hello")
+    // Left behind by this node's previous run
+    data, err := json.Marshal(job)
+    require.NoError(t, err)
+    require.NoError(t, q.redis.LPush(context.Background(), scanProcessingPrefix+"node-a", data).Err())
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        q.Run(ctx)
+        close(done)
+    }()
+    require.Eventually(t, func() bool {
+        return q.attachment(t, job.AttachmentID).Status == StatusUploaded
+    }, 5*time.Second, 10*time.Millisecond)
+    cancel()
+    <-done
+    length, err := q.redis.LLen(context.Background(), scanProcessingPrefix+"node-a").Result()
+    require.NoError(t, err)
+    assert.Zero(t, length)
+}
@@ -0,0 +1,39 @@
+package scan
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+)
+
+var ErrScannerUnavailable = errors.New("malware scanner unavailable")
+
+// Verdict is the outcome of scanning one file
+type Verdict struct {
+    Infected  bool   `json:"infected"`
+    Signature string `json:"signature,omitempty"` // name of the signature that matched
+}
+
+// Scanner inspects file contents for malware
+type Scanner interface {
+    Scan(ctx context.Context, reader io.Reader) (*Verdict, error)
+}
+
+// NewScanner creates the scanner selected by cfg.Scanner. It returns nil
+// when scanning is disabled.
+func NewScanner(cfg appconfig.UploadConfig) (Scanner, error) {
+    switch strings.ToLower(cfg.Scanner) {
+    case "":
+        return nil, nil
+    case "clamd", "clamav":
+        return NewClamdScanner(cfg.ClamdAddress, cfg.ScanTimeout, strings.ToLower(cfg.ScanOversized))
+    case "signatures":
+        return LoadSignatureScanner(cfg.ScanSignatures)
+    default:
+        return nil, fmt.Errorf("unsupported malware scanner: %s", cfg.Scanner)
+    }
+}
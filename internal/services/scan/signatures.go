@@ -0,0 +1,108 @@
+package scan
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+)
+
+// EICARSignature is the name of the EICAR antivirus test file, which every
+// SignatureScanner detects
+const EICARSignature = "Eicar-Test-Signature"
+
+var eicarPattern = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+type signature struct {
+    name    string
+    pattern []byte
+}
+
+// SignatureScanner flags files containing any of a list of byte patterns. It
+// needs no daemon, which suits tests and development.
+type SignatureScanner struct {
+    signatures []signature
+    overlap    int
+}
+
+// NewSignatureScanner detects the given patterns by name, plus EICAR
+func NewSignatureScanner(patterns map[string][]byte) *SignatureScanner {
+    s := &SignatureScanner{signatures: []signature{{name: EICARSignature, pattern: eicarPattern}}}
+    names := make([]string, 0, len(patterns))
+    for name := range patterns {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if len(patterns[name]) > 0 {
+            s.signatures = append(s.signatures, signature{name: name, pattern: patterns[name]})
+        }
+    }
+    for _, sig := range s.signatures {
+        s.overlap = max(s.overlap, len(sig.pattern)-1)
+    }
+    return s
+}
+
+// LoadSignatureScanner reads name:hexpattern lines from path. Blank lines and
+// lines starting with # are skipped. An empty path only detects EICAR.
+func LoadSignatureScanner(path string) (*SignatureScanner, error) {
+    patterns := make(map[string][]byte)
+    if path == "" {
+        return NewSignatureScanner(patterns), nil
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open signature list: %w", err)
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    for line := 1; scanner.Scan(); line++ {
+        entry := strings.TrimSpace(scanner.Text())
+        if entry == "" || strings.HasPrefix(entry, "#") {
+            continue
+        }
+        name, encoded, ok := strings.Cut(entry, ":")
+        pattern, err := hex.DecodeString(strings.TrimSpace(encoded))
+        if !ok || name == "" || err != nil || len(pattern) == 0 {
+            return nil, fmt.Errorf("invalid signature on line %d of %s", line, path)
+        }
+        patterns[strings.TrimSpace(name)] = pattern
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read signature list: %w", err)
+    }
+    return NewSignatureScanner(patterns), nil
+}
+
+// Scan reads reader in chunks, keeping enough of the previous chunk that
+// patterns spanning a chunk boundary still match
+func (s *SignatureScanner) Scan(ctx context.Context, reader io.Reader) (*Verdict, error) {
+    buf := make([]byte, s.overlap+64*1024)
+    kept := 0
+    for {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        n, err := reader.Read(buf[kept:])
+        window := buf[:kept+n]
+        for _, sig := range s.signatures {
+            if bytes.Contains(window, sig.pattern) {
+                return &Verdict{Infected: true, Signature: sig.name}, nil
+            }
+        }
+        if err == io.EOF {
+            return &Verdict{}, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read file: %w", err)
+        }
+        kept = min(s.overlap, len(window))
+        copy(buf, window[len(window)-kept:])
+    }
+}
@@ -0,0 +1,297 @@
+package storage
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+)
+
+const (
+    // BlobFolder holds content-addressed objects
+    BlobFolder = "blobs"
+    // MetaSHA256 is the object metadata key holding the content hash
+    MetaSHA256 = "sha256"
+
+    blobRefsKeyPrefix = "blob_refs:"
+)
+
+// ReferenceCounter is implemented by storage that shares one object between
+// several owners. Release drops one reference and returns how many remain.
+type ReferenceCounter interface {
+    Retain(ctx context.Context, storageKey string) (int64, error)
+    Release(ctx context.Context, storageKey string) (int64, error)
+}
+
+// DedupStorageService stores uploads once per user under a key derived from
+// their SHA-256 and counts references to each blob in Redis, so identical
+// re-uploads share one object. Uploads with an explicit key or filename are
+// passed through unchanged.
+type DedupStorageService struct {
+    StorageService
+    redis   *redis.Client
+    tempDir string
+}
+
+// NewDedupStorageService wraps backend with content-addressed deduplication.
+// Uploads are spooled to tempDir while they are hashed.
+func NewDedupStorageService(backend StorageService, redisClient *redis.Client, tempDir string) *DedupStorageService {
+    if err := os.MkdirAll(tempDir, 0o755); err != nil {
+        log.Warn().Err(err).Str("dir", tempDir).Msg("Failed to create dedup spool directory")
+    }
+    return &DedupStorageService{
+        StorageService: backend,
+        redis:          redisClient,
+        tempDir:        tempDir,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *DedupStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// BlobKey returns the content-addressed key for content with the given hash
+func BlobKey(userID uuid.UUID, sum string, filename string) string {
+    parts := []string{BlobFolder}
+    if userID != uuid.Nil {
+        parts = append(parts, userID.String())
+    }
+    parts = append(parts, sum[:2], sum+strings.ToLower(filepath.Ext(filename)))
+    return path.Join(parts...)
+}
+
+func isBlobKey(storageKey string) bool {
+    return strings.HasPrefix(storageKey, BlobFolder+"/")
+}
+
+func blobRefsKey(storageKey string) string {
+    return blobRefsKeyPrefix + storageKey
+}
+
+// Upload deduplicates a multipart file
+func (s *DedupStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    contentType := header.Header.Get("Content-Type")
+    if opts != nil {
+        contentType = detectContentType(header.Filename, opts.ContentType, contentType)
+    }
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader hashes the upload while spooling it to disk, then either
+// adds a reference to the existing blob or stores a new one
+func (s *DedupStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    if opts.StorageKey != "" || opts.CustomFilename != "" {
+        return s.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, opts)
+    }
+    spool, err := os.CreateTemp(s.tempDir, "dedup-*")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create spool file: %w", err)
+    }
+    defer os.Remove(spool.Name())
+    defer spool.Close()
+    hash := sha256.New()
+    written, err := io.Copy(io.MultiWriter(spool, hash), reader)
+    if err != nil {
+        return nil, fmt.Errorf("failed to spool upload: %w", err)
+    }
+    sum := hex.EncodeToString(hash.Sum(nil))
+    storageKey := BlobKey(opts.UserID, sum, filename)
+
+    exists, err := s.StorageService.Exists(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    refs, err := s.redis.Incr(ctx, blobRefsKey(storageKey)).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to reference blob %s: %w", storageKey, err)
+    }
+    if exists {
+        log.Info().Str("storage_key", storageKey).Int64("refs", refs).Msg("Upload deduplicated")
+        return s.existingBlob(ctx, storageKey, opts)
+    }
+
+    if _, err := spool.Seek(0, io.SeekStart); err != nil {
+        s.redis.Decr(ctx, blobRefsKey(storageKey))
+        return nil, fmt.Errorf("failed to rewind spool file: %w", err)
+    }
+    blobOpts := *opts
+    blobOpts.StorageKey = storageKey
+    blobOpts.Metadata = copyMetadata(opts.Metadata)
+    if blobOpts.Metadata == nil {
+        blobOpts.Metadata = make(map[string]string)
+    }
+    blobOpts.Metadata[MetaSHA256] = sum
+    result, err := s.StorageService.UploadFromReader(ctx, spool, filename, contentType, written, &blobOpts)
+    if err != nil {
+        s.redis.Decr(ctx, blobRefsKey(storageKey))
+        return nil, err
+    }
+    return result, nil
+}
+
+// Adopt moves an object that was written around the decorator, such as a
+// completed multipart or presigned upload, into the blob store. If the user
+// already has a blob with the same contents the object is deleted and the
+// blob gets another reference.
+func (s *DedupStorageService) Adopt(ctx context.Context, storageKey string, userID uuid.UUID) (*UploadResult, error) {
+    if isBlobKey(storageKey) {
+        return nil, fmt.Errorf("%s is already a blob", storageKey)
+    }
+    hash := sha256.New()
+    if err := s.StorageService.DownloadToWriter(ctx, storageKey, hash); err != nil {
+        return nil, fmt.Errorf("failed to hash %s: %w", storageKey, err)
+    }
+    sum := hex.EncodeToString(hash.Sum(nil))
+    blobKey := BlobKey(userID, sum, storageKey)
+
+    exists, err := s.StorageService.Exists(ctx, blobKey)
+    if err != nil {
+        return nil, err
+    }
+    refs, err := s.redis.Incr(ctx, blobRefsKey(blobKey)).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to reference blob %s: %w", blobKey, err)
+    }
+    opts := NewUploadOptions()
+    opts.UserID = userID
+    if exists {
+        if err := s.StorageService.Delete(ctx, storageKey); err != nil {
+            log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to delete deduplicated upload")
+        }
+        log.Info().Str("storage_key", blobKey).Int64("refs", refs).Msg("Upload deduplicated")
+        return s.existingBlob(ctx, blobKey, opts)
+    }
+    if err := s.StorageService.Move(ctx, storageKey, blobKey); err != nil {
+        s.redis.Decr(ctx, blobRefsKey(blobKey))
+        return nil, err
+    }
+    if err := MergeMetadata(ctx, s.StorageService, blobKey, map[string]string{MetaSHA256: sum}); err != nil {
+        log.Warn().Err(err).Str("storage_key", blobKey).Msg("Failed to record blob hash")
+    }
+    return s.existingBlob(ctx, blobKey, opts)
+}
+
+// existingBlob describes a blob that was stored by an earlier upload
+func (s *DedupStorageService) existingBlob(ctx context.Context, storageKey string, opts *UploadOptions) (*UploadResult, error) {
+    metadata, err := s.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    result := &UploadResult{
+        StorageKey:  storageKey,
+        StoragePath: storageKey,
+        URL:         s.GetStorageURL(storageKey),
+        FileName:    metadata.FileName,
+        FileSize:    metadata.FileSize,
+        ContentType: metadata.ContentType,
+        Metadata:    metadata.Metadata,
+    }
+    for k, v := range opts.Metadata {
+        result.Metadata[k] = v
+    }
+    if isImageContentType(metadata.ContentType) {
+        // Image headers sit at the start of the file once it has been sanitized
+        if head, err := ReadHead(ctx, s.StorageService, storageKey, 64*1024); err == nil {
+            result.Width, result.Height = imageDimensions(head)
+        }
+        if opts.GenerateThumbnail {
+            if exists, _ := s.StorageService.Exists(ctx, thumbnailKey(storageKey)); exists {
+                result.ThumbnailURL = s.GetStorageURL(thumbnailKey(storageKey))
+            }
+        }
+        result.Derivatives = NewDerivativeService(s.StorageService, opts.Derivatives).List(ctx, storageKey)
+    }
+    return result, nil
+}
+
+// GetMetadata returns the object metadata including its content hash
+func (s *DedupStorageService) GetMetadata(ctx context.Context, storageKey string) (*FileMetadata, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    if metadata.Metadata == nil {
+        metadata.Metadata = make(map[string]string)
+    }
+    metadata.SHA256 = metadata.Metadata[MetaSHA256]
+    return metadata, nil
+}
+
+// Retain adds a reference to an existing blob
+func (s *DedupStorageService) Retain(ctx context.Context, storageKey string) (int64, error) {
+    exists, err := s.StorageService.Exists(ctx, storageKey)
+    if err != nil {
+        return 0, err
+    }
+    if !exists {
+        return 0, fmt.Errorf("%w: %s", ErrObjectNotFound, storageKey)
+    }
+    refs, err := s.redis.Incr(ctx, blobRefsKey(storageKey)).Result()
+    if err != nil {
+        return 0, fmt.Errorf("failed to reference blob %s: %w", storageKey, err)
+    }
+    return refs, nil
+}
+
+// Release drops a reference to a blob. The reference count is removed once
+// it reaches zero, and the caller is then responsible for deleting the blob.
+func (s *DedupStorageService) Release(ctx context.Context, storageKey string) (int64, error) {
+    if !isBlobKey(storageKey) {
+        return 0, nil
+    }
+    refs, err := s.redis.Decr(ctx, blobRefsKey(storageKey)).Result()
+    if err != nil {
+        return 0, fmt.Errorf("failed to release blob %s: %w", storageKey, err)
+    }
+    if refs > 0 {
+        return refs, nil
+    }
+    s.redis.Del(ctx, blobRefsKey(storageKey))
+    return 0, nil
+}
+
+// Delete releases a reference to a blob and only deletes it with the last one.
+// Other keys are deleted directly.
+func (s *DedupStorageService) Delete(ctx context.Context, storageKey string) error {
+    refs, err := s.Release(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    if refs > 0 {
+        log.Debug().Str("storage_key", storageKey).Int64("refs", refs).Msg("Blob still referenced")
+        return nil
+    }
+    return s.StorageService.Delete(ctx, storageKey)
+}
+
+// DeleteMultiple deletes several objects, releasing blob references
+func (s *DedupStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    var unreferenced []string
+    for _, key := range storageKeys {
+        refs, err := s.Release(ctx, key)
+        if err != nil {
+            return err
+        }
+        if refs == 0 {
+            unreferenced = append(unreferenced, key)
+        }
+    }
+    if len(unreferenced) == 0 {
+        return nil
+    }
+    return s.StorageService.DeleteMultiple(ctx, unreferenced)
+}
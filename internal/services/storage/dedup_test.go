@@ -0,0 +1,167 @@
+package storage_test
+
+import (
+    "context"
+    "strings"
+    "testing"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// newRedis returns a client of an in-memory Redis server that lives as long as the test
+func newRedis(t *testing.T) *redis.Client {
+    server := miniredis.RunT(t)
+    client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+    t.Cleanup(func() { client.Close() })
+    return client
+}
+
+func uploadText(t *testing.T, svc storage.StorageService, userID uuid.UUID, name, content string) *storage.UploadResult {
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    result, err := svc.UploadFromReader(context.Background(), strings.NewReader(content), name, "text/plain", int64(len(content)), opts)
+    require.NoError(t, err)
+    return result
+}
+
+func assertExists(t *testing.T, svc storage.StorageService, storageKey string, want bool) {
+    t.Helper()
+    exists, err := svc.Exists(context.Background(), storageKey)
+    require.NoError(t, err)
+    assert.Equal(t, want, exists, storageKey)
+}
+
+func TestDedupSharesBlobUntilLastReference(t *testing.T) {
+    ctx := context.Background()
+    backend := storage.NewMemoryStorageService("")
+    dedup := storage.NewDedupStorageService(backend, newRedis(t), t.TempDir())
+    userID := uuid.New()
+
+    first := uploadText(t, dedup, userID, "notes.txt", "same contents")
+    second := uploadText(t, dedup, userID, "copy.txt", "same contents")
+    assert.Equal(t, first.StorageKey, second.StorageKey)
+    assert.True(t, strings.HasPrefix(first.StorageKey, storage.BlobFolder+"/"+userID.String()+"/"))
+    metadata, err := dedup.GetMetadata(ctx, first.StorageKey)
+    require.NoError(t, err)
+    assert.Len(t, metadata.SHA256, 64)
+
+    // Blobs are per user
+    other := uploadText(t, dedup, uuid.New(), "notes.txt", "same contents")
+    assert.NotEqual(t, first.StorageKey, other.StorageKey)
+
+    require.NoError(t, dedup.Delete(ctx, first.StorageKey))
+    assertExists(t, backend, first.StorageKey, true)
+    require.NoError(t, dedup.Delete(ctx, first.StorageKey))
+    assertExists(t, backend, first.StorageKey, false)
+    assertExists(t, backend, other.StorageKey, true)
+}
+
+func TestDedupRetainAndRelease(t *testing.T) {
+    ctx := context.Background()
+    backend := storage.NewMemoryStorageService("")
+    dedup := storage.NewDedupStorageService(backend, newRedis(t), t.TempDir())
+    blob := uploadText(t, dedup, uuid.New(), "notes.txt", "contents")
+
+    refs, err := dedup.Retain(ctx, blob.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, int64(2), refs)
+    refs, err = dedup.Release(ctx, blob.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, int64(1), refs)
+
+    _, err = dedup.Retain(ctx, "blobs/missing.txt")
+    assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+
+    // DeleteMultiple releases blobs and deletes other keys outright
+    plain := uploadText(t, backend, uuid.Nil, "plain.txt", "plain")
+    require.NoError(t, dedup.DeleteMultiple(ctx, []string{blob.StorageKey, plain.StorageKey}))
+    assertExists(t, backend, blob.StorageKey, false)
+    assertExists(t, backend, plain.StorageKey, false)
+}
+
+func TestDedupAdopt(t *testing.T) {
+    ctx := context.Background()
+    backend := storage.NewMemoryStorageService("")
+    dedup := storage.NewDedupStorageService(backend, newRedis(t), t.TempDir())
+    userID := uuid.New()
+
+    // Objects written around the decorator, as presigned uploads are
+    first := uploadText(t, backend, uuid.Nil, "first.txt", "adopted")
+    second := uploadText(t, backend, uuid.Nil, "second.txt", "adopted")
+    adopted, err := dedup.Adopt(ctx, first.StorageKey, userID)
+    require.NoError(t, err)
+    assert.True(t, strings.HasPrefix(adopted.StorageKey, storage.BlobFolder+"/"+userID.String()+"/"))
+    assertExists(t, backend, first.StorageKey, false)
+    data, err := dedup.Download(ctx, adopted.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, "adopted", string(data))
+
+    again, err := dedup.Adopt(ctx, second.StorageKey, userID)
+    require.NoError(t, err)
+    assert.Equal(t, adopted.StorageKey, again.StorageKey)
+    assertExists(t, backend, second.StorageKey, false)
+
+    _, err = dedup.Adopt(ctx, adopted.StorageKey, userID)
+    assert.Error(t, err, "blobs can't be adopted again")
+
+    // Both adoptions hold a reference
+    require.NoError(t, dedup.Delete(ctx, adopted.StorageKey))
+    assertExists(t, backend, adopted.StorageKey, true)
+    require.NoError(t, dedup.Delete(ctx, adopted.StorageKey))
+    assertExists(t, backend, adopted.StorageKey, false)
+}
+
+func TestDedupUnderQuotaAndEvents(t *testing.T) {
+    ctx := context.Background()
+    redisClient := newRedis(t)
+    backend := storage.NewMemoryStorageService("")
+    quota := storage.NewQuotaStorageService(storage.NewDedupStorageService(backend, redisClient, t.TempDir()), redisClient, map[string]int64{"free": 100}, "free")
+    events := storage.NewEventStorageService(quota)
+    var published []storage.Event
+    events.Subscribe("test", storage.EventSubscriberFunc(func(ctx context.Context, event storage.Event) error {
+        published = append(published, event)
+        return nil
+    }))
+    userID := uuid.New()
+    used := func() int64 {
+        usage, err := quota.UserUsage(ctx, userID)
+        require.NoError(t, err)
+        return usage.Used
+    }
+
+    first := uploadText(t, events, userID, "a.txt", "0123456789")
+    second := uploadText(t, events, userID, "b.txt", "0123456789")
+    require.Equal(t, first.StorageKey, second.StorageKey)
+    assert.Equal(t, int64(10), used(), "a shared blob is charged once")
+
+    var created []string
+    for _, event := range published {
+        if event.Type == storage.EventObjectCreated {
+            created = append(created, event.StorageKey)
+        }
+    }
+    assert.Equal(t, []string{first.StorageKey, first.StorageKey}, created)
+
+    require.NoError(t, events.Delete(ctx, first.StorageKey))
+    assert.Equal(t, int64(10), used(), "the blob is still referenced")
+    assertExists(t, backend, first.StorageKey, true)
+    require.NoError(t, events.Delete(ctx, first.StorageKey))
+    assert.Equal(t, int64(0), used())
+    assertExists(t, backend, first.StorageKey, false)
+
+    // Only the delete that removed the blob is announced
+    var deleted []string
+    for _, event := range published {
+        if event.Type == storage.EventObjectDeleted {
+            deleted = append(deleted, event.StorageKey)
+        }
+    }
+    assert.Equal(t, []string{first.StorageKey}, deleted)
+}
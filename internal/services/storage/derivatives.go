@@ -0,0 +1,404 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "image"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/disintegration/imaging"
+    "github.com/rs/zerolog/log"
+)
+
+const (
+    DerivativeModeFill = "fill" // crop to exactly Width x Height
+    DerivativeModeFit  = "fit"  // scale to fit within Width x Height
+
+    DerivativeFormatJPEG = "jpeg"
+    DerivativeFormatPNG  = "png"
+    DerivativeFormatWebP = "webp"
+)
+
+// Metadata keys stored on derivative objects
+const (
+    MetaDerivativeOf = "derivative-of"
+    MetaProfile      = "profile"
+    MetaWidth        = "width"
+    MetaHeight       = "height"
+)
+
+// ErrUnknownProfile is returned for a derivative profile that isn't configured
+var ErrUnknownProfile = errors.New("unknown derivative profile")
+
+// DefaultDerivativeProfiles are used when no profiles are configured
+const DefaultDerivativeProfiles = "small:320x320:fit:jpeg:80,medium:800x800:fit:jpeg:85,large:1600x1600:fit:jpeg:85:lazy,square:300x300:fill:jpeg:85"
+
+// DerivativeProfile declares a resized rendition of an uploaded image
+type DerivativeProfile struct {
+    Name    string
+    Width   int
+    Height  int
+    Mode    string
+    Format  string
+    Quality int
+    // Lazy profiles are generated on first request instead of at upload time
+    Lazy bool
+}
+
+// Derivative is a generated rendition of an image
+type Derivative struct {
+    Profile     string `json:"profile"`
+    StorageKey  string `json:"storage_key"`
+    URL         string `json:"url"`
+    Width       int    `json:"width"`
+    Height      int    `json:"height"`
+    ContentType string `json:"content_type"`
+    FileSize    int64  `json:"file_size"`
+}
+
+// ParseDerivativeProfiles parses a comma separated list of profiles of the
+// form name:WIDTHxHEIGHT:mode:format:quality[:lazy]
+func ParseDerivativeProfiles(spec string) ([]DerivativeProfile, error) {
+    var profiles []DerivativeProfile
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        fields := strings.Split(entry, ":")
+        if len(fields) < 5 || len(fields) > 6 {
+            return nil, fmt.Errorf("invalid derivative profile %q", entry)
+        }
+        profile := DerivativeProfile{
+            Name:   fields[0],
+            Mode:   fields[2],
+            Format: fields[3],
+            Lazy:   len(fields) == 6 && fields[5] == "lazy",
+        }
+        if profile.Name == "" || strings.ContainsAny(profile.Name, "/._") {
+            return nil, fmt.Errorf("invalid derivative profile name %q", profile.Name)
+        }
+        if _, err := fmt.Sscanf(fields[1], "%dx%d", &profile.Width, &profile.Height); err != nil || profile.Width <= 0 || profile.Height <= 0 {
+            return nil, fmt.Errorf("invalid size %q in derivative profile %s", fields[1], profile.Name)
+        }
+        if profile.Mode != DerivativeModeFill && profile.Mode != DerivativeModeFit {
+            return nil, fmt.Errorf("invalid mode %q in derivative profile %s", profile.Mode, profile.Name)
+        }
+        switch profile.Format {
+        case DerivativeFormatJPEG, DerivativeFormatPNG, DerivativeFormatWebP:
+        default:
+            return nil, fmt.Errorf("invalid format %q in derivative profile %s", profile.Format, profile.Name)
+        }
+        quality, err := strconv.Atoi(fields[4])
+        if err != nil || quality < 1 || quality > 100 {
+            return nil, fmt.Errorf("invalid quality %q in derivative profile %s", fields[4], profile.Name)
+        }
+        profile.Quality = quality
+        profiles = append(profiles, profile)
+    }
+    return profiles, nil
+}
+
+// LoadDerivativeProfiles parses spec, falling back to the default profiles
+// when it is empty or invalid
+func LoadDerivativeProfiles(spec string) []DerivativeProfile {
+    if spec != "" {
+        profiles, err := ParseDerivativeProfiles(spec)
+        if err == nil {
+            return profiles
+        }
+        log.Error().Err(err).Msg("Invalid derivative profiles, using defaults")
+    }
+    profiles, _ := ParseDerivativeProfiles(DefaultDerivativeProfiles)
+    return profiles
+}
+
+// DerivativeKey returns the key a derivative of storageKey is stored under.
+// Derivatives sit next to the original so they can be found by prefix. The
+// prefix keeps the original's extension, so blobs that differ only in their
+// extension don't share derivatives.
+func DerivativeKey(storageKey string, profile DerivativeProfile) string {
+    return derivativePrefix(storageKey) + profile.Name + "." + profile.extension()
+}
+
+func derivativePrefix(storageKey string) string {
+    return storageKey + "_"
+}
+
+// SourceKey returns the key of the object a thumbnail or derivative was
+// generated from. It reports false for objects that were uploaded.
+func SourceKey(ctx context.Context, svc StorageService, storageKey string) (string, bool) {
+    ext := filepath.Ext(storageKey)
+    if base := strings.TrimSuffix(storageKey, ext); strings.HasSuffix(base, "_thumb") {
+        return strings.TrimSuffix(base, "_thumb") + ext, true
+    }
+    metadata, err := svc.GetMetadata(ctx, storageKey)
+    if err != nil || metadata.Metadata[MetaDerivativeOf] == "" {
+        return "", false
+    }
+    return metadata.Metadata[MetaDerivativeOf], true
+}
+
+func (p DerivativeProfile) extension() string {
+    if p.Format == DerivativeFormatJPEG {
+        return "jpg"
+    }
+    return p.Format
+}
+
+func (p DerivativeProfile) contentType() string {
+    return "image/" + p.Format
+}
+
+// render resizes img per the profile and encodes it
+func (p DerivativeProfile) render(img image.Image) ([]byte, int, int, error) {
+    var resized *image.NRGBA
+    if p.Mode == DerivativeModeFill {
+        resized = imaging.Fill(img, p.Width, p.Height, imaging.Center, imaging.Lanczos)
+    } else if img.Bounds().Dx() > p.Width || img.Bounds().Dy() > p.Height {
+        resized = imaging.Fit(img, p.Width, p.Height, imaging.Lanczos)
+    } else {
+        // Never upscale
+        resized = imaging.Clone(img)
+    }
+    var buf bytes.Buffer
+    var err error
+    switch p.Format {
+    case DerivativeFormatPNG:
+        err = imaging.Encode(&buf, resized, imaging.PNG)
+    case DerivativeFormatWebP:
+        err = encodeWebP(&buf, resized, p.Quality)
+    default:
+        err = imaging.Encode(&buf, resized, imaging.JPEG, imaging.JPEGQuality(p.Quality))
+    }
+    if err != nil {
+        return nil, 0, 0, fmt.Errorf("failed to encode %s derivative: %w", p.Name, err)
+    }
+    return buf.Bytes(), resized.Bounds().Dx(), resized.Bounds().Dy(), nil
+}
+
+// encodeWebP encodes through the cwebp tool, since Go has no WebP encoder
+func encodeWebP(buf *bytes.Buffer, img image.Image, quality int) error {
+    cwebp, err := exec.LookPath("cwebp")
+    if err != nil {
+        return fmt.Errorf("cwebp is required for WebP output: %w", err)
+    }
+    dir, err := os.MkdirTemp("", "derivative-*")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(dir)
+    input := filepath.Join(dir, "in.png")
+    output := filepath.Join(dir, "out.webp")
+    if err := imaging.Save(img, input); err != nil {
+        return err
+    }
+    if out, err := exec.Command(cwebp, "-quiet", "-q", strconv.Itoa(quality), input, "-o", output).CombinedOutput(); err != nil {
+        return fmt.Errorf("cwebp failed: %v: %s", err, out)
+    }
+    data, err := os.ReadFile(output)
+    if err != nil {
+        return err
+    }
+    buf.Write(data)
+    return nil
+}
+
+// DerivativeService generates, lists and deletes image derivatives on top
+// of any storage backend
+type DerivativeService struct {
+    storage  StorageService
+    profiles []DerivativeProfile
+}
+
+// NewDerivativeService creates a derivative service for the given profiles
+func NewDerivativeService(svc StorageService, profiles []DerivativeProfile) *DerivativeService {
+    return &DerivativeService{
+        storage:  svc,
+        profiles: profiles,
+    }
+}
+
+// Profiles returns the configured profiles
+func (d *DerivativeService) Profiles() []DerivativeProfile {
+    return d.profiles
+}
+
+func (d *DerivativeService) profile(name string) (DerivativeProfile, bool) {
+    for _, profile := range d.profiles {
+        if profile.Name == name {
+            return profile, true
+        }
+    }
+    return DerivativeProfile{}, false
+}
+
+// Generate renders the non-lazy profiles of an image already in memory
+func (d *DerivativeService) Generate(ctx context.Context, storageKey string, data []byte) []Derivative {
+    return generateDerivatives(ctx, d.storage, storageKey, data, d.profiles)
+}
+
+// Get returns the derivative of storageKey for profile, generating it from
+// the original on first request
+func (d *DerivativeService) Get(ctx context.Context, storageKey, name string) (*Derivative, error) {
+    profile, ok := d.profile(name)
+    if !ok {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+    }
+    if derivative, err := d.stat(ctx, storageKey, profile); err == nil {
+        return derivative, nil
+    } else if !errors.Is(err, ErrObjectNotFound) {
+        return nil, err
+    }
+    data, err := d.storage.Download(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    img, err := decodeImage(data)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode image: %w", err)
+    }
+    return storeDerivative(ctx, d.storage, storageKey, img, profile)
+}
+
+// List returns the derivatives of storageKey that have been generated
+func (d *DerivativeService) List(ctx context.Context, storageKey string) []Derivative {
+    var derivatives []Derivative
+    for _, profile := range d.profiles {
+        if derivative, err := d.stat(ctx, storageKey, profile); err == nil {
+            derivatives = append(derivatives, *derivative)
+        }
+    }
+    return derivatives
+}
+
+// ExpireLazy deletes the generated derivatives of lazy profiles after the
+// contents of storageKey changed, so they are rendered again on request
+func (d *DerivativeService) ExpireLazy(ctx context.Context, storageKey string) error {
+    var keys []string
+    for _, profile := range d.profiles {
+        if !profile.Lazy {
+            continue
+        }
+        if _, err := d.stat(ctx, storageKey, profile); err == nil {
+            keys = append(keys, DerivativeKey(storageKey, profile))
+        }
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return d.storage.DeleteMultiple(ctx, keys)
+}
+
+func (d *DerivativeService) stat(ctx context.Context, storageKey string, profile DerivativeProfile) (*Derivative, error) {
+    key := DerivativeKey(storageKey, profile)
+    metadata, err := d.storage.GetMetadata(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    width, _ := strconv.Atoi(metadata.Metadata[MetaWidth])
+    height, _ := strconv.Atoi(metadata.Metadata[MetaHeight])
+    return &Derivative{
+        Profile:     profile.Name,
+        StorageKey:  key,
+        URL:         d.storage.GetStorageURL(key),
+        Width:       width,
+        Height:      height,
+        ContentType: metadata.ContentType,
+        FileSize:    metadata.FileSize,
+    }, nil
+}
+
+// DeleteWithDerivatives deletes an object together with every derivative and
+// thumbnail stored next to it, including those of profiles since removed.
+// Shared blobs keep their derivatives until the last reference is released.
+func (d *DerivativeService) DeleteWithDerivatives(ctx context.Context, storageKey string) error {
+    // Deleting a shared blob releases one reference; it's only gone with the last
+    if err := d.storage.Delete(ctx, storageKey); err != nil {
+        return err
+    }
+    if exists, err := d.storage.Exists(ctx, storageKey); err != nil || exists {
+        return err
+    }
+    files, err := d.storage.ListFiles(ctx, derivativePrefix(storageKey), 0)
+    if err != nil {
+        return err
+    }
+    keys := make([]string, 0, len(files)+1)
+    for _, file := range files {
+        keys = append(keys, file.StorageKey)
+    }
+    if exists, err := d.storage.Exists(ctx, thumbnailKey(storageKey)); err != nil {
+        return err
+    } else if exists {
+        keys = append(keys, thumbnailKey(storageKey))
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return d.storage.DeleteMultiple(ctx, keys)
+}
+
+// generateDerivatives renders the non-lazy profiles for an uploaded image.
+// Failures are logged so a bad profile never fails the upload itself.
+func generateDerivatives(ctx context.Context, svc StorageService, storageKey string, data []byte, profiles []DerivativeProfile) []Derivative {
+    var img image.Image
+    var derivatives []Derivative
+    for _, profile := range profiles {
+        if profile.Lazy {
+            continue
+        }
+        if img == nil {
+            decoded, err := decodeImage(data)
+            if err != nil {
+                log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to decode image for derivatives")
+                return nil
+            }
+            img = decoded
+        }
+        derivative, err := storeDerivative(ctx, svc, storageKey, img, profile)
+        if err != nil {
+            log.Warn().Err(err).Str("storage_key", storageKey).Str("profile", profile.Name).Msg("Failed to generate derivative")
+            continue
+        }
+        derivatives = append(derivatives, *derivative)
+    }
+    return derivatives
+}
+
+func storeDerivative(ctx context.Context, svc StorageService, storageKey string, img image.Image, profile DerivativeProfile) (*Derivative, error) {
+    data, width, height, err := profile.render(img)
+    if err != nil {
+        return nil, err
+    }
+    opts := NewUploadOptions()
+    opts.StorageKey = DerivativeKey(storageKey, profile)
+    // Renditions are regenerated with their original and keep no history
+    opts.SkipVersion = true
+    opts.StripMetadata = false
+    opts.Metadata = map[string]string{
+        MetaDerivativeOf: storageKey,
+        MetaProfile:      profile.Name,
+        MetaWidth:        strconv.Itoa(width),
+        MetaHeight:       strconv.Itoa(height),
+    }
+    result, err := svc.UploadFromReader(ctx, bytes.NewReader(data), opts.StorageKey, profile.contentType(), int64(len(data)), opts)
+    if err != nil {
+        return nil, err
+    }
+    return &Derivative{
+        Profile:     profile.Name,
+        StorageKey:  result.StorageKey,
+        URL:         result.URL,
+        Width:       width,
+        Height:      height,
+        ContentType: result.ContentType,
+        FileSize:    result.FileSize,
+    }, nil
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+// recordingBackend remembers the options of every upload
+type recordingBackend struct {
+    storage.StorageService
+    uploads []*storage.UploadOptions
+}
+
+func (r *recordingBackend) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *storage.UploadOptions) (*storage.UploadResult, error) {
+    r.uploads = append(r.uploads, opts)
+    return r.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, opts)
+}
+
+func TestDeleteWithDerivativesKeepsBlobsWithAnotherExtension(t *testing.T) {
+    ctx := context.Background()
+    svc := storage.NewMemoryStorageService("")
+    derivatives := storage.NewDerivativeService(svc, storage.LoadDerivativeProfiles(""))
+    data := storagetest.NewPNG(t, 100, 50)
+    upload := func(key string) {
+        opts := storage.NewUploadOptions()
+        opts.StorageKey = key
+        opts.GenerateThumbnail = true
+        opts.Derivatives = derivatives.Profiles()
+        _, err := svc.UploadFromReader(ctx, bytes.NewReader(data), key, "image/png", int64(len(data)), opts)
+        require.NoError(t, err)
+    }
+    upload("blobs/ab/abcdef.jpg")
+    upload("blobs/ab/abcdef.jpeg")
+    require.Len(t, derivatives.List(ctx, "blobs/ab/abcdef.jpeg"), 3)
+
+    require.NoError(t, derivatives.DeleteWithDerivatives(ctx, "blobs/ab/abcdef.jpg"))
+    files, err := svc.ListFiles(ctx, "blobs/", 0)
+    require.NoError(t, err)
+    assert.ElementsMatch(t, []string{
+        "blobs/ab/abcdef.jpeg",
+        "blobs/ab/abcdef_thumb.jpeg",
+        "blobs/ab/abcdef.jpeg_small.jpg",
+        "blobs/ab/abcdef.jpeg_medium.jpg",
+        "blobs/ab/abcdef.jpeg_square.jpg",
+    }, fileKeys(files))
+}
+
+func TestDerivativesSkipVersions(t *testing.T) {
+    ctx := context.Background()
+    backend := &recordingBackend{StorageService: storage.NewMemoryStorageService("")}
+    derivatives := storage.NewDerivativeService(backend, storage.LoadDerivativeProfiles(""))
+    data := storagetest.NewPNG(t, 100, 50)
+    opts := storage.NewUploadOptions()
+    opts.StorageKey = "uploads/photo.png"
+    _, err := backend.UploadFromReader(ctx, bytes.NewReader(data), "photo.png", "image/png", int64(len(data)), opts)
+    require.NoError(t, err)
+
+    derivative, err := derivatives.Get(ctx, "uploads/photo.png", "large")
+    require.NoError(t, err)
+    assert.Equal(t, "uploads/photo.png_large.jpg", derivative.StorageKey)
+    require.Len(t, backend.uploads, 2)
+    assert.True(t, backend.uploads[1].SkipVersion)
+}
+
+func fileKeys(files []*storage.FileInfo) []string {
+    keys := make([]string, len(files))
+    for n, file := range files {
+        keys[n] = file.StorageKey
+    }
+    return keys
+}
@@ -0,0 +1,796 @@
+package storage
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "strings"
+    "time"
+
+    "github.com/rs/zerolog/log"
+)
+
+// Envelope metadata keys. The data key is stored wrapped by a master key
+// next to the object it encrypts.
+const (
+    MetaEncryptionKeyID  = "enc-key-id"
+    MetaEncryptedDataKey = "enc-data-key"
+    MetaEncryptionNonce  = "enc-nonce"
+)
+
+// DecryptRoute serves encrypted objects, decrypted, to holders of a URL
+// signed by GeneratePresignedURL
+const DecryptRoute = "/storage/decrypt"
+
+const (
+    // Objects are sealed in segments so they can be streamed in both
+    // directions without buffering them whole
+    encryptionSegmentSize = 64 * 1024
+    encryptionOverhead    = 16
+    dataKeySize           = 32
+    noncePrefixSize       = 7
+)
+
+var (
+    ErrDecryptionFailed    = errors.New("failed to decrypt object")
+    ErrRotationUnsupported = errors.New("storage backend cannot rotate encryption keys")
+    ErrMetadataUnsupported = errors.New("storage backend cannot update object metadata")
+)
+
+// MetadataUpdater is implemented by backends that can replace the user
+// metadata of an object without rewriting its contents
+type MetadataUpdater interface {
+    UpdateMetadata(ctx context.Context, storageKey string, metadata map[string]string) error
+}
+
+// MergeMetadata sets the given user metadata keys on an object and keeps the
+// rest. The current metadata is read from the layer that updates it, so keys
+// kept by the layers above it, like wrapped data keys, survive.
+func MergeMetadata(ctx context.Context, svc StorageService, storageKey string, values map[string]string) error {
+    updater, ok := Backend[MetadataUpdater](svc)
+    if !ok {
+        return ErrMetadataUnsupported
+    }
+    reader, ok := updater.(StorageService)
+    if !ok {
+        return ErrMetadataUnsupported
+    }
+    metadata, err := reader.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    merged := make(map[string]string, len(metadata.Metadata)+len(values))
+    for k, v := range metadata.Metadata {
+        merged[k] = v
+    }
+    for k, v := range values {
+        merged[k] = v
+    }
+    return updater.UpdateMetadata(ctx, storageKey, merged)
+}
+
+// EncryptedStorageService encrypts objects before they reach the wrapped
+// backend. Every object gets its own AES-256-GCM data key, wrapped by the
+// active master key of the key ring and stored in the object's metadata.
+// Images are sanitized and their thumbnails and derivatives rendered here,
+// since the backend only ever sees ciphertext. Objects without an envelope,
+// such as those stored before encryption was enabled, are read as is.
+type EncryptedStorageService struct {
+    StorageService
+    keys    *KeyRing
+    signer  *URLSigner
+    baseURL string
+}
+
+// NewEncryptedStorageService wraps backend with envelope encryption. Signed
+// URLs to DecryptRoute under baseURL are signed with signingKey.
+func NewEncryptedStorageService(backend StorageService, keys *KeyRing, baseURL, signingKey string) *EncryptedStorageService {
+    return &EncryptedStorageService{
+        StorageService: backend,
+        keys:           keys,
+        signer:         NewURLSigner(signingKey),
+        baseURL:        strings.TrimRight(baseURL, "/"),
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *EncryptedStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// ActiveKeyID returns the ID of the master key new data keys are wrapped with
+func (s *EncryptedStorageService) ActiveKeyID() string {
+    return s.keys.ActiveKeyID()
+}
+
+// envelope is the wrapped data key and nonce prefix of an encrypted object
+type envelope struct {
+    keyID   string
+    dataKey string
+    nonce   string
+}
+
+func envelopeFromMetadata(metadata map[string]string) (*envelope, bool) {
+    env := &envelope{
+        keyID:   metadata[MetaEncryptionKeyID],
+        dataKey: metadata[MetaEncryptedDataKey],
+        nonce:   metadata[MetaEncryptionNonce],
+    }
+    return env, env.keyID != "" && env.dataKey != ""
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// wrapKey seals a data key with the active master key
+func (s *EncryptedStorageService) wrapKey(dataKey []byte) (string, string, error) {
+    keyID := s.keys.ActiveKeyID()
+    master, err := s.keys.key(keyID)
+    if err != nil {
+        return "", "", err
+    }
+    aead, err := newGCM(master)
+    if err != nil {
+        return "", "", err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return "", "", fmt.Errorf("failed to generate nonce: %w", err)
+    }
+    sealed := aead.Seal(nonce, nonce, dataKey, []byte(keyID))
+    return keyID, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrapKey opens a data key sealed by wrapKey
+func (s *EncryptedStorageService) unwrapKey(keyID, wrapped string) ([]byte, error) {
+    master, err := s.keys.key(keyID)
+    if err != nil {
+        return nil, err
+    }
+    aead, err := newGCM(master)
+    if err != nil {
+        return nil, err
+    }
+    sealed, err := base64.StdEncoding.DecodeString(wrapped)
+    if err != nil || len(sealed) < aead.NonceSize() {
+        return nil, ErrDecryptionFailed
+    }
+    dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID))
+    if err != nil {
+        return nil, ErrDecryptionFailed
+    }
+    return dataKey, nil
+}
+
+func (s *EncryptedStorageService) openEnvelope(env *envelope) (*segmentCipher, error) {
+    dataKey, err := s.unwrapKey(env.keyID, env.dataKey)
+    if err != nil {
+        return nil, err
+    }
+    prefix, err := base64.StdEncoding.DecodeString(env.nonce)
+    if err != nil || len(prefix) != noncePrefixSize {
+        return nil, ErrDecryptionFailed
+    }
+    return newSegmentCipher(dataKey, prefix)
+}
+
+// Upload encrypts and stores a multipart file
+func (s *EncryptedStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    contentType := detectContentType(header.Filename, opts.ContentType, header.Header.Get("Content-Type"))
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader encrypts and stores data from a reader
+func (s *EncryptedStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    contentType = detectContentType(filename, opts.ContentType, contentType)
+    storageKey := generateStorageKey(opts, filename)
+    var data []byte
+    if isImageContentType(contentType) {
+        var err error
+        if data, err = io.ReadAll(reader); err != nil {
+            return nil, fmt.Errorf("failed to read data: %w", err)
+        }
+        if data, opts, err = sanitizeUpload(data, contentType, opts); err != nil {
+            return nil, err
+        }
+        reader, size = bytes.NewReader(data), int64(len(data))
+    }
+    result, err := s.store(ctx, storageKey, reader, contentType, size, opts)
+    if err != nil {
+        return nil, err
+    }
+    if data != nil {
+        result.Width, result.Height = imageDimensions(data)
+        result.Derivatives = generateDerivatives(ctx, s, storageKey, data, opts.Derivatives)
+        if opts.GenerateThumbnail {
+            if thumb, err := s.storeThumbnail(ctx, storageKey, data, opts); err != nil {
+                log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to generate thumbnail")
+            } else {
+                result.ThumbnailURL = thumb.URL
+            }
+        }
+    }
+    return result, nil
+}
+
+// store encrypts reader under a new data key and hands the ciphertext to the
+// backend
+func (s *EncryptedStorageService) store(ctx context.Context, storageKey string, reader io.Reader, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    dataKey := make([]byte, dataKeySize)
+    prefix := make([]byte, noncePrefixSize)
+    if _, err := rand.Read(dataKey); err != nil {
+        return nil, fmt.Errorf("failed to generate data key: %w", err)
+    }
+    if _, err := rand.Read(prefix); err != nil {
+        return nil, fmt.Errorf("failed to generate nonce: %w", err)
+    }
+    keyID, wrapped, err := s.wrapKey(dataKey)
+    if err != nil {
+        return nil, fmt.Errorf("failed to wrap data key: %w", err)
+    }
+    segments, err := newSegmentCipher(dataKey, prefix)
+    if err != nil {
+        return nil, err
+    }
+    sealed := newSealReader(reader, segments)
+    backendOpts := *opts
+    backendOpts.StorageKey = storageKey
+    backendOpts.GenerateThumbnail = false
+    backendOpts.StripMetadata = false
+    backendOpts.Derivatives = nil
+    backendOpts.Metadata = copyMetadata(opts.Metadata)
+    if backendOpts.Metadata == nil {
+        backendOpts.Metadata = make(map[string]string)
+    }
+    backendOpts.Metadata[MetaEncryptionKeyID] = keyID
+    backendOpts.Metadata[MetaEncryptedDataKey] = wrapped
+    backendOpts.Metadata[MetaEncryptionNonce] = base64.StdEncoding.EncodeToString(prefix)
+    result, err := s.StorageService.UploadFromReader(ctx, sealed, storageKey, contentType, ciphertextSize(size), &backendOpts)
+    if err != nil {
+        return nil, err
+    }
+    result.FileSize = sealed.plaintextBytes
+    result.Metadata = opts.Metadata
+    return result, nil
+}
+
+func (s *EncryptedStorageService) storeThumbnail(ctx context.Context, storageKey string, data []byte, opts *UploadOptions) (*UploadResult, error) {
+    thumb, err := createThumbnail(bytes.NewReader(data), storageKey, opts.ThumbnailWidth, opts.ThumbnailHeight)
+    if err != nil {
+        return nil, err
+    }
+    key := thumbnailKey(storageKey)
+    result, err := s.store(ctx, key, bytes.NewReader(thumb), detectContentType(key), int64(len(thumb)), opts)
+    if err != nil {
+        return nil, err
+    }
+    result.Width, result.Height = imageDimensions(thumb)
+    return result, nil
+}
+
+// Download reads and decrypts a whole object
+func (s *EncryptedStorageService) Download(ctx context.Context, storageKey string) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := s.DownloadToWriter(ctx, storageKey, &buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// DownloadToWriter streams an object into writer, decrypting it on the way
+func (s *EncryptedStorageService) DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    env, ok := envelopeFromMetadata(metadata.Metadata)
+    if !ok {
+        return s.StorageService.DownloadToWriter(ctx, storageKey, writer)
+    }
+    segments, err := s.openEnvelope(env)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %w", storageKey, err)
+    }
+    opener := &openWriter{dst: writer, cipher: segments}
+    if err := s.StorageService.DownloadToWriter(ctx, storageKey, opener); err != nil {
+        return err
+    }
+    if err := opener.Close(); err != nil {
+        return fmt.Errorf("failed to open %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// DownloadRange streams part of an object into writer. Only the segments
+// that overlap the range are fetched and decrypted.
+func (s *EncryptedStorageService) DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    env, ok := envelopeFromMetadata(metadata.Metadata)
+    if !ok {
+        return s.StorageService.DownloadRange(ctx, storageKey, offset, length, writer)
+    }
+    size := plaintextSize(metadata.FileSize)
+    if length, err = rangeLength(storageKey, offset, length, size); err != nil {
+        return err
+    }
+    segments, err := s.openEnvelope(env)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %w", storageKey, err)
+    }
+    total := max((size+encryptionSegmentSize-1)/encryptionSegmentSize, 1)
+    first := offset / encryptionSegmentSize
+    last := first
+    if length > 0 {
+        last = (offset + length - 1) / encryptionSegmentSize
+    }
+    segments.counter = uint32(first)
+    opener := &openWriter{
+        dst:     &rangeWriter{dst: writer, skip: offset - first*encryptionSegmentSize, remaining: length},
+        cipher:  segments,
+        partial: last < total-1,
+    }
+    sealedSegmentSize := int64(encryptionSegmentSize + encryptionOverhead)
+    cipherOffset := first * sealedSegmentSize
+    cipherLength := min((last+1)*sealedSegmentSize, metadata.FileSize) - cipherOffset
+    if err := s.StorageService.DownloadRange(ctx, storageKey, cipherOffset, cipherLength, opener); err != nil {
+        return err
+    }
+    if err := opener.Close(); err != nil {
+        return fmt.Errorf("failed to open %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// GetMetadata returns the metadata of an object with its plaintext size.
+// The envelope is not part of the returned metadata.
+func (s *EncryptedStorageService) GetMetadata(ctx context.Context, storageKey string) (*FileMetadata, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    return plaintextMetadata(metadata), nil
+}
+
+// plaintextMetadata reports the plaintext size of an encrypted object and
+// drops its envelope
+func plaintextMetadata(metadata *FileMetadata) *FileMetadata {
+    if _, ok := envelopeFromMetadata(metadata.Metadata); ok {
+        metadata.FileSize = plaintextSize(metadata.FileSize)
+        metadata.Metadata = copyMetadata(metadata.Metadata)
+        delete(metadata.Metadata, MetaEncryptionKeyID)
+        delete(metadata.Metadata, MetaEncryptedDataKey)
+        delete(metadata.Metadata, MetaEncryptionNonce)
+    }
+    return metadata
+}
+
+// ListFiles lists objects with their plaintext sizes. The backend only knows
+// the size of the ciphertext, so each encrypted object costs a metadata read.
+func (s *EncryptedStorageService) ListFiles(ctx context.Context, prefix string, limit int) ([]*FileInfo, error) {
+    files, err := s.StorageService.ListFiles(ctx, prefix, limit)
+    if err != nil {
+        return nil, err
+    }
+    s.plaintextSizes(ctx, files)
+    return files, nil
+}
+
+// ListFilesPage lists one page of objects with their plaintext sizes
+func (s *EncryptedStorageService) ListFilesPage(ctx context.Context, prefix string, opts ListOptions) (*FileList, error) {
+    page, err := s.StorageService.ListFilesPage(ctx, prefix, opts)
+    if err != nil {
+        return nil, err
+    }
+    s.plaintextSizes(ctx, page.Files)
+    return page, nil
+}
+
+// plaintextSizes replaces the ciphertext sizes of encrypted objects
+func (s *EncryptedStorageService) plaintextSizes(ctx context.Context, files []*FileInfo) {
+    for _, file := range files {
+        if file.IsDirectory {
+            continue
+        }
+        metadata, err := s.StorageService.GetMetadata(ctx, file.StorageKey)
+        if err != nil {
+            continue
+        }
+        if _, ok := envelopeFromMetadata(metadata.Metadata); ok {
+            file.FileSize = plaintextSize(file.FileSize)
+        }
+    }
+}
+
+// GenerateThumbnail creates an encrypted thumbnail for a stored image
+func (s *EncryptedStorageService) GenerateThumbnail(ctx context.Context, storageKey string, width, height int) (*UploadResult, error) {
+    data, err := s.Download(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    opts := NewUploadOptions()
+    opts.ThumbnailWidth = width
+    opts.ThumbnailHeight = height
+    return s.storeThumbnail(ctx, storageKey, data, opts)
+}
+
+// GeneratePresignedURL returns a signed URL to DecryptRoute for encrypted
+// objects, since the backend can only serve their ciphertext
+func (s *EncryptedStorageService) GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return "", err
+    }
+    if _, ok := envelopeFromMetadata(metadata.Metadata); !ok {
+        return s.StorageService.GeneratePresignedURL(ctx, storageKey, expiry)
+    }
+    return s.signer.SignURL(s.baseURL, DecryptRoute+"/"+storageKey, expiry), nil
+}
+
+// VerifyAccess checks a URL signed by GeneratePresignedURL
+func (s *EncryptedStorageService) VerifyAccess(storageKey, expires, signature string) error {
+    return s.signer.Verify(DecryptRoute+"/"+storageKey, expires, signature)
+}
+
+// Encrypt encrypts in place an object that was written straight to the
+// backend, such as a presigned or resumable upload. Objects that are
+// already encrypted are left alone.
+func (s *EncryptedStorageService) Encrypt(ctx context.Context, storageKey string) error {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    if _, ok := envelopeFromMetadata(metadata.Metadata); ok {
+        return nil
+    }
+    reader, writer := io.Pipe()
+    go func() {
+        writer.CloseWithError(s.StorageService.DownloadToWriter(ctx, storageKey, writer))
+    }()
+    opts := NewUploadOptions()
+    opts.StripMetadata = false
+    // The plaintext must not survive as a version of the object
+    opts.SkipVersion = true
+    opts.Metadata = metadata.Metadata
+    _, err = s.store(ctx, storageKey, reader, metadata.ContentType, metadata.FileSize, opts)
+    reader.CloseWithError(err)
+    if err != nil {
+        return fmt.Errorf("failed to encrypt %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// RotateKeys re-wraps the data keys of objects under prefix that were wrapped
+// with a master key other than the active one. Object contents are not
+// re-encrypted, so rotation only rewrites metadata. Emulated versions are
+// rotated with their objects; versions kept by S3 itself can't be rewritten
+// and stay wrapped with their original master key.
+func (s *EncryptedStorageService) RotateKeys(ctx context.Context, prefix string) (int, error) {
+    updater, ok := Backend[MetadataUpdater](s.StorageService)
+    if !ok {
+        return 0, ErrRotationUnsupported
+    }
+    files, err := s.StorageService.ListFiles(ctx, prefix, 0)
+    if err != nil {
+        return 0, err
+    }
+    if _, ok := Backend[*VersionedStorageService](s.StorageService); ok {
+        versions, err := s.StorageService.ListFiles(ctx, VersionFolder+"/"+prefix, 0)
+        if err != nil {
+            return 0, err
+        }
+        files = append(files, versions...)
+    }
+    rotated := 0
+    for _, file := range files {
+        if file.IsDirectory {
+            continue
+        }
+        metadata, err := s.StorageService.GetMetadata(ctx, file.StorageKey)
+        if err != nil {
+            return rotated, err
+        }
+        env, ok := envelopeFromMetadata(metadata.Metadata)
+        if !ok || env.keyID == s.keys.ActiveKeyID() {
+            continue
+        }
+        dataKey, err := s.unwrapKey(env.keyID, env.dataKey)
+        if err != nil {
+            return rotated, fmt.Errorf("failed to unwrap data key of %s: %w", file.StorageKey, err)
+        }
+        keyID, wrapped, err := s.wrapKey(dataKey)
+        if err != nil {
+            return rotated, fmt.Errorf("failed to wrap data key of %s: %w", file.StorageKey, err)
+        }
+        updated := copyMetadata(metadata.Metadata)
+        updated[MetaEncryptionKeyID] = keyID
+        updated[MetaEncryptedDataKey] = wrapped
+        if err := updater.UpdateMetadata(ctx, file.StorageKey, updated); err != nil {
+            if errors.Is(err, ErrMetadataUnsupported) {
+                return rotated, ErrRotationUnsupported
+            }
+            return rotated, err
+        }
+        rotated++
+    }
+    log.Info().Str("prefix", prefix).Str("key_id", s.keys.ActiveKeyID()).Int("rotated", rotated).Msg("Storage data keys rotated")
+    return rotated, nil
+}
+
+// versioner returns the version history kept below the encryption
+func (s *EncryptedStorageService) versioner() (Versioner, error) {
+    versioner, ok := Backend[Versioner](s.StorageService)
+    if !ok {
+        return nil, ErrVersioningUnsupported
+    }
+    return versioner, nil
+}
+
+// ListVersions lists the versions of an object with their plaintext sizes
+func (s *EncryptedStorageService) ListVersions(ctx context.Context, storageKey string) ([]*ObjectVersion, error) {
+    versioner, err := s.versioner()
+    if err != nil {
+        return nil, err
+    }
+    versions, err := versioner.ListVersions(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    for _, version := range versions {
+        metadata, err := versioner.GetVersionMetadata(ctx, storageKey, version.VersionID)
+        if err != nil {
+            continue
+        }
+        if _, ok := envelopeFromMetadata(metadata.Metadata); ok {
+            version.FileSize = plaintextSize(version.FileSize)
+        }
+    }
+    return versions, nil
+}
+
+// GetVersionMetadata returns the metadata of one version of an object with
+// its plaintext size
+func (s *EncryptedStorageService) GetVersionMetadata(ctx context.Context, storageKey, versionID string) (*FileMetadata, error) {
+    versioner, err := s.versioner()
+    if err != nil {
+        return nil, err
+    }
+    metadata, err := versioner.GetVersionMetadata(ctx, storageKey, versionID)
+    if err != nil {
+        return nil, err
+    }
+    return plaintextMetadata(metadata), nil
+}
+
+// DownloadVersion streams one version of an object into writer, decrypting
+// it with the envelope stored alongside that version
+func (s *EncryptedStorageService) DownloadVersion(ctx context.Context, storageKey, versionID string, writer io.Writer) error {
+    versioner, err := s.versioner()
+    if err != nil {
+        return err
+    }
+    metadata, err := versioner.GetVersionMetadata(ctx, storageKey, versionID)
+    if err != nil {
+        return err
+    }
+    env, ok := envelopeFromMetadata(metadata.Metadata)
+    if !ok {
+        return versioner.DownloadVersion(ctx, storageKey, versionID, writer)
+    }
+    segments, err := s.openEnvelope(env)
+    if err != nil {
+        return fmt.Errorf("failed to open %s@%s: %w", storageKey, versionID, err)
+    }
+    opener := &openWriter{dst: writer, cipher: segments}
+    if err := versioner.DownloadVersion(ctx, storageKey, versionID, opener); err != nil {
+        return err
+    }
+    if err := opener.Close(); err != nil {
+        return fmt.Errorf("failed to open %s@%s: %w", storageKey, versionID, err)
+    }
+    return nil
+}
+
+// RestoreVersion restores a version as is. Its envelope is restored with it.
+func (s *EncryptedStorageService) RestoreVersion(ctx context.Context, storageKey, versionID string) error {
+    versioner, err := s.versioner()
+    if err != nil {
+        return err
+    }
+    return versioner.RestoreVersion(ctx, storageKey, versionID)
+}
+
+// ciphertextSize returns the stored size of size bytes of plaintext, or -1
+// when size is unknown
+func ciphertextSize(size int64) int64 {
+    if size < 0 {
+        return -1
+    }
+    segments := max((size+encryptionSegmentSize-1)/encryptionSegmentSize, 1)
+    return size + segments*encryptionOverhead
+}
+
+// plaintextSize is the inverse of ciphertextSize
+func plaintextSize(size int64) int64 {
+    segments := (size + encryptionSegmentSize + encryptionOverhead - 1) / (encryptionSegmentSize + encryptionOverhead)
+    return max(size-segments*encryptionOverhead, 0)
+}
+
+// segmentCipher seals consecutive segments of one object. Each nonce is the
+// object's random prefix, the segment counter and a flag marking the final
+// segment, so segments can't be reordered, dropped or truncated unnoticed.
+type segmentCipher struct {
+    aead    cipher.AEAD
+    prefix  []byte
+    counter uint32
+}
+
+func newSegmentCipher(dataKey, prefix []byte) (*segmentCipher, error) {
+    aead, err := newGCM(dataKey)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create cipher: %w", err)
+    }
+    return &segmentCipher{aead: aead, prefix: prefix}, nil
+}
+
+func (c *segmentCipher) nonce(last bool) []byte {
+    nonce := make([]byte, c.aead.NonceSize())
+    copy(nonce, c.prefix)
+    binary.BigEndian.PutUint32(nonce[noncePrefixSize:], c.counter)
+    if last {
+        nonce[len(nonce)-1] = 1
+    }
+    c.counter++
+    return nonce
+}
+
+func (c *segmentCipher) seal(dst, plaintext []byte, last bool) []byte {
+    return c.aead.Seal(dst, c.nonce(last), plaintext, nil)
+}
+
+func (c *segmentCipher) open(dst, ciphertext []byte, last bool) ([]byte, error) {
+    plaintext, err := c.aead.Open(dst, c.nonce(last), ciphertext, nil)
+    if err != nil {
+        return nil, ErrDecryptionFailed
+    }
+    return plaintext, nil
+}
+
+// sealReader encrypts a reader segment by segment
+type sealReader struct {
+    src            *bufio.Reader
+    cipher         *segmentCipher
+    plain          []byte
+    sealed         []byte
+    pending        []byte
+    done           bool
+    plaintextBytes int64
+}
+
+func newSealReader(src io.Reader, segments *segmentCipher) *sealReader {
+    return &sealReader{
+        src:    bufio.NewReader(src),
+        cipher: segments,
+        plain:  make([]byte, encryptionSegmentSize),
+    }
+}
+
+func (r *sealReader) Read(p []byte) (int, error) {
+    for len(r.pending) == 0 {
+        if r.done {
+            return 0, io.EOF
+        }
+        n, err := io.ReadFull(r.src, r.plain)
+        if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            return 0, err
+        }
+        r.plaintextBytes += int64(n)
+        last := n < len(r.plain)
+        if !last {
+            if _, err := r.src.Peek(1); err == io.EOF {
+                last = true
+            } else if err != nil {
+                return 0, err
+            }
+        }
+        r.sealed = r.cipher.seal(r.sealed[:0], r.plain[:n], last)
+        r.pending = r.sealed
+        r.done = last
+    }
+    n := copy(p, r.pending)
+    r.pending = r.pending[n:]
+    return n, nil
+}
+
+// openWriter decrypts segments written to it into dst. A full segment is
+// only opened once more data follows, since the final segment is sealed
+// with its own nonce. partial is set when the segments written stop short
+// of the end of the object.
+type openWriter struct {
+    dst     io.Writer
+    cipher  *segmentCipher
+    partial bool
+    buf     []byte
+    plain   []byte
+}
+
+func (w *openWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        if len(w.buf) == encryptionSegmentSize+encryptionOverhead {
+            if err := w.flush(false); err != nil {
+                return written, err
+            }
+        }
+        n := min(len(p), encryptionSegmentSize+encryptionOverhead-len(w.buf))
+        w.buf = append(w.buf, p[:n]...)
+        p = p[n:]
+        written += n
+    }
+    return written, nil
+}
+
+func (w *openWriter) flush(last bool) error {
+    plaintext, err := w.cipher.open(w.plain[:0], w.buf, last)
+    if err != nil {
+        return err
+    }
+    w.plain = plaintext
+    w.buf = w.buf[:0]
+    _, err = w.dst.Write(plaintext)
+    return err
+}
+
+// Close opens the final segment
+func (w *openWriter) Close() error {
+    if len(w.buf) < encryptionOverhead {
+        return ErrDecryptionFailed
+    }
+    return w.flush(!w.partial)
+}
+
+// rangeWriter passes on remaining bytes after skipping the first skip bytes
+type rangeWriter struct {
+    dst       io.Writer
+    skip      int64
+    remaining int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+    n := len(p)
+    skipped := min(int64(len(p)), w.skip)
+    w.skip -= skipped
+    p = p[skipped:]
+    if int64(len(p)) > w.remaining {
+        p = p[:w.remaining]
+    }
+    if len(p) > 0 {
+        if _, err := w.dst.Write(p); err != nil {
+            return 0, err
+        }
+        w.remaining -= int64(len(p))
+    }
+    return n, nil
+}
@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/base64"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+// newKeySpec returns fresh master keys with the given IDs as id:base64key pairs
+func newKeySpec(t *testing.T, ids ...string) string {
+    var keys []string
+    for _, id := range ids {
+        key := make([]byte, 32)
+        _, err := rand.Read(key)
+        require.NoError(t, err)
+        keys = append(keys, id+":"+base64.StdEncoding.EncodeToString(key))
+    }
+    return strings.Join(keys, ",")
+}
+
+// plainBackend hides every capability of a backend beyond StorageService
+type plainBackend struct {
+    storage.StorageService
+}
+
+func TestEncryptedStorage(t *testing.T) {
+    keys, err := storage.LoadKeyRing(newKeySpec(t, "a"), "", "")
+    require.NoError(t, err)
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        return storage.NewEncryptedStorageService(storage.NewMemoryStorageService(""), keys, "http://localhost:8080", "test-signing-key")
+    })
+}
+
+func TestEncryptedStorageRotateKeys(t *testing.T) {
+    ctx := context.Background()
+    spec := newKeySpec(t, "old", "new")
+    oldKeys, err := storage.LoadKeyRing(spec, "", "old")
+    require.NoError(t, err)
+    newKeys, err := storage.LoadKeyRing(spec, "", "new")
+    require.NoError(t, err)
+    backend := storage.NewMemoryStorageService("")
+    data := []byte("rotate me")
+    result, err := storage.NewEncryptedStorageService(backend, oldKeys, "", "").UploadFromReader(ctx, bytes.NewReader(data), "notes.txt", "text/plain", int64(len(data)), nil)
+    require.NoError(t, err)
+
+    rotated, err := storage.NewEncryptedStorageService(backend, newKeys, "", "").RotateKeys(ctx, "")
+    require.NoError(t, err)
+    assert.Equal(t, 1, rotated)
+
+    // The retired key is no longer needed to read the object
+    onlyNew, err := storage.LoadKeyRing(strings.Split(spec, ",")[1], "", "")
+    require.NoError(t, err)
+    got, err := storage.NewEncryptedStorageService(backend, onlyNew, "", "").Download(ctx, result.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, data, got)
+}
+
+func TestEncryptedStorageRotateKeysUnsupported(t *testing.T) {
+    ctx := context.Background()
+    spec := newKeySpec(t, "old", "new")
+    oldKeys, err := storage.LoadKeyRing(spec, "", "old")
+    require.NoError(t, err)
+    newKeys, err := storage.LoadKeyRing(spec, "", "new")
+    require.NoError(t, err)
+    replicated, err := storage.NewReplicatedStorageService(plainBackend{storage.NewMemoryStorageService("")}, nil, storage.ReplicationSync)
+    require.NoError(t, err)
+    _, err = storage.NewEncryptedStorageService(replicated, oldKeys, "", "").UploadFromReader(ctx, strings.NewReader("data"), "notes.txt", "text/plain", 4, nil)
+    require.NoError(t, err)
+
+    // The replication decorator can't update metadata the primary can't
+    err = replicated.UpdateMetadata(ctx, "missing.txt", nil)
+    assert.ErrorIs(t, err, storage.ErrMetadataUnsupported)
+    _, err = storage.NewEncryptedStorageService(replicated, newKeys, "", "").RotateKeys(ctx, "")
+    assert.ErrorIs(t, err, storage.ErrRotationUnsupported)
+    assert.NotEqual(t, storage.ErrMetadataUnsupported.Error(), storage.ErrRotationUnsupported.Error())
+}
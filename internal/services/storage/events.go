@@ -0,0 +1,271 @@
+package storage
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+)
+
+// Storage event types
+const (
+    EventObjectCreated = "object.created"
+    EventObjectDeleted = "object.deleted"
+    EventObjectCopied  = "object.copied"
+    EventObjectMoved   = "object.moved"
+)
+
+// Event describes a change to a stored object
+type Event struct {
+    ID          uuid.UUID `json:"id"`
+    Type        string    `json:"type"`
+    StorageKey  string    `json:"storage_key"`
+    SourceKey   string    `json:"source_key,omitempty"` // copies and moves
+    Size        int64     `json:"size"`
+    ContentType string    `json:"content_type,omitempty"`
+    UserID      uuid.UUID `json:"user_id,omitempty"`
+    Time        time.Time `json:"time"`
+}
+
+// EventSubscriber receives storage events. HandleEvent runs on the path of
+// the write that caused the event, so subscribers with slow work should
+// queue it. Errors are logged and never fail the write.
+type EventSubscriber interface {
+    HandleEvent(ctx context.Context, event Event) error
+}
+
+// EventSubscriberFunc adapts an in-process callback to EventSubscriber
+type EventSubscriberFunc func(ctx context.Context, event Event) error
+
+func (f EventSubscriberFunc) HandleEvent(ctx context.Context, event Event) error {
+    return f(ctx, event)
+}
+
+type subscription struct {
+    name       string
+    subscriber EventSubscriber
+    types      []string
+}
+
+// EventStorageService emits an Event to its subscribers after every
+// successful upload, copy, move and delete made through it. Uploads that
+// bypass the storage service, such as presigned and multipart uploads, are
+// announced with Publish once they are confirmed.
+type EventStorageService struct {
+    StorageService
+    mu            sync.RWMutex
+    subscriptions []subscription
+}
+
+// NewEventStorageService wraps backend with event publishing
+func NewEventStorageService(backend StorageService) *EventStorageService {
+    return &EventStorageService{
+        StorageService: backend,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *EventStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// Subscribe registers subscriber for events of the given types, or for every
+// event when no type is given. name identifies it in logs.
+func (s *EventStorageService) Subscribe(name string, subscriber EventSubscriber, types ...string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.subscriptions = append(s.subscriptions, subscription{name: name, subscriber: subscriber, types: types})
+}
+
+// Publish stamps event with an ID and time and hands it to the subscribers
+func (s *EventStorageService) Publish(ctx context.Context, event Event) {
+    if event.ID == uuid.Nil {
+        event.ID, _ = uuid.NewV7()
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now().UTC()
+    }
+    if event.UserID == uuid.Nil {
+        event.UserID = keyOwner(event.StorageKey)
+    }
+    s.mu.RLock()
+    subscriptions := s.subscriptions
+    s.mu.RUnlock()
+    for _, sub := range subscriptions {
+        if len(sub.types) > 0 && !slices.Contains(sub.types, event.Type) {
+            continue
+        }
+        if err := sub.subscriber.HandleEvent(ctx, event); err != nil {
+            log.Warn().Err(err).Str("subscriber", sub.name).Str("event", event.Type).Str("storage_key", event.StorageKey).Msg("Storage event subscriber failed")
+        }
+    }
+}
+
+// Upload stores a multipart file and emits object.created
+func (s *EventStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    result, err := s.StorageService.Upload(ctx, file, header, opts)
+    if err != nil {
+        return nil, err
+    }
+    s.publishUpload(ctx, result, opts)
+    return result, nil
+}
+
+// UploadFromReader stores data and emits object.created
+func (s *EventStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    result, err := s.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, opts)
+    if err != nil {
+        return nil, err
+    }
+    s.publishUpload(ctx, result, opts)
+    return result, nil
+}
+
+func (s *EventStorageService) publishUpload(ctx context.Context, result *UploadResult, opts *UploadOptions) {
+    event := Event{
+        Type:        EventObjectCreated,
+        StorageKey:  result.StorageKey,
+        Size:        result.FileSize,
+        ContentType: result.ContentType,
+    }
+    if opts != nil {
+        event.UserID = opts.UserID
+    }
+    s.Publish(ctx, event)
+}
+
+// Copy copies an object and emits object.copied
+func (s *EventStorageService) Copy(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.StorageService.Copy(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    s.publishTransfer(ctx, EventObjectCopied, sourceKey, destKey)
+    return nil
+}
+
+// Move moves an object and emits object.moved
+func (s *EventStorageService) Move(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.StorageService.Move(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    s.publishTransfer(ctx, EventObjectMoved, sourceKey, destKey)
+    return nil
+}
+
+func (s *EventStorageService) publishTransfer(ctx context.Context, eventType, sourceKey, destKey string) {
+    event := Event{Type: eventType, StorageKey: destKey, SourceKey: sourceKey}
+    if metadata, err := s.StorageService.GetMetadata(ctx, destKey); err == nil {
+        event.Size = metadata.FileSize
+        event.ContentType = metadata.ContentType
+    }
+    s.Publish(ctx, event)
+}
+
+// Delete deletes an object and emits object.deleted with the size and content
+// type it had
+func (s *EventStorageService) Delete(ctx context.Context, storageKey string) error {
+    event, ok := s.deleteEvent(ctx, storageKey)
+    if err := s.StorageService.Delete(ctx, storageKey); err != nil {
+        return err
+    }
+    if ok {
+        s.publishDeleted(ctx, []Event{event})
+    }
+    return nil
+}
+
+// DeleteMultiple deletes several objects and emits object.deleted for each
+func (s *EventStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    events := make([]Event, 0, len(storageKeys))
+    for _, key := range storageKeys {
+        if event, ok := s.deleteEvent(ctx, key); ok {
+            events = append(events, event)
+        }
+    }
+    if err := s.StorageService.DeleteMultiple(ctx, storageKeys); err != nil {
+        return err
+    }
+    s.publishDeleted(ctx, events)
+    return nil
+}
+
+// publishDeleted emits the events of objects that are really gone. A shared
+// blob survives its delete while other references remain.
+func (s *EventStorageService) publishDeleted(ctx context.Context, events []Event) {
+    for _, event := range events {
+        if exists, err := s.StorageService.Exists(ctx, event.StorageKey); err == nil && !exists {
+            s.Publish(ctx, event)
+        }
+    }
+}
+
+// deleteEvent describes an object about to be deleted. It reports false
+// for keys that don't exist, whose delete emits nothing.
+func (s *EventStorageService) deleteEvent(ctx context.Context, storageKey string) (Event, bool) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if errors.Is(err, ErrObjectNotFound) {
+        return Event{}, false
+    }
+    event := Event{Type: EventObjectDeleted, StorageKey: storageKey}
+    if err == nil {
+        event.Size = metadata.FileSize
+        event.ContentType = metadata.ContentType
+    }
+    return event, true
+}
+
+// keyOwner returns the user a key generated by NewStorageKey was stored for
+func keyOwner(storageKey string) uuid.UUID {
+    for _, segment := range strings.SplitN(storageKey, "/", 3) {
+        if id, err := uuid.Parse(segment); err == nil {
+            return id
+        }
+    }
+    return uuid.Nil
+}
+
+// RedisStreamSubscriber appends events to a Redis stream, where consumer
+// groups in other services can read them
+type RedisStreamSubscriber struct {
+    redis  *redis.Client
+    stream string
+    maxLen int64
+}
+
+// NewRedisStreamSubscriber appends events to stream, trimmed to about maxLen
+// entries. A maxLen of 0 keeps every entry.
+func NewRedisStreamSubscriber(redisClient *redis.Client, stream string, maxLen int64) *RedisStreamSubscriber {
+    return &RedisStreamSubscriber{
+        redis:  redisClient,
+        stream: stream,
+        maxLen: maxLen,
+    }
+}
+
+// HandleEvent adds event to the stream with its type and JSON encoding
+func (s *RedisStreamSubscriber) HandleEvent(ctx context.Context, event Event) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    err = s.redis.XAdd(ctx, &redis.XAddArgs{
+        Stream: s.stream,
+        MaxLen: s.maxLen,
+        Approx: s.maxLen > 0,
+        Values: map[string]interface{}{"type": event.Type, "data": data},
+    }).Err()
+    if err != nil {
+        return fmt.Errorf("failed to add event to stream %s: %w", s.stream, err)
+    }
+    return nil
+}
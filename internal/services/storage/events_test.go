@@ -0,0 +1,45 @@
+package storage_test
+
+import (
+    "context"
+    "testing"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+func TestEventStorage(t *testing.T) {
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        return storage.NewEventStorageService(storage.NewMemoryStorageService(""))
+    })
+}
+
+func TestEventsOnDelete(t *testing.T) {
+    ctx := context.Background()
+    events := storage.NewEventStorageService(storage.NewMemoryStorageService(""))
+    var deleted []storage.Event
+    events.Subscribe("test", storage.EventSubscriberFunc(func(ctx context.Context, event storage.Event) error {
+        deleted = append(deleted, event)
+        return nil
+    }), storage.EventObjectDeleted)
+    userID := uuid.New()
+    first := uploadText(t, events, userID, "a.txt", "first")
+    second := uploadText(t, events, userID, "b.txt", "second")
+
+    require.NoError(t, events.Delete(ctx, first.StorageKey))
+    require.Len(t, deleted, 1)
+    assert.Equal(t, first.StorageKey, deleted[0].StorageKey)
+    assert.Equal(t, int64(5), deleted[0].Size)
+    assert.Equal(t, "text/plain", deleted[0].ContentType)
+    assert.Equal(t, userID, deleted[0].UserID)
+
+    // Keys that don't exist are not announced
+    require.NoError(t, events.Delete(ctx, first.StorageKey))
+    require.NoError(t, events.DeleteMultiple(ctx, []string{first.StorageKey, second.StorageKey, "uploads/missing.txt"}))
+    require.Len(t, deleted, 2)
+    assert.Equal(t, second.StorageKey, deleted[1].StorageKey)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
     "context"
+    "errors"
     "io"
     "mime/multipart"
     "time"
@@ -16,6 +17,9 @@ type StorageService interface {
     UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error)
     Download(ctx context.Context, storageKey string) ([]byte, error)
     DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error
+    // DownloadRange streams length bytes of an object starting at offset into
+    // writer. A negative length reads to the end of the object.
+    DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error
     Delete(ctx context.Context, storageKey string) error
     DeleteMultiple(ctx context.Context, storageKeys []string) error
     GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error)
@@ -25,9 +29,42 @@ type StorageService interface {
     Copy(ctx context.Context, sourceKey, destKey string) error
     Move(ctx context.Context, sourceKey, destKey string) error
     ListFiles(ctx context.Context, prefix string, limit int) ([]*FileInfo, error)
+    // ListFilesPage lists one page of the objects under prefix in key order.
+    // Pass the NextContinuationToken of a page to get the next one.
+    ListFilesPage(ctx context.Context, prefix string, opts ListOptions) (*FileList, error)
     GetStorageURL(storageKey string) string
 }
 
+// Backend walks a chain of storage decorators and returns the first service
+// that is a T, so optional capabilities of a backend stay reachable when it
+// is wrapped. Decorators expose what they wrap through Unwrap.
+func Backend[T any](svc StorageService) (T, bool) {
+    for svc != nil {
+        if backend, ok := svc.(T); ok {
+            return backend, true
+        }
+        wrapper, ok := svc.(interface{ Unwrap() StorageService })
+        if !ok {
+            break
+        }
+        svc = wrapper.Unwrap()
+    }
+    var zero T
+    return zero, false
+}
+
+// Base returns the backend at the bottom of a chain of storage decorators,
+// which lists every object, including those the decorators hide
+func Base(svc StorageService) StorageService {
+    for {
+        wrapper, ok := svc.(interface{ Unwrap() StorageService })
+        if !ok {
+            return svc
+        }
+        svc = wrapper.Unwrap()
+    }
+}
+
 // UploadOptions contains options for file upload
 // ...existing code...
 type UploadOptions struct {
@@ -41,6 +78,18 @@ type UploadOptions struct {
     Metadata map[string]string
     ACL string
     CacheControl string
+    // StripMetadata sanitizes images: orientation is applied and EXIF, XMP
+    // and ICC data are removed before the image is stored
+    StripMetadata bool
+    // KeepColorProfile keeps the ICC profile when StripMetadata is set
+    KeepColorProfile bool
+    // Derivatives are rendered from image uploads, except lazy profiles
+    Derivatives []DerivativeProfile
+    // StorageKey stores the upload under this exact key instead of a generated one
+    StorageKey string
+    // SkipVersion overwrites StorageKey without keeping the contents it
+    // replaces as a version
+    SkipVersion bool
 }
 
 // UploadResult contains the result of a file upload
@@ -56,6 +105,7 @@ type UploadResult struct {
     Width        int
     Height       int
     Metadata     map[string]string
+    Derivatives  []Derivative
 }
 
 // FileMetadata contains metadata about a stored file
@@ -68,6 +118,7 @@ type FileMetadata struct {
     LastModified time.Time
     ETag         string
     Metadata     map[string]string
+    SHA256       string // set for content-addressed objects
 }
 
 // FileInfo contains basic information about a file
@@ -87,6 +138,12 @@ const (
     DefaultCacheControl    = "max-age=31536000"
 )
 
+// ErrObjectNotFound is wrapped by backends when a storage key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrInvalidRange is wrapped by DownloadRange when offset is outside the object
+var ErrInvalidRange = errors.New("range not satisfiable")
+
 // NewUploadOptions creates default upload options
 func NewUploadOptions() *UploadOptions {
     return &UploadOptions{
@@ -96,5 +153,6 @@ func NewUploadOptions() *UploadOptions {
         ACL:               DefaultACL,
         CacheControl:      DefaultCacheControl,
         Metadata:          make(map[string]string),
+        StripMetadata:     true,
     }
 }
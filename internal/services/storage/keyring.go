@@ -0,0 +1,77 @@
+package storage
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// MasterKeySize is the length of master keys, which are AES-256 keys
+const MasterKeySize = 32
+
+var ErrUnknownMasterKey = errors.New("unknown master key")
+
+// KeyRing holds the master keys data keys are wrapped with. New objects are
+// wrapped with the active key; retired keys stay in the ring so objects
+// wrapped with them can still be read until they are rotated.
+type KeyRing struct {
+    keys   map[string][]byte
+    active string
+}
+
+// LoadKeyRing parses master keys of the form id:base64key separated by
+// commas or newlines from spec and from the file at keyFile. The active key
+// defaults to the first key listed.
+func LoadKeyRing(spec, keyFile, active string) (*KeyRing, error) {
+    if keyFile != "" {
+        data, err := os.ReadFile(keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read key file: %w", err)
+        }
+        spec = spec + "\n" + string(data)
+    }
+    ring := &KeyRing{keys: make(map[string][]byte), active: active}
+    for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+        entry = strings.TrimSpace(entry)
+        if entry == "" || strings.HasPrefix(entry, "#") {
+            continue
+        }
+        id, encoded, ok := strings.Cut(entry, ":")
+        if !ok || id == "" {
+            return nil, fmt.Errorf("invalid master key entry %q", id)
+        }
+        key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+        if err != nil || len(key) != MasterKeySize {
+            return nil, fmt.Errorf("master key %s must be %d base64 encoded bytes", id, MasterKeySize)
+        }
+        if _, ok := ring.keys[id]; ok {
+            return nil, fmt.Errorf("duplicate master key %s", id)
+        }
+        ring.keys[id] = key
+        if ring.active == "" {
+            ring.active = id
+        }
+    }
+    if len(ring.keys) == 0 {
+        return nil, errors.New("no master keys configured")
+    }
+    if _, ok := ring.keys[ring.active]; !ok {
+        return nil, fmt.Errorf("%w: active key %s", ErrUnknownMasterKey, ring.active)
+    }
+    return ring, nil
+}
+
+// ActiveKeyID returns the ID of the key new data keys are wrapped with
+func (r *KeyRing) ActiveKeyID() string {
+    return r.active
+}
+
+func (r *KeyRing) key(id string) ([]byte, error) {
+    key, ok := r.keys[id]
+    if !ok {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownMasterKey, id)
+    }
+    return key, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+    "context"
+    "encoding/base64"
+    "errors"
+    "sort"
+)
+
+const (
+    // DefaultListLimit is the page size of ListFilesPage when none is given
+    DefaultListLimit = 1000
+    // MaxListLimit is the largest page ListFilesPage returns, as on S3
+    MaxListLimit = 1000
+)
+
+var ErrInvalidListToken = errors.New("invalid continuation token")
+
+// ListOptions selects one page of a listing
+type ListOptions struct {
+    Limit             int    // objects per page, DefaultListLimit when 0
+    ContinuationToken string // NextContinuationToken of the previous page
+}
+
+// FileList is one page of objects, in key order
+type FileList struct {
+    Files                 []*FileInfo
+    NextContinuationToken string // empty on the last page
+}
+
+// ListAll calls fn with each page of the objects under prefix until the
+// listing ends or fn returns an error
+func ListAll(ctx context.Context, svc StorageService, prefix string, fn func(files []*FileInfo) error) error {
+    opts := ListOptions{}
+    for {
+        page, err := svc.ListFilesPage(ctx, prefix, opts)
+        if err != nil {
+            return err
+        }
+        if err := fn(page.Files); err != nil {
+            return err
+        }
+        if page.NextContinuationToken == "" {
+            return nil
+        }
+        opts.ContinuationToken = page.NextContinuationToken
+    }
+}
+
+// EncodeListToken returns the continuation token of a listing that stopped
+// at storageKey. Tokens hold the last key returned, so every backend and
+// decorator can resume a listing the same way.
+func EncodeListToken(storageKey string) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(storageKey))
+}
+
+// DecodeListToken returns the key a listing resumes after
+func DecodeListToken(token string) (string, error) {
+    if token == "" {
+        return "", nil
+    }
+    key, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil || len(key) == 0 {
+        return "", ErrInvalidListToken
+    }
+    return string(key), nil
+}
+
+// listLimit clamps a requested page size
+func listLimit(limit int) int {
+    if limit <= 0 {
+        return DefaultListLimit
+    }
+    return min(limit, MaxListLimit)
+}
+
+// pageFiles cuts one page out of a complete listing, for backends that
+// can't list from a position themselves
+func pageFiles(files []*FileInfo, opts ListOptions) (*FileList, error) {
+    after, err := DecodeListToken(opts.ContinuationToken)
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i].StorageKey < files[j].StorageKey })
+    start := sort.Search(len(files), func(i int) bool { return files[i].StorageKey > after })
+    files = files[start:]
+    page := &FileList{Files: files}
+    if limit := listLimit(opts.Limit); len(files) > limit {
+        page.Files = files[:limit]
+        page.NextContinuationToken = EncodeListToken(files[limit-1].StorageKey)
+    }
+    return page, nil
+}
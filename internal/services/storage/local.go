@@ -0,0 +1,768 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "mime/multipart"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+)
+
+const (
+    // LocalFileRoute is the path prefix the local backend serves files under
+    LocalFileRoute = "/storage/files"
+    // LocalUploadRoute is the path prefix the local backend accepts direct uploads under
+    LocalUploadRoute = "/storage/uploads"
+
+    localMetaDir = ".meta"
+    localTempDir = ".tmp"
+)
+
+// LocalStorageService implements StorageService on the local filesystem.
+// Object metadata is kept in JSON sidecars under root/.meta so that
+// content type, ACL and user metadata survive restarts.
+type LocalStorageService struct {
+    root    string
+    baseURL string
+    signer  *URLSigner
+}
+
+// localObjectMeta is the sidecar persisted next to every stored object
+type localObjectMeta struct {
+    FileName     string            `json:"file_name"`
+    ContentType  string            `json:"content_type"`
+    ETag         string            `json:"etag"`
+    ACL          string            `json:"acl,omitempty"`
+    CacheControl string            `json:"cache_control,omitempty"`
+    Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// NewLocalStorageService creates a new local filesystem storage service
+func NewLocalStorageService(root, baseURL, signingKey string) (*LocalStorageService, error) {
+    if root == "" {
+        return nil, fmt.Errorf("local storage root is required")
+    }
+    absRoot, err := filepath.Abs(root)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve storage root: %w", err)
+    }
+    for _, dir := range []string{absRoot, filepath.Join(absRoot, localMetaDir), filepath.Join(absRoot, localTempDir)} {
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+            return nil, fmt.Errorf("failed to create storage directory %s: %w", dir, err)
+        }
+    }
+    service := &LocalStorageService{
+        root:    absRoot,
+        baseURL: strings.TrimRight(baseURL, "/"),
+        signer:  NewURLSigner(signingKey),
+    }
+    log.Info().Str("root", absRoot).Msg("Local storage service initialized")
+    return service, nil
+}
+
+// objectPath maps a storage key to a file path inside root, rejecting keys
+// that would escape it or collide with the internal directories
+func (s *LocalStorageService) objectPath(storageKey string) (string, error) {
+    clean := strings.TrimPrefix(path.Clean("/"+storageKey), "/")
+    if clean == "" || clean == "." {
+        return "", fmt.Errorf("invalid storage key %q", storageKey)
+    }
+    first := strings.SplitN(clean, "/", 2)[0]
+    if first == localMetaDir || first == localTempDir {
+        return "", fmt.Errorf("invalid storage key %q", storageKey)
+    }
+    return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStorageService) metaPath(storageKey string) (string, error) {
+    clean := strings.TrimPrefix(path.Clean("/"+storageKey), "/")
+    if clean == "" || clean == "." {
+        return "", fmt.Errorf("invalid storage key %q", storageKey)
+    }
+    return filepath.Join(s.root, localMetaDir, filepath.FromSlash(clean)+".json"), nil
+}
+
+func (s *LocalStorageService) readMeta(storageKey string) (*localObjectMeta, error) {
+    metaPath, err := s.metaPath(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(metaPath)
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return &localObjectMeta{
+                FileName:    path.Base(storageKey),
+                ContentType: detectContentType(storageKey),
+            }, nil
+        }
+        return nil, fmt.Errorf("failed to read metadata for %s: %w", storageKey, err)
+    }
+    var meta localObjectMeta
+    if err := json.Unmarshal(data, &meta); err != nil {
+        return nil, fmt.Errorf("failed to parse metadata for %s: %w", storageKey, err)
+    }
+    return &meta, nil
+}
+
+func (s *LocalStorageService) writeMeta(storageKey string, meta *localObjectMeta) error {
+    metaPath, err := s.metaPath(storageKey)
+    if err != nil {
+        return err
+    }
+    data, err := json.Marshal(meta)
+    if err != nil {
+        return fmt.Errorf("failed to encode metadata for %s: %w", storageKey, err)
+    }
+    if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+        return fmt.Errorf("failed to create metadata directory: %w", err)
+    }
+    return os.WriteFile(metaPath, data, 0o644)
+}
+
+// writeObject streams reader into the object file through a temp file so
+// readers never observe a partially written object
+func (s *LocalStorageService) writeObject(storageKey string, reader io.Reader) (int64, string, error) {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return 0, "", err
+    }
+    if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+        return 0, "", fmt.Errorf("failed to create directory for %s: %w", storageKey, err)
+    }
+    tmp, err := os.CreateTemp(filepath.Join(s.root, localTempDir), "upload-*")
+    if err != nil {
+        return 0, "", fmt.Errorf("failed to create temp file: %w", err)
+    }
+    defer os.Remove(tmp.Name())
+    hash := md5.New()
+    size, err := io.Copy(io.MultiWriter(tmp, hash), reader)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return 0, "", fmt.Errorf("failed to write %s: %w", storageKey, err)
+    }
+    if err := os.Rename(tmp.Name(), objectPath); err != nil {
+        return 0, "", fmt.Errorf("failed to store %s: %w", storageKey, err)
+    }
+    return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *LocalStorageService) store(storageKey string, reader io.Reader, contentType string, opts *UploadOptions) (*UploadResult, error) {
+    size, etag, err := s.writeObject(storageKey, reader)
+    if err != nil {
+        return nil, err
+    }
+    meta := &localObjectMeta{
+        FileName:     path.Base(storageKey),
+        ContentType:  contentType,
+        ETag:         etag,
+        ACL:          opts.ACL,
+        CacheControl: opts.CacheControl,
+        Metadata:     opts.Metadata,
+    }
+    if err := s.writeMeta(storageKey, meta); err != nil {
+        return nil, err
+    }
+    objectPath, _ := s.objectPath(storageKey)
+    return &UploadResult{
+        StorageKey:  storageKey,
+        StoragePath: objectPath,
+        URL:         s.GetStorageURL(storageKey),
+        FileName:    meta.FileName,
+        FileSize:    size,
+        ContentType: contentType,
+        Metadata:    opts.Metadata,
+    }, nil
+}
+
+// Upload stores a multipart file on disk
+func (s *LocalStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    contentType := header.Header.Get("Content-Type")
+    if opts != nil {
+        contentType = detectContentType(header.Filename, opts.ContentType, contentType)
+    }
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader stores data from a reader on disk
+func (s *LocalStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    contentType = detectContentType(filename, opts.ContentType, contentType)
+    storageKey := generateStorageKey(opts, filename)
+    var data []byte
+    if isImageContentType(contentType) {
+        // Images are buffered so they can be sanitized and their dimensions
+        // and thumbnails derived
+        var err error
+        if data, err = io.ReadAll(reader); err != nil {
+            return nil, fmt.Errorf("failed to read data: %w", err)
+        }
+        if data, opts, err = sanitizeUpload(data, contentType, opts); err != nil {
+            return nil, err
+        }
+        reader = bytes.NewReader(data)
+    }
+    result, err := s.store(storageKey, reader, contentType, opts)
+    if err != nil {
+        return nil, err
+    }
+    if data != nil {
+        result.Width, result.Height = imageDimensions(data)
+        result.Derivatives = generateDerivatives(ctx, s, storageKey, data, opts.Derivatives)
+        if opts.GenerateThumbnail {
+            if thumb, err := s.storeThumbnail(storageKey, bytes.NewReader(data), opts); err != nil {
+                log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to generate thumbnail")
+            } else {
+                result.ThumbnailURL = thumb.URL
+            }
+        }
+    }
+    log.Info().Str("storage_key", storageKey).Int64("size", result.FileSize).Str("content_type", contentType).Msg("File stored locally")
+    return result, nil
+}
+
+func (s *LocalStorageService) storeThumbnail(storageKey string, reader io.Reader, opts *UploadOptions) (*UploadResult, error) {
+    thumb, err := createThumbnail(reader, storageKey, opts.ThumbnailWidth, opts.ThumbnailHeight)
+    if err != nil {
+        return nil, err
+    }
+    key := thumbnailKey(storageKey)
+    result, err := s.store(key, bytes.NewReader(thumb), detectContentType(key), opts)
+    if err != nil {
+        return nil, err
+    }
+    result.Width, result.Height = imageDimensions(thumb)
+    return result, nil
+}
+
+// Download reads a whole object into memory
+func (s *LocalStorageService) Download(ctx context.Context, storageKey string) ([]byte, error) {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(objectPath)
+    if err != nil {
+        return nil, localError("read", storageKey, err)
+    }
+    return data, nil
+}
+
+// DownloadToWriter streams an object into writer
+func (s *LocalStorageService) DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error {
+    file, err := s.Open(storageKey)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    if _, err := io.Copy(writer, file); err != nil {
+        return fmt.Errorf("failed to read %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// DownloadRange streams part of an object into writer
+func (s *LocalStorageService) DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error {
+    file, err := s.Open(storageKey)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %w", storageKey, err)
+    }
+    if length, err = rangeLength(storageKey, offset, length, info.Size()); err != nil {
+        return err
+    }
+    if _, err := io.Copy(writer, io.NewSectionReader(file, offset, length)); err != nil {
+        return fmt.Errorf("failed to read %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// Open opens an object for reading
+func (s *LocalStorageService) Open(storageKey string) (*os.File, error) {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    file, err := os.Open(objectPath)
+    if err != nil {
+        return nil, localError("open", storageKey, err)
+    }
+    return file, nil
+}
+
+// Delete removes an object and its metadata. Deleting a missing object is not an error.
+func (s *LocalStorageService) Delete(ctx context.Context, storageKey string) error {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return fmt.Errorf("failed to delete %s: %w", storageKey, err)
+    }
+    if metaPath, err := s.metaPath(storageKey); err == nil {
+        os.Remove(metaPath)
+    }
+    log.Debug().Str("storage_key", storageKey).Msg("File deleted from local storage")
+    return nil
+}
+
+// DeleteMultiple removes several objects
+func (s *LocalStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    var failed []string
+    for _, key := range storageKeys {
+        if err := s.Delete(ctx, key); err != nil {
+            failed = append(failed, key)
+        }
+    }
+    if len(failed) > 0 {
+        return fmt.Errorf("failed to delete %d objects: %s", len(failed), strings.Join(failed, ", "))
+    }
+    return nil
+}
+
+// GeneratePresignedURL creates a signed download URL served by LocalFileRoute
+func (s *LocalStorageService) GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error) {
+    if _, err := s.objectPath(storageKey); err != nil {
+        return "", err
+    }
+    return s.signer.SignURL(s.baseURL, s.filePath(storageKey), expiry), nil
+}
+
+// VerifyAccess checks that a request for storageKey is allowed, either because
+// the object is public-read or because expires/signature are a valid signature
+func (s *LocalStorageService) VerifyAccess(storageKey, expires, signature string) error {
+    if signature == "" {
+        meta, err := s.readMeta(storageKey)
+        if err == nil && meta.ACL == "public-read" {
+            return nil
+        }
+        return ErrSignatureInvalid
+    }
+    return s.signer.Verify(s.filePath(storageKey), expires, signature)
+}
+
+// PresignUpload creates a signed URL that LocalUploadRoute accepts a direct
+// upload of storageKey on, bound to the policy content type and size
+func (s *LocalStorageService) PresignUpload(ctx context.Context, storageKey string, policy UploadPolicy) (*PresignedUpload, error) {
+    if _, err := s.objectPath(storageKey); err != nil {
+        return nil, err
+    }
+    uploadPath := LocalUploadRoute + "/" + strings.TrimPrefix(storageKey, "/")
+    expiresAt := time.Now().Add(policy.Expiry)
+    fields := map[string]string{
+        "max_size":  strconv.FormatInt(policy.MaxSize, 10),
+        "expires":   strconv.FormatInt(expiresAt.Unix(), 10),
+        "signature": s.signer.Sign(uploadPolicyString(uploadPath, policy.ContentType, policy.MaxSize), expiresAt),
+    }
+    upload := &PresignedUpload{
+        Method:     policy.Method,
+        URL:        s.baseURL + uploadPath,
+        StorageKey: storageKey,
+        ExpiresAt:  expiresAt,
+    }
+    switch policy.Method {
+    case PresignMethodPut:
+        query := make(url.Values)
+        for k, v := range fields {
+            query.Set(k, v)
+        }
+        upload.URL += "?" + query.Encode()
+        upload.Headers = map[string]string{"Content-Type": policy.ContentType}
+    case PresignMethodPost:
+        fields["Content-Type"] = policy.ContentType
+        upload.Fields = fields
+    default:
+        return nil, fmt.Errorf("unsupported presign method %q", policy.Method)
+    }
+    return upload, nil
+}
+
+// AcceptUpload stores a direct upload after checking it against the policy
+// signed by PresignUpload
+func (s *LocalStorageService) AcceptUpload(storageKey, contentType, maxSize, expires, signature string, reader io.Reader) (*UploadResult, error) {
+    limit, err := strconv.ParseInt(maxSize, 10, 64)
+    if err != nil {
+        return nil, ErrSignatureInvalid
+    }
+    uploadPath := LocalUploadRoute + "/" + strings.TrimPrefix(storageKey, "/")
+    if err := s.signer.Verify(uploadPolicyString(uploadPath, contentType, limit), expires, signature); err != nil {
+        return nil, err
+    }
+    opts := NewUploadOptions()
+    result, err := s.store(storageKey, &policyReader{r: reader, remaining: limit}, contentType, opts)
+    if err != nil {
+        return nil, err
+    }
+    log.Info().Str("storage_key", storageKey).Int64("size", result.FileSize).Msg("Direct upload stored locally")
+    return result, nil
+}
+
+// policyReader fails the read once more than remaining bytes are consumed,
+// so oversized uploads never replace the object
+type policyReader struct {
+    r         io.Reader
+    remaining int64
+}
+
+func (p *policyReader) Read(b []byte) (int, error) {
+    n, err := p.r.Read(b)
+    p.remaining -= int64(n)
+    if p.remaining < 0 {
+        return n, ErrUploadRejected
+    }
+    return n, err
+}
+
+// GenerateThumbnail creates a thumbnail for an image already on disk
+func (s *LocalStorageService) GenerateThumbnail(ctx context.Context, storageKey string, width, height int) (*UploadResult, error) {
+    file, err := s.Open(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    meta, err := s.readMeta(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    opts := NewUploadOptions()
+    opts.ThumbnailWidth = width
+    opts.ThumbnailHeight = height
+    opts.ACL = meta.ACL
+    return s.storeThumbnail(storageKey, file, opts)
+}
+
+// GetMetadata returns the metadata of an object
+func (s *LocalStorageService) GetMetadata(ctx context.Context, storageKey string) (*FileMetadata, error) {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    info, err := os.Stat(objectPath)
+    if err != nil {
+        return nil, localError("stat", storageKey, err)
+    }
+    meta, err := s.readMeta(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    return &FileMetadata{
+        StorageKey:   storageKey,
+        FileName:     meta.FileName,
+        FileSize:     info.Size(),
+        ContentType:  meta.ContentType,
+        LastModified: info.ModTime(),
+        ETag:         meta.ETag,
+        Metadata:     meta.Metadata,
+    }, nil
+}
+
+// UpdateMetadata replaces the user metadata of an object
+func (s *LocalStorageService) UpdateMetadata(ctx context.Context, storageKey string, metadata map[string]string) error {
+    exists, err := s.Exists(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return fmt.Errorf("%w: %s", ErrObjectNotFound, storageKey)
+    }
+    meta, err := s.readMeta(storageKey)
+    if err != nil {
+        return err
+    }
+    meta.Metadata = copyMetadata(metadata)
+    return s.writeMeta(storageKey, meta)
+}
+
+// Exists reports whether an object exists
+func (s *LocalStorageService) Exists(ctx context.Context, storageKey string) (bool, error) {
+    objectPath, err := s.objectPath(storageKey)
+    if err != nil {
+        return false, err
+    }
+    info, err := os.Stat(objectPath)
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return false, nil
+        }
+        return false, fmt.Errorf("failed to check %s: %w", storageKey, err)
+    }
+    return !info.IsDir(), nil
+}
+
+// Copy copies an object and its metadata to destKey
+func (s *LocalStorageService) Copy(ctx context.Context, sourceKey, destKey string) error {
+    source, err := s.Open(sourceKey)
+    if err != nil {
+        return err
+    }
+    defer source.Close()
+    meta, err := s.readMeta(sourceKey)
+    if err != nil {
+        return err
+    }
+    if _, _, err := s.writeObject(destKey, source); err != nil {
+        return err
+    }
+    meta.FileName = path.Base(destKey)
+    return s.writeMeta(destKey, meta)
+}
+
+// Move renames an object and its metadata to destKey
+func (s *LocalStorageService) Move(ctx context.Context, sourceKey, destKey string) error {
+    sourcePath, err := s.objectPath(sourceKey)
+    if err != nil {
+        return err
+    }
+    destPath, err := s.objectPath(destKey)
+    if err != nil {
+        return err
+    }
+    meta, err := s.readMeta(sourceKey)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+        return fmt.Errorf("failed to create directory for %s: %w", destKey, err)
+    }
+    if err := os.Rename(sourcePath, destPath); err != nil {
+        return localError("move", sourceKey, err)
+    }
+    meta.FileName = path.Base(destKey)
+    if err := s.writeMeta(destKey, meta); err != nil {
+        return err
+    }
+    if metaPath, err := s.metaPath(sourceKey); err == nil {
+        os.Remove(metaPath)
+    }
+    return nil
+}
+
+// ListFiles lists up to limit objects whose key starts with prefix, in key order
+func (s *LocalStorageService) ListFiles(ctx context.Context, prefix string, limit int) ([]*FileInfo, error) {
+    walkRoot := s.root
+    if i := strings.LastIndex(prefix, "/"); i > 0 {
+        walkRoot = filepath.Join(s.root, filepath.FromSlash(path.Clean("/" + prefix[:i])))
+    }
+    var files []*FileInfo
+    err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if errors.Is(err, fs.ErrNotExist) {
+                return nil
+            }
+            return err
+        }
+        rel, err := filepath.Rel(s.root, p)
+        if err != nil {
+            return err
+        }
+        key := filepath.ToSlash(rel)
+        if d.IsDir() {
+            if key == localMetaDir || key == localTempDir {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !strings.HasPrefix(key, prefix) {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        files = append(files, &FileInfo{
+            StorageKey:   key,
+            FileName:     d.Name(),
+            FileSize:     info.Size(),
+            LastModified: info.ModTime(),
+        })
+        return nil
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to list files under %s: %w", prefix, err)
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i].StorageKey < files[j].StorageKey })
+    if limit > 0 && len(files) > limit {
+        files = files[:limit]
+    }
+    return files, nil
+}
+
+// ListFilesPage lists one page of the objects under prefix
+func (s *LocalStorageService) ListFilesPage(ctx context.Context, prefix string, opts ListOptions) (*FileList, error) {
+    files, err := s.ListFiles(ctx, prefix, 0)
+    if err != nil {
+        return nil, err
+    }
+    return pageFiles(files, opts)
+}
+
+// GetStorageURL returns the URL an object is served under. Objects that
+// aren't public-read need a signature from GeneratePresignedURL.
+func (s *LocalStorageService) GetStorageURL(storageKey string) string {
+    return s.baseURL + s.filePath(storageKey)
+}
+
+// localError maps missing files to ErrObjectNotFound
+func localError(op, storageKey string, err error) error {
+    if errors.Is(err, fs.ErrNotExist) {
+        return fmt.Errorf("%w: %s", ErrObjectNotFound, storageKey)
+    }
+    return fmt.Errorf("failed to %s %s: %w", op, storageKey, err)
+}
+
+func (s *LocalStorageService) filePath(storageKey string) string {
+    return LocalFileRoute + "/" + strings.TrimPrefix(storageKey, "/")
+}
+
+// multipartDir is where the parts of a multipart upload are staged until completion
+func (s *LocalStorageService) multipartDir(uploadID string) (string, error) {
+    if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+        return "", fmt.Errorf("invalid upload ID %q", uploadID)
+    }
+    return filepath.Join(s.root, localTempDir, "multipart", uploadID), nil
+}
+
+// CreateMultipartUpload stages a new multipart upload in the temp directory
+func (s *LocalStorageService) CreateMultipartUpload(ctx context.Context, storageKey string, contentType string, opts *UploadOptions) (string, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    if _, err := s.objectPath(storageKey); err != nil {
+        return "", err
+    }
+    uploadID := strings.ReplaceAll(uuid.New().String(), "-", "")
+    dir, _ := s.multipartDir(uploadID)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return "", fmt.Errorf("failed to create multipart staging directory: %w", err)
+    }
+    meta := &localObjectMeta{
+        FileName:     path.Base(storageKey),
+        ContentType:  contentType,
+        ACL:          opts.ACL,
+        CacheControl: opts.CacheControl,
+        Metadata:     opts.Metadata,
+    }
+    data, err := json.Marshal(meta)
+    if err != nil {
+        return "", fmt.Errorf("failed to encode metadata for %s: %w", storageKey, err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "upload.json"), data, 0o644); err != nil {
+        return "", fmt.Errorf("failed to write multipart metadata: %w", err)
+    }
+    return uploadID, nil
+}
+
+// UploadPart stages one part of a multipart upload. Re-uploading a part
+// number replaces the earlier part.
+func (s *LocalStorageService) UploadPart(ctx context.Context, storageKey, uploadID string, partNumber int, reader io.Reader, size int64) (*CompletedPart, error) {
+    dir, err := s.multipartDir(uploadID)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := os.Stat(dir); err != nil {
+        return nil, fmt.Errorf("multipart upload %s not found: %w", uploadID, err)
+    }
+    tmp, err := os.CreateTemp(dir, "part-*.tmp")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create part file: %w", err)
+    }
+    defer os.Remove(tmp.Name())
+    hash := md5.New()
+    written, err := io.Copy(io.MultiWriter(tmp, hash), reader)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to write part %d: %w", partNumber, err)
+    }
+    if err := os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("part-%05d", partNumber))); err != nil {
+        return nil, fmt.Errorf("failed to store part %d: %w", partNumber, err)
+    }
+    return &CompletedPart{
+        PartNumber: partNumber,
+        ETag:       hex.EncodeToString(hash.Sum(nil)),
+        Size:       written,
+    }, nil
+}
+
+// CompleteMultipartUpload concatenates the staged parts into the final object
+func (s *LocalStorageService) CompleteMultipartUpload(ctx context.Context, storageKey, uploadID string, parts []CompletedPart) (*UploadResult, error) {
+    dir, err := s.multipartDir(uploadID)
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+    if err != nil {
+        return nil, fmt.Errorf("multipart upload %s not found: %w", uploadID, err)
+    }
+    var meta localObjectMeta
+    if err := json.Unmarshal(data, &meta); err != nil {
+        return nil, fmt.Errorf("failed to parse multipart metadata: %w", err)
+    }
+    sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+    readers := make([]io.Reader, 0, len(parts))
+    for _, part := range parts {
+        file, err := os.Open(filepath.Join(dir, fmt.Sprintf("part-%05d", part.PartNumber)))
+        if err != nil {
+            return nil, fmt.Errorf("part %d of upload %s is missing: %w", part.PartNumber, uploadID, err)
+        }
+        defer file.Close()
+        readers = append(readers, file)
+    }
+    size, etag, err := s.writeObject(storageKey, io.MultiReader(readers...))
+    if err != nil {
+        return nil, err
+    }
+    meta.ETag = etag
+    if err := s.writeMeta(storageKey, &meta); err != nil {
+        return nil, err
+    }
+    if err := os.RemoveAll(dir); err != nil {
+        log.Warn().Err(err).Str("upload_id", uploadID).Msg("Failed to remove multipart staging directory")
+    }
+    objectPath, _ := s.objectPath(storageKey)
+    return &UploadResult{
+        StorageKey:  storageKey,
+        StoragePath: objectPath,
+        URL:         s.GetStorageURL(storageKey),
+        FileName:    meta.FileName,
+        FileSize:    size,
+        ContentType: meta.ContentType,
+        Metadata:    meta.Metadata,
+    }, nil
+}
+
+// AbortMultipartUpload discards the staged parts of a multipart upload
+func (s *LocalStorageService) AbortMultipartUpload(ctx context.Context, storageKey, uploadID string) error {
+    dir, err := s.multipartDir(uploadID)
+    if err != nil {
+        return err
+    }
+    if err := os.RemoveAll(dir); err != nil {
+        return fmt.Errorf("failed to abort multipart upload %s: %w", uploadID, err)
+    }
+    return nil
+}
@@ -0,0 +1,18 @@
+package storage_test
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+func TestLocalStorage(t *testing.T) {
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        service, err := storage.NewLocalStorageService(t.TempDir(), "http://localhost:8080", "test-signing-key")
+        require.NoError(t, err)
+        return service
+    })
+}
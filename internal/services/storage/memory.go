@@ -0,0 +1,398 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "crypto/md5"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// MemoryStorageService implements StorageService in process memory.
+// It is safe for concurrent use and is intended for tests and local tooling.
+type MemoryStorageService struct {
+    baseURL string
+    objects map[string]*memoryObject
+    uploads map[string]*memoryUpload
+    mu      sync.RWMutex
+}
+
+type memoryObject struct {
+    data         []byte
+    contentType  string
+    etag         string
+    lastModified time.Time
+    metadata     map[string]string
+}
+
+type memoryUpload struct {
+    storageKey  string
+    contentType string
+    metadata    map[string]string
+    parts       map[int][]byte
+}
+
+// NewMemoryStorageService creates a new in-memory storage service
+func NewMemoryStorageService(baseURL string) *MemoryStorageService {
+    if baseURL == "" {
+        baseURL = "memory://storage"
+    }
+    return &MemoryStorageService{
+        baseURL: strings.TrimRight(baseURL, "/"),
+        objects: make(map[string]*memoryObject),
+        uploads: make(map[string]*memoryUpload),
+    }
+}
+
+func (s *MemoryStorageService) put(storageKey string, data []byte, contentType string, metadata map[string]string) *memoryObject {
+    sum := md5.Sum(data)
+    object := &memoryObject{
+        data:         data,
+        contentType:  contentType,
+        etag:         hex.EncodeToString(sum[:]),
+        lastModified: time.Now(),
+        metadata:     copyMetadata(metadata),
+    }
+    s.mu.Lock()
+    s.objects[storageKey] = object
+    s.mu.Unlock()
+    return object
+}
+
+func (s *MemoryStorageService) get(storageKey string) (*memoryObject, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    object, ok := s.objects[storageKey]
+    if !ok {
+        return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, storageKey)
+    }
+    return object, nil
+}
+
+// Upload stores a multipart file in memory
+func (s *MemoryStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    contentType := header.Header.Get("Content-Type")
+    if opts != nil {
+        contentType = detectContentType(header.Filename, opts.ContentType, contentType)
+    }
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader stores data from a reader in memory
+func (s *MemoryStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    data, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read data: %w", err)
+    }
+    contentType = detectContentType(filename, opts.ContentType, contentType)
+    storageKey := generateStorageKey(opts, filename)
+    if data, opts, err = sanitizeUpload(data, contentType, opts); err != nil {
+        return nil, err
+    }
+    s.put(storageKey, data, contentType, opts.Metadata)
+    result := &UploadResult{
+        StorageKey:  storageKey,
+        StoragePath: "memory://" + storageKey,
+        URL:         s.GetStorageURL(storageKey),
+        FileName:    path.Base(storageKey),
+        FileSize:    int64(len(data)),
+        ContentType: contentType,
+        Metadata:    opts.Metadata,
+    }
+    if isImageContentType(contentType) {
+        result.Width, result.Height = imageDimensions(data)
+        result.Derivatives = generateDerivatives(ctx, s, storageKey, data, opts.Derivatives)
+        if opts.GenerateThumbnail {
+            if thumb, err := s.storeThumbnail(storageKey, data, opts.ThumbnailWidth, opts.ThumbnailHeight); err == nil {
+                result.ThumbnailURL = thumb.URL
+            }
+        }
+    }
+    return result, nil
+}
+
+func (s *MemoryStorageService) storeThumbnail(storageKey string, data []byte, width, height int) (*UploadResult, error) {
+    thumb, err := createThumbnail(bytes.NewReader(data), storageKey, width, height)
+    if err != nil {
+        return nil, err
+    }
+    key := thumbnailKey(storageKey)
+    contentType := detectContentType(key)
+    s.put(key, thumb, contentType, nil)
+    thumbWidth, thumbHeight := imageDimensions(thumb)
+    return &UploadResult{
+        StorageKey:  key,
+        StoragePath: "memory://" + key,
+        URL:         s.GetStorageURL(key),
+        FileName:    path.Base(key),
+        FileSize:    int64(len(thumb)),
+        ContentType: contentType,
+        Width:       thumbWidth,
+        Height:      thumbHeight,
+    }, nil
+}
+
+// Download returns a copy of an object's contents
+func (s *MemoryStorageService) Download(ctx context.Context, storageKey string) ([]byte, error) {
+    object, err := s.get(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    return append([]byte(nil), object.data...), nil
+}
+
+// DownloadToWriter writes an object's contents to writer
+func (s *MemoryStorageService) DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error {
+    object, err := s.get(storageKey)
+    if err != nil {
+        return err
+    }
+    _, err = writer.Write(object.data)
+    return err
+}
+
+// DownloadRange writes part of an object's contents to writer
+func (s *MemoryStorageService) DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error {
+    object, err := s.get(storageKey)
+    if err != nil {
+        return err
+    }
+    if length, err = rangeLength(storageKey, offset, length, int64(len(object.data))); err != nil {
+        return err
+    }
+    _, err = writer.Write(object.data[offset : offset+length])
+    return err
+}
+
+// Delete removes an object. Deleting a missing object is not an error.
+func (s *MemoryStorageService) Delete(ctx context.Context, storageKey string) error {
+    s.mu.Lock()
+    delete(s.objects, storageKey)
+    s.mu.Unlock()
+    return nil
+}
+
+// DeleteMultiple removes several objects
+func (s *MemoryStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, key := range storageKeys {
+        delete(s.objects, key)
+    }
+    return nil
+}
+
+// GeneratePresignedURL returns the object URL with an expiry parameter.
+// The URL is not signed since nothing serves it.
+func (s *MemoryStorageService) GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error) {
+    if _, err := s.get(storageKey); err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("%s?expires=%d", s.GetStorageURL(storageKey), time.Now().Add(expiry).Unix()), nil
+}
+
+// PresignUpload returns the object URL with an expiry parameter.
+// The URL is not signed since nothing serves it.
+func (s *MemoryStorageService) PresignUpload(ctx context.Context, storageKey string, policy UploadPolicy) (*PresignedUpload, error) {
+    expiresAt := time.Now().Add(policy.Expiry)
+    return &PresignedUpload{
+        Method:     policy.Method,
+        URL:        fmt.Sprintf("%s?expires=%d", s.GetStorageURL(storageKey), expiresAt.Unix()),
+        StorageKey: storageKey,
+        Headers:    map[string]string{"Content-Type": policy.ContentType},
+        ExpiresAt:  expiresAt,
+    }, nil
+}
+
+// GenerateThumbnail creates a thumbnail for a stored image
+func (s *MemoryStorageService) GenerateThumbnail(ctx context.Context, storageKey string, width, height int) (*UploadResult, error) {
+    object, err := s.get(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    return s.storeThumbnail(storageKey, object.data, width, height)
+}
+
+// GetMetadata returns the metadata of an object
+func (s *MemoryStorageService) GetMetadata(ctx context.Context, storageKey string) (*FileMetadata, error) {
+    object, err := s.get(storageKey)
+    if err != nil {
+        return nil, err
+    }
+    return &FileMetadata{
+        StorageKey:   storageKey,
+        FileName:     path.Base(storageKey),
+        FileSize:     int64(len(object.data)),
+        ContentType:  object.contentType,
+        LastModified: object.lastModified,
+        ETag:         object.etag,
+        Metadata:     copyMetadata(object.metadata),
+    }, nil
+}
+
+// UpdateMetadata replaces the user metadata of an object
+func (s *MemoryStorageService) UpdateMetadata(ctx context.Context, storageKey string, metadata map[string]string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    object, ok := s.objects[storageKey]
+    if !ok {
+        return fmt.Errorf("%w: %s", ErrObjectNotFound, storageKey)
+    }
+    object.metadata = copyMetadata(metadata)
+    return nil
+}
+
+// Exists reports whether an object exists
+func (s *MemoryStorageService) Exists(ctx context.Context, storageKey string) (bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    _, ok := s.objects[storageKey]
+    return ok, nil
+}
+
+// Copy copies an object to destKey
+func (s *MemoryStorageService) Copy(ctx context.Context, sourceKey, destKey string) error {
+    object, err := s.get(sourceKey)
+    if err != nil {
+        return err
+    }
+    s.put(destKey, append([]byte(nil), object.data...), object.contentType, object.metadata)
+    return nil
+}
+
+// Move renames an object to destKey
+func (s *MemoryStorageService) Move(ctx context.Context, sourceKey, destKey string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    object, ok := s.objects[sourceKey]
+    if !ok {
+        return fmt.Errorf("%w: %s", ErrObjectNotFound, sourceKey)
+    }
+    delete(s.objects, sourceKey)
+    object.lastModified = time.Now()
+    s.objects[destKey] = object
+    return nil
+}
+
+// ListFiles lists up to limit objects whose key starts with prefix, in key order
+func (s *MemoryStorageService) ListFiles(ctx context.Context, prefix string, limit int) ([]*FileInfo, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    var files []*FileInfo
+    for key, object := range s.objects {
+        if !strings.HasPrefix(key, prefix) {
+            continue
+        }
+        files = append(files, &FileInfo{
+            StorageKey:   key,
+            FileName:     path.Base(key),
+            FileSize:     int64(len(object.data)),
+            LastModified: object.lastModified,
+        })
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i].StorageKey < files[j].StorageKey })
+    if limit > 0 && len(files) > limit {
+        files = files[:limit]
+    }
+    return files, nil
+}
+
+// ListFilesPage lists one page of the objects under prefix
+func (s *MemoryStorageService) ListFilesPage(ctx context.Context, prefix string, opts ListOptions) (*FileList, error) {
+    files, err := s.ListFiles(ctx, prefix, 0)
+    if err != nil {
+        return nil, err
+    }
+    return pageFiles(files, opts)
+}
+
+// GetStorageURL returns the URL of an object
+func (s *MemoryStorageService) GetStorageURL(storageKey string) string {
+    return s.baseURL + "/" + storageKey
+}
+
+// CreateMultipartUpload starts a multipart upload held in memory
+func (s *MemoryStorageService) CreateMultipartUpload(ctx context.Context, storageKey string, contentType string, opts *UploadOptions) (string, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    uploadID := uuid.New().String()
+    s.mu.Lock()
+    s.uploads[uploadID] = &memoryUpload{
+        storageKey:  storageKey,
+        contentType: contentType,
+        metadata:    copyMetadata(opts.Metadata),
+        parts:       make(map[int][]byte),
+    }
+    s.mu.Unlock()
+    return uploadID, nil
+}
+
+// UploadPart stores one part of a multipart upload
+func (s *MemoryStorageService) UploadPart(ctx context.Context, storageKey, uploadID string, partNumber int, reader io.Reader, size int64) (*CompletedPart, error) {
+    data, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read part %d: %w", partNumber, err)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    upload, ok := s.uploads[uploadID]
+    if !ok || upload.storageKey != storageKey {
+        return nil, fmt.Errorf("multipart upload %s not found", uploadID)
+    }
+    upload.parts[partNumber] = data
+    sum := md5.Sum(data)
+    return &CompletedPart{PartNumber: partNumber, ETag: hex.EncodeToString(sum[:]), Size: int64(len(data))}, nil
+}
+
+// CompleteMultipartUpload concatenates the parts into the final object
+func (s *MemoryStorageService) CompleteMultipartUpload(ctx context.Context, storageKey, uploadID string, parts []CompletedPart) (*UploadResult, error) {
+    s.mu.Lock()
+    upload, ok := s.uploads[uploadID]
+    if !ok || upload.storageKey != storageKey {
+        s.mu.Unlock()
+        return nil, fmt.Errorf("multipart upload %s not found", uploadID)
+    }
+    sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+    var buf bytes.Buffer
+    for _, part := range parts {
+        data, ok := upload.parts[part.PartNumber]
+        if !ok {
+            s.mu.Unlock()
+            return nil, fmt.Errorf("part %d of upload %s is missing", part.PartNumber, uploadID)
+        }
+        buf.Write(data)
+    }
+    delete(s.uploads, uploadID)
+    s.mu.Unlock()
+    s.put(storageKey, buf.Bytes(), upload.contentType, upload.metadata)
+    return &UploadResult{
+        StorageKey:  storageKey,
+        StoragePath: "memory://" + storageKey,
+        URL:         s.GetStorageURL(storageKey),
+        FileName:    path.Base(storageKey),
+        FileSize:    int64(buf.Len()),
+        ContentType: upload.contentType,
+        Metadata:    upload.metadata,
+    }, nil
+}
+
+// AbortMultipartUpload discards a multipart upload
+func (s *MemoryStorageService) AbortMultipartUpload(ctx context.Context, storageKey, uploadID string) error {
+    s.mu.Lock()
+    delete(s.uploads, uploadID)
+    s.mu.Unlock()
+    return nil
+}
@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+    "testing"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        return storage.NewMemoryStorageService("http://localhost:8080")
+    })
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "io"
+)
+
+// MinMultipartPartSize is the smallest part S3 accepts for any part but the last
+const MinMultipartPartSize = 5 * 1024 * 1024
+
+// ErrMultipartUnsupported is returned by decorators that pass multipart
+// uploads on when the backend they wrap can't assemble objects from parts
+var ErrMultipartUnsupported = errors.New("storage backend does not support multipart uploads")
+
+// MultipartStorage is implemented by backends that can assemble an object
+// from parts uploaded separately, so large uploads can be resumed
+type MultipartStorage interface {
+    CreateMultipartUpload(ctx context.Context, storageKey string, contentType string, opts *UploadOptions) (string, error)
+    UploadPart(ctx context.Context, storageKey, uploadID string, partNumber int, reader io.Reader, size int64) (*CompletedPart, error)
+    CompleteMultipartUpload(ctx context.Context, storageKey, uploadID string, parts []CompletedPart) (*UploadResult, error)
+    AbortMultipartUpload(ctx context.Context, storageKey, uploadID string) error
+}
+
+// CompletedPart identifies an uploaded part of a multipart upload
+type CompletedPart struct {
+    PartNumber int    `json:"part_number"`
+    ETag       string `json:"etag"`
+    Size       int64  `json:"size"`
+}
+
+// NewStorageKey generates a unique key for filename, for callers that need
+// the key before the object is written
+func NewStorageKey(opts *UploadOptions, filename string) string {
+    return generateStorageKey(opts, filename)
+}
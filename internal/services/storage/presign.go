@@ -0,0 +1,79 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "strconv"
+    "time"
+)
+
+const (
+    PresignMethodPut  = "PUT"
+    PresignMethodPost = "POST"
+)
+
+// ErrUploadRejected is returned when a direct upload violates its signed policy
+var ErrUploadRejected = errors.New("upload does not satisfy the signed policy")
+
+// PresignedUploader is implemented by backends that let clients upload
+// straight to storage instead of streaming through the API
+type PresignedUploader interface {
+    PresignUpload(ctx context.Context, storageKey string, policy UploadPolicy) (*PresignedUpload, error)
+}
+
+// UploadPolicy constrains what a client may upload with a presigned URL
+type UploadPolicy struct {
+    Method      string
+    ContentType string
+    // MaxSize is the exact object size for PUT and the upper bound for POST
+    MaxSize int64
+    Expiry  time.Duration
+}
+
+// PresignedUpload describes how the client performs a direct upload. PUT
+// requests must send Headers; POST requests are multipart forms carrying
+// Fields followed by the file in a "file" field.
+type PresignedUpload struct {
+    Method     string            `json:"method"`
+    URL        string            `json:"url"`
+    StorageKey string            `json:"storage_key"`
+    Headers    map[string]string `json:"headers,omitempty"`
+    Fields     map[string]string `json:"fields,omitempty"`
+    ExpiresAt  time.Time         `json:"expires_at"`
+}
+
+// uploadPolicyString is the canonical string HMAC-signed for local direct uploads
+func uploadPolicyString(urlPath, contentType string, maxSize int64) string {
+    return urlPath + "\n" + contentType + "\n" + strconv.FormatInt(maxSize, 10)
+}
+
+// errStopRead aborts a download once ReadHead has collected enough bytes
+var errStopRead = errors.New("read limit reached")
+
+type headWriter struct {
+    buf []byte
+    max int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+    n := w.max - len(w.buf)
+    if len(p) < n {
+        n = len(p)
+    }
+    w.buf = append(w.buf, p[:n]...)
+    if len(w.buf) >= w.max {
+        return n, errStopRead
+    }
+    return n, nil
+}
+
+// ReadHead returns up to the first n bytes of an object without downloading
+// the rest, for content sniffing
+func ReadHead(ctx context.Context, svc StorageService, storageKey string, n int) ([]byte, error) {
+    w := &headWriter{max: n}
+    err := svc.DownloadToWriter(ctx, storageKey, w)
+    if err != nil && !errors.Is(err, errStopRead) {
+        return nil, err
+    }
+    return w.buf, nil
+}
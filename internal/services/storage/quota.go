@@ -0,0 +1,459 @@
+package storage
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+)
+
+// Usage categories
+const (
+    UsageUploads    = "uploads"
+    UsageThumbnails = "thumbnails"
+    UsageVideos     = "videos"
+)
+
+var usageCategories = []string{UsageUploads, UsageThumbnails, UsageVideos}
+
+const (
+    usageKeyPrefix       = "storage_usage:"
+    reservationKeyPrefix = "storage_reserved:"
+    planKeyPrefix        = "storage_plan:"
+    usageObjectsKey      = "storage_usage_objects"
+)
+
+// reservationTTL bounds how long an upload in flight holds its share of the
+// quota, should the process die before it is charged
+const reservationTTL = time.Hour
+
+// ErrUnknownPlan is returned when assigning a plan that isn't configured
+var ErrUnknownPlan = errors.New("unknown storage plan")
+
+// QuotaExceededError is returned when an upload would take a user over
+// their plan's storage quota
+type QuotaExceededError struct {
+    Plan      string `json:"plan"`
+    Limit     int64  `json:"limit"`
+    Used      int64  `json:"used"`
+    Requested int64  `json:"requested"`
+}
+
+func (e *QuotaExceededError) Error() string {
+    return fmt.Sprintf("storage quota exceeded: %d of %d bytes used, %d requested", e.Used, e.Limit, e.Requested)
+}
+
+// Usage is the storage consumed by a user. Reserved counts uploads that are
+// still in flight.
+type Usage struct {
+    Plan       string           `json:"plan"`
+    Limit      int64            `json:"limit"`
+    Used       int64            `json:"used"`
+    Reserved   int64            `json:"reserved"`
+    Categories map[string]int64 `json:"categories"`
+}
+
+// usageEntry records who is charged for a stored object
+type usageEntry struct {
+    UserID   uuid.UUID `json:"user_id"`
+    Category string    `json:"category"`
+    Size     int64     `json:"size"`
+}
+
+// ParseQuotaPlans parses a comma separated list of plan:bytes pairs
+func ParseQuotaPlans(spec string) (map[string]int64, error) {
+    plans := make(map[string]int64)
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        name, limit, ok := strings.Cut(entry, ":")
+        bytes, err := strconv.ParseInt(limit, 10, 64)
+        if !ok || name == "" || err != nil || bytes < 0 {
+            return nil, fmt.Errorf("invalid quota plan %q", entry)
+        }
+        plans[name] = bytes
+    }
+    return plans, nil
+}
+
+// QuotaStorageService keeps a usage ledger in Redis of every object stored
+// through it and rejects uploads that would exceed the owner's plan. Each
+// object is charged to the user in its UploadOptions. Usage is tracked per
+// category: uploads, thumbnails and videos.
+//
+// An upload reserves its size before it is stored, atomically with the
+// quota check, so concurrent uploads can't together overshoot the limit.
+// The reservation turns into a charge once the object is stored.
+type QuotaStorageService struct {
+    StorageService
+    redis       *redis.Client
+    plans       map[string]int64
+    defaultPlan string
+}
+
+// NewQuotaStorageService wraps backend with quota enforcement
+func NewQuotaStorageService(backend StorageService, redisClient *redis.Client, plans map[string]int64, defaultPlan string) *QuotaStorageService {
+    return &QuotaStorageService{
+        StorageService: backend,
+        redis:          redisClient,
+        plans:          plans,
+        defaultPlan:    defaultPlan,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *QuotaStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+func usageKey(userID uuid.UUID) string {
+    return usageKeyPrefix + userID.String()
+}
+
+func reservationKey(userID uuid.UUID) string {
+    return reservationKeyPrefix + userID.String()
+}
+
+// SetUserPlan assigns a plan to a user
+func (s *QuotaStorageService) SetUserPlan(ctx context.Context, userID uuid.UUID, plan string) error {
+    if _, ok := s.plans[plan]; !ok {
+        return fmt.Errorf("%w: %q", ErrUnknownPlan, plan)
+    }
+    if err := s.redis.Set(ctx, planKeyPrefix+userID.String(), plan, 0).Err(); err != nil {
+        return fmt.Errorf("failed to assign plan: %w", err)
+    }
+    return nil
+}
+
+// userPlan returns the plan of a user and its limit. A limit of zero means
+// the plan is unlimited.
+func (s *QuotaStorageService) userPlan(ctx context.Context, userID uuid.UUID) (string, int64, error) {
+    plan, err := s.redis.Get(ctx, planKeyPrefix+userID.String()).Result()
+    if err != nil && err != redis.Nil {
+        return "", 0, fmt.Errorf("failed to load plan: %w", err)
+    }
+    if _, ok := s.plans[plan]; !ok {
+        plan = s.defaultPlan
+    }
+    return plan, s.plans[plan], nil
+}
+
+// UserUsage returns the usage of a user and the limit of their plan
+func (s *QuotaStorageService) UserUsage(ctx context.Context, userID uuid.UUID) (*Usage, error) {
+    plan, limit, err := s.userPlan(ctx, userID)
+    if err != nil {
+        return nil, err
+    }
+    values, err := s.redis.HGetAll(ctx, usageKey(userID)).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load usage: %w", err)
+    }
+    reservations, err := s.redis.ZRangeByScore(ctx, reservationKey(userID), &redis.ZRangeBy{
+        Min: strconv.FormatInt(time.Now().UnixMilli(), 10),
+        Max: "+inf",
+    }).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load usage: %w", err)
+    }
+    usage := &Usage{Plan: plan, Limit: limit, Categories: make(map[string]int64)}
+    for _, category := range usageCategories {
+        bytes, _ := strconv.ParseInt(values[category], 10, 64)
+        usage.Categories[category] = bytes
+        usage.Used += bytes
+    }
+    for _, reservation := range reservations {
+        _, size, _ := strings.Cut(reservation, "|")
+        bytes, _ := strconv.ParseInt(size, 10, 64)
+        usage.Reserved += bytes
+    }
+    return usage, nil
+}
+
+// Check returns a *QuotaExceededError if storing size more bytes would take
+// the user over quota. It reserves nothing, so it only serves to reject
+// uploads early; Charge and the decorator's uploads enforce the quota.
+func (s *QuotaStorageService) Check(ctx context.Context, userID uuid.UUID, size int64) error {
+    if userID == uuid.Nil {
+        return nil
+    }
+    if size < 0 {
+        size = 0
+    }
+    usage, err := s.UserUsage(ctx, userID)
+    if err != nil {
+        return err
+    }
+    used := usage.Used + usage.Reserved
+    if usage.Limit > 0 && (used+size > usage.Limit || used >= usage.Limit) {
+        return &QuotaExceededError{Plan: usage.Plan, Limit: usage.Limit, Used: used, Requested: size}
+    }
+    return nil
+}
+
+// reserveQuota drops expired reservations, then adds one of ARGV[4] bytes
+// unless the user's usage and reservations leave no room for it. It returns
+// whether it did and the usage it checked.
+var reserveQuota = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local used = 0
+for i = 6, #ARGV do
+    used = used + (tonumber(redis.call('HGET', KEYS[1], ARGV[i])) or 0)
+end
+for _, reservation in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+    used = used + tonumber(string.match(reservation, '|(%d+)$'))
+end
+local size = tonumber(ARGV[4])
+local limit = tonumber(ARGV[5])
+if limit > 0 and (used + size > limit or used >= limit) then
+    return {0, used}
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+return {1, used}
+`)
+
+// reserve holds size bytes of the user's quota until the upload is charged
+// or released. It returns the reservation, which is empty for uploads
+// without an owner.
+func (s *QuotaStorageService) reserve(ctx context.Context, userID uuid.UUID, size int64) (string, error) {
+    if userID == uuid.Nil {
+        return "", nil
+    }
+    if size < 0 {
+        size = 0
+    }
+    plan, limit, err := s.userPlan(ctx, userID)
+    if err != nil {
+        return "", err
+    }
+    reservation := uuid.NewString() + "|" + strconv.FormatInt(size, 10)
+    now := time.Now()
+    args := []interface{}{now.UnixMilli(), now.Add(reservationTTL).UnixMilli(), reservation, size, limit}
+    for _, category := range usageCategories {
+        args = append(args, category)
+    }
+    reply, err := reserveQuota.Run(ctx, s.redis, []string{usageKey(userID), reservationKey(userID)}, args...).Int64Slice()
+    if err != nil {
+        return "", fmt.Errorf("failed to reserve quota: %w", err)
+    }
+    if reply[0] == 0 {
+        return "", &QuotaExceededError{Plan: plan, Limit: limit, Used: reply[1], Requested: size}
+    }
+    return reservation, nil
+}
+
+// release gives back a reservation whose upload failed
+func (s *QuotaStorageService) release(ctx context.Context, userID uuid.UUID, reservation string) {
+    if reservation == "" {
+        return
+    }
+    if err := s.redis.ZRem(ctx, reservationKey(userID), reservation).Err(); err != nil {
+        log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to release quota reservation")
+    }
+}
+
+// Charge reserves and charges an object written around the decorator, such
+// as a completed multipart or confirmed presigned upload, in one step. It
+// returns a *QuotaExceededError, and charges nothing, if the user has no
+// room for it. A key that is already charged, such as a shared blob, costs
+// nothing more.
+func (s *QuotaStorageService) Charge(ctx context.Context, storageKey string, userID uuid.UUID, category string, size int64) error {
+    charged, err := s.redis.HExists(ctx, usageObjectsKey, storageKey).Result()
+    if err != nil {
+        return fmt.Errorf("failed to record usage of %s: %w", storageKey, err)
+    }
+    if charged {
+        return nil
+    }
+    reservation, err := s.reserve(ctx, userID, size)
+    if err != nil {
+        return err
+    }
+    _, err = s.record(ctx, storageKey, usageEntry{UserID: userID, Category: category, Size: size}, reservation)
+    return err
+}
+
+// Track charges an object written around the decorator without checking
+// the quota, for uploads that were already accepted
+func (s *QuotaStorageService) Track(ctx context.Context, storageKey string, userID uuid.UUID, category string, size int64) error {
+    _, err := s.record(ctx, storageKey, usageEntry{UserID: userID, Category: category, Size: size}, "")
+    return err
+}
+
+// recordUsage releases the reservation ARGV[5], if any, and charges the
+// object unless its key already is
+var recordUsage = redis.NewScript(`
+if ARGV[5] ~= '' then
+    redis.call('ZREM', KEYS[3], ARGV[5])
+end
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+    return 0
+end
+redis.call('HINCRBY', KEYS[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+// record charges an object to its owner, turning its reservation into the
+// charge. It reports false when the key was already charged; deduplicated
+// and overwritten objects keep their original entry.
+func (s *QuotaStorageService) record(ctx context.Context, storageKey string, entry usageEntry, reservation string) (bool, error) {
+    if entry.UserID == uuid.Nil {
+        return false, nil
+    }
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return false, err
+    }
+    keys := []string{usageObjectsKey, usageKey(entry.UserID), reservationKey(entry.UserID)}
+    added, err := recordUsage.Run(ctx, s.redis, keys, storageKey, data, entry.Category, entry.Size, reservation).Int()
+    if err != nil {
+        return false, fmt.Errorf("failed to record usage of %s: %w", storageKey, err)
+    }
+    return added == 1, nil
+}
+
+func (s *QuotaStorageService) entry(ctx context.Context, storageKey string) (*usageEntry, error) {
+    data, err := s.redis.HGet(ctx, usageObjectsKey, storageKey).Bytes()
+    if err != nil {
+        return nil, err
+    }
+    var entry usageEntry
+    if err := json.Unmarshal(data, &entry); err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
+
+// credit removes a deleted object from the ledger
+func (s *QuotaStorageService) credit(ctx context.Context, storageKey string) {
+    entry, err := s.entry(ctx, storageKey)
+    if err != nil {
+        return
+    }
+    removed, err := s.redis.HDel(ctx, usageObjectsKey, storageKey).Result()
+    if err != nil || removed == 0 {
+        return
+    }
+    s.redis.HIncrBy(ctx, usageKey(entry.UserID), entry.Category, -entry.Size)
+}
+
+// usageCategory decides which category an upload is charged to
+func usageCategory(opts *UploadOptions) string {
+    switch {
+    case opts.Metadata[MetaDerivativeOf] != "", strings.Trim(opts.Folder, "/") == "thumbnails":
+        return UsageThumbnails
+    case strings.Trim(opts.Folder, "/") == "videos":
+        return UsageVideos
+    }
+    return UsageUploads
+}
+
+// Upload checks the quota and records a multipart file
+func (s *QuotaStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    contentType := detectContentType(header.Filename, opts.ContentType, header.Header.Get("Content-Type"))
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader checks the quota before anything is stored, then charges
+// the object and any thumbnail and derivatives generated with it
+func (s *QuotaStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    owner := usageEntry{UserID: opts.UserID, Category: usageCategory(opts)}
+    if original := opts.Metadata[MetaDerivativeOf]; original != "" && owner.UserID == uuid.Nil {
+        // Lazily rendered derivatives are charged to the owner of the original
+        if entry, err := s.entry(ctx, original); err == nil {
+            owner.UserID = entry.UserID
+        }
+    }
+    var reservation string
+    if owner.Category != UsageThumbnails {
+        var err error
+        if reservation, err = s.reserve(ctx, owner.UserID, size); err != nil {
+            return nil, err
+        }
+    }
+    result, err := s.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, opts)
+    if err != nil {
+        s.release(ctx, owner.UserID, reservation)
+        return nil, err
+    }
+    if owner.UserID == uuid.Nil {
+        return result, nil
+    }
+    entry := owner
+    entry.Size = result.FileSize
+    if added, err := s.record(ctx, result.StorageKey, entry, reservation); err != nil || !added {
+        // A deduplicated upload is already charged along with its thumbnails
+        if err != nil {
+            s.release(ctx, owner.UserID, reservation)
+            log.Error().Err(err).Str("storage_key", result.StorageKey).Msg("Failed to record storage usage")
+        }
+        return result, nil
+    }
+    thumbnails := owner
+    thumbnails.Category = UsageThumbnails
+    if result.ThumbnailURL != "" {
+        key := thumbnailKey(result.StorageKey)
+        if metadata, err := s.StorageService.GetMetadata(ctx, key); err == nil {
+            thumbnails.Size = metadata.FileSize
+            s.record(ctx, key, thumbnails, "")
+        }
+    }
+    for _, derivative := range result.Derivatives {
+        thumbnails.Size = derivative.FileSize
+        s.record(ctx, derivative.StorageKey, thumbnails, "")
+    }
+    return result, nil
+}
+
+// Delete deletes an object and credits its owner once it is really gone
+func (s *QuotaStorageService) Delete(ctx context.Context, storageKey string) error {
+    if err := s.StorageService.Delete(ctx, storageKey); err != nil {
+        return err
+    }
+    s.creditDeleted(ctx, []string{storageKey})
+    return nil
+}
+
+// DeleteMultiple deletes several objects and credits their owners
+func (s *QuotaStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    if err := s.StorageService.DeleteMultiple(ctx, storageKeys); err != nil {
+        return err
+    }
+    s.creditDeleted(ctx, storageKeys)
+    return nil
+}
+
+// creditDeleted credits keys that no longer exist. A shared blob survives
+// its delete while other references remain and stays charged.
+func (s *QuotaStorageService) creditDeleted(ctx context.Context, storageKeys []string) {
+    for _, key := range storageKeys {
+        if exists, err := s.StorageService.Exists(ctx, key); err == nil && !exists {
+            s.credit(ctx, key)
+        }
+    }
+}
+
+// IsQuotaExceeded reports whether err is a quota rejection
+func IsQuotaExceeded(err error) (*QuotaExceededError, bool) {
+    var quotaErr *QuotaExceededError
+    if errors.As(err, &quotaErr) {
+        return quotaErr, true
+    }
+    return nil, false
+}
@@ -0,0 +1,176 @@
+package storage_test
+
+import (
+    "bytes"
+    "context"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+func newQuota(t *testing.T, limit int64) (*storage.QuotaStorageService, storage.StorageService) {
+    backend := storage.NewMemoryStorageService("")
+    plans := map[string]int64{"free": limit, "pro": 10 * limit, "unlimited": 0}
+    return storage.NewQuotaStorageService(backend, newRedis(t), plans, "free"), backend
+}
+
+func userUsage(t *testing.T, quota *storage.QuotaStorageService, userID uuid.UUID) *storage.Usage {
+    usage, err := quota.UserUsage(context.Background(), userID)
+    require.NoError(t, err)
+    return usage
+}
+
+func TestQuotaChargesByCategory(t *testing.T) {
+    ctx := context.Background()
+    quota, _ := newQuota(t, 1<<20)
+    userID := uuid.New()
+
+    uploadText(t, quota, userID, "notes.txt", "0123456789")
+    image := storagetest.NewPNG(t, 200, 100)
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    opts.GenerateThumbnail = true
+    photo, err := quota.UploadFromReader(ctx, bytes.NewReader(image), "photo.png", "image/png", int64(len(image)), opts)
+    require.NoError(t, err)
+    opts = storage.NewUploadOptions()
+    opts.Folder = "videos"
+    opts.UserID = userID
+    _, err = quota.UploadFromReader(ctx, strings.NewReader("video"), "clip.mp4", "video/mp4", 5, opts)
+    require.NoError(t, err)
+
+    usage := userUsage(t, quota, userID)
+    assert.Equal(t, "free", usage.Plan)
+    assert.Equal(t, int64(1<<20), usage.Limit)
+    assert.Equal(t, 10+photo.FileSize, usage.Categories[storage.UsageUploads])
+    assert.Positive(t, usage.Categories[storage.UsageThumbnails])
+    assert.Equal(t, int64(5), usage.Categories[storage.UsageVideos])
+    assert.Equal(t, usage.Categories[storage.UsageUploads]+usage.Categories[storage.UsageThumbnails]+5, usage.Used)
+    assert.Zero(t, usage.Reserved)
+
+    // Deleting credits the object and its thumbnail alike
+    require.NoError(t, quota.DeleteMultiple(ctx, []string{photo.StorageKey, strings.TrimSuffix(photo.StorageKey, ".png") + "_thumb.png"}))
+    usage = userUsage(t, quota, userID)
+    assert.Equal(t, int64(10), usage.Categories[storage.UsageUploads])
+    assert.Zero(t, usage.Categories[storage.UsageThumbnails])
+
+    // Missing keys and repeated deletes credit nothing
+    require.NoError(t, quota.Delete(ctx, photo.StorageKey))
+    assert.Equal(t, int64(15), userUsage(t, quota, userID).Used)
+}
+
+func TestQuotaRejectsUploadsOverLimit(t *testing.T) {
+    ctx := context.Background()
+    quota, backend := newQuota(t, 16)
+    userID := uuid.New()
+    uploadText(t, quota, userID, "a.txt", "0123456789")
+
+    opts := storage.NewUploadOptions()
+    opts.Folder = "uploads"
+    opts.UserID = userID
+    _, err := quota.UploadFromReader(ctx, strings.NewReader("0123456789"), "b.txt", "text/plain", 10, opts)
+    quotaErr, ok := storage.IsQuotaExceeded(err)
+    require.True(t, ok, "got %v", err)
+    assert.Equal(t, &storage.QuotaExceededError{Plan: "free", Limit: 16, Used: 10, Requested: 10}, quotaErr)
+    files, err := backend.ListFiles(ctx, "uploads/", 0)
+    require.NoError(t, err)
+    assert.Len(t, files, 1, "nothing is stored past the quota")
+    assert.Error(t, quota.Check(ctx, userID, 10))
+    assert.NoError(t, quota.Check(ctx, userID, 6))
+
+    // Uploads without an owner aren't limited
+    _, err = quota.UploadFromReader(ctx, strings.NewReader("0123456789"), "b.txt", "text/plain", 10, storage.NewUploadOptions())
+    assert.NoError(t, err)
+}
+
+func TestQuotaConcurrentUploadsStayWithinLimit(t *testing.T) {
+    ctx := context.Background()
+    quota, _ := newQuota(t, 50)
+    userID := uuid.New()
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var stored, rejected int
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            opts := storage.NewUploadOptions()
+            opts.Folder = "uploads"
+            opts.UserID = userID
+            content := strings.Repeat(string(rune('a'+i)), 10)
+            _, err := quota.UploadFromReader(ctx, strings.NewReader(content), "file.txt", "text/plain", 10, opts)
+            mu.Lock()
+            defer mu.Unlock()
+            if _, ok := storage.IsQuotaExceeded(err); ok {
+                rejected++
+            } else if assert.NoError(t, err) {
+                stored++
+            }
+        }(i)
+    }
+    wg.Wait()
+    assert.Equal(t, 5, stored)
+    assert.Equal(t, 5, rejected)
+    usage := userUsage(t, quota, userID)
+    assert.Equal(t, int64(50), usage.Used)
+    assert.Zero(t, usage.Reserved)
+}
+
+func TestQuotaCharge(t *testing.T) {
+    ctx := context.Background()
+    quota, _ := newQuota(t, 16)
+    userID := uuid.New()
+
+    require.NoError(t, quota.Charge(ctx, "uploads/a.txt", userID, storage.UsageUploads, 10))
+    require.NoError(t, quota.Charge(ctx, "uploads/a.txt", userID, storage.UsageUploads, 10), "a key is charged once")
+    assert.Equal(t, int64(10), userUsage(t, quota, userID).Used)
+
+    err := quota.Charge(ctx, "uploads/b.txt", userID, storage.UsageUploads, 10)
+    _, ok := storage.IsQuotaExceeded(err)
+    assert.True(t, ok, "got %v", err)
+    usage := userUsage(t, quota, userID)
+    assert.Equal(t, int64(10), usage.Used)
+    assert.Zero(t, usage.Reserved, "a rejected charge holds nothing")
+
+    // Track records uploads that were already accepted, whatever the quota
+    require.NoError(t, quota.Track(ctx, "uploads/c.txt", userID, storage.UsageUploads, 10))
+    assert.Equal(t, int64(20), userUsage(t, quota, userID).Used)
+}
+
+func TestQuotaPlans(t *testing.T) {
+    ctx := context.Background()
+    quota, _ := newQuota(t, 16)
+    userID := uuid.New()
+
+    assert.ErrorIs(t, quota.SetUserPlan(ctx, userID, "platinum"), storage.ErrUnknownPlan)
+    require.NoError(t, quota.SetUserPlan(ctx, userID, "pro"))
+    usage := userUsage(t, quota, userID)
+    assert.Equal(t, "pro", usage.Plan)
+    assert.Equal(t, int64(160), usage.Limit)
+    require.NoError(t, quota.Charge(ctx, "uploads/a.txt", userID, storage.UsageUploads, 100))
+
+    require.NoError(t, quota.SetUserPlan(ctx, userID, "unlimited"))
+    assert.NoError(t, quota.Check(ctx, userID, 1<<40))
+
+    // Other users keep the default plan
+    assert.Equal(t, "free", userUsage(t, quota, uuid.New()).Plan)
+}
+
+func TestParseQuotaPlans(t *testing.T) {
+    plans, err := storage.ParseQuotaPlans("free:100, pro:2000,enterprise:0,")
+    require.NoError(t, err)
+    assert.Equal(t, map[string]int64{"free": 100, "pro": 2000, "enterprise": 0}, plans)
+
+    for _, spec := range []string{"free", "free:-1", ":100", "free:lots"} {
+        _, err := storage.ParseQuotaPlans(spec)
+        assert.Error(t, err, spec)
+    }
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "maps"
+    "mime/multipart"
+    "path"
+    "time"
+
+    "github.com/rs/zerolog/log"
+)
+
+// Replication modes
+const (
+    ReplicationSync  = "sync"
+    ReplicationAsync = "async"
+
+    replicationQueueSize = 1024
+)
+
+// ErrReplicationFailed is returned by writes in sync mode when an object
+// reached the primary but not every secondary
+var ErrReplicationFailed = errors.New("replication failed")
+
+// ReplicatedStorageService writes to a primary backend and mirrors every
+// write to one or more secondaries, either before the write returns (sync)
+// or from a background queue (async). Reads are served by the primary and
+// fall back to the secondaries when it fails. Multipart uploads are
+// assembled on the primary and replicated once they complete. Objects written
+// around the decorator, such as presigned uploads, are mirrored with
+// Replicate. Async writes dropped by a full queue reach the secondaries with
+// the next repair run.
+type ReplicatedStorageService struct {
+    StorageService
+    secondaries []StorageService
+    async       bool
+    queue       chan replicationTask
+}
+
+// replicationTask mirrors one change of the primary to the secondaries
+type replicationTask struct {
+    key      string
+    delete   bool
+    metadata map[string]string // set for metadata-only updates
+}
+
+// RepairReport summarizes a repair run
+type RepairReport struct {
+    StartedAt  time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+    Prefix     string    `json:"prefix"`
+    Scanned    int       `json:"scanned"`
+    Repaired   int       `json:"repaired"`
+    Failed     int       `json:"failed"`
+}
+
+// NewReplicatedStorageService mirrors primary to secondaries. In async mode
+// Run must be started to drain the replication queue.
+func NewReplicatedStorageService(primary StorageService, secondaries []StorageService, mode string) (*ReplicatedStorageService, error) {
+    if mode != ReplicationSync && mode != ReplicationAsync {
+        return nil, fmt.Errorf("invalid replication mode %q", mode)
+    }
+    return &ReplicatedStorageService{
+        StorageService: primary,
+        secondaries:    secondaries,
+        async:          mode == ReplicationAsync,
+        queue:          make(chan replicationTask, replicationQueueSize),
+    }, nil
+}
+
+// Unwrap returns the primary backend
+func (s *ReplicatedStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// Upload stores a multipart file on the primary and replicates it
+func (s *ReplicatedStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    result, err := s.StorageService.Upload(ctx, file, header, opts)
+    if err != nil {
+        return nil, err
+    }
+    return result, s.replicate(ctx, putTasks(result)...)
+}
+
+// UploadFromReader stores data on the primary and replicates it
+func (s *ReplicatedStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    result, err := s.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, opts)
+    if err != nil {
+        return nil, err
+    }
+    return result, s.replicate(ctx, putTasks(result)...)
+}
+
+// putTasks replicates an uploaded object with the thumbnail and derivatives
+// the primary rendered for it
+func putTasks(result *UploadResult) []replicationTask {
+    tasks := []replicationTask{{key: result.StorageKey}}
+    if result.ThumbnailURL != "" {
+        tasks = append(tasks, replicationTask{key: thumbnailKey(result.StorageKey)})
+    }
+    for _, derivative := range result.Derivatives {
+        tasks = append(tasks, replicationTask{key: derivative.StorageKey})
+    }
+    return tasks
+}
+
+// Replicate mirrors an object that was written to the primary around the
+// decorator to the secondaries
+func (s *ReplicatedStorageService) Replicate(ctx context.Context, storageKey string) error {
+    return s.replicate(ctx, replicationTask{key: storageKey})
+}
+
+// CreateMultipartUpload starts a multipart upload on the primary
+func (s *ReplicatedStorageService) CreateMultipartUpload(ctx context.Context, storageKey string, contentType string, opts *UploadOptions) (string, error) {
+    backend, ok := Backend[MultipartStorage](s.StorageService)
+    if !ok {
+        return "", ErrMultipartUnsupported
+    }
+    return backend.CreateMultipartUpload(ctx, storageKey, contentType, opts)
+}
+
+// UploadPart stores a part on the primary. Parts aren't replicated; the
+// assembled object is.
+func (s *ReplicatedStorageService) UploadPart(ctx context.Context, storageKey, uploadID string, partNumber int, reader io.Reader, size int64) (*CompletedPart, error) {
+    backend, ok := Backend[MultipartStorage](s.StorageService)
+    if !ok {
+        return nil, ErrMultipartUnsupported
+    }
+    return backend.UploadPart(ctx, storageKey, uploadID, partNumber, reader, size)
+}
+
+// CompleteMultipartUpload assembles the object on the primary and replicates it
+func (s *ReplicatedStorageService) CompleteMultipartUpload(ctx context.Context, storageKey, uploadID string, parts []CompletedPart) (*UploadResult, error) {
+    backend, ok := Backend[MultipartStorage](s.StorageService)
+    if !ok {
+        return nil, ErrMultipartUnsupported
+    }
+    result, err := backend.CompleteMultipartUpload(ctx, storageKey, uploadID, parts)
+    if err != nil {
+        return nil, err
+    }
+    return result, s.replicate(ctx, replicationTask{key: result.StorageKey})
+}
+
+// AbortMultipartUpload discards a multipart upload on the primary
+func (s *ReplicatedStorageService) AbortMultipartUpload(ctx context.Context, storageKey, uploadID string) error {
+    backend, ok := Backend[MultipartStorage](s.StorageService)
+    if !ok {
+        return ErrMultipartUnsupported
+    }
+    return backend.AbortMultipartUpload(ctx, storageKey, uploadID)
+}
+
+// GenerateThumbnail renders a thumbnail on the primary and replicates it
+func (s *ReplicatedStorageService) GenerateThumbnail(ctx context.Context, storageKey string, width, height int) (*UploadResult, error) {
+    result, err := s.StorageService.GenerateThumbnail(ctx, storageKey, width, height)
+    if err != nil {
+        return nil, err
+    }
+    return result, s.replicate(ctx, replicationTask{key: result.StorageKey})
+}
+
+// Copy copies an object on the primary and replicates the copy
+func (s *ReplicatedStorageService) Copy(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.StorageService.Copy(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    return s.replicate(ctx, replicationTask{key: destKey})
+}
+
+// Move moves an object on the primary and replicates the move
+func (s *ReplicatedStorageService) Move(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.StorageService.Move(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    return s.replicate(ctx, replicationTask{key: destKey}, replicationTask{key: sourceKey, delete: true})
+}
+
+// Delete deletes an object from the primary and the secondaries. Failures on
+// a secondary are logged, since the object is already gone from the primary.
+func (s *ReplicatedStorageService) Delete(ctx context.Context, storageKey string) error {
+    if err := s.StorageService.Delete(ctx, storageKey); err != nil {
+        return err
+    }
+    s.replicate(ctx, replicationTask{key: storageKey, delete: true})
+    return nil
+}
+
+// DeleteMultiple deletes several objects from the primary and the secondaries
+func (s *ReplicatedStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    if err := s.StorageService.DeleteMultiple(ctx, storageKeys); err != nil {
+        return err
+    }
+    tasks := make([]replicationTask, 0, len(storageKeys))
+    for _, key := range storageKeys {
+        tasks = append(tasks, replicationTask{key: key, delete: true})
+    }
+    s.replicate(ctx, tasks...)
+    return nil
+}
+
+// UpdateMetadata replaces the user metadata of an object on the primary and
+// the secondaries, so rewrapped encryption keys stay in step
+func (s *ReplicatedStorageService) UpdateMetadata(ctx context.Context, storageKey string, metadata map[string]string) error {
+    updater, ok := Backend[MetadataUpdater](s.StorageService)
+    if !ok {
+        return ErrMetadataUnsupported
+    }
+    if err := updater.UpdateMetadata(ctx, storageKey, metadata); err != nil {
+        return err
+    }
+    return s.replicate(ctx, replicationTask{key: storageKey, metadata: maps.Clone(metadata)})
+}
+
+// GetMetadata reads metadata from the primary, falling back to the
+// secondaries
+func (s *ReplicatedStorageService) GetMetadata(ctx context.Context, storageKey string) (*FileMetadata, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err == nil {
+        return metadata, nil
+    }
+    for _, secondary := range s.secondaries {
+        if metadata, fallbackErr := secondary.GetMetadata(ctx, storageKey); fallbackErr == nil {
+            s.logFallback(storageKey, err)
+            return metadata, nil
+        }
+    }
+    return nil, err
+}
+
+// Download reads an object from the primary, falling back to the secondaries
+func (s *ReplicatedStorageService) Download(ctx context.Context, storageKey string) ([]byte, error) {
+    data, err := s.StorageService.Download(ctx, storageKey)
+    if err == nil {
+        return data, nil
+    }
+    for _, secondary := range s.secondaries {
+        if data, fallbackErr := secondary.Download(ctx, storageKey); fallbackErr == nil {
+            s.logFallback(storageKey, err)
+            return data, nil
+        }
+    }
+    return nil, err
+}
+
+// DownloadToWriter streams an object from the primary, falling back to the
+// secondaries as long as nothing has been written yet
+func (s *ReplicatedStorageService) DownloadToWriter(ctx context.Context, storageKey string, writer io.Writer) error {
+    return s.fallback(storageKey, writer, func(svc StorageService, w io.Writer) error {
+        return svc.DownloadToWriter(ctx, storageKey, w)
+    })
+}
+
+// DownloadRange streams part of an object from the primary, falling back to
+// the secondaries as long as nothing has been written yet
+func (s *ReplicatedStorageService) DownloadRange(ctx context.Context, storageKey string, offset, length int64, writer io.Writer) error {
+    return s.fallback(storageKey, writer, func(svc StorageService, w io.Writer) error {
+        return svc.DownloadRange(ctx, storageKey, offset, length, w)
+    })
+}
+
+func (s *ReplicatedStorageService) fallback(storageKey string, writer io.Writer, read func(StorageService, io.Writer) error) error {
+    counter := &countingWriter{dst: writer}
+    err := read(s.StorageService, counter)
+    if err == nil || counter.written > 0 || errors.Is(err, ErrInvalidRange) {
+        return err
+    }
+    for _, secondary := range s.secondaries {
+        if fallbackErr := read(secondary, counter); fallbackErr == nil {
+            s.logFallback(storageKey, err)
+            return nil
+        } else if counter.written > 0 {
+            return fallbackErr
+        }
+    }
+    return err
+}
+
+func (s *ReplicatedStorageService) logFallback(storageKey string, err error) {
+    log.Warn().Err(err).Str("storage_key", storageKey).Msg("Primary storage read failed, served from a replica")
+}
+
+// countingWriter counts the bytes passed on to dst
+type countingWriter struct {
+    dst     io.Writer
+    written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+    n, err := w.dst.Write(p)
+    w.written += int64(n)
+    return n, err
+}
+
+// replicate applies tasks to the secondaries now in sync mode, or queues
+// them in async mode. Only sync puts report failures.
+func (s *ReplicatedStorageService) replicate(ctx context.Context, tasks ...replicationTask) error {
+    if s.async {
+        for _, task := range tasks {
+            select {
+            case s.queue <- task:
+            default:
+                log.Warn().Str("storage_key", task.key).Msg("Replication queue full, leaving object to the repair job")
+            }
+        }
+        return nil
+    }
+    var errs []error
+    for _, task := range tasks {
+        if err := s.apply(ctx, task); err != nil && !task.delete {
+            errs = append(errs, err)
+        }
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%w: %w", ErrReplicationFailed, errors.Join(errs...))
+    }
+    return nil
+}
+
+// apply mirrors one task to every secondary
+func (s *ReplicatedStorageService) apply(ctx context.Context, task replicationTask) error {
+    var errs []error
+    for i, secondary := range s.secondaries {
+        if err := s.applyTo(ctx, secondary, task); err != nil {
+            log.Warn().Err(err).Int("replica", i).Str("storage_key", task.key).Bool("delete", task.delete).Msg("Failed to replicate object")
+            errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (s *ReplicatedStorageService) applyTo(ctx context.Context, secondary StorageService, task replicationTask) error {
+    if task.delete {
+        return secondary.Delete(ctx, task.key)
+    }
+    if task.metadata != nil {
+        if updater, ok := secondary.(MetadataUpdater); ok {
+            err := updater.UpdateMetadata(ctx, task.key, task.metadata)
+            if !errors.Is(err, ErrObjectNotFound) {
+                return err
+            }
+        }
+    }
+    return s.copyTo(ctx, secondary, task.key)
+}
+
+// copyTo streams an object from the primary to a secondary with its metadata
+func (s *ReplicatedStorageService) copyTo(ctx context.Context, secondary StorageService, storageKey string) error {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return err
+    }
+    reader, writer := io.Pipe()
+    go func() {
+        writer.CloseWithError(s.StorageService.DownloadToWriter(ctx, storageKey, writer))
+    }()
+    opts := NewUploadOptions()
+    opts.StorageKey = storageKey
+    opts.ContentType = metadata.ContentType
+    opts.StripMetadata = false
+    opts.SkipVersion = true
+    opts.Metadata = metadata.Metadata
+    _, err = secondary.UploadFromReader(ctx, reader, path.Base(storageKey), metadata.ContentType, metadata.FileSize, opts)
+    reader.CloseWithError(err)
+    if err != nil {
+        return fmt.Errorf("failed to copy %s to replica: %w", storageKey, err)
+    }
+    return nil
+}
+
+// Run drains the async replication queue and repairs the secondaries every
+// interval until ctx is cancelled. A zero interval disables repair runs.
+func (s *ReplicatedStorageService) Run(ctx context.Context, interval time.Duration) {
+    var tick <-chan time.Time
+    if interval > 0 {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case task := <-s.queue:
+            s.apply(ctx, task)
+        case <-tick:
+            if _, err := s.Repair(ctx, ""); err != nil {
+                log.Error().Err(err).Msg("Replica repair failed")
+            }
+        }
+    }
+}
+
+// Repair copies objects under prefix that are missing on a secondary, or
+// whose size differs from the primary's, from the primary
+func (s *ReplicatedStorageService) Repair(ctx context.Context, prefix string) (*RepairReport, error) {
+    report := &RepairReport{StartedAt: time.Now(), Prefix: prefix}
+    files, err := s.StorageService.ListFiles(ctx, prefix, 0)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list primary objects: %w", err)
+    }
+    for i, secondary := range s.secondaries {
+        replicated, err := secondary.ListFiles(ctx, prefix, 0)
+        if err != nil {
+            return nil, fmt.Errorf("failed to list objects of replica %d: %w", i, err)
+        }
+        sizes := make(map[string]int64, len(replicated))
+        for _, file := range replicated {
+            sizes[file.StorageKey] = file.FileSize
+        }
+        for _, file := range files {
+            if file.IsDirectory {
+                continue
+            }
+            report.Scanned++
+            if size, ok := sizes[file.StorageKey]; ok && size == file.FileSize {
+                continue
+            }
+            if err := s.copyTo(ctx, secondary, file.StorageKey); err != nil {
+                log.Warn().Err(err).Int("replica", i).Str("storage_key", file.StorageKey).Msg("Failed to repair replica")
+                report.Failed++
+                continue
+            }
+            report.Repaired++
+        }
+    }
+    report.FinishedAt = time.Now()
+    log.Info().Str("prefix", prefix).Int("scanned", report.Scanned).Int("repaired", report.Repaired).Int("failed", report.Failed).Dur("took", report.FinishedAt.Sub(report.StartedAt)).Msg("Replica repair finished")
+    return report, nil
+}
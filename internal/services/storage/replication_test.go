@@ -0,0 +1,72 @@
+package storage_test
+
+import (
+    "context"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+func TestReplicatedStorage(t *testing.T) {
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        service, err := storage.NewReplicatedStorageService(storage.NewMemoryStorageService(""), []storage.StorageService{storage.NewMemoryStorageService("")}, storage.ReplicationSync)
+        require.NoError(t, err)
+        return service
+    })
+}
+
+func TestReplicatedMultipartUpload(t *testing.T) {
+    ctx := context.Background()
+    primary := storage.NewMemoryStorageService("")
+    secondary := storage.NewMemoryStorageService("")
+    service, err := storage.NewReplicatedStorageService(primary, []storage.StorageService{secondary}, storage.ReplicationSync)
+    require.NoError(t, err)
+
+    // Resumable uploads find the multipart backend through the decorator
+    multipart, ok := storage.Backend[storage.MultipartStorage](storage.NewEventStorageService(service))
+    require.True(t, ok)
+    assert.Same(t, service, multipart)
+
+    uploadID, err := multipart.CreateMultipartUpload(ctx, "uploads/big.txt", "text/plain", nil)
+    require.NoError(t, err)
+    first, err := multipart.UploadPart(ctx, "uploads/big.txt", uploadID, 1, strings.NewReader("hello "), 6)
+    require.NoError(t, err)
+    second, err := multipart.UploadPart(ctx, "uploads/big.txt", uploadID, 2, strings.NewReader("world"), 5)
+    require.NoError(t, err)
+    exists, err := secondary.Exists(ctx, "uploads/big.txt")
+    require.NoError(t, err)
+    assert.False(t, exists, "parts should stay on the primary")
+
+    _, err = multipart.CompleteMultipartUpload(ctx, "uploads/big.txt", uploadID, []storage.CompletedPart{*first, *second})
+    require.NoError(t, err)
+    data, err := secondary.Download(ctx, "uploads/big.txt")
+    require.NoError(t, err)
+    assert.Equal(t, "hello world", string(data))
+}
+
+func TestReplicatedReplicate(t *testing.T) {
+    ctx := context.Background()
+    primary := storage.NewMemoryStorageService("")
+    secondary := storage.NewMemoryStorageService("")
+    service, err := storage.NewReplicatedStorageService(primary, []storage.StorageService{secondary}, storage.ReplicationSync)
+    require.NoError(t, err)
+
+    // A presigned upload lands on the primary without passing the decorator
+    opts := storage.NewUploadOptions()
+    opts.StorageKey = "uploads/direct.txt"
+    _, err = primary.UploadFromReader(ctx, strings.NewReader("direct"), "direct.txt", "text/plain", 6, opts)
+    require.NoError(t, err)
+    exists, err := secondary.Exists(ctx, "uploads/direct.txt")
+    require.NoError(t, err)
+    require.False(t, exists)
+
+    require.NoError(t, service.Replicate(ctx, "uploads/direct.txt"))
+    data, err := secondary.Download(ctx, "uploads/direct.txt")
+    require.NoError(t, err)
+    assert.Equal(t, "direct", string(data))
+}
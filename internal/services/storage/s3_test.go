@@ -0,0 +1,61 @@
+package storage_test
+
+import (
+    "context"
+    "os"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+    "github.com/D43M0N18/qilin_core/internal/services/storage/storagetest"
+)
+
+// TestS3Storage runs against a real bucket, which it empties before every
+// subtest, so only point it at one kept for tests:
+//
+//    STORAGE_TEST_S3_BUCKET=qilin-test STORAGE_TEST_S3_ENDPOINT=http://localhost:9000 \
+//    STORAGE_TEST_S3_ACCESS_KEY=minioadmin STORAGE_TEST_S3_SECRET_KEY=minioadmin go test ./internal/services/storage/
+func TestS3Storage(t *testing.T) {
+    bucket := os.Getenv("STORAGE_TEST_S3_BUCKET")
+    if bucket == "" {
+        t.Skip("STORAGE_TEST_S3_BUCKET not set")
+    }
+    cfg := appconfig.StorageConfig{
+        Provider:  "s3",
+        Bucket:    bucket,
+        Region:    os.Getenv("STORAGE_TEST_S3_REGION"),
+        Endpoint:  os.Getenv("STORAGE_TEST_S3_ENDPOINT"),
+        AccessKey: os.Getenv("STORAGE_TEST_S3_ACCESS_KEY"),
+        SecretKey: os.Getenv("STORAGE_TEST_S3_SECRET_KEY"),
+    }
+    if cfg.Region == "" {
+        cfg.Region = "us-east-1"
+    }
+    if cfg.Endpoint != "" {
+        cfg.Provider = "minio"
+    }
+    storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+        service, err := storage.NewS3Service(cfg)
+        require.NoError(t, err)
+        emptyBucket(t, service)
+        t.Cleanup(func() { emptyBucket(t, service) })
+        return service
+    })
+}
+
+func emptyBucket(t *testing.T, service storage.StorageService) {
+    t.Helper()
+    ctx := context.Background()
+    files, err := service.ListFiles(ctx, "", 0)
+    require.NoError(t, err)
+    if len(files) == 0 {
+        return
+    }
+    keys := make([]string, len(files))
+    for i, file := range files {
+        keys[i] = file.StorageKey
+    }
+    require.NoError(t, service.DeleteMultiple(ctx, keys))
+}
@@ -0,0 +1,471 @@
+package storage
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "image"
+    "strconv"
+    "strings"
+
+    "github.com/disintegration/imaging"
+)
+
+// Metadata keys the image sanitizer records on an upload
+const (
+    MetaSanitized      = "sanitized"
+    MetaOriginalWidth  = "original_width"
+    MetaOriginalHeight = "original_height"
+    MetaStripped       = "stripped"
+)
+
+const sanitizedJPEGQuality = 92
+
+// sanitizeReport describes what sanitizeImage did to an image
+type sanitizeReport struct {
+    originalWidth  int
+    originalHeight int
+    orientation    int
+    stripped       []string
+}
+
+func (r *sanitizeReport) strip(kind string) {
+    for _, s := range r.stripped {
+        if s == kind {
+            return
+        }
+    }
+    r.stripped = append(r.stripped, kind)
+}
+
+func (r *sanitizeReport) metadata() map[string]string {
+    metadata := map[string]string{
+        MetaSanitized:      "true",
+        MetaOriginalWidth:  strconv.Itoa(r.originalWidth),
+        MetaOriginalHeight: strconv.Itoa(r.originalHeight),
+    }
+    if len(r.stripped) > 0 {
+        metadata[MetaStripped] = strings.Join(r.stripped, ",")
+    }
+    return metadata
+}
+
+// sanitizeImage removes EXIF, XMP, IPTC, comments and, unless keepICC is set,
+// ICC profiles from an image. JPEG and PNG are decoded, rotated according to
+// their EXIF orientation and re-encoded. WebP, which we can't encode, and
+// animated PNG have their metadata chunks dropped in place, keeping only the
+// orientation tag since their pixels stay as stored. GIF carries no camera
+// metadata and is returned unchanged.
+func sanitizeImage(data []byte, contentType string, keepICC bool) ([]byte, *sanitizeReport, error) {
+    switch contentType {
+    case "image/jpeg":
+        return sanitizeJPEG(data, keepICC)
+    case "image/png":
+        return sanitizePNG(data, keepICC)
+    case "image/webp":
+        return sanitizeWebP(data, keepICC)
+    }
+    report := &sanitizeReport{orientation: 1}
+    report.originalWidth, report.originalHeight = imageDimensions(data)
+    return data, report, nil
+}
+
+type jpegSegment struct {
+    marker  byte
+    payload []byte
+    raw     []byte
+}
+
+// jpegSegments returns the marker segments that precede the image data
+func jpegSegments(data []byte) ([]jpegSegment, error) {
+    if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+        return nil, fmt.Errorf("not a JPEG file")
+    }
+    var segments []jpegSegment
+    pos := 2
+    for pos+4 <= len(data) {
+        if data[pos] != 0xFF {
+            return nil, fmt.Errorf("invalid JPEG marker at offset %d", pos)
+        }
+        marker := data[pos+1]
+        if marker == 0xFF {
+            pos++
+            continue
+        }
+        if marker == 0xDA || marker == 0xD9 {
+            break
+        }
+        length := int(binary.BigEndian.Uint16(data[pos+2:]))
+        if length < 2 || pos+2+length > len(data) {
+            return nil, fmt.Errorf("truncated JPEG segment at offset %d", pos)
+        }
+        segments = append(segments, jpegSegment{
+            marker:  marker,
+            payload: data[pos+4 : pos+2+length],
+            raw:     data[pos : pos+2+length],
+        })
+        pos += 2 + length
+    }
+    return segments, nil
+}
+
+func sanitizeJPEG(data []byte, keepICC bool) ([]byte, *sanitizeReport, error) {
+    segments, err := jpegSegments(data)
+    if err != nil {
+        return nil, nil, err
+    }
+    report := &sanitizeReport{orientation: 1}
+    var iccSegments [][]byte
+    for _, segment := range segments {
+        switch {
+        case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte("Exif\x00\x00")):
+            report.orientation = exifOrientation(segment.payload[6:])
+            report.strip("exif")
+        case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte("http://ns.adobe.com/")):
+            report.strip("xmp")
+        case segment.marker == 0xE2 && bytes.HasPrefix(segment.payload, []byte("ICC_PROFILE\x00")):
+            if keepICC {
+                iccSegments = append(iccSegments, segment.raw)
+            } else {
+                report.strip("icc")
+            }
+        case segment.marker == 0xED:
+            report.strip("iptc")
+        case segment.marker == 0xFE:
+            report.strip("comment")
+        }
+    }
+    img, err := imaging.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+    }
+    report.originalWidth, report.originalHeight = img.Bounds().Dx(), img.Bounds().Dy()
+    var buf bytes.Buffer
+    if err := imaging.Encode(&buf, applyOrientation(img, report.orientation), imaging.JPEG, imaging.JPEGQuality(sanitizedJPEGQuality)); err != nil {
+        return nil, nil, fmt.Errorf("failed to encode image: %w", err)
+    }
+    encoded := buf.Bytes()
+    if len(iccSegments) == 0 {
+        return encoded, report, nil
+    }
+    // The encoder writes no APPn segments, so the profile goes right after SOI
+    out := make([]byte, 0, len(encoded)+len(bytes.Join(iccSegments, nil)))
+    out = append(out, encoded[:2]...)
+    for _, segment := range iccSegments {
+        out = append(out, segment...)
+    }
+    return append(out, encoded[2:]...), report, nil
+}
+
+type pngChunk struct {
+    kind string
+    data []byte
+    raw  []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func pngChunks(data []byte) ([]pngChunk, error) {
+    if !bytes.HasPrefix(data, pngSignature) {
+        return nil, fmt.Errorf("not a PNG file")
+    }
+    var chunks []pngChunk
+    pos := len(pngSignature)
+    for pos+12 <= len(data) {
+        length := int(binary.BigEndian.Uint32(data[pos:]))
+        end := pos + 12 + length
+        if length < 0 || end > len(data) {
+            return nil, fmt.Errorf("truncated PNG chunk at offset %d", pos)
+        }
+        chunks = append(chunks, pngChunk{
+            kind: string(data[pos+4 : pos+8]),
+            data: data[pos+8 : pos+8+length],
+            raw:  data[pos:end],
+        })
+        pos = end
+    }
+    return chunks, nil
+}
+
+// newPNGChunk encodes a chunk with its CRC
+func newPNGChunk(kind string, data []byte) pngChunk {
+    raw := make([]byte, 8, 12+len(data))
+    binary.BigEndian.PutUint32(raw, uint32(len(data)))
+    copy(raw[4:], kind)
+    raw = append(raw, data...)
+    raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw[4:]))
+    return pngChunk{kind: kind, data: raw[8 : 8+len(data)], raw: raw}
+}
+
+func joinPNGChunks(chunks []pngChunk) []byte {
+    out := append([]byte(nil), pngSignature...)
+    for _, chunk := range chunks {
+        out = append(out, chunk.raw...)
+    }
+    return out
+}
+
+// pngColorChunks describe how to interpret pixel values and are kept with the ICC profile
+var pngColorChunks = map[string]bool{"iCCP": true, "sRGB": true, "gAMA": true, "cHRM": true}
+
+func sanitizePNG(data []byte, keepICC bool) ([]byte, *sanitizeReport, error) {
+    chunks, err := pngChunks(data)
+    if err != nil {
+        return nil, nil, err
+    }
+    report := &sanitizeReport{orientation: 1}
+    report.originalWidth, report.originalHeight = imageDimensions(data)
+    var kept, colorChunks []pngChunk
+    animated := false
+    exifAt := -1
+    for _, chunk := range chunks {
+        switch {
+        case chunk.kind == "eXIf":
+            report.orientation = exifOrientation(chunk.data)
+            report.strip("exif")
+            exifAt = len(kept)
+        case chunk.kind == "iTXt" && bytes.HasPrefix(chunk.data, []byte("XML:com.adobe.xmp\x00")):
+            report.strip("xmp")
+        case chunk.kind == "tEXt", chunk.kind == "zTXt", chunk.kind == "iTXt", chunk.kind == "tIME":
+            report.strip("text")
+        case pngColorChunks[chunk.kind]:
+            if keepICC {
+                colorChunks = append(colorChunks, chunk)
+                kept = append(kept, chunk)
+            } else if chunk.kind == "iCCP" {
+                report.strip("icc")
+            }
+        default:
+            if chunk.kind == "acTL" {
+                animated = true
+            }
+            kept = append(kept, chunk)
+        }
+    }
+    if animated {
+        // Re-encoding would flatten an APNG to its first frame
+        if exifAt >= 0 && report.orientation > 1 {
+            exif := newPNGChunk("eXIf", orientationEXIF(report.orientation))
+            kept = append(kept[:exifAt], append([]pngChunk{exif}, kept[exifAt:]...)...)
+        }
+        return joinPNGChunks(kept), report, nil
+    }
+    img, err := imaging.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+    }
+    var buf bytes.Buffer
+    if err := imaging.Encode(&buf, applyOrientation(img, report.orientation), imaging.PNG); err != nil {
+        return nil, nil, fmt.Errorf("failed to encode image: %w", err)
+    }
+    if len(colorChunks) == 0 {
+        return buf.Bytes(), report, nil
+    }
+    encoded, err := pngChunks(buf.Bytes())
+    if err != nil || len(encoded) == 0 {
+        return nil, nil, fmt.Errorf("failed to re-encode image")
+    }
+    // Color chunks must precede PLTE and IDAT, so they follow IHDR directly
+    out := append([]pngChunk{encoded[0]}, colorChunks...)
+    return joinPNGChunks(append(out, encoded[1:]...)), report, nil
+}
+
+// VP8X feature flags
+const (
+    webpFlagICC  = 0x20
+    webpFlagEXIF = 0x08
+    webpFlagXMP  = 0x04
+)
+
+// sanitizeWebP drops the XMP and optionally ICCP chunks of a WebP file and
+// reduces its EXIF to the orientation tag. The image is not re-encoded, so
+// viewers still need the orientation to display it upright.
+func sanitizeWebP(data []byte, keepICC bool) ([]byte, *sanitizeReport, error) {
+    if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+        return nil, nil, fmt.Errorf("not a WebP file")
+    }
+    report := &sanitizeReport{orientation: 1}
+    var body []byte
+    vp8xOffset := -1
+    keptEXIF := false
+    pos := 12
+    for pos+8 <= len(data) {
+        fourCC := string(data[pos : pos+4])
+        size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+        end := pos + 8 + size + size%2
+        if size < 0 || pos+8+size > len(data) {
+            return nil, nil, fmt.Errorf("truncated WebP chunk at offset %d", pos)
+        }
+        if end > len(data) {
+            end = len(data)
+        }
+        payload := data[pos+8 : pos+8+size]
+        switch fourCC {
+        case "EXIF":
+            report.orientation = exifOrientation(bytes.TrimPrefix(payload, []byte("Exif\x00\x00")))
+            report.strip("exif")
+            if report.orientation > 1 {
+                body = append(body, webpChunk("EXIF", orientationEXIF(report.orientation))...)
+                keptEXIF = true
+            }
+        case "XMP ":
+            report.strip("xmp")
+        case "ICCP":
+            if !keepICC {
+                report.strip("icc")
+                break
+            }
+            body = append(body, data[pos:end]...)
+        default:
+            if fourCC == "VP8X" {
+                vp8xOffset = len(body)
+            }
+            if report.originalWidth == 0 {
+                report.originalWidth, report.originalHeight = webpDimensions(fourCC, payload)
+            }
+            body = append(body, data[pos:end]...)
+        }
+        pos = end
+    }
+    if vp8xOffset >= 0 && len(body) > vp8xOffset+8 {
+        flags := body[vp8xOffset+8] &^ webpFlagXMP
+        if !keptEXIF {
+            flags &^= webpFlagEXIF
+        }
+        if !keepICC {
+            flags &^= webpFlagICC
+        }
+        body[vp8xOffset+8] = flags
+    }
+    out := make([]byte, 12, 12+len(body))
+    copy(out, "RIFF")
+    binary.LittleEndian.PutUint32(out[4:], uint32(4+len(body)))
+    copy(out[8:], "WEBP")
+    return append(out, body...), report, nil
+}
+
+// webpChunk encodes a RIFF chunk, padded to an even length
+func webpChunk(fourCC string, payload []byte) []byte {
+    chunk := make([]byte, 8, 8+len(payload)+1)
+    copy(chunk, fourCC)
+    binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+    chunk = append(chunk, payload...)
+    if len(payload)%2 == 1 {
+        chunk = append(chunk, 0)
+    }
+    return chunk
+}
+
+// webpDimensions reads the canvas size from a VP8X, VP8 or VP8L chunk
+func webpDimensions(fourCC string, payload []byte) (int, int) {
+    le24 := func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 }
+    switch {
+    case fourCC == "VP8X" && len(payload) >= 10:
+        return le24(payload[4:]) + 1, le24(payload[7:]) + 1
+    case fourCC == "VP8 " && len(payload) >= 10:
+        return int(binary.LittleEndian.Uint16(payload[6:]) & 0x3FFF), int(binary.LittleEndian.Uint16(payload[8:]) & 0x3FFF)
+    case fourCC == "VP8L" && len(payload) >= 5:
+        bits := binary.LittleEndian.Uint32(payload[1:])
+        return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1
+    }
+    return 0, 0
+}
+
+// exifOrientation reads the orientation tag from a TIFF-structured EXIF block
+func exifOrientation(tiff []byte) int {
+    if len(tiff) < 8 {
+        return 1
+    }
+    var order binary.ByteOrder
+    switch string(tiff[:2]) {
+    case "II":
+        order = binary.LittleEndian
+    case "MM":
+        order = binary.BigEndian
+    default:
+        return 1
+    }
+    ifd := int(order.Uint32(tiff[4:]))
+    if ifd < 8 || ifd+2 > len(tiff) {
+        return 1
+    }
+    entries := int(order.Uint16(tiff[ifd:]))
+    for i := 0; i < entries; i++ {
+        entry := ifd + 2 + i*12
+        if entry+12 > len(tiff) {
+            break
+        }
+        if order.Uint16(tiff[entry:]) == 0x0112 {
+            if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+                return value
+            }
+            break
+        }
+    }
+    return 1
+}
+
+// orientationEXIF returns a TIFF-structured EXIF block holding nothing but
+// the orientation tag
+func orientationEXIF(orientation int) []byte {
+    tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+    entry := make([]byte, 12)
+    binary.BigEndian.PutUint16(entry, 0x0112)
+    binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+    binary.BigEndian.PutUint32(entry[4:], 1)
+    binary.BigEndian.PutUint16(entry[8:], uint16(orientation))
+    return append(append(tiff, entry...), 0, 0, 0, 0)
+}
+
+// storedOrientation reads the EXIF orientation an image still carries,
+// because it was stored without sanitizing or couldn't be re-encoded
+func storedOrientation(data []byte) int {
+    switch {
+    case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+        segments, _ := jpegSegments(data)
+        for _, segment := range segments {
+            if segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte("Exif\x00\x00")) {
+                return exifOrientation(segment.payload[6:])
+            }
+        }
+    case bytes.HasPrefix(data, pngSignature):
+        chunks, _ := pngChunks(data)
+        for _, chunk := range chunks {
+            if chunk.kind == "eXIf" {
+                return exifOrientation(chunk.data)
+            }
+        }
+    }
+    return 1
+}
+
+// decodeImage decodes an image and rotates it upright
+func decodeImage(data []byte) (image.Image, error) {
+    img, err := imaging.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    return applyOrientation(img, storedOrientation(data)), nil
+}
+
+// applyOrientation transforms img so it displays upright without its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+    switch orientation {
+    case 2:
+        return imaging.FlipH(img)
+    case 3:
+        return imaging.Rotate180(img)
+    case 4:
+        return imaging.FlipV(img)
+    case 5:
+        return imaging.Transpose(img)
+    case 6:
+        return imaging.Rotate270(img)
+    case 7:
+        return imaging.Transverse(img)
+    case 8:
+        return imaging.Rotate90(img)
+    }
+    return img
+}
@@ -0,0 +1,213 @@
+package storage_test
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "hash/crc32"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "image/png"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// exifTIFF returns a big-endian EXIF block with an orientation tag, after a
+// camera make tag when camera is set
+func exifTIFF(orientation uint16, camera bool) []byte {
+    entry := func(tag, kind uint16, count uint32, value []byte) []byte {
+        e := make([]byte, 12)
+        binary.BigEndian.PutUint16(e, tag)
+        binary.BigEndian.PutUint16(e[2:], kind)
+        binary.BigEndian.PutUint32(e[4:], count)
+        copy(e[8:], value)
+        return e
+    }
+    var entries [][]byte
+    if camera {
+        entries = append(entries, entry(0x010F, 2, 4, []byte("Acm\x00")))
+    }
+    entries = append(entries, entry(0x0112, 3, 1, binary.BigEndian.AppendUint16(nil, orientation)))
+    tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+    tiff = binary.BigEndian.AppendUint16(tiff, uint16(len(entries)))
+    for _, e := range entries {
+        tiff = append(tiff, e...)
+    }
+    return append(tiff, 0, 0, 0, 0)
+}
+
+// landscape returns a 40x20 image, so rotating it by 90 degrees is visible in its size
+func landscape() image.Image {
+    img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+    for x := 0; x < 40; x++ {
+        for y := 0; y < 20; y++ {
+            img.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 12), 128, 255})
+        }
+    }
+    return img
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+    segment := []byte{0xFF, marker, 0, 0}
+    binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+    return append(segment, payload...)
+}
+
+func pngChunk(kind string, data []byte) []byte {
+    chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+    chunk = append(append(chunk, kind...), data...)
+    return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// pngChunkData returns the data of the first chunk of the given kind
+func pngChunkData(data []byte, kind string) ([]byte, bool) {
+    for pos := 8; pos+12 <= len(data); {
+        length := int(binary.BigEndian.Uint32(data[pos:]))
+        if string(data[pos+4:pos+8]) == kind {
+            return data[pos+8 : pos+8+length], true
+        }
+        pos += 12 + length
+    }
+    return nil, false
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+    chunk := append([]byte(fourCC), 0, 0, 0, 0)
+    binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+    chunk = append(chunk, payload...)
+    if len(payload)%2 == 1 {
+        chunk = append(chunk, 0)
+    }
+    return chunk
+}
+
+// webpChunks maps the chunks of a WebP file by FourCC
+func webpChunks(t *testing.T, data []byte) map[string][]byte {
+    require.Equal(t, "RIFF", string(data[:4]))
+    require.Equal(t, len(data)-8, int(binary.LittleEndian.Uint32(data[4:])))
+    chunks := make(map[string][]byte)
+    for pos := 12; pos+8 <= len(data); {
+        size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+        chunks[string(data[pos:pos+4])] = data[pos+8 : pos+8+size]
+        pos += 8 + size + size%2
+    }
+    return chunks
+}
+
+// newWebP returns an extended-format WebP of a 40x20 lossless image with
+// EXIF and XMP chunks. The pixel data is not a valid bitstream, which the
+// sanitizer never decodes.
+func newWebP(exif []byte) []byte {
+    vp8x := []byte{0x08 | 0x04, 0, 0, 0, 39, 0, 0, 19, 0, 0}
+    vp8l := binary.LittleEndian.AppendUint32([]byte{0x2F}, 39|19<<14)
+    body := append([]byte("WEBP"), webpChunk("VP8X", vp8x)...)
+    body = append(body, webpChunk("VP8L", vp8l)...)
+    body = append(body, webpChunk("EXIF", exif)...)
+    body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta/>"))...)
+    out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+    return append(out, body...)
+}
+
+func sanitizeUpload(t *testing.T, data []byte, filename, contentType string, keepICC bool) ([]byte, *storage.UploadResult) {
+    ctx := context.Background()
+    svc := storage.NewMemoryStorageService("")
+    opts := storage.NewUploadOptions()
+    opts.KeepColorProfile = keepICC
+    result, err := svc.UploadFromReader(ctx, bytes.NewReader(data), filename, contentType, int64(len(data)), opts)
+    require.NoError(t, err)
+    stored, err := svc.Download(ctx, result.StorageKey)
+    require.NoError(t, err)
+    return stored, result
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+    var buf bytes.Buffer
+    require.NoError(t, jpeg.Encode(&buf, landscape(), nil))
+    encoded := buf.Bytes()
+    data := append([]byte{}, encoded[:2]...)
+    data = append(data, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifTIFF(6, true)...))...)
+    data = append(data, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+    data = append(data, jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))...)
+    data = append(data, jpegSegment(0xFE, []byte("Shot on Acme"))...)
+    data = append(data, encoded[2:]...)
+
+    stored, result := sanitizeUpload(t, data, "photo.jpg", "image/jpeg", false)
+    assert.Equal(t, 20, result.Width)
+    assert.Equal(t, 40, result.Height)
+    for _, marker := range []string{"Exif\x00\x00", "http://ns.adobe.com/", "ICC_PROFILE", "Acme"} {
+        assert.NotContains(t, string(stored), marker)
+    }
+    assert.Equal(t, map[string]string{
+        storage.MetaSanitized:      "true",
+        storage.MetaOriginalWidth:  "40",
+        storage.MetaOriginalHeight: "20",
+        storage.MetaStripped:       "exif,xmp,icc,comment",
+    }, result.Metadata)
+
+    // The color profile survives when asked for
+    stored, result = sanitizeUpload(t, data, "photo.jpg", "image/jpeg", true)
+    assert.Contains(t, string(stored), "ICC_PROFILE\x00\x01\x01profile")
+    assert.Equal(t, "exif,xmp,comment", result.Metadata[storage.MetaStripped])
+}
+
+func TestSanitizePNG(t *testing.T) {
+    var buf bytes.Buffer
+    require.NoError(t, png.Encode(&buf, landscape()))
+    encoded := buf.Bytes()
+    // IHDR is the first chunk, 25 bytes after the signature
+    ihdrEnd := 8 + 25
+    withMetadata := func(chunks ...[]byte) []byte {
+        data := append([]byte{}, encoded[:ihdrEnd]...)
+        for _, chunk := range chunks {
+            data = append(data, chunk...)
+        }
+        return append(data, encoded[ihdrEnd:]...)
+    }
+    exif := pngChunk("eXIf", exifTIFF(6, true))
+    text := pngChunk("tEXt", []byte("Author\x00Acme"))
+
+    stored, result := sanitizeUpload(t, withMetadata(exif, text), "photo.png", "image/png", false)
+    assert.Equal(t, 20, result.Width)
+    assert.Equal(t, 40, result.Height)
+    _, hasEXIF := pngChunkData(stored, "eXIf")
+    assert.False(t, hasEXIF)
+    _, hasText := pngChunkData(stored, "tEXt")
+    assert.False(t, hasText)
+    assert.Equal(t, "exif,text", result.Metadata[storage.MetaStripped])
+    assert.NotContains(t, result.Metadata, "orientation")
+
+    // An animated PNG isn't re-encoded, so it keeps its orientation alone
+    acTL := pngChunk("acTL", []byte{0, 0, 0, 1, 0, 0, 0, 0})
+    stored, result = sanitizeUpload(t, withMetadata(acTL, exif, text), "animated.png", "image/png", false)
+    assert.Equal(t, 40, result.Width)
+    assert.Equal(t, 20, result.Height)
+    exifData, hasEXIF := pngChunkData(stored, "eXIf")
+    require.True(t, hasEXIF)
+    assert.Equal(t, exifTIFF(6, false), exifData)
+    _, hasText = pngChunkData(stored, "tEXt")
+    assert.False(t, hasText)
+    _, err := png.Decode(bytes.NewReader(stored))
+    assert.NoError(t, err, "chunk CRCs must stay valid")
+}
+
+func TestSanitizeWebP(t *testing.T) {
+    stored, result := sanitizeUpload(t, newWebP(exifTIFF(6, true)), "photo.webp", "image/webp", false)
+    chunks := webpChunks(t, stored)
+    assert.NotContains(t, chunks, "XMP ")
+    assert.Equal(t, exifTIFF(6, false), chunks["EXIF"], "only the orientation is kept")
+    assert.Equal(t, byte(0x08), chunks["VP8X"][0], "the EXIF flag stays and the XMP flag is cleared")
+    assert.Equal(t, "40", result.Metadata[storage.MetaOriginalWidth])
+    assert.Equal(t, "20", result.Metadata[storage.MetaOriginalHeight])
+    assert.Equal(t, "exif,xmp", result.Metadata[storage.MetaStripped])
+
+    // Upright photos need no EXIF at all
+    stored, _ = sanitizeUpload(t, newWebP(exifTIFF(1, true)), "upright.webp", "image/webp", false)
+    chunks = webpChunks(t, stored)
+    assert.NotContains(t, chunks, "EXIF")
+    assert.Equal(t, byte(0), chunks["VP8X"][0])
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// MediaRoute serves objects to holders of a URL signed by
+// SignedURLStorageService
+const MediaRoute = "/media"
+
+const (
+    revokedLinksKeyPrefix = "storage_links_revoked:"
+    // Revocations are kept at least this long, so presigned URLs with a
+    // longer expiry than any configured TTL are still covered
+    minRevocationRetention = 7 * 24 * time.Hour
+)
+
+var ErrLinkRevoked = errors.New("signed URL has been revoked")
+
+// SigningKeys holds the secrets media URLs are signed with. New URLs are
+// signed with the active key; retired keys keep verifying URLs issued before
+// a rotation until they expire.
+type SigningKeys struct {
+    signers map[string]*URLSigner
+    active  string
+}
+
+// ParseSigningKeys parses URL signing keys of the form id:secret separated by
+// commas. The first key listed is active. An empty spec yields a single key
+// "default" holding defaultSecret, the dedicated STORAGE_URL_SIGNING_SECRET.
+func ParseSigningKeys(spec, defaultSecret string) (*SigningKeys, error) {
+    keys := &SigningKeys{signers: make(map[string]*URLSigner)}
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        id, secret, ok := strings.Cut(entry, ":")
+        if !ok || id == "" || secret == "" {
+            return nil, fmt.Errorf("invalid URL signing key %q", id)
+        }
+        if _, ok := keys.signers[id]; ok {
+            return nil, fmt.Errorf("duplicate URL signing key %s", id)
+        }
+        keys.signers[id] = NewURLSigner(secret)
+        if keys.active == "" {
+            keys.active = id
+        }
+    }
+    if len(keys.signers) == 0 {
+        if defaultSecret == "" {
+            return nil, errors.New("no URL signing keys configured")
+        }
+        keys.signers["default"] = NewURLSigner(defaultSecret)
+        keys.active = "default"
+    }
+    return keys, nil
+}
+
+// ParseURLTTLs parses a comma separated list of folder:minutes pairs giving
+// signed URLs of objects under a top-level folder their own lifetime
+func ParseURLTTLs(spec string) (map[string]time.Duration, error) {
+    ttls := make(map[string]time.Duration)
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        folder, value, ok := strings.Cut(entry, ":")
+        minutes, err := strconv.Atoi(value)
+        if !ok || folder == "" || err != nil || minutes <= 0 {
+            return nil, fmt.Errorf("invalid signed URL TTL %q", entry)
+        }
+        ttls[strings.Trim(folder, "/")] = time.Duration(minutes) * time.Minute
+    }
+    return ttls, nil
+}
+
+// SignedURLStorageService hands out expiring signed URLs to MediaRoute in
+// place of the backend's own, so objects can stay private. The token is
+// carried in the query string, which CDNs can forward to the origin or check
+// at the edge:
+//
+//    kid        ID of the signing key
+//    issued     Unix milliseconds the URL was signed at
+//    expires    Unix seconds the URL stops working at
+//    signature  hex HMAC-SHA256 of "<path>\n<issued>\n<expires>"
+//
+// Links to an object are revoked by recording when they were revoked in
+// Redis; URLs issued before then are refused. Upload results keep the
+// backend's URL, which is what records store; see ObjectURL and SignURL.
+type SignedURLStorageService struct {
+    StorageService
+    keys    *SigningKeys
+    redis   *redis.Client
+    baseURL string
+    ttl     time.Duration
+    ttls    map[string]time.Duration
+}
+
+// NewSignedURLStorageService signs URLs to MediaRoute under baseURL, usually
+// a CDN in front of the API. URLs are valid for ttl unless ttls sets another
+// lifetime for the object's top-level folder.
+func NewSignedURLStorageService(backend StorageService, redisClient *redis.Client, keys *SigningKeys, baseURL string, ttl time.Duration, ttls map[string]time.Duration) *SignedURLStorageService {
+    return &SignedURLStorageService{
+        StorageService: backend,
+        keys:           keys,
+        redis:          redisClient,
+        baseURL:        strings.TrimRight(baseURL, "/"),
+        ttl:            ttl,
+        ttls:           ttls,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *SignedURLStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// GetStorageURL returns a signed URL valid for the TTL of the object's folder
+func (s *SignedURLStorageService) GetStorageURL(storageKey string) string {
+    return s.SignedURL(storageKey, s.TTL(storageKey))
+}
+
+// GeneratePresignedURL returns a signed URL valid for expiry
+func (s *SignedURLStorageService) GeneratePresignedURL(ctx context.Context, storageKey string, expiry time.Duration) (string, error) {
+    return s.SignedURL(storageKey, expiry), nil
+}
+
+// TTL returns how long URLs to storageKey are signed for
+func (s *SignedURLStorageService) TTL(storageKey string) time.Duration {
+    folder, _, _ := strings.Cut(strings.TrimPrefix(storageKey, "/"), "/")
+    if ttl, ok := s.ttls[folder]; ok {
+        return ttl
+    }
+    return s.ttl
+}
+
+// SignedURL signs a URL to storageKey valid for ttl
+func (s *SignedURLStorageService) SignedURL(storageKey string, ttl time.Duration) string {
+    urlPath := mediaPath(storageKey)
+    now := time.Now()
+    issued := strconv.FormatInt(now.UnixMilli(), 10)
+    expires := now.Add(ttl)
+    query := url.Values{}
+    query.Set("kid", s.keys.active)
+    query.Set("issued", issued)
+    query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+    query.Set("signature", s.keys.signers[s.keys.active].Sign(urlPath+"\n"+issued, expires))
+    return s.baseURL + (&url.URL{Path: urlPath}).EscapedPath() + "?" + query.Encode()
+}
+
+// VerifyURL checks the token of a request for storageKey and that links to
+// the object, or to the object a thumbnail or derivative was rendered from,
+// haven't been revoked since it was issued
+func (s *SignedURLStorageService) VerifyURL(ctx context.Context, storageKey string, query url.Values) error {
+    signer, ok := s.keys.signers[query.Get("kid")]
+    if !ok {
+        return ErrSignatureInvalid
+    }
+    issued := query.Get("issued")
+    if err := signer.Verify(mediaPath(storageKey)+"\n"+issued, query.Get("expires"), query.Get("signature")); err != nil {
+        return err
+    }
+    issuedAt, err := strconv.ParseInt(issued, 10, 64)
+    if err != nil {
+        return ErrSignatureInvalid
+    }
+    keys := []string{revokedLinksKeyPrefix + storageKey}
+    if source, ok := SourceKey(ctx, s, storageKey); ok {
+        keys = append(keys, revokedLinksKeyPrefix+source)
+    }
+    revocations, err := s.redis.MGet(ctx, keys...).Result()
+    if err != nil {
+        return fmt.Errorf("failed to check link revocation: %w", err)
+    }
+    for _, value := range revocations {
+        revoked, ok := value.(string)
+        if !ok {
+            continue
+        }
+        if revokedAt, err := strconv.ParseInt(revoked, 10, 64); err == nil && issuedAt <= revokedAt {
+            return ErrLinkRevoked
+        }
+    }
+    return nil
+}
+
+// RevokeURLs invalidates every URL signed so far for the given objects and
+// anything rendered from them. URLs signed afterwards work as usual. Copies a
+// CDN already cached stay served until they age out of its cache.
+func (s *SignedURLStorageService) RevokeURLs(ctx context.Context, storageKeys ...string) error {
+    retention := max(s.ttl, minRevocationRetention)
+    for _, ttl := range s.ttls {
+        retention = max(retention, ttl)
+    }
+    now := time.Now().UnixMilli()
+    _, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+        for _, storageKey := range storageKeys {
+            pipe.Set(ctx, revokedLinksKeyPrefix+storageKey, now, retention)
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to revoke links: %w", err)
+    }
+    return nil
+}
+
+func mediaPath(storageKey string) string {
+    return MediaRoute + "/" + strings.TrimPrefix(storageKey, "/")
+}
+
+// ObjectURL returns the unsigned URL the backend serves an object under.
+// Records store this URL, since signed URLs expire.
+func ObjectURL(svc StorageService, storageKey string) string {
+    if signed, ok := Backend[*SignedURLStorageService](svc); ok {
+        return signed.StorageService.GetStorageURL(storageKey)
+    }
+    return svc.GetStorageURL(storageKey)
+}
+
+// SignURL turns the unsigned URL a record kept into a signed URL for a
+// response. URLs that don't point into storage are returned unchanged.
+func SignURL(svc StorageService, objectURL string) string {
+    storageKey, ok := KeyFromURL(svc, objectURL)
+    if !ok {
+        return objectURL
+    }
+    return svc.GetStorageURL(storageKey)
+}
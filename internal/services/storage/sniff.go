@@ -0,0 +1,170 @@
+package storage
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net/http"
+)
+
+// SniffLength is how many leading bytes SniffContentType needs
+const SniffLength = 512
+
+// isoBrands maps ISO base media file brands to the container they imply
+var isoBrands = map[string]string{
+    "qt  ": "video/quicktime",
+    "isom": "video/mp4",
+    "iso2": "video/mp4",
+    "iso4": "video/mp4",
+    "iso5": "video/mp4",
+    "iso6": "video/mp4",
+    "mp41": "video/mp4",
+    "mp42": "video/mp4",
+    "avc1": "video/mp4",
+    "dash": "video/mp4",
+    "M4V ": "video/mp4",
+    "M4VH": "video/mp4",
+    "M4VP": "video/mp4",
+    "MSNV": "video/mp4",
+    "3gp4": "video/mp4",
+    "3gp5": "video/mp4",
+}
+
+// SniffContentType detects the content type of a file from its leading
+// bytes. Media containers we accept are parsed explicitly; anything else is
+// named by http.DetectContentType so rejections can say what was found.
+func SniffContentType(head []byte) string {
+    switch {
+    case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+        return "image/jpeg"
+    case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+        return "image/png"
+    case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+        return "image/gif"
+    case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+        return "image/webp"
+    case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("AVI ")):
+        return "video/x-msvideo"
+    }
+    if contentType := sniffISOBMFF(head); contentType != "" {
+        return contentType
+    }
+    if contentType := sniffEBML(head); contentType != "" {
+        return contentType
+    }
+    return http.DetectContentType(head)
+}
+
+// sniffISOBMFF recognises MP4 and QuickTime files by their leading box. The
+// ftyp box names the major and compatible brands; QuickTime files written
+// before ftyp existed start straight with a moov, mdat, wide or free box.
+func sniffISOBMFF(head []byte) string {
+    if len(head) < 8 {
+        return ""
+    }
+    boxSize := binary.BigEndian.Uint32(head[:4])
+    switch string(head[4:8]) {
+    case "ftyp":
+        if boxSize < 16 || len(head) < 12 {
+            return ""
+        }
+        if contentType, ok := isoBrands[string(head[8:12])]; ok {
+            return contentType
+        }
+        // Unknown major brand: fall back to the compatible brands list
+        end := int(boxSize)
+        if end > len(head) {
+            end = len(head)
+        }
+        for i := 16; i+4 <= end; i += 4 {
+            if contentType, ok := isoBrands[string(head[i:i+4])]; ok {
+                return contentType
+            }
+        }
+    case "moov", "mdat", "wide", "free", "skip", "pnot":
+        if boxSize >= 8 || boxSize == 1 {
+            return "video/quicktime"
+        }
+    }
+    return ""
+}
+
+// sniffEBML recognises WebM by walking the EBML header for its DocType
+func sniffEBML(head []byte) string {
+    if !bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+        return ""
+    }
+    size, n := readVint(head[4:])
+    if n == 0 {
+        return ""
+    }
+    pos := 4 + n
+    end := pos + int(size)
+    if end > len(head) || end < pos {
+        end = len(head)
+    }
+    for pos < end {
+        id, idLen := readElementID(head[pos:])
+        if idLen == 0 {
+            return ""
+        }
+        pos += idLen
+        length, lenLen := readVint(head[pos:])
+        if lenLen == 0 {
+            return ""
+        }
+        pos += lenLen
+        if length > uint64(len(head)-pos) {
+            return ""
+        }
+        if id == 0x4282 {
+            docType := string(bytes.TrimRight(head[pos:pos+int(length)], "\x00"))
+            if docType == "webm" {
+                return "video/webm"
+            }
+            if docType == "matroska" {
+                return "video/x-matroska"
+            }
+            return ""
+        }
+        pos += int(length)
+    }
+    return ""
+}
+
+// readVint decodes an EBML variable length integer with its marker bit cleared
+func readVint(b []byte) (uint64, int) {
+    if len(b) == 0 || b[0] == 0 {
+        return 0, 0
+    }
+    length := 1
+    for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+        length++
+    }
+    if len(b) < length {
+        return 0, 0
+    }
+    value := uint64(b[0] & (0xFF >> length))
+    for i := 1; i < length; i++ {
+        value = value<<8 | uint64(b[i])
+    }
+    return value, length
+}
+
+// readElementID decodes an EBML element ID, which keeps its marker bit
+func readElementID(b []byte) (uint32, int) {
+    if len(b) == 0 || b[0] == 0 {
+        return 0, 0
+    }
+    length := 1
+    for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > 4 || len(b) < length {
+        return 0, 0
+    }
+    var id uint32
+    for i := 0; i < length; i++ {
+        id = id<<8 | uint32(b[i])
+    }
+    return id, length
+}
@@ -0,0 +1,60 @@
+package storage_test
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// ebmlHeader returns an EBML header holding a DocType element after a
+// DocTypeVersion element
+func ebmlHeader(docType string) []byte {
+    body := []byte{0x42, 0x87, 0x81, 0x04, 0x42, 0x82, 0x80 | byte(len(docType))}
+    body = append(body, docType...)
+    return append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x80 | byte(len(body))}, body...)
+}
+
+func TestSniffContentType(t *testing.T) {
+    tests := []struct {
+        name string
+        head string
+        want string
+    }{
+        {"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00", "image/jpeg"},
+        {"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+        {"gif87a", "GIF87a\x01\x00\x01\x00", "image/gif"},
+        {"gif89a", "GIF89a\x01\x00\x01\x00", "image/gif"},
+        {"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+        {"avi", "RIFF\x24\x00\x00\x00AVI LIST", "video/x-msvideo"},
+        {"riff wave", "RIFF\x24\x00\x00\x00WAVEfmt ", "audio/wave"},
+        {"mp4 isom", "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2", "video/mp4"},
+        {"mp4 mp42", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom", "video/mp4"},
+        {"m4v", "\x00\x00\x00\x14ftypM4V \x00\x00\x00\x01M4V ", "video/mp4"},
+        {"3gp", "\x00\x00\x00\x14ftyp3gp4\x00\x00\x02\x00isom", "video/mp4"},
+        {"dash", "\x00\x00\x00\x14ftypdash\x00\x00\x00\x00iso6", "video/mp4"},
+        {"quicktime brand", "\x00\x00\x00\x14ftypqt  \x20\x05\x03\x00qt  ", "video/quicktime"},
+        {"compatible brand", "\x00\x00\x00\x18ftypXAVC\x00\x00\x00\x00XAVCmp42", "video/mp4"},
+        {"compatible brand past box", "\x00\x00\x00\x10ftypXAVC\x00\x00\x00\x00mp42", "application/octet-stream"},
+        {"short ftyp", "\x00\x00\x00\x0cftypqt  ", "application/octet-stream"},
+        {"quicktime moov", "\x00\x00\x01\x00moov\x00\x00\x00\x6cmvhd", "video/quicktime"},
+        {"quicktime mdat", "\x00\x00\x00\x01mdat\x00\x00\x00\x00\x00\x01\x00\x00", "video/quicktime"},
+        {"quicktime wide", "\x00\x00\x00\x08wide\x00\x01\x00\x00mdat", "video/quicktime"},
+        {"moov with bad size", "\x00\x00\x00\x04moov\x00\x00\x00\x00", "application/octet-stream"},
+        {"webm", string(ebmlHeader("webm")), "video/webm"},
+        {"matroska", string(ebmlHeader("matroska")), "video/x-matroska"},
+        {"executable", "MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00", "application/octet-stream"},
+        {"text", "hello, world", "text/plain; charset=utf-8"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, tt.want, storage.SniffContentType([]byte(tt.head)))
+        })
+    }
+}
+
+func TestSniffContentTypeMatroskaPaddedDocType(t *testing.T) {
+    // Some muxers pad the DocType with zero bytes
+    assert.Equal(t, "video/x-matroska", storage.SniffContentType(ebmlHeader("matroska\x00\x00")))
+}
@@ -0,0 +1,455 @@
+// Package storagetest provides a conformance suite that every
+// storage.StorageService implementation is expected to pass.
+//
+// Backends run it from their own tests:
+//
+//    func TestMemoryStorage(t *testing.T) {
+//        storagetest.RunConformance(t, func(t *testing.T) storage.StorageService {
+//            return storage.NewMemoryStorageService("")
+//        })
+//    }
+package storagetest
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/png"
+    "io"
+    "mime/multipart"
+    "net/textproto"
+    "path"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+// Factory returns a fresh, empty backend for a single subtest
+type Factory func(t *testing.T) storage.StorageService
+
+// RunConformance runs the full conformance suite against the backend built by newService
+func RunConformance(t *testing.T, newService Factory) {
+    t.Run("Upload", func(t *testing.T) { testUpload(t, newService(t)) })
+    t.Run("UploadFromReader", func(t *testing.T) { testUploadFromReader(t, newService(t)) })
+    t.Run("Download", func(t *testing.T) { testDownload(t, newService(t)) })
+    t.Run("DownloadRange", func(t *testing.T) { testDownloadRange(t, newService(t)) })
+    t.Run("ExistsAndDelete", func(t *testing.T) { testExistsAndDelete(t, newService(t)) })
+    t.Run("DeleteMultiple", func(t *testing.T) { testDeleteMultiple(t, newService(t)) })
+    t.Run("CopyAndMove", func(t *testing.T) { testCopyAndMove(t, newService(t)) })
+    t.Run("ListFiles", func(t *testing.T) { testListFiles(t, newService(t)) })
+    t.Run("ListFilesPage", func(t *testing.T) { testListFilesPage(t, newService(t)) })
+    t.Run("Thumbnails", func(t *testing.T) { testThumbnails(t, newService(t)) })
+    t.Run("PresignedURL", func(t *testing.T) { testPresignedURL(t, newService(t)) })
+    t.Run("Versioning", func(t *testing.T) { testVersioning(t, newService(t)) })
+}
+
+func testUpload(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    data := []byte("hello conformance")
+    file, header := NewFileHeader(t, "notes.txt", "text/plain", data)
+    defer file.Close()
+
+    opts := newOptions("uploads")
+    opts.Metadata["original_name"] = "notes.txt"
+    result, err := svc.Upload(ctx, file, header, opts)
+    require.NoError(t, err)
+
+    assert.NotEmpty(t, result.StorageKey)
+    assert.True(t, strings.HasPrefix(result.StorageKey, "uploads/"+opts.UserID.String()+"/"), "key %q should be under folder and user", result.StorageKey)
+    assert.Equal(t, ".txt", path.Ext(result.StorageKey))
+    assert.Equal(t, int64(len(data)), result.FileSize)
+    assert.Equal(t, "text/plain", result.ContentType)
+    assert.Equal(t, path.Base(result.StorageKey), result.FileName)
+    assert.NotEmpty(t, result.URL)
+    assert.Equal(t, svc.GetStorageURL(result.StorageKey), result.URL)
+
+    metadata, err := svc.GetMetadata(ctx, result.StorageKey)
+    require.NoError(t, err)
+    assert.Equal(t, result.StorageKey, metadata.StorageKey)
+    assert.Equal(t, int64(len(data)), metadata.FileSize)
+    assert.Equal(t, "text/plain", metadata.ContentType)
+    assert.Equal(t, "notes.txt", metadata.Metadata["original_name"])
+    assert.False(t, metadata.LastModified.IsZero())
+}
+
+func testUploadFromReader(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    data := bytes.Repeat([]byte("video"), 1024)
+
+    opts := newOptions("videos")
+    opts.CustomFilename = "ad.mp4"
+    result, err := svc.UploadFromReader(ctx, bytes.NewReader(data), "ignored.mp4", "video/mp4", int64(len(data)), opts)
+    require.NoError(t, err)
+    assert.Equal(t, "ad.mp4", path.Base(result.StorageKey))
+    assert.Equal(t, int64(len(data)), result.FileSize)
+    assert.Equal(t, "video/mp4", result.ContentType)
+
+    // Unknown sizes must be accepted as well
+    result, err = svc.UploadFromReader(ctx, bytes.NewReader(data), "clip.mp4", "", -1, newOptions("videos"))
+    require.NoError(t, err)
+    assert.Equal(t, int64(len(data)), result.FileSize)
+    assert.Equal(t, "video/mp4", result.ContentType, "content type should fall back to the extension")
+
+    // Keys must be unique across uploads of the same file
+    again, err := svc.UploadFromReader(ctx, bytes.NewReader(data), "clip.mp4", "video/mp4", int64(len(data)), newOptions("videos"))
+    require.NoError(t, err)
+    assert.NotEqual(t, result.StorageKey, again.StorageKey)
+}
+
+func testDownload(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    data := []byte("download me")
+    key := mustUpload(t, svc, "downloads", "file.bin", data)
+
+    got, err := svc.Download(ctx, key)
+    require.NoError(t, err)
+    assert.Equal(t, data, got)
+
+    var buf bytes.Buffer
+    require.NoError(t, svc.DownloadToWriter(ctx, key, &buf))
+    assert.Equal(t, data, buf.Bytes())
+
+    _, err = svc.Download(ctx, "downloads/missing.bin")
+    assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+    _, err = svc.GetMetadata(ctx, "downloads/missing.bin")
+    assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func testDownloadRange(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    data := make([]byte, 200*1024)
+    for i := range data {
+        data[i] = byte(i % 251)
+    }
+    key := mustUpload(t, svc, "ranges", "clip.bin", data)
+
+    ranges := []struct{ offset, length int64 }{
+        {0, 10},
+        {5, 1},
+        {65530, 20},
+        {131072, 65536},
+        {int64(len(data)) - 7, -1},
+        {int64(len(data)) - 7, 100},
+        {100, -1},
+    }
+    for _, r := range ranges {
+        var buf bytes.Buffer
+        require.NoError(t, svc.DownloadRange(ctx, key, r.offset, r.length, &buf), "range %d+%d", r.offset, r.length)
+        end := int64(len(data))
+        if r.length >= 0 && r.offset+r.length < end {
+            end = r.offset + r.length
+        }
+        assert.Equal(t, data[r.offset:end], buf.Bytes(), "range %d+%d", r.offset, r.length)
+    }
+
+    err := svc.DownloadRange(ctx, key, int64(len(data)), 10, io.Discard)
+    assert.ErrorIs(t, err, storage.ErrInvalidRange)
+    err = svc.DownloadRange(ctx, "ranges/missing.bin", 0, 10, io.Discard)
+    assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func testVersioning(t *testing.T, svc storage.StorageService) {
+    versioner, ok := storage.Backend[storage.Versioner](svc)
+    if !ok {
+        t.Skip("backend does not keep versions")
+    }
+    ctx := context.Background()
+    key := mustUpload(t, svc, "versions", "doc.txt", []byte("first"))
+    opts := newOptions("versions")
+    opts.StorageKey = key
+    _, err := svc.UploadFromReader(ctx, strings.NewReader("second"), "doc.txt", "", 6, opts)
+    require.NoError(t, err)
+
+    versions, err := versioner.ListVersions(ctx, key)
+    if errors.Is(err, storage.ErrVersioningUnsupported) {
+        t.Skip("backend does not keep versions")
+    }
+    require.NoError(t, err)
+    require.Len(t, versions, 2)
+    assert.True(t, versions[0].IsCurrent)
+    assert.False(t, versions[1].IsCurrent)
+    assert.Equal(t, int64(6), versions[0].FileSize)
+    assert.Equal(t, int64(5), versions[1].FileSize)
+
+    var buf bytes.Buffer
+    require.NoError(t, versioner.DownloadVersion(ctx, key, versions[1].VersionID, &buf))
+    assert.Equal(t, "first", buf.String())
+    metadata, err := versioner.GetVersionMetadata(ctx, key, versions[1].VersionID)
+    require.NoError(t, err)
+    assert.Equal(t, int64(5), metadata.FileSize)
+    assert.ErrorIs(t, versioner.DownloadVersion(ctx, key, "missing", io.Discard), storage.ErrVersionNotFound)
+
+    require.NoError(t, versioner.RestoreVersion(ctx, key, versions[1].VersionID))
+    data, err := svc.Download(ctx, key)
+    require.NoError(t, err)
+    assert.Equal(t, "first", string(data))
+    versions, err = versioner.ListVersions(ctx, key)
+    require.NoError(t, err)
+    assert.Len(t, versions, 3)
+
+    // The history is not listed with the objects
+    files, err := svc.ListFiles(ctx, "", 0)
+    require.NoError(t, err)
+    assert.Equal(t, []string{key}, storageKeys(files))
+}
+
+func testExistsAndDelete(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    key := mustUpload(t, svc, "exists", "a.txt", []byte("a"))
+
+    exists, err := svc.Exists(ctx, key)
+    require.NoError(t, err)
+    assert.True(t, exists)
+
+    exists, err = svc.Exists(ctx, "exists/never-uploaded.txt")
+    require.NoError(t, err)
+    assert.False(t, exists)
+
+    require.NoError(t, svc.Delete(ctx, key))
+    exists, err = svc.Exists(ctx, key)
+    require.NoError(t, err)
+    assert.False(t, exists)
+
+    // Deleting is idempotent, as it is on S3
+    assert.NoError(t, svc.Delete(ctx, key))
+}
+
+func testDeleteMultiple(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    keep := mustUpload(t, svc, "multi", "keep.txt", []byte("keep"))
+    var keys []string
+    for i := 0; i < 3; i++ {
+        keys = append(keys, mustUpload(t, svc, "multi", fmt.Sprintf("%d.txt", i), []byte{byte(i)}))
+    }
+
+    require.NoError(t, svc.DeleteMultiple(ctx, append(keys, "multi/missing.txt")))
+    for _, key := range keys {
+        exists, err := svc.Exists(ctx, key)
+        require.NoError(t, err)
+        assert.False(t, exists, "%s should be deleted", key)
+    }
+    exists, err := svc.Exists(ctx, keep)
+    require.NoError(t, err)
+    assert.True(t, exists, "unrelated keys must survive")
+
+    assert.NoError(t, svc.DeleteMultiple(ctx, nil))
+}
+
+func testCopyAndMove(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    data := []byte("copy me")
+    source := mustUpload(t, svc, "copy", "source.txt", data)
+
+    copied := "copy/dest/copied.txt"
+    require.NoError(t, svc.Copy(ctx, source, copied))
+    for _, key := range []string{source, copied} {
+        got, err := svc.Download(ctx, key)
+        require.NoError(t, err)
+        assert.Equal(t, data, got, "%s after copy", key)
+    }
+    sourceMetadata, err := svc.GetMetadata(ctx, source)
+    require.NoError(t, err)
+    metadata, err := svc.GetMetadata(ctx, copied)
+    require.NoError(t, err)
+    assert.Equal(t, sourceMetadata.ContentType, metadata.ContentType, "copy should keep the content type")
+
+    moved := "copy/dest/moved.txt"
+    require.NoError(t, svc.Move(ctx, source, moved))
+    exists, err := svc.Exists(ctx, source)
+    require.NoError(t, err)
+    assert.False(t, exists, "move should remove the source")
+    got, err := svc.Download(ctx, moved)
+    require.NoError(t, err)
+    assert.Equal(t, data, got)
+
+    assert.ErrorIs(t, svc.Copy(ctx, "copy/missing.txt", "copy/x.txt"), storage.ErrObjectNotFound)
+    assert.ErrorIs(t, svc.Move(ctx, "copy/missing.txt", "copy/y.txt"), storage.ErrObjectNotFound)
+}
+
+func testListFiles(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    var keys []string
+    for i := 0; i < 5; i++ {
+        keys = append(keys, mustUpload(t, svc, "list/a", fmt.Sprintf("%d.txt", i), []byte("x")))
+    }
+    other := mustUpload(t, svc, "list/b", "other.txt", []byte("y"))
+
+    files, err := svc.ListFiles(ctx, "list/a/", 0)
+    require.NoError(t, err)
+    assert.ElementsMatch(t, keys, storageKeys(files))
+    for _, file := range files {
+        assert.Equal(t, int64(1), file.FileSize)
+        assert.Equal(t, path.Base(file.StorageKey), file.FileName)
+        assert.False(t, file.IsDirectory)
+    }
+
+    files, err = svc.ListFiles(ctx, "list/", 0)
+    require.NoError(t, err)
+    assert.Contains(t, storageKeys(files), other)
+    assert.Len(t, files, 6)
+
+    files, err = svc.ListFiles(ctx, "list/a/", 2)
+    require.NoError(t, err)
+    assert.Len(t, files, 2, "limit should cap the result")
+
+    // A prefix may end mid-segment, as it can on S3
+    files, err = svc.ListFiles(ctx, "list/", 100)
+    require.NoError(t, err)
+    assert.Len(t, files, 6)
+    files, err = svc.ListFiles(ctx, "lis", 0)
+    require.NoError(t, err)
+    assert.Len(t, files, 6)
+
+    files, err = svc.ListFiles(ctx, "nothing-here/", 10)
+    require.NoError(t, err)
+    assert.Empty(t, files)
+}
+
+func testListFilesPage(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    var keys []string
+    for i := 0; i < 5; i++ {
+        keys = append(keys, mustUpload(t, svc, "pages", fmt.Sprintf("%d.txt", i), []byte("x")))
+    }
+    sort.Strings(keys)
+
+    var listed []string
+    opts := storage.ListOptions{Limit: 2}
+    for pages := 1; ; pages++ {
+        page, err := svc.ListFilesPage(ctx, "pages/", opts)
+        require.NoError(t, err)
+        assert.LessOrEqual(t, len(page.Files), 2)
+        listed = append(listed, storageKeys(page.Files)...)
+        if page.NextContinuationToken == "" {
+            assert.Equal(t, 3, pages)
+            break
+        }
+        require.Less(t, pages, 3, "listing should end")
+        opts.ContinuationToken = page.NextContinuationToken
+    }
+    assert.Equal(t, keys, listed, "pages should cover every object once, in key order")
+
+    page, err := svc.ListFilesPage(ctx, "pages/", storage.ListOptions{})
+    require.NoError(t, err)
+    assert.Len(t, page.Files, 5)
+    assert.Empty(t, page.NextContinuationToken)
+
+    _, err = svc.ListFilesPage(ctx, "pages/", storage.ListOptions{ContinuationToken: "%%%"})
+    assert.ErrorIs(t, err, storage.ErrInvalidListToken)
+}
+
+func testThumbnails(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    file, header := NewFileHeader(t, "product.png", "image/png", NewPNG(t, 640, 480))
+    defer file.Close()
+
+    opts := newOptions("uploads")
+    opts.GenerateThumbnail = true
+    opts.ThumbnailWidth = 120
+    opts.ThumbnailHeight = 80
+    result, err := svc.Upload(ctx, file, header, opts)
+    require.NoError(t, err)
+    assert.Equal(t, 640, result.Width)
+    assert.Equal(t, 480, result.Height)
+    assert.NotEmpty(t, result.ThumbnailURL)
+
+    thumbKey := strings.TrimSuffix(result.StorageKey, ".png") + "_thumb.png"
+    assertImageSize(t, svc, thumbKey, 120, 80)
+
+    thumb, err := svc.GenerateThumbnail(ctx, result.StorageKey, 50, 50)
+    require.NoError(t, err)
+    assert.Equal(t, 50, thumb.Width)
+    assert.Equal(t, 50, thumb.Height)
+    assertImageSize(t, svc, thumb.StorageKey, 50, 50)
+
+    _, err = svc.GenerateThumbnail(ctx, "uploads/missing.png", 50, 50)
+    assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func testPresignedURL(t *testing.T, svc storage.StorageService) {
+    ctx := context.Background()
+    key := mustUpload(t, svc, "presign", "file.txt", []byte("signed"))
+    url, err := svc.GeneratePresignedURL(ctx, key, time.Minute)
+    require.NoError(t, err)
+    assert.NotEmpty(t, url)
+}
+
+// NewFileHeader builds a real multipart file and header, as a handler
+// would receive them from ParseMultipartForm
+func NewFileHeader(t *testing.T, filename, contentType string, data []byte) (multipart.File, *multipart.FileHeader) {
+    t.Helper()
+    var body bytes.Buffer
+    writer := multipart.NewWriter(&body)
+    partHeader := textproto.MIMEHeader{}
+    partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+    partHeader.Set("Content-Type", contentType)
+    part, err := writer.CreatePart(partHeader)
+    require.NoError(t, err)
+    _, err = part.Write(data)
+    require.NoError(t, err)
+    require.NoError(t, writer.Close())
+
+    form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(int64(len(data)) + 1024)
+    require.NoError(t, err)
+    t.Cleanup(func() { form.RemoveAll() })
+    header := form.File["file"][0]
+    file, err := header.Open()
+    require.NoError(t, err)
+    return file, header
+}
+
+// NewPNG encodes a width x height gradient PNG
+func NewPNG(t *testing.T, width, height int) []byte {
+    t.Helper()
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+        }
+    }
+    var buf bytes.Buffer
+    require.NoError(t, png.Encode(&buf, img))
+    return buf.Bytes()
+}
+
+func newOptions(folder string) *storage.UploadOptions {
+    opts := storage.NewUploadOptions()
+    opts.Folder = folder
+    opts.UserID = uuid.New()
+    return opts
+}
+
+func mustUpload(t *testing.T, svc storage.StorageService, folder, filename string, data []byte) string {
+    t.Helper()
+    result, err := svc.UploadFromReader(context.Background(), bytes.NewReader(data), filename, "", int64(len(data)), newOptions(folder))
+    require.NoError(t, err)
+    return result.StorageKey
+}
+
+func storageKeys(files []*storage.FileInfo) []string {
+    keys := make([]string, len(files))
+    for i, file := range files {
+        keys[i] = file.StorageKey
+    }
+    return keys
+}
+
+func assertImageSize(t *testing.T, svc storage.StorageService, storageKey string, width, height int) {
+    t.Helper()
+    data, err := svc.Download(context.Background(), storageKey)
+    require.NoError(t, err)
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    require.NoError(t, err)
+    assert.Equal(t, width, cfg.Width)
+    assert.Equal(t, height, cfg.Height)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "io"
+    "mime"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/disintegration/imaging"
+    "github.com/google/uuid"
+)
+
+// generateStorageKey builds a unique object key of the form
+// folder/userID/yyyy/mm/dd/uuid.ext for a new upload
+func generateStorageKey(opts *UploadOptions, filename string) string {
+    if opts.StorageKey != "" {
+        return opts.StorageKey
+    }
+    ext := strings.ToLower(filepath.Ext(filename))
+    name := uuid.New().String() + ext
+    if opts.CustomFilename != "" {
+        name = opts.CustomFilename
+        if filepath.Ext(name) == "" {
+            name += ext
+        }
+    }
+    parts := []string{}
+    if opts.Folder != "" {
+        parts = append(parts, strings.Trim(opts.Folder, "/"))
+    }
+    if opts.UserID != uuid.Nil {
+        parts = append(parts, opts.UserID.String())
+    }
+    parts = append(parts, time.Now().UTC().Format("2006/01/02"), name)
+    return path.Join(parts...)
+}
+
+// KeyFromURL returns the storage key of an object from the URL it is served
+// under, for records that kept the URL but not the key
+func KeyFromURL(svc StorageService, objectURL string) (string, bool) {
+    base := ObjectURL(svc, "")
+    if objectURL == "" || !strings.HasPrefix(objectURL, base) {
+        return "", false
+    }
+    key := strings.TrimPrefix(objectURL, base)
+    if i := strings.IndexByte(key, '?'); i >= 0 {
+        key = key[:i]
+    }
+    return key, key != ""
+}
+
+// rangeLength checks a range against an object of size bytes and returns
+// its length clamped to the end of the object
+func rangeLength(storageKey string, offset, length, size int64) (int64, error) {
+    if offset < 0 || (offset >= size && !(offset == 0 && size == 0)) {
+        return 0, fmt.Errorf("%w: offset %d of %s", ErrInvalidRange, offset, storageKey)
+    }
+    if length < 0 || offset+length > size {
+        length = size - offset
+    }
+    return length, nil
+}
+
+// thumbnailKey returns the key a thumbnail of storageKey is stored under
+func thumbnailKey(storageKey string) string {
+    ext := filepath.Ext(storageKey)
+    return strings.TrimSuffix(storageKey, ext) + "_thumb" + ext
+}
+
+// extContentTypes covers the media types we accept even on hosts without a
+// system mime.types file
+var extContentTypes = map[string]string{
+    ".jpg":  "image/jpeg",
+    ".jpeg": "image/jpeg",
+    ".png":  "image/png",
+    ".gif":  "image/gif",
+    ".webp": "image/webp",
+    ".mp4":  "video/mp4",
+    ".mov":  "video/quicktime",
+    ".avi":  "video/x-msvideo",
+    ".webm": "video/webm",
+    ".pdf":  "application/pdf",
+    ".txt":  "text/plain",
+}
+
+// detectContentType resolves the content type of an upload, preferring the
+// explicitly provided value over the file extension
+func detectContentType(filename string, provided ...string) string {
+    for _, ct := range provided {
+        if ct != "" && ct != "application/octet-stream" {
+            return ct
+        }
+    }
+    ext := strings.ToLower(filepath.Ext(filename))
+    if ct, ok := extContentTypes[ext]; ok {
+        return ct
+    }
+    if ct := mime.TypeByExtension(ext); ct != "" {
+        return ct
+    }
+    return "application/octet-stream"
+}
+
+// isImageContentType reports whether thumbnails can be generated for contentType
+func isImageContentType(contentType string) bool {
+    return strings.HasPrefix(contentType, "image/")
+}
+
+// imageDimensions decodes only the image header to read its dimensions
+func imageDimensions(data []byte) (int, int) {
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return 0, 0
+    }
+    return cfg.Width, cfg.Height
+}
+
+// createThumbnail scales the image to fill width x height and encodes it in
+// the format implied by the storage key
+func createThumbnail(r io.Reader, storageKey string, width, height int) ([]byte, error) {
+    if width <= 0 {
+        width = DefaultThumbnailWidth
+    }
+    if height <= 0 {
+        height = DefaultThumbnailHeight
+    }
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read image: %w", err)
+    }
+    img, err := decodeImage(data)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode image: %w", err)
+    }
+    format, err := imaging.FormatFromFilename(storageKey)
+    if err != nil {
+        format = imaging.JPEG
+    }
+    thumb := imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos)
+    var buf bytes.Buffer
+    if err := imaging.Encode(&buf, thumb, format, imaging.JPEGQuality(85)); err != nil {
+        return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// sanitizeUpload runs the image sanitizer over data when opts asks for it.
+// It returns the bytes to store and the options to store them with, whose
+// Metadata records what the sanitizer did.
+func sanitizeUpload(data []byte, contentType string, opts *UploadOptions) ([]byte, *UploadOptions, error) {
+    if !opts.StripMetadata || !isImageContentType(contentType) {
+        return data, opts, nil
+    }
+    sanitized, report, err := sanitizeImage(data, contentType, opts.KeepColorProfile)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to sanitize image: %w", err)
+    }
+    withReport := *opts
+    withReport.Metadata = copyMetadata(opts.Metadata)
+    if withReport.Metadata == nil {
+        withReport.Metadata = make(map[string]string)
+    }
+    for k, v := range report.metadata() {
+        withReport.Metadata[k] = v
+    }
+    return sanitized, &withReport, nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+    if metadata == nil {
+        return nil
+    }
+    copied := make(map[string]string, len(metadata))
+    for k, v := range metadata {
+        copied[k] = v
+    }
+    return copied
+}
@@ -0,0 +1,422 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "path"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/rs/zerolog/log"
+)
+
+const (
+    // VersionFolder holds the previous contents of overwritten objects when
+    // versioning is emulated
+    VersionFolder = ".versions"
+    // MetaVersionID is the object metadata key holding the emulated version ID
+    MetaVersionID = "version-id"
+    // NullVersion is the version ID of an object written before versioning
+    // was enabled, as S3 calls it
+    NullVersion = "null"
+)
+
+var (
+    ErrVersionNotFound       = errors.New("object version not found")
+    ErrVersioningUnsupported = errors.New("storage backend does not keep object versions")
+)
+
+// ObjectVersion describes one version of an object
+type ObjectVersion struct {
+    VersionID    string    `json:"version_id"`
+    FileSize     int64     `json:"file_size"`
+    ETag         string    `json:"etag,omitempty"`
+    LastModified time.Time `json:"last_modified"`
+    IsCurrent    bool      `json:"is_current"`
+}
+
+// Versioner is implemented by storage that keeps the previous contents of
+// overwritten objects. Versions are listed newest first, the current one
+// included. Restoring a version makes a copy of it the current version, so
+// the history is never rewritten.
+type Versioner interface {
+    ListVersions(ctx context.Context, storageKey string) ([]*ObjectVersion, error)
+    GetVersionMetadata(ctx context.Context, storageKey, versionID string) (*FileMetadata, error)
+    DownloadVersion(ctx context.Context, storageKey, versionID string, writer io.Writer) error
+    RestoreVersion(ctx context.Context, storageKey, versionID string) error
+}
+
+// VersionedStorageService emulates object versioning for backends that
+// don't keep versions themselves. Before an object is overwritten, its
+// current contents are copied under VersionFolder, and only the newest
+// maxVersions copies of each key are kept. Deleting an object deletes its
+// history with it.
+type VersionedStorageService struct {
+    StorageService
+    maxVersions int
+}
+
+// NewVersionedStorageService wraps backend with emulated versioning
+func NewVersionedStorageService(backend StorageService, maxVersions int) *VersionedStorageService {
+    return &VersionedStorageService{
+        StorageService: backend,
+        maxVersions:    maxVersions,
+    }
+}
+
+// Unwrap returns the wrapped backend
+func (s *VersionedStorageService) Unwrap() StorageService {
+    return s.StorageService
+}
+
+// versionPrefix returns the prefix the versions of storageKey are stored under
+func versionPrefix(storageKey string) string {
+    return path.Join(VersionFolder, storageKey) + "/"
+}
+
+func isVersionKey(storageKey string) bool {
+    return strings.HasPrefix(storageKey, VersionFolder+"/")
+}
+
+// VersionOf returns the object a version key holds a previous version of
+func VersionOf(storageKey string) (string, bool) {
+    if !isVersionKey(storageKey) {
+        return "", false
+    }
+    return path.Dir(strings.TrimPrefix(storageKey, VersionFolder+"/")), true
+}
+
+// isRenditionKey reports whether an upload is a thumbnail or derivative of
+// another object. Renditions are regenerated with their original, so they
+// keep no history of their own.
+func isRenditionKey(storageKey string, opts *UploadOptions) bool {
+    if opts.Metadata[MetaDerivativeOf] != "" {
+        return true
+    }
+    return strings.HasSuffix(strings.TrimSuffix(storageKey, path.Ext(storageKey)), "_thumb")
+}
+
+// newVersionID returns a time-ordered version ID, so versions sort by age
+func newVersionID() string {
+    return uuid.Must(uuid.NewV7()).String()
+}
+
+// versionTime returns when a version was written, from its ID
+func versionTime(versionID string) time.Time {
+    id, err := uuid.Parse(versionID)
+    if err != nil || id.Version() != 7 {
+        return time.Time{}
+    }
+    sec, nsec := id.Time().UnixTime()
+    return time.Unix(sec, nsec)
+}
+
+func currentVersionID(metadata *FileMetadata) string {
+    if id := metadata.Metadata[MetaVersionID]; id != "" {
+        return id
+    }
+    return NullVersion
+}
+
+// Upload stores a multipart file, keeping the version it replaces
+func (s *VersionedStorageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    contentType := detectContentType(header.Filename, opts.ContentType, header.Header.Get("Content-Type"))
+    return s.UploadFromReader(ctx, file, header.Filename, contentType, header.Size, opts)
+}
+
+// UploadFromReader stores data under a new version ID. When the upload
+// overwrites an existing key, the previous contents are kept as a version
+// unless opts.SkipVersion is set.
+func (s *VersionedStorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string, size int64, opts *UploadOptions) (*UploadResult, error) {
+    if opts == nil {
+        opts = NewUploadOptions()
+    }
+    versioned := opts.StorageKey != "" && !opts.SkipVersion && !isVersionKey(opts.StorageKey) && !isRenditionKey(opts.StorageKey, opts)
+    if versioned {
+        if err := s.snapshot(ctx, opts.StorageKey); err != nil {
+            return nil, err
+        }
+    }
+    versionOpts := *opts
+    versionOpts.Metadata = copyMetadata(opts.Metadata)
+    if versionOpts.Metadata == nil {
+        versionOpts.Metadata = make(map[string]string)
+    }
+    versionOpts.Metadata[MetaVersionID] = newVersionID()
+    result, err := s.StorageService.UploadFromReader(ctx, reader, filename, contentType, size, &versionOpts)
+    if err != nil {
+        return nil, err
+    }
+    if versioned {
+        s.prune(ctx, opts.StorageKey)
+    }
+    return result, nil
+}
+
+// Copy copies an object, keeping the version of destKey it replaces
+func (s *VersionedStorageService) Copy(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.snapshot(ctx, destKey); err != nil {
+        return err
+    }
+    if err := s.StorageService.Copy(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    s.prune(ctx, destKey)
+    return nil
+}
+
+// Move moves an object, keeping the version of destKey it replaces. The
+// history of sourceKey stays with sourceKey.
+func (s *VersionedStorageService) Move(ctx context.Context, sourceKey, destKey string) error {
+    if err := s.snapshot(ctx, destKey); err != nil {
+        return err
+    }
+    if err := s.StorageService.Move(ctx, sourceKey, destKey); err != nil {
+        return err
+    }
+    s.prune(ctx, destKey)
+    return nil
+}
+
+// snapshot copies the current contents of storageKey into its history
+func (s *VersionedStorageService) snapshot(ctx context.Context, storageKey string) error {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        if errors.Is(err, ErrObjectNotFound) {
+            return nil
+        }
+        return err
+    }
+    versionID := metadata.Metadata[MetaVersionID]
+    if versionID == "" {
+        versionID = newVersionID()
+    }
+    if err := s.StorageService.Copy(ctx, storageKey, versionPrefix(storageKey)+versionID); err != nil {
+        return fmt.Errorf("failed to keep version of %s: %w", storageKey, err)
+    }
+    return nil
+}
+
+// prune deletes the oldest versions of storageKey beyond maxVersions
+func (s *VersionedStorageService) prune(ctx context.Context, storageKey string) {
+    if s.maxVersions <= 0 {
+        return
+    }
+    files, err := s.StorageService.ListFiles(ctx, versionPrefix(storageKey), 0)
+    if err != nil || len(files) <= s.maxVersions {
+        return
+    }
+    // Version IDs sort by age, oldest first
+    sort.Slice(files, func(i, j int) bool { return files[i].StorageKey < files[j].StorageKey })
+    expired := storageKeys(files[:len(files)-s.maxVersions])
+    if err := s.StorageService.DeleteMultiple(ctx, expired); err != nil {
+        log.Warn().Err(err).Str("storage_key", storageKey).Msg("Failed to prune object versions")
+    }
+}
+
+// Delete deletes an object together with its history
+func (s *VersionedStorageService) Delete(ctx context.Context, storageKey string) error {
+    if err := s.StorageService.Delete(ctx, storageKey); err != nil {
+        return err
+    }
+    s.deleteVersions(ctx, []string{storageKey})
+    return nil
+}
+
+// DeleteMultiple deletes several objects together with their history
+func (s *VersionedStorageService) DeleteMultiple(ctx context.Context, storageKeys []string) error {
+    if err := s.StorageService.DeleteMultiple(ctx, storageKeys); err != nil {
+        return err
+    }
+    s.deleteVersions(ctx, storageKeys)
+    return nil
+}
+
+func (s *VersionedStorageService) deleteVersions(ctx context.Context, keys []string) {
+    for _, key := range keys {
+        if isVersionKey(key) {
+            continue
+        }
+        files, err := s.StorageService.ListFiles(ctx, versionPrefix(key), 0)
+        if err != nil || len(files) == 0 {
+            continue
+        }
+        if err := s.StorageService.DeleteMultiple(ctx, storageKeys(files)); err != nil {
+            log.Warn().Err(err).Str("storage_key", key).Msg("Failed to delete object versions")
+        }
+    }
+}
+
+// ListFiles hides the version history unless it is listed explicitly
+func (s *VersionedStorageService) ListFiles(ctx context.Context, prefix string, limit int) ([]*FileInfo, error) {
+    if !strings.HasPrefix(VersionFolder+"/", prefix) || isVersionKey(prefix) {
+        return s.StorageService.ListFiles(ctx, prefix, limit)
+    }
+    // The history is filtered out before limit applies
+    files, err := s.StorageService.ListFiles(ctx, prefix, 0)
+    if err != nil {
+        return nil, err
+    }
+    current := files[:0]
+    for _, file := range files {
+        if isVersionKey(file.StorageKey) {
+            continue
+        }
+        current = append(current, file)
+        if limit > 0 && len(current) == limit {
+            break
+        }
+    }
+    return current, nil
+}
+
+// ListFilesPage hides the version history unless it is listed explicitly.
+// Pages that held only versions are skipped, so a page is only empty at the
+// end of the listing.
+func (s *VersionedStorageService) ListFilesPage(ctx context.Context, prefix string, opts ListOptions) (*FileList, error) {
+    if !strings.HasPrefix(VersionFolder+"/", prefix) || isVersionKey(prefix) {
+        return s.StorageService.ListFilesPage(ctx, prefix, opts)
+    }
+    for {
+        page, err := s.StorageService.ListFilesPage(ctx, prefix, opts)
+        if err != nil {
+            return nil, err
+        }
+        current := page.Files[:0]
+        for _, file := range page.Files {
+            if !isVersionKey(file.StorageKey) {
+                current = append(current, file)
+            }
+        }
+        page.Files = current
+        if len(current) > 0 || page.NextContinuationToken == "" {
+            return page, nil
+        }
+        opts.ContinuationToken = page.NextContinuationToken
+    }
+}
+
+// ListVersions lists the versions of an object, newest first
+func (s *VersionedStorageService) ListVersions(ctx context.Context, storageKey string) ([]*ObjectVersion, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return nil, err
+    }
+    versions := []*ObjectVersion{{
+        VersionID:    currentVersionID(metadata),
+        FileSize:     metadata.FileSize,
+        ETag:         metadata.ETag,
+        LastModified: metadata.LastModified,
+        IsCurrent:    true,
+    }}
+    files, err := s.StorageService.ListFiles(ctx, versionPrefix(storageKey), 0)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list versions of %s: %w", storageKey, err)
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i].StorageKey > files[j].StorageKey })
+    for _, file := range files {
+        version := &ObjectVersion{
+            VersionID:    path.Base(file.StorageKey),
+            FileSize:     file.FileSize,
+            LastModified: versionTime(path.Base(file.StorageKey)),
+        }
+        if version.LastModified.IsZero() {
+            version.LastModified = file.LastModified
+        }
+        versions = append(versions, version)
+    }
+    return versions, nil
+}
+
+// versionKey returns the key a version of storageKey is read from
+func (s *VersionedStorageService) versionKey(ctx context.Context, storageKey, versionID string) (string, error) {
+    metadata, err := s.StorageService.GetMetadata(ctx, storageKey)
+    if err != nil {
+        return "", err
+    }
+    if versionID == currentVersionID(metadata) {
+        return storageKey, nil
+    }
+    if versionID == "" || strings.Contains(versionID, "/") {
+        return "", fmt.Errorf("%w: %s@%s", ErrVersionNotFound, storageKey, versionID)
+    }
+    return versionPrefix(storageKey) + versionID, nil
+}
+
+func versionError(storageKey, versionID string, err error) error {
+    if errors.Is(err, ErrObjectNotFound) {
+        return fmt.Errorf("%w: %s@%s", ErrVersionNotFound, storageKey, versionID)
+    }
+    return err
+}
+
+// GetVersionMetadata returns the metadata of one version of an object
+func (s *VersionedStorageService) GetVersionMetadata(ctx context.Context, storageKey, versionID string) (*FileMetadata, error) {
+    key, err := s.versionKey(ctx, storageKey, versionID)
+    if err != nil {
+        return nil, err
+    }
+    metadata, err := s.StorageService.GetMetadata(ctx, key)
+    if err != nil {
+        return nil, versionError(storageKey, versionID, err)
+    }
+    metadata.StorageKey = storageKey
+    metadata.FileName = path.Base(storageKey)
+    return metadata, nil
+}
+
+// DownloadVersion streams one version of an object into writer
+func (s *VersionedStorageService) DownloadVersion(ctx context.Context, storageKey, versionID string, writer io.Writer) error {
+    key, err := s.versionKey(ctx, storageKey, versionID)
+    if err != nil {
+        return err
+    }
+    return versionError(storageKey, versionID, s.StorageService.DownloadToWriter(ctx, key, writer))
+}
+
+// RestoreVersion writes a copy of a version as the current contents of the
+// object. The contents it replaces become a version of their own.
+func (s *VersionedStorageService) RestoreVersion(ctx context.Context, storageKey, versionID string) error {
+    key, err := s.versionKey(ctx, storageKey, versionID)
+    if err != nil {
+        return err
+    }
+    if key == storageKey {
+        return nil
+    }
+    metadata, err := s.StorageService.GetMetadata(ctx, key)
+    if err != nil {
+        return versionError(storageKey, versionID, err)
+    }
+    reader, writer := io.Pipe()
+    go func() {
+        writer.CloseWithError(s.StorageService.DownloadToWriter(ctx, key, writer))
+    }()
+    opts := NewUploadOptions()
+    opts.StorageKey = storageKey
+    opts.StripMetadata = false
+    opts.ContentType = metadata.ContentType
+    opts.Metadata = metadata.Metadata
+    _, err = s.UploadFromReader(ctx, reader, path.Base(storageKey), metadata.ContentType, metadata.FileSize, opts)
+    reader.CloseWithError(err)
+    if err != nil {
+        return fmt.Errorf("failed to restore %s@%s: %w", storageKey, versionID, err)
+    }
+    return nil
+}
+
+func storageKeys(files []*FileInfo) []string {
+    keys := make([]string, 0, len(files))
+    for _, file := range files {
+        keys = append(keys, file.StorageKey)
+    }
+    return keys
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/rs/zerolog/log"
+)
+
+const (
+    webhookQueueSize   = 1024
+    webhookMaxAttempts = 5
+    webhookRetryDelay  = time.Second
+)
+
+// WebhookSubscriber posts events as JSON to an outbound webhook from a
+// background queue, so slow receivers don't hold up writes. Each request
+// carries the event ID, for deduplicating retries, and an HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the shared secret:
+//
+//    X-Storage-Event-ID: <event id>
+//    X-Storage-Timestamp: <unix seconds>
+//    X-Storage-Signature: sha256=<hex hmac>
+//
+// Failed deliveries are retried with exponential backoff, then dropped.
+type WebhookSubscriber struct {
+    url        string
+    secret     []byte
+    httpClient *http.Client
+    queue      chan Event
+}
+
+// NewWebhookSubscriber delivers events to url signed with secret. Run must be
+// started to deliver them.
+func NewWebhookSubscriber(url, secret string) *WebhookSubscriber {
+    return &WebhookSubscriber{
+        url:    url,
+        secret: []byte(secret),
+        httpClient: &http.Client{
+            Timeout: 10 * time.Second,
+        },
+        queue: make(chan Event, webhookQueueSize),
+    }
+}
+
+// HandleEvent queues event for delivery, dropping it when the queue is full
+func (s *WebhookSubscriber) HandleEvent(ctx context.Context, event Event) error {
+    select {
+    case s.queue <- event:
+        return nil
+    default:
+        return fmt.Errorf("webhook queue full, dropped event %s", event.ID)
+    }
+}
+
+// Run delivers queued events until ctx is cancelled
+func (s *WebhookSubscriber) Run(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case event := <-s.queue:
+            s.deliver(ctx, event)
+        }
+    }
+}
+
+func (s *WebhookSubscriber) deliver(ctx context.Context, event Event) {
+    body, err := json.Marshal(event)
+    if err != nil {
+        log.Error().Err(err).Str("event_id", event.ID.String()).Msg("Failed to encode storage event")
+        return
+    }
+    delay := webhookRetryDelay
+    for attempt := 1; ; attempt++ {
+        err = s.post(ctx, event, body)
+        if err == nil {
+            return
+        }
+        if attempt == webhookMaxAttempts {
+            break
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delay):
+        }
+        delay *= 2
+    }
+    log.Error().Err(err).Str("event_id", event.ID.String()).Str("event", event.Type).Str("storage_key", event.StorageKey).Msg("Failed to deliver storage event webhook")
+}
+
+func (s *WebhookSubscriber) post(ctx context.Context, event Event, body []byte) error {
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+    if err != nil {
+        return fmt.Errorf("failed to create request: %w", err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Storage-Event-ID", event.ID.String())
+    req.Header.Set("X-Storage-Timestamp", timestamp)
+    req.Header.Set("X-Storage-Signature", "sha256="+s.sign(timestamp, body))
+    resp, err := s.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to send request: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+func (s *WebhookSubscriber) sign(timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, s.secret)
+    mac.Write([]byte(timestamp))
+    mac.Write([]byte{'.'})
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
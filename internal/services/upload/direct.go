@@ -0,0 +1,98 @@
+package upload
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+)
+
+const directUploadKeyPrefix = "direct_upload:"
+
+// ErrDirectUploadNotFound is returned for presigned uploads that were never
+// issued to the user, have expired or were already confirmed
+var ErrDirectUploadNotFound = errors.New("direct upload not found")
+
+// DirectUpload is a presigned upload handed out to a client
+type DirectUpload struct {
+    ID         uuid.UUID `json:"id"`
+    UserID     uuid.UUID `json:"user_id"`
+    FileName   string    `json:"file_name"`
+    StorageKey string    `json:"storage_key"`
+}
+
+// DirectUploads records the presigned uploads the API issued, so a client
+// can only confirm a key it was given, and only once
+type DirectUploads struct {
+    redis *redis.Client
+    ttl   time.Duration
+}
+
+// NewDirectUploads keeps records until the presigned URL has expired and the
+// client had time to confirm
+func NewDirectUploads(redisClient *redis.Client, cfg appconfig.UploadConfig) *DirectUploads {
+    return &DirectUploads{
+        redis: redisClient,
+        ttl:   cfg.PresignExpiry + sessionRecordGrace,
+    }
+}
+
+// Issue records a presigned upload of storageKey for a user
+func (d *DirectUploads) Issue(ctx context.Context, userID uuid.UUID, filename, storageKey string) (*DirectUpload, error) {
+    upload := &DirectUpload{
+        ID:         uuid.New(),
+        UserID:     userID,
+        FileName:   filename,
+        StorageKey: storageKey,
+    }
+    data, err := json.Marshal(upload)
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode direct upload: %w", err)
+    }
+    if err := d.redis.Set(ctx, directUploadKey(upload.ID), data, d.ttl).Err(); err != nil {
+        return nil, fmt.Errorf("failed to record direct upload: %w", err)
+    }
+    return upload, nil
+}
+
+// Get returns a user's presigned upload that hasn't been confirmed yet
+func (d *DirectUploads) Get(ctx context.Context, userID, uploadID uuid.UUID) (*DirectUpload, error) {
+    data, err := d.redis.Get(ctx, directUploadKey(uploadID)).Bytes()
+    if err != nil {
+        if errors.Is(err, redis.Nil) {
+            return nil, ErrDirectUploadNotFound
+        }
+        return nil, fmt.Errorf("failed to load direct upload: %w", err)
+    }
+    var upload DirectUpload
+    if err := json.Unmarshal(data, &upload); err != nil {
+        return nil, fmt.Errorf("failed to parse direct upload: %w", err)
+    }
+    if upload.UserID != userID {
+        return nil, ErrDirectUploadNotFound
+    }
+    return &upload, nil
+}
+
+// Claim marks an upload as confirmed. Only one of concurrent claims
+// succeeds, the others get ErrDirectUploadNotFound.
+func (d *DirectUploads) Claim(ctx context.Context, uploadID uuid.UUID) error {
+    removed, err := d.redis.Del(ctx, directUploadKey(uploadID)).Result()
+    if err != nil {
+        return fmt.Errorf("failed to claim direct upload: %w", err)
+    }
+    if removed == 0 {
+        return ErrDirectUploadNotFound
+    }
+    return nil
+}
+
+func directUploadKey(uploadID uuid.UUID) string {
+    return directUploadKeyPrefix + uploadID.String()
+}
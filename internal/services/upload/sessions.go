@@ -0,0 +1,340 @@
+package upload
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+
+    appconfig "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/services/storage"
+)
+
+const (
+    sessionKeyPrefix = "upload_session:"
+    sessionExpiryKey = "upload_sessions:expiry"
+    // Session records outlive their expiry so the janitor can still read
+    // them to abort the backend upload
+    sessionRecordGrace = time.Hour
+)
+
+var (
+    ErrSessionNotFound  = errors.New("upload session not found")
+    ErrInvalidChunk     = errors.New("invalid chunk")
+    ErrUploadIncomplete = errors.New("upload is incomplete")
+)
+
+// Session is a resumable upload in progress. The file is sent in fixed-size
+// chunks, each stored as one part of a backend multipart upload.
+type Session struct {
+    ID          uuid.UUID               `json:"id"`
+    UserID      uuid.UUID               `json:"user_id"`
+    FileName    string                  `json:"file_name"`
+    ContentType string                  `json:"content_type"`
+    TotalSize   int64                   `json:"total_size"`
+    ChunkSize   int64                   `json:"chunk_size"`
+    StorageKey  string                  `json:"storage_key"`
+    UploadID    string                  `json:"upload_id"`
+    Metadata    map[string]string       `json:"metadata,omitempty"`
+    CreatedAt   time.Time               `json:"created_at"`
+    ExpiresAt   time.Time               `json:"expires_at"`
+    Parts       []storage.CompletedPart `json:"-"`
+}
+
+// PartCount returns the number of chunks the file is split into
+func (s *Session) PartCount() int {
+    return int((s.TotalSize + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// ReceivedBytes returns how many bytes have been stored so far
+func (s *Session) ReceivedBytes() int64 {
+    var received int64
+    for _, part := range s.Parts {
+        received += part.Size
+    }
+    return received
+}
+
+// NextOffset returns the offset of the first chunk not yet received, or
+// TotalSize when every chunk is in
+func (s *Session) NextOffset() int64 {
+    received := make(map[int]bool, len(s.Parts))
+    for _, part := range s.Parts {
+        received[part.PartNumber] = true
+    }
+    for partNumber := 1; partNumber <= s.PartCount(); partNumber++ {
+        if !received[partNumber] {
+            return int64(partNumber-1) * s.ChunkSize
+        }
+    }
+    return s.TotalSize
+}
+
+// IsComplete reports whether every chunk has been received
+func (s *Session) IsComplete() bool {
+    return len(s.Parts) == s.PartCount()
+}
+
+// chunkLength returns the size the chunk starting at offset must have
+func (s *Session) chunkLength(offset int64) int64 {
+    if remaining := s.TotalSize - offset; remaining < s.ChunkSize {
+        return remaining
+    }
+    return s.ChunkSize
+}
+
+// SessionManager tracks resumable uploads per user. Sessions live in Redis
+// so any API instance can accept the next chunk, and the parts live in the
+// storage backend's multipart upload.
+type SessionManager struct {
+    backend   storage.MultipartStorage
+    redis     *redis.Client
+    chunkSize int64
+    ttl       time.Duration
+}
+
+// NewSessionManager creates a session manager on top of a multipart-capable backend
+func NewSessionManager(svc storage.StorageService, redisClient *redis.Client, cfg appconfig.UploadConfig) (*SessionManager, error) {
+    backend, ok := storage.Backend[storage.MultipartStorage](svc)
+    if !ok {
+        return nil, storage.ErrMultipartUnsupported
+    }
+    chunkSize := cfg.ChunkSize
+    if chunkSize < storage.MinMultipartPartSize {
+        chunkSize = storage.MinMultipartPartSize
+    }
+    return &SessionManager{
+        backend:   backend,
+        redis:     redisClient,
+        chunkSize: chunkSize,
+        ttl:       cfg.SessionTTL,
+    }, nil
+}
+
+// Init starts a new resumable upload of totalSize bytes
+func (m *SessionManager) Init(ctx context.Context, userID uuid.UUID, filename, contentType string, totalSize int64, opts *storage.UploadOptions) (*Session, error) {
+    if totalSize <= 0 {
+        return nil, fmt.Errorf("%w: total size must be positive", ErrInvalidChunk)
+    }
+    if opts == nil {
+        opts = storage.NewUploadOptions()
+    }
+    storageKey := storage.NewStorageKey(opts, filename)
+    uploadID, err := m.backend.CreateMultipartUpload(ctx, storageKey, contentType, opts)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    session := &Session{
+        ID:          uuid.New(),
+        UserID:      userID,
+        FileName:    filename,
+        ContentType: contentType,
+        TotalSize:   totalSize,
+        ChunkSize:   m.chunkSize,
+        StorageKey:  storageKey,
+        UploadID:    uploadID,
+        Metadata:    opts.Metadata,
+        CreatedAt:   now,
+        ExpiresAt:   now.Add(m.ttl),
+    }
+    if err := m.save(ctx, session); err != nil {
+        m.backend.AbortMultipartUpload(ctx, storageKey, uploadID)
+        return nil, err
+    }
+    log.Info().Str("session_id", session.ID.String()).Str("user_id", userID.String()).Int64("total_size", totalSize).Int("parts", session.PartCount()).Msg("Upload session started")
+    return session, nil
+}
+
+// Get returns a user's session with the parts received so far
+func (m *SessionManager) Get(ctx context.Context, userID, sessionID uuid.UUID) (*Session, error) {
+    session, err := m.load(ctx, sessionID)
+    if err != nil {
+        return nil, err
+    }
+    if session.UserID != userID {
+        return nil, ErrSessionNotFound
+    }
+    return session, nil
+}
+
+// WriteChunk stores the chunk starting at offset. Chunks must start on a
+// ChunkSize boundary and be exactly ChunkSize long, except the last one.
+// Sending a chunk again replaces it, so clients can safely retry.
+func (m *SessionManager) WriteChunk(ctx context.Context, userID, sessionID uuid.UUID, offset int64, reader io.Reader, size int64) (*Session, error) {
+    session, err := m.Get(ctx, userID, sessionID)
+    if err != nil {
+        return nil, err
+    }
+    if offset < 0 || offset >= session.TotalSize || offset%session.ChunkSize != 0 {
+        return nil, fmt.Errorf("%w: offset %d is not a chunk boundary", ErrInvalidChunk, offset)
+    }
+    expected := session.chunkLength(offset)
+    if size >= 0 && size != expected {
+        return nil, fmt.Errorf("%w: chunk at offset %d must be %d bytes, got %d", ErrInvalidChunk, offset, expected, size)
+    }
+    partNumber := int(offset/session.ChunkSize) + 1
+    part, err := m.backend.UploadPart(ctx, session.StorageKey, session.UploadID, partNumber, io.LimitReader(reader, expected), expected)
+    if err != nil {
+        return nil, err
+    }
+    if part.Size != expected {
+        return nil, fmt.Errorf("%w: chunk at offset %d was truncated to %d bytes", ErrInvalidChunk, offset, part.Size)
+    }
+    data, err := json.Marshal(part)
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode part: %w", err)
+    }
+    if err := m.redis.HSet(ctx, partsKey(sessionID), strconv.Itoa(partNumber), data).Err(); err != nil {
+        return nil, fmt.Errorf("failed to record part: %w", err)
+    }
+    session.ExpiresAt = time.Now().Add(m.ttl)
+    if err := m.save(ctx, session); err != nil {
+        return nil, err
+    }
+    return m.Get(ctx, userID, sessionID)
+}
+
+// Complete assembles the uploaded chunks into the final object
+func (m *SessionManager) Complete(ctx context.Context, userID, sessionID uuid.UUID) (*storage.UploadResult, error) {
+    session, err := m.Get(ctx, userID, sessionID)
+    if err != nil {
+        return nil, err
+    }
+    if !session.IsComplete() {
+        return nil, fmt.Errorf("%w: received %d of %d bytes", ErrUploadIncomplete, session.ReceivedBytes(), session.TotalSize)
+    }
+    result, err := m.backend.CompleteMultipartUpload(ctx, session.StorageKey, session.UploadID, session.Parts)
+    if err != nil {
+        return nil, err
+    }
+    m.remove(ctx, sessionID)
+    log.Info().Str("session_id", sessionID.String()).Str("storage_key", result.StorageKey).Int64("size", result.FileSize).Msg("Upload session completed")
+    return result, nil
+}
+
+// Abort cancels a user's upload and discards its chunks
+func (m *SessionManager) Abort(ctx context.Context, userID, sessionID uuid.UUID) error {
+    session, err := m.Get(ctx, userID, sessionID)
+    if err != nil {
+        return err
+    }
+    if err := m.backend.AbortMultipartUpload(ctx, session.StorageKey, session.UploadID); err != nil {
+        return err
+    }
+    m.remove(ctx, sessionID)
+    log.Info().Str("session_id", sessionID.String()).Msg("Upload session aborted")
+    return nil
+}
+
+// Run periodically aborts sessions that have expired until ctx is cancelled
+func (m *SessionManager) Run(ctx context.Context) {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            m.expireSessions(ctx)
+        }
+    }
+}
+
+func (m *SessionManager) expireSessions(ctx context.Context) {
+    ids, err := m.redis.ZRangeByScore(ctx, sessionExpiryKey, &redis.ZRangeBy{
+        Min: "-inf",
+        Max: strconv.FormatInt(time.Now().Unix(), 10),
+    }).Result()
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to list expired upload sessions")
+        return
+    }
+    for _, id := range ids {
+        // Only the instance that removes the index entry cleans up
+        removed, err := m.redis.ZRem(ctx, sessionExpiryKey, id).Result()
+        if err != nil || removed == 0 {
+            continue
+        }
+        sessionID, err := uuid.Parse(id)
+        if err != nil {
+            continue
+        }
+        session, err := m.load(ctx, sessionID)
+        if err != nil {
+            continue
+        }
+        if err := m.backend.AbortMultipartUpload(ctx, session.StorageKey, session.UploadID); err != nil {
+            log.Warn().Err(err).Str("session_id", id).Msg("Failed to abort expired upload")
+        }
+        m.remove(ctx, sessionID)
+        log.Info().Str("session_id", id).Str("user_id", session.UserID.String()).Msg("Expired upload session aborted")
+    }
+}
+
+func (m *SessionManager) save(ctx context.Context, session *Session) error {
+    data, err := json.Marshal(session)
+    if err != nil {
+        return fmt.Errorf("failed to encode session: %w", err)
+    }
+    recordTTL := time.Until(session.ExpiresAt) + sessionRecordGrace
+    pipe := m.redis.TxPipeline()
+    pipe.Set(ctx, sessionKey(session.ID), data, recordTTL)
+    pipe.Expire(ctx, partsKey(session.ID), recordTTL)
+    pipe.ZAdd(ctx, sessionExpiryKey, redis.Z{Score: float64(session.ExpiresAt.Unix()), Member: session.ID.String()})
+    if _, err := pipe.Exec(ctx); err != nil {
+        return fmt.Errorf("failed to save session: %w", err)
+    }
+    return nil
+}
+
+func (m *SessionManager) load(ctx context.Context, sessionID uuid.UUID) (*Session, error) {
+    data, err := m.redis.Get(ctx, sessionKey(sessionID)).Bytes()
+    if err != nil {
+        if errors.Is(err, redis.Nil) {
+            return nil, ErrSessionNotFound
+        }
+        return nil, fmt.Errorf("failed to load session: %w", err)
+    }
+    var session Session
+    if err := json.Unmarshal(data, &session); err != nil {
+        return nil, fmt.Errorf("failed to parse session: %w", err)
+    }
+    parts, err := m.redis.HGetAll(ctx, partsKey(sessionID)).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load session parts: %w", err)
+    }
+    for _, raw := range parts {
+        var part storage.CompletedPart
+        if err := json.Unmarshal([]byte(raw), &part); err == nil {
+            session.Parts = append(session.Parts, part)
+        }
+    }
+    sort.Slice(session.Parts, func(i, j int) bool { return session.Parts[i].PartNumber < session.Parts[j].PartNumber })
+    return &session, nil
+}
+
+func (m *SessionManager) remove(ctx context.Context, sessionID uuid.UUID) {
+    pipe := m.redis.TxPipeline()
+    pipe.Del(ctx, sessionKey(sessionID), partsKey(sessionID))
+    pipe.ZRem(ctx, sessionExpiryKey, sessionID.String())
+    if _, err := pipe.Exec(ctx); err != nil {
+        log.Warn().Err(err).Str("session_id", sessionID.String()).Msg("Failed to remove upload session")
+    }
+}
+
+func sessionKey(sessionID uuid.UUID) string {
+    return sessionKeyPrefix + sessionID.String()
+}
+
+func partsKey(sessionID uuid.UUID) string {
+    return sessionKeyPrefix + sessionID.String() + ":parts"
+}
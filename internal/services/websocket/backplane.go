@@ -0,0 +1,192 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+)
+
+// recentWindow is how many envelope IDs a hub remembers to drop duplicates
+const recentWindow = 4096
+
+// Envelope carries a broadcast between replicas. Exactly one of
+// ConversationID and UserID is set.
+type Envelope struct {
+    ID             uuid.UUID       `json:"id"`
+    NodeID         string          `json:"node_id"`
+    ConversationID uuid.UUID       `json:"conversation_id,omitempty"`
+    UserID         uuid.UUID       `json:"user_id,omitempty"`
+    Seq            int64           `json:"seq,omitempty"` // sequence number of a conversation frame
+    Payload        json.RawMessage `json:"payload"`
+}
+
+// Backplane fans broadcasts out to the hubs of every replica. Publishers
+// receive their own envelopes back, and may receive any envelope more than
+// once; hubs drop both.
+type Backplane interface {
+    Publish(ctx context.Context, envelope *Envelope) error
+    // Subscribe calls deliver with every envelope published until ctx is
+    // done or the subscription fails
+    Subscribe(ctx context.Context, deliver func(*Envelope)) error
+}
+
+// NewBackplane returns the backplane cfg selects, or nil when broadcasts
+// stay in process
+func NewBackplane(cfg config.WebSocketConfig, redisClient *redis.Client) (Backplane, error) {
+    switch cfg.Backplane {
+    case "":
+        return nil, nil
+    case "redis":
+        return NewRedisBackplane(redisClient, cfg.Channel), nil
+    default:
+        return nil, fmt.Errorf("unknown websocket backplane %q", cfg.Backplane)
+    }
+}
+
+// NodeID returns id, or a name for this process when id is empty: the host
+// name, which is the pod name on Kubernetes, and a random suffix
+func NodeID(id string) string {
+    if id != "" {
+        return id
+    }
+    host, err := os.Hostname()
+    if err != nil {
+        host = "node"
+    }
+    return host + "-" + uuid.New().String()[:8]
+}
+
+// RedisBackplane publishes envelopes on a Redis pub/sub channel
+type RedisBackplane struct {
+    client  *redis.Client
+    channel string
+}
+
+// NewRedisBackplane creates a backplane over channel
+func NewRedisBackplane(client *redis.Client, channel string) *RedisBackplane {
+    return &RedisBackplane{
+        client:  client,
+        channel: channel,
+    }
+}
+
+// Publish sends envelope to every subscribed replica
+func (b *RedisBackplane) Publish(ctx context.Context, envelope *Envelope) error {
+    data, err := json.Marshal(envelope)
+    if err != nil {
+        return fmt.Errorf("failed to marshal envelope: %w", err)
+    }
+    return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+// Subscribe listens on the channel. The client reconnects by itself, and
+// envelopes published while it's disconnected are lost.
+func (b *RedisBackplane) Subscribe(ctx context.Context, deliver func(*Envelope)) error {
+    sub := b.client.Subscribe(ctx, b.channel)
+    defer sub.Close()
+    // Wait for the subscription to be confirmed, so failures surface here
+    if _, err := sub.Receive(ctx); err != nil {
+        return fmt.Errorf("failed to subscribe to %s: %w", b.channel, err)
+    }
+    messages := sub.Channel()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case message, ok := <-messages:
+            if !ok {
+                return errors.New("backplane subscription closed")
+            }
+            var envelope Envelope
+            if err := json.Unmarshal([]byte(message.Payload), &envelope); err != nil {
+                continue
+            }
+            deliver(&envelope)
+        }
+    }
+}
+
+// MemoryBackplane connects hubs in one process, standing in for Redis when
+// testing several replicas
+type MemoryBackplane struct {
+    mu          sync.RWMutex
+    subscribers map[int]func(*Envelope)
+    next        int
+}
+
+// NewMemoryBackplane creates an in-process backplane
+func NewMemoryBackplane() *MemoryBackplane {
+    return &MemoryBackplane{
+        subscribers: make(map[int]func(*Envelope)),
+    }
+}
+
+// Publish delivers envelope to every subscriber before it returns. Each gets
+// its own copy, as if it had come over the wire.
+func (b *MemoryBackplane) Publish(ctx context.Context, envelope *Envelope) error {
+    data, err := json.Marshal(envelope)
+    if err != nil {
+        return fmt.Errorf("failed to marshal envelope: %w", err)
+    }
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    for _, deliver := range b.subscribers {
+        var copied Envelope
+        if err := json.Unmarshal(data, &copied); err != nil {
+            return err
+        }
+        deliver(&copied)
+    }
+    return nil
+}
+
+// Subscribe delivers envelopes until ctx is done
+func (b *MemoryBackplane) Subscribe(ctx context.Context, deliver func(*Envelope)) error {
+    b.mu.Lock()
+    id := b.next
+    b.next++
+    b.subscribers[id] = deliver
+    b.mu.Unlock()
+    <-ctx.Done()
+    b.mu.Lock()
+    delete(b.subscribers, id)
+    b.mu.Unlock()
+    return nil
+}
+
+// recentIDs remembers the last envelope IDs a hub delivered
+type recentIDs struct {
+    mu   sync.Mutex
+    ids  map[uuid.UUID]bool
+    ring []uuid.UUID
+    next int
+}
+
+func newRecentIDs(size int) *recentIDs {
+    return &recentIDs{
+        ids:  make(map[uuid.UUID]bool, size),
+        ring: make([]uuid.UUID, size),
+    }
+}
+
+// seen reports whether id was added before, and adds it
+func (r *recentIDs) seen(id uuid.UUID) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.ids[id] {
+        return true
+    }
+    delete(r.ids, r.ring[r.next])
+    r.ring[r.next] = id
+    r.next = (r.next + 1) % len(r.ring)
+    r.ids[id] = true
+    return false
+}
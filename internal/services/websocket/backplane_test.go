@@ -0,0 +1,154 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// newReplicas starts two hubs connected by a memory backplane and waits
+// until both are subscribed
+func newReplicas(t *testing.T) (*MemoryBackplane, *Hub, *Hub) {
+    backplane := NewMemoryBackplane()
+    a := NewHubWithOptions(HubOptions{NodeID: "a", Backplane: backplane})
+    b := NewHubWithOptions(HubOptions{NodeID: "b", Backplane: backplane})
+    for _, hub := range []*Hub{a, b} {
+        go hub.Run()
+        t.Cleanup(hub.Shutdown)
+    }
+    require.Eventually(t, func() bool {
+        backplane.mu.RLock()
+        defer backplane.mu.RUnlock()
+        return len(backplane.subscribers) == 2
+    }, time.Second, time.Millisecond)
+    return backplane, a, b
+}
+
+// registerUserClient registers a client of userID in conversationID
+func registerUserClient(t *testing.T, hub *Hub, userID, conversationID uuid.UUID) *Client {
+    client := newTestClient(hub, conversationID)
+    client.userID = userID
+    hub.Register(client)
+    require.Eventually(t, func() bool {
+        return len(hub.GetUserClients(userID)) > 0
+    }, time.Second, time.Millisecond)
+    return client
+}
+
+// receiveBroadcast returns the next frame a client gets, skipping presence
+func receiveBroadcast(t *testing.T, client *Client) string {
+    t.Helper()
+    for {
+        select {
+        case data := <-client.send:
+            var frame struct {
+                Type string `json:"type"`
+            }
+            if json.Unmarshal(data, &frame) == nil && frame.Type == MessageTypePresence {
+                continue
+            }
+            return string(data)
+        case <-time.After(time.Second):
+            t.Fatal("no frame received")
+            return ""
+        }
+    }
+}
+
+// assertNoBroadcast checks a client gets nothing but presence
+func assertNoBroadcast(t *testing.T, client *Client) {
+    t.Helper()
+    for {
+        select {
+        case data := <-client.send:
+            var frame struct {
+                Type string `json:"type"`
+            }
+            if json.Unmarshal(data, &frame) == nil && frame.Type == MessageTypePresence {
+                continue
+            }
+            t.Fatalf("unexpected %s", data)
+        case <-time.After(100 * time.Millisecond):
+            return
+        }
+    }
+}
+
+func TestBackplaneConversationFanOut(t *testing.T) {
+    _, a, b := newReplicas(t)
+    conversationID := uuid.New()
+    onA := registerTestClient(t, a, conversationID)
+    onB := registerTestClient(t, b, conversationID)
+    elsewhere := registerTestClient(t, b, uuid.New())
+
+    a.BroadcastToConversation(conversationID, map[string]int{"n": 1}, nil)
+    assert.Equal(t, `{"n":1}`, receiveBroadcast(t, onA))
+    assert.Equal(t, `{"n":1}`, receiveBroadcast(t, onB))
+
+    b.BroadcastToConversation(conversationID, map[string]int{"n": 2}, onB)
+    assert.Equal(t, `{"n":2}`, receiveBroadcast(t, onA))
+
+    // Each replica delivered once: the sender's own envelope came back to it
+    // through the backplane and was dropped
+    assertNoBroadcast(t, onA)
+    assertNoBroadcast(t, onB)
+    assertNoBroadcast(t, elsewhere)
+}
+
+func TestBackplaneUserFanOut(t *testing.T) {
+    _, a, b := newReplicas(t)
+    userID := uuid.New()
+    onA := registerUserClient(t, a, userID, uuid.New())
+    onB := registerUserClient(t, b, userID, uuid.New())
+    other := registerUserClient(t, b, uuid.New(), uuid.New())
+
+    b.BroadcastToUser(userID, "hello")
+    assert.Equal(t, `"hello"`, receiveBroadcast(t, onA))
+    assert.Equal(t, `"hello"`, receiveBroadcast(t, onB))
+    assertNoBroadcast(t, onA)
+    assertNoBroadcast(t, onB)
+    assertNoBroadcast(t, other)
+}
+
+func TestBackplaneDropsRepeatsAndOwnEnvelopes(t *testing.T) {
+    backplane, a, b := newReplicas(t)
+    userID := uuid.New()
+    onA := registerUserClient(t, a, userID, uuid.New())
+    onB := registerUserClient(t, b, userID, uuid.New())
+    ctx := context.Background()
+
+    // An envelope from another replica that arrives twice
+    repeated := &Envelope{ID: uuid.New(), NodeID: "c", UserID: userID, Payload: json.RawMessage(`"once"`)}
+    require.NoError(t, backplane.Publish(ctx, repeated))
+    require.NoError(t, backplane.Publish(ctx, repeated))
+    assert.Equal(t, `"once"`, receiveBroadcast(t, onA))
+    assert.Equal(t, `"once"`, receiveBroadcast(t, onB))
+    assertNoBroadcast(t, onA)
+    assertNoBroadcast(t, onB)
+
+    // An envelope a published is only delivered elsewhere
+    own := &Envelope{ID: uuid.New(), NodeID: a.NodeID(), UserID: userID, Payload: json.RawMessage(`"from a"`)}
+    require.NoError(t, backplane.Publish(ctx, own))
+    assert.Equal(t, `"from a"`, receiveBroadcast(t, onB))
+    assertNoBroadcast(t, onA)
+}
+
+func TestRecentIDs(t *testing.T) {
+    recent := newRecentIDs(2)
+    first, second, third := uuid.New(), uuid.New(), uuid.New()
+    assert.False(t, recent.seen(first))
+    assert.True(t, recent.seen(first))
+    assert.False(t, recent.seen(second))
+    assert.True(t, recent.seen(first), "still within the window")
+
+    // A third ID pushes the oldest out of the window
+    assert.False(t, recent.seen(third))
+    assert.True(t, recent.seen(second))
+    assert.True(t, recent.seen(third))
+    assert.False(t, recent.seen(first))
+}
@@ -3,6 +3,7 @@ package websocket
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "sync"
     "time"
@@ -30,23 +31,42 @@ type Client struct {
     conn           *websocket.Conn
     send           chan []byte
     userID         uuid.UUID
-    conversationID uuid.UUID
+    conversationID uuid.UUID // the conversation a conversation socket was opened for, nil on a user socket
+    subscriptions  map[uuid.UUID]bool
     lastActivity   time.Time
+    lastInput      time.Time // last message from the client; pongs keep it connected but don't count
     mu             sync.RWMutex
     messageHandler MessageHandler
     ctx    context.Context
     cancel context.CancelFunc
+    // While a reconnecting client is sent the frames it missed, live frames
+    // are held back so they arrive after them
+    resuming    bool
+    resumeAfter int64
+    held        []heldFrame
+    replayed    int64 // last frame of the conversation the replay sent
+}
+
+// heldFrame is a live frame kept back while the client resumes. A user
+// socket's frames come from several conversations, each numbered on its own.
+type heldFrame struct {
+    conversationID uuid.UUID
+    Frame
 }
 
 // MessageHandler defines the interface for handling incoming messages
 // ...existing code...
 type MessageHandler interface {
     HandleMessage(ctx context.Context, client *Client, message *IncomingMessage) error
-    HandleTyping(ctx context.Context, client *Client) error
+    HandleTyping(ctx context.Context, client *Client, message *IncomingMessage) error
     HandleDisconnect(ctx context.Context, client *Client) error
+    // AuthorizeSubscription returns an error unless the client's user may
+    // follow a conversation
+    AuthorizeSubscription(ctx context.Context, client *Client, conversationID uuid.UUID) error
 }
 
-// IncomingMessage represents a message from the client
+// IncomingMessage represents a message from the client. On a user socket,
+// messages and typing name the conversation they're for.
 // ...existing code...
 type IncomingMessage struct {
     Type           string                 `json:"type"`
@@ -54,11 +74,17 @@ type IncomingMessage struct {
     ConversationID uuid.UUID              `json:"conversation_id,omitempty"`
     AttachmentIDs  []uuid.UUID            `json:"attachment_ids,omitempty"`
     Metadata       map[string]interface{} `json:"metadata,omitempty"`
+    DeliveryID     uuid.UUID              `json:"delivery_id,omitempty"` // the critical message an ack confirms
 }
 
-// NewClient creates a new Client instance
+// NewClient creates a new Client instance. A nil conversationID makes a user
+// socket, which follows conversations as it subscribes to them.
 func NewClient(hub *Hub, conn *websocket.Conn, userID uuid.UUID, conversationID uuid.UUID, handler MessageHandler) *Client {
     ctx, cancel := context.WithCancel(context.Background())
+    subscriptions := make(map[uuid.UUID]bool)
+    if conversationID != uuid.Nil {
+        subscriptions[conversationID] = true
+    }
     return &Client{
         id:             uuid.New().String(),
         hub:            hub,
@@ -66,7 +92,9 @@ func NewClient(hub *Hub, conn *websocket.Conn, userID uuid.UUID, conversationID
         send:           make(chan []byte, sendBufferSize),
         userID:         userID,
         conversationID: conversationID,
+        subscriptions:  subscriptions,
         lastActivity:   time.Now(),
+        lastInput:      time.Now(),
         messageHandler: handler,
         ctx:            ctx,
         cancel:         cancel,
@@ -107,6 +135,7 @@ func (c *Client) ReadPump() {
                 return
             }
             c.updateActivity()
+            c.updateInput()
             var incomingMsg IncomingMessage
             if err := json.Unmarshal(messageBytes, &incomingMsg); err != nil {
                 log.Error().Err(err).Str("client_id", c.id).Str("raw_message", string(messageBytes)).Msg("Failed to parse incoming message")
@@ -116,7 +145,7 @@ func (c *Client) ReadPump() {
             log.Debug().Str("client_id", c.id).Str("type", incomingMsg.Type).Str("conversation_id", incomingMsg.ConversationID.String()).Msg("Received message")
             if err := c.handleIncomingMessage(&incomingMsg); err != nil {
                 log.Error().Err(err).Str("client_id", c.id).Str("type", incomingMsg.Type).Msg("Error handling message")
-                c.SendError(fmt.Sprintf("Error processing message: %v", err))
+                c.SendConversationError(incomingMsg.ConversationID, fmt.Sprintf("Error processing message: %v", err))
             }
         }
     }
@@ -170,15 +199,32 @@ func (c *Client) handleIncomingMessage(msg *IncomingMessage) error {
     defer cancel()
     switch msg.Type {
     case "message":
+        if err := c.route(msg); err != nil {
+            return err
+        }
         if c.messageHandler != nil {
             return c.messageHandler.HandleMessage(ctx, c, msg)
         }
     case "typing":
+        if err := c.route(msg); err != nil {
+            return err
+        }
         if c.messageHandler != nil {
-            return c.messageHandler.HandleTyping(ctx, c)
+            return c.messageHandler.HandleTyping(ctx, c, msg)
         }
+    case MessageTypeSubscribe:
+        return c.subscribe(ctx, msg.ConversationID)
+    case MessageTypeUnsubscribe:
+        return c.unsubscribe(msg.ConversationID)
     case "ping":
         return c.SendMessage(models.NewWebSocketMessage("pong", c.conversationID, uuid.Nil))
+    case MessageTypeAck:
+        if msg.DeliveryID == uuid.Nil {
+            return fmt.Errorf("ack without delivery_id")
+        }
+        if _, err := c.hub.Ack(ctx, c.userID, msg.DeliveryID); err != nil && !errors.Is(err, ErrInboxDisabled) {
+            return err
+        }
     default:
         return fmt.Errorf("unknown message type: %s", msg.Type)
     }
@@ -201,7 +247,16 @@ func (c *Client) SendMessage(message *models.WebSocketMessage) error {
 }
 
 func (c *Client) SendError(errorMsg string) {
-    msg := models.NewWebSocketMessage(models.MessageTypeError, c.conversationID, uuid.Nil)
+    c.SendConversationError(c.conversationID, errorMsg)
+}
+
+// SendConversationError sends an error about a conversation, so a user
+// socket can tell which one it concerns
+func (c *Client) SendConversationError(conversationID uuid.UUID, errorMsg string) {
+    if conversationID == uuid.Nil {
+        conversationID = c.conversationID
+    }
+    msg := models.NewWebSocketMessage(models.MessageTypeError, conversationID, uuid.Nil)
     msg.Error = errorMsg
     if err := c.SendMessage(msg); err != nil {
         log.Error().Err(err).Str("client_id", c.id).Str("error_message", errorMsg).Msg("Failed to send error to client")
@@ -209,12 +264,18 @@ func (c *Client) SendError(errorMsg string) {
 }
 
 func (c *Client) SendTypingIndicator(isTyping bool) {
-    msg := models.NewWebSocketMessage(models.MessageTypeTyping, c.conversationID, uuid.Nil)
+    c.SendTypingIndicatorTo(c.conversationID, isTyping)
+}
+
+// SendTypingIndicatorTo tells the other clients in a conversation the user
+// is typing there
+func (c *Client) SendTypingIndicatorTo(conversationID uuid.UUID, isTyping bool) {
+    msg := models.NewWebSocketMessage(models.MessageTypeTyping, conversationID, uuid.Nil)
     msg.Metadata = map[string]interface{}{
         "user_id":   c.userID.String(),
         "is_typing": isTyping,
     }
-    c.hub.BroadcastToConversation(c.conversationID, msg, c)
+    c.hub.BroadcastToConversation(conversationID, msg, c)
 }
 
 func (c *Client) BroadcastToConversation(message *models.WebSocketMessage) {
@@ -225,12 +286,88 @@ func (c *Client) BroadcastToConversationExceptSelf(message *models.WebSocketMess
     c.hub.BroadcastToConversation(c.conversationID, message, c)
 }
 
+func (c *Client) isResuming() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.resuming
+}
+
+// holdFrame keeps a live frame back while the client is resuming. Afterwards
+// it drops frames of the conversation that the replay already sent, since a
+// frame can be numbered before the replay is read and reach the hub after it
+// finished.
+func (c *Client) holdFrame(conversationID uuid.UUID, seq int64, data []byte) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.resuming {
+        return seq != 0 && conversationID == c.conversationID && seq <= c.replayed
+    }
+    c.held = append(c.held, heldFrame{conversationID: conversationID, Frame: Frame{Seq: seq, Data: data}})
+    return true
+}
+
+// finishResume sends the frames of the client's conversation replayed after
+// lastSeq, then the live frames held back meanwhile, skipping those the
+// replay or an earlier frame of the same conversation already covered
+func (c *Client) finishResume(frames []Frame, lastSeq int64) {
+    through := map[uuid.UUID]int64{c.conversationID: lastSeq}
+    pending := make([]heldFrame, len(frames))
+    for i, frame := range frames {
+        pending[i] = heldFrame{conversationID: c.conversationID, Frame: frame}
+    }
+    for {
+        for _, frame := range pending {
+            if frame.Seq != 0 && frame.Seq <= through[frame.conversationID] {
+                continue
+            }
+            select {
+            case c.send <- frame.Data:
+            case <-c.ctx.Done():
+                return
+            case <-time.After(writeWait):
+                log.Warn().Str("client_id", c.id).Msg("Timed out replaying frames to client")
+                c.Close()
+                return
+            }
+            through[frame.conversationID] = max(through[frame.conversationID], frame.Seq)
+        }
+        c.mu.Lock()
+        if len(c.held) == 0 {
+            c.resuming = false
+            c.replayed = through[c.conversationID]
+            c.mu.Unlock()
+            return
+        }
+        pending, c.held = c.held, nil
+        c.mu.Unlock()
+    }
+}
+
 func (c *Client) updateActivity() {
     c.mu.Lock()
     defer c.mu.Unlock()
     c.lastActivity = time.Now()
 }
 
+// updateInput records a message from the client. A client that was idle is
+// active again straight away, rather than at the next presence check.
+func (c *Client) updateInput() {
+    c.mu.Lock()
+    wasIdle := time.Since(c.lastInput) > c.hub.idleAfter
+    c.lastInput = time.Now()
+    c.mu.Unlock()
+    if wasIdle {
+        go c.hub.presenceChanged(c, c.Subscriptions()...)
+    }
+}
+
+// GetLastInput returns when the client last sent a message
+func (c *Client) GetLastInput() time.Time {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.lastInput
+}
+
 func (c *Client) GetLastActivity() time.Time {
     c.mu.RLock()
     defer c.mu.RUnlock()
@@ -0,0 +1,38 @@
+package websocket
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+func TestClientFinishResumeTracksEachConversation(t *testing.T) {
+    conversationID, otherID := uuid.New(), uuid.New()
+    client := newTestClient(nil, conversationID)
+    client.subscriptions[otherID] = true
+    client.resuming = true
+
+    frame := func(seq int64) []byte {
+        return []byte(fmt.Sprintf(`{"seq":%d}`, seq))
+    }
+    // Live frames arrive while the replay is read: one the replay covers
+    // and one of another conversation with a lower number of its own
+    require.True(t, client.holdFrame(conversationID, 6, frame(6)))
+    require.True(t, client.holdFrame(otherID, 2, frame(2)))
+    require.True(t, client.holdFrame(conversationID, 7, frame(7)))
+
+    client.finishResume([]Frame{{Seq: 5, Data: frame(5)}, {Seq: 6, Data: frame(6)}}, 4)
+    for _, want := range []int64{5, 6, 2, 7} {
+        assert.Equal(t, want, receiveSeq(t, client))
+    }
+    assert.Empty(t, client.send)
+    assert.False(t, client.isResuming())
+
+    // A frame the replay sent that reaches the hub late is dropped
+    assert.True(t, client.holdFrame(conversationID, 6, frame(6)))
+    assert.False(t, client.holdFrame(conversationID, 8, frame(8)))
+    assert.False(t, client.holdFrame(otherID, 3, frame(3)))
+}
@@ -3,8 +3,10 @@ package websocket
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "sync"
+    "sync/atomic"
     "time"
 
     "github.com/google/uuid"
@@ -23,6 +25,40 @@ type Hub struct {
     mu sync.RWMutex
     ctx context.Context
     cancel context.CancelFunc
+    // Broadcasts reach the clients of other replicas over the backplane
+    nodeID    string
+    backplane Backplane
+    outbound  chan *Envelope
+    recent    *recentIDs
+    // Conversation frames are numbered and kept for clients that reconnect.
+    // Each conversation's frames are numbered by one of the sequencers, in
+    // the order they were queued.
+    replay     ReplayBuffer
+    sequencers []chan *BroadcastMessage
+    // Critical messages are sent again until they're acked
+    inbox       Inbox
+    maxAttempts int
+    retrying    atomic.Bool
+    // Who is viewing each conversation, as last reported by this replica
+    presenceStore PresenceStore
+    presence      map[presenceKey]string
+    presenceMu    sync.Mutex
+    idleAfter     time.Duration
+    refreshing    atomic.Bool
+}
+
+// HubOptions configures a hub that runs on several replicas. The zero value
+// is a hub of its own.
+type HubOptions struct {
+    NodeID    string       // names this replica in the envelopes it publishes, generated when empty
+    Backplane Backplane    // nil keeps broadcasts in process
+    Replay    ReplayBuffer // nil leaves conversation frames unnumbered
+    Inbox     Inbox        // nil sends critical messages once, like any other
+    // MaxAttempts bounds how often a critical message is sent before it's
+    // only kept in the inbox, DefaultMaxAttempts when 0
+    MaxAttempts int
+    Presence    PresenceStore // nil keeps presence to this replica's viewers
+    IdleAfter   time.Duration // DefaultIdleAfter when 0
 }
 
 // BroadcastMessage represents a message to be broadcast
@@ -31,12 +67,38 @@ type BroadcastMessage struct {
     UserID         uuid.UUID
     Message        interface{}
     ExcludeClient  *Client // Don't send to this client (sender)
+    payload        []byte  // Message already marshaled, for broadcasts from other replicas
+    seq            int64   // Sequence number of the frame in its conversation, 0 when unnumbered
 }
 
+const (
+    // publishTimeout bounds a single publish to the backplane
+    publishTimeout = 5 * time.Second
+    // resubscribeDelay is the wait before a lost backplane subscription is retried
+    resubscribeDelay = 2 * time.Second
+    // retryInterval is how often due critical messages are sent again
+    retryInterval = time.Second
+    // sequencerCount is how many conversations can have a frame numbered at once
+    sequencerCount = 8
+)
+
 // NewHub creates a new Hub instance
 func NewHub() *Hub {
+    return NewHubWithOptions(HubOptions{})
+}
+
+// NewHubWithOptions creates a hub whose broadcasts also reach the clients
+// connected to other replicas, and whose conversation frames can be replayed
+// to clients that reconnect
+func NewHubWithOptions(opts HubOptions) *Hub {
     ctx, cancel := context.WithCancel(context.Background())
-    return &Hub{
+    if opts.MaxAttempts <= 0 {
+        opts.MaxAttempts = DefaultMaxAttempts
+    }
+    if opts.IdleAfter <= 0 {
+        opts.IdleAfter = DefaultIdleAfter
+    }
+    h := &Hub{
         broadcast:     make(chan *BroadcastMessage, 256),
         register:      make(chan *Client, 64),
         unregister:    make(chan *Client, 64),
@@ -44,7 +106,24 @@ func NewHub() *Hub {
         conversations: make(map[uuid.UUID]map[*Client]bool),
         ctx:           ctx,
         cancel:        cancel,
+        nodeID:        NodeID(opts.NodeID),
+        backplane:     opts.Backplane,
+        outbound:      make(chan *Envelope, 1024),
+        recent:        newRecentIDs(recentWindow),
+        replay:        opts.Replay,
+        inbox:         opts.Inbox,
+        maxAttempts:   opts.MaxAttempts,
+        presenceStore: opts.Presence,
+        presence:      make(map[presenceKey]string),
+        idleAfter:     opts.IdleAfter,
+    }
+    if h.replay != nil {
+        h.sequencers = make([]chan *BroadcastMessage, sequencerCount)
+        for i := range h.sequencers {
+            h.sequencers[i] = make(chan *BroadcastMessage, 256)
+        }
     }
+    return h
 }
 
 func (h *Hub) Run() {
@@ -56,6 +135,21 @@ func (h *Hub) Run() {
     defer cleanupTicker.Stop()
     statsTicker := time.NewTicker(5 * time.Minute)
     defer statsTicker.Stop()
+    presenceTicker := time.NewTicker(presenceInterval)
+    defer presenceTicker.Stop()
+    if h.backplane != nil {
+        go h.subscribeBackplane()
+        go h.publishBackplane()
+    }
+    for _, queue := range h.sequencers {
+        go h.sequence(queue)
+    }
+    var retry <-chan time.Time
+    if h.inbox != nil {
+        retryTicker := time.NewTicker(retryInterval)
+        defer retryTicker.Stop()
+        retry = retryTicker.C
+    }
     for {
         select {
         case <-h.ctx.Done():
@@ -71,23 +165,75 @@ func (h *Hub) Run() {
             h.cleanupStaleConnections()
         case <-statsTicker.C:
             h.logStatistics()
+        case <-retry:
+            go h.retryDeliveries()
+        case <-presenceTicker.C:
+            go h.refreshAllPresence()
+        }
+    }
+}
+
+// Register adds a client to the hub
+func (h *Hub) Register(client *Client) {
+    h.register <- client
+}
+
+// Resume registers a client that reconnected after receiving frame lastSeq
+// of its conversation and sends it the frames it missed, ahead of any live
+// ones. When those frames are no longer kept the client is sent
+// resync_required instead, and must reload the conversation.
+func (h *Hub) Resume(client *Client, lastSeq int64) {
+    if h.replay != nil && client.conversationID != uuid.Nil {
+        client.mu.Lock()
+        client.resuming = true
+        client.resumeAfter = lastSeq
+        client.mu.Unlock()
+    }
+    h.register <- client
+}
+
+// resume replays the frames a client missed. It starts once the client is
+// registered, so every later frame is held back for it and none is lost in
+// between.
+func (h *Hub) resume(client *Client) {
+    client.mu.RLock()
+    lastSeq := client.resumeAfter
+    client.mu.RUnlock()
+    ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+    defer cancel()
+    frames, err := h.replay.Since(ctx, client.conversationID, lastSeq)
+    if err != nil {
+        if !errors.Is(err, ErrResyncRequired) {
+            log.Warn().Err(err).Str("client_id", client.id).Msg("Failed to read replay buffer")
         }
+        msg := models.NewWebSocketMessage(MessageTypeResync, client.conversationID, uuid.Nil)
+        msg.Metadata = map[string]interface{}{"last_seq": lastSeq}
+        data, _ := json.Marshal(msg)
+        frames = []Frame{{Data: data}}
     }
+    log.Debug().Str("client_id", client.id).Int64("last_seq", lastSeq).Int("frames", len(frames)).Msg("Resuming client")
+    client.finishResume(frames, lastSeq)
 }
 
 func (h *Hub) registerClient(client *Client) {
     h.mu.Lock()
     defer h.mu.Unlock()
+    if client.isResuming() {
+        go h.resume(client)
+    }
+    if h.inbox != nil {
+        // Unacked messages whose retry is due go out now, after any replay
+        go h.redeliverTo(client.userID)
+    }
     if h.clients[client.userID] == nil {
         h.clients[client.userID] = make(map[*Client]bool)
     }
     h.clients[client.userID][client] = true
-    if client.conversationID != uuid.Nil {
-        if h.conversations[client.conversationID] == nil {
-            h.conversations[client.conversationID] = make(map[*Client]bool)
-        }
-        h.conversations[client.conversationID][client] = true
+    subscriptions := client.Subscriptions()
+    for _, conversationID := range subscriptions {
+        h.index(client, conversationID)
     }
+    go h.presenceChanged(client, subscriptions...)
     log.Info().Str("user_id", client.userID.String()).Str("conversation_id", client.conversationID.String()).Str("client_id", client.id).Msg("Client registered")
 }
 
@@ -103,24 +249,24 @@ func (h *Hub) unregisterClient(client *Client) {
             }
         }
     }
-    if client.conversationID != uuid.Nil {
-        if clients, ok := h.conversations[client.conversationID]; ok {
-            delete(clients, client)
-            if len(clients) == 0 {
-                delete(h.conversations, client.conversationID)
-            }
-        }
+    subscriptions := client.Subscriptions()
+    for _, conversationID := range subscriptions {
+        h.unindex(client, conversationID)
     }
+    go h.presenceChanged(client, subscriptions...)
     log.Info().Str("user_id", client.userID.String()).Str("conversation_id", client.conversationID.String()).Str("client_id", client.id).Msg("Client unregistered")
 }
 
 func (h *Hub) broadcastMessage(broadcast *BroadcastMessage) {
     h.mu.RLock()
     defer h.mu.RUnlock()
-    data, err := json.Marshal(broadcast.Message)
-    if err != nil {
-        log.Error().Err(err).Msg("Failed to marshal broadcast message")
-        return
+    data := broadcast.payload
+    if data == nil {
+        var err error
+        if data, err = json.Marshal(broadcast.Message); err != nil {
+            log.Error().Err(err).Msg("Failed to marshal broadcast message")
+            return
+        }
     }
     if clients, ok := h.conversations[broadcast.ConversationID]; ok {
         sentCount := 0
@@ -128,6 +274,10 @@ func (h *Hub) broadcastMessage(broadcast *BroadcastMessage) {
             if broadcast.ExcludeClient != nil && client == broadcast.ExcludeClient {
                 continue
             }
+            if client.holdFrame(broadcast.ConversationID, broadcast.seq, data) {
+                sentCount++
+                continue
+            }
             select {
             case client.send <- data:
                 sentCount++
@@ -140,22 +290,217 @@ func (h *Hub) broadcastMessage(broadcast *BroadcastMessage) {
     }
 }
 
+// BroadcastToConversation sends message to the clients in a conversation,
+// on this replica and, through the backplane, on every other one. With a
+// replay buffer the message is stamped with the conversation's next "seq";
+// it's numbered and sent in the background, in the order of the calls.
 func (h *Hub) BroadcastToConversation(conversationID uuid.UUID, message interface{}, excludeClient *Client) {
-    h.broadcast <- &BroadcastMessage{
+    data, err := json.Marshal(message)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to marshal broadcast message")
+        return
+    }
+    h.broadcastToConversation(conversationID, data, excludeClient)
+}
+
+func (h *Hub) broadcastToConversation(conversationID uuid.UUID, data []byte, excludeClient *Client) {
+    broadcast := &BroadcastMessage{
         ConversationID: conversationID,
-        Message:        message,
         ExcludeClient:  excludeClient,
+        payload:        data,
+    }
+    if h.replay == nil {
+        h.broadcast <- broadcast
+        h.publish(&Envelope{ConversationID: conversationID, Payload: data})
+        return
+    }
+    // Numbering waits on the replay buffer, which the caller shouldn't
+    queue := h.sequencers[int(conversationID[0])%len(h.sequencers)]
+    select {
+    case queue <- broadcast:
+    case <-h.ctx.Done():
     }
 }
 
+// sequence numbers the frames of its conversations one at a time and sends
+// each before numbering the next, so clients here and on other replicas get
+// them in the order of their "seq"
+func (h *Hub) sequence(queue chan *BroadcastMessage) {
+    for {
+        select {
+        case <-h.ctx.Done():
+            return
+        case broadcast := <-queue:
+            ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+            seq, err := h.replay.Append(ctx, broadcast.ConversationID, broadcast.payload)
+            cancel()
+            if err != nil {
+                // Sent unnumbered; a client that misses it will have to resync
+                log.Warn().Err(err).Str("conversation_id", broadcast.ConversationID.String()).Msg("Failed to sequence broadcast")
+            } else {
+                broadcast.seq = seq
+                broadcast.payload = stampSequence(broadcast.payload, seq)
+            }
+            select {
+            case h.broadcast <- broadcast:
+            case <-h.ctx.Done():
+                return
+            }
+            h.publish(&Envelope{ConversationID: broadcast.ConversationID, Seq: broadcast.seq, Payload: broadcast.payload})
+        }
+    }
+}
+
+// BroadcastToUser sends message to every connection of a user, on this
+// replica and, through the backplane, on every other one
 func (h *Hub) BroadcastToUser(userID uuid.UUID, message interface{}) {
-    h.mu.RLock()
-    defer h.mu.RUnlock()
     data, err := json.Marshal(message)
     if err != nil {
         log.Error().Err(err).Msg("Failed to marshal user broadcast message")
         return
     }
+    h.sendToUser(userID, data)
+    h.publish(&Envelope{UserID: userID, Payload: data})
+}
+
+// BroadcastCritical sends a message the user's client must ack by its
+// "delivery_id": to the clients in the conversation when conversationID is
+// set, otherwise to every connection of the user. Until it's acked it's sent
+// again with backoff, including when the user reconnects, and after the last
+// attempt it waits in the user's inbox. Without an inbox it's broadcast once.
+func (h *Hub) BroadcastCritical(userID, conversationID uuid.UUID, message interface{}) {
+    data, err := json.Marshal(message)
+    if err != nil {
+        log.Error().Err(err).Msg("Failed to marshal critical message")
+        return
+    }
+    if h.inbox != nil {
+        data = h.track(userID, conversationID, data)
+    }
+    if conversationID != uuid.Nil {
+        h.broadcastToConversation(conversationID, data, nil)
+        return
+    }
+    h.sendToUser(userID, data)
+    h.publish(&Envelope{UserID: userID, Payload: data})
+}
+
+// track stores a critical message in the inbox and returns it stamped with
+// its delivery ID. When it can't be stored it's returned as is, to be sent
+// once.
+func (h *Hub) track(userID, conversationID uuid.UUID, data []byte) []byte {
+    var header struct {
+        Type string `json:"type"`
+    }
+    json.Unmarshal(data, &header)
+    delivery := &Delivery{
+        ID:             uuid.New(),
+        UserID:         userID,
+        ConversationID: conversationID,
+        Type:           header.Type,
+        Attempts:       1,
+        CreatedAt:      time.Now(),
+    }
+    delivery.Payload = stampField(data, "delivery_id", []byte(`"`+delivery.ID.String()+`"`))
+    ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+    defer cancel()
+    if err := h.inbox.Add(ctx, delivery); err != nil {
+        log.Warn().Err(err).Str("user_id", userID.String()).Str("type", delivery.Type).Msg("Failed to store critical message, sending it once")
+        return data
+    }
+    return delivery.Payload
+}
+
+// Ack confirms a critical message, reporting whether it was still pending
+func (h *Hub) Ack(ctx context.Context, userID, deliveryID uuid.UUID) (bool, error) {
+    if h.inbox == nil {
+        return false, ErrInboxDisabled
+    }
+    return h.inbox.Ack(ctx, userID, deliveryID)
+}
+
+// Pending returns the critical messages a user hasn't acked, oldest first
+func (h *Hub) Pending(ctx context.Context, userID uuid.UUID) ([]*Delivery, error) {
+    if h.inbox == nil {
+        return nil, ErrInboxDisabled
+    }
+    return h.inbox.Pending(ctx, userID)
+}
+
+// retryDeliveries sends the due critical messages of every user connected
+// here. A pass still running when the next is due is left to finish.
+func (h *Hub) retryDeliveries() {
+    if !h.retrying.CompareAndSwap(false, true) {
+        return
+    }
+    defer h.retrying.Store(false)
+    h.mu.RLock()
+    userIDs := make([]uuid.UUID, 0, len(h.clients))
+    for userID := range h.clients {
+        userIDs = append(userIDs, userID)
+    }
+    h.mu.RUnlock()
+    for _, userID := range userIDs {
+        if h.ctx.Err() != nil {
+            return
+        }
+        h.redeliverTo(userID)
+    }
+}
+
+// redeliverTo sends a user's due critical messages to the user's clients
+// here and schedules the next attempt. Messages with no client here to go to
+// stay due.
+func (h *Hub) redeliverTo(userID uuid.UUID) {
+    ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+    defer cancel()
+    deliveries, err := h.inbox.Due(ctx, userID, time.Now())
+    if err != nil {
+        log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to read due critical messages")
+        return
+    }
+    for _, delivery := range deliveries {
+        if !h.sendDelivery(delivery) {
+            continue
+        }
+        next := time.Now().Add(retryDelay(delivery.Attempts + 1))
+        if delivery.Attempts+1 >= h.maxAttempts {
+            // Left for the client to fetch from the inbox
+            next = time.Time{}
+        }
+        if err := h.inbox.Reschedule(ctx, delivery, next); err != nil {
+            log.Warn().Err(err).Str("delivery_id", delivery.ID.String()).Msg("Failed to reschedule critical message")
+        }
+    }
+}
+
+// sendDelivery sends a critical message to the clients here it was meant
+// for, reporting whether there were any
+func (h *Hub) sendDelivery(delivery *Delivery) bool {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    sent := false
+    for client := range h.clients[delivery.UserID] {
+        if delivery.ConversationID != uuid.Nil && !client.IsSubscribed(delivery.ConversationID) {
+            continue
+        }
+        if client.holdFrame(delivery.ConversationID, 0, delivery.Payload) {
+            sent = true
+            continue
+        }
+        select {
+        case client.send <- delivery.Payload:
+            sent = true
+        default:
+            log.Warn().Str("client_id", client.id).Msg("Client send channel full")
+        }
+    }
+    return sent
+}
+
+func (h *Hub) sendToUser(userID uuid.UUID, data []byte) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
     if clients, ok := h.clients[userID]; ok {
         for client := range clients {
             select {
@@ -167,6 +512,74 @@ func (h *Hub) BroadcastToUser(userID uuid.UUID, message interface{}) {
     }
 }
 
+// publish queues an envelope for the backplane. Envelopes leave in the
+// order they're queued, so streamed deltas arrive in order everywhere.
+func (h *Hub) publish(envelope *Envelope) {
+    if h.backplane == nil {
+        return
+    }
+    envelope.ID = uuid.New()
+    envelope.NodeID = h.nodeID
+    select {
+    case h.outbound <- envelope:
+    default:
+        log.Warn().Str("node_id", h.nodeID).Msg("Backplane queue full, broadcast not sent to other replicas")
+    }
+}
+
+func (h *Hub) publishBackplane() {
+    for {
+        select {
+        case <-h.ctx.Done():
+            return
+        case envelope := <-h.outbound:
+            ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+            if err := h.backplane.Publish(ctx, envelope); err != nil {
+                log.Warn().Err(err).Str("envelope_id", envelope.ID.String()).Msg("Failed to publish broadcast to backplane")
+            }
+            cancel()
+        }
+    }
+}
+
+func (h *Hub) subscribeBackplane() {
+    for {
+        err := h.backplane.Subscribe(h.ctx, h.receive)
+        if h.ctx.Err() != nil {
+            return
+        }
+        log.Warn().Err(err).Str("node_id", h.nodeID).Msg("Backplane subscription lost, resubscribing")
+        select {
+        case <-h.ctx.Done():
+            return
+        case <-time.After(resubscribeDelay):
+        }
+    }
+}
+
+// receive delivers a broadcast from another replica to the clients here.
+// The hub's own envelopes were delivered when they were sent, and repeats
+// of an envelope are dropped.
+func (h *Hub) receive(envelope *Envelope) {
+    if envelope.NodeID == h.nodeID || h.recent.seen(envelope.ID) {
+        return
+    }
+    switch {
+    case envelope.ConversationID != uuid.Nil:
+        select {
+        case h.broadcast <- &BroadcastMessage{ConversationID: envelope.ConversationID, payload: envelope.Payload, seq: envelope.Seq}:
+        case <-h.ctx.Done():
+        }
+    case envelope.UserID != uuid.Nil:
+        h.sendToUser(envelope.UserID, envelope.Payload)
+    }
+}
+
+// NodeID returns the name of this replica on the backplane
+func (h *Hub) NodeID() string {
+    return h.nodeID
+}
+
 func (h *Hub) SendToClient(client *Client, message interface{}) error {
     data, err := json.Marshal(message)
     if err != nil {
@@ -279,6 +692,7 @@ func (h *Hub) GetStats() map[string]interface{} {
         "total_clients":        totalClients,
         "unique_users":         len(h.clients),
         "active_conversations": len(h.conversations),
+        "node_id":              h.nodeID,
         "timestamp":            time.Now(),
     }
 }
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "math/rand"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client subscribed to conversationID without a connection
+func newTestClient(hub *Hub, conversationID uuid.UUID) *Client {
+    client := &Client{
+        id:             uuid.New().String(),
+        hub:            hub,
+        send:           make(chan []byte, sendBufferSize),
+        userID:         uuid.New(),
+        conversationID: conversationID,
+        subscriptions:  map[uuid.UUID]bool{conversationID: true},
+        lastActivity:   time.Now(),
+        lastInput:      time.Now(),
+    }
+    client.ctx, client.cancel = context.WithCancel(context.Background())
+    return client
+}
+
+// registerTestClient registers a client and waits until broadcasts reach it
+func registerTestClient(t *testing.T, hub *Hub, conversationID uuid.UUID) *Client {
+    client := newTestClient(hub, conversationID)
+    hub.Register(client)
+    require.Eventually(t, func() bool {
+        return hub.GetConversationClientCount(conversationID) > 0
+    }, time.Second, time.Millisecond)
+    return client
+}
+
+func receiveSeq(t *testing.T, client *Client) int64 {
+    select {
+    case data := <-client.send:
+        var frame struct {
+            Seq int64 `json:"seq"`
+        }
+        require.NoError(t, json.Unmarshal(data, &frame))
+        return frame.Seq
+    case <-time.After(2 * time.Second):
+        t.Fatal("no frame received")
+        return 0
+    }
+}
+
+// delayedReplay returns from Append after a random delay, so callers that
+// number frames concurrently finish in any order
+type delayedReplay struct {
+    *MemoryReplay
+}
+
+func (r delayedReplay) Append(ctx context.Context, conversationID uuid.UUID, frame []byte) (int64, error) {
+    seq, err := r.MemoryReplay.Append(ctx, conversationID, frame)
+    time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+    return seq, err
+}
+
+// blockingReplay doesn't number frames until release is closed
+type blockingReplay struct {
+    *MemoryReplay
+    release chan struct{}
+}
+
+func (r blockingReplay) Append(ctx context.Context, conversationID uuid.UUID, frame []byte) (int64, error) {
+    <-r.release
+    return r.MemoryReplay.Append(ctx, conversationID, frame)
+}
+
+func TestHubSendsFramesInSequence(t *testing.T) {
+    hub := NewHubWithOptions(HubOptions{Replay: delayedReplay{NewMemoryReplay(100, time.Hour)}})
+    go hub.Run()
+    defer hub.Shutdown()
+    conversationID := uuid.New()
+    client := registerTestClient(t, hub, conversationID)
+
+    const broadcasts = 50
+    var wg sync.WaitGroup
+    for n := 0; n < broadcasts; n++ {
+        wg.Add(1)
+        go func(n int) {
+            defer wg.Done()
+            hub.BroadcastToConversation(conversationID, map[string]int{"n": n}, nil)
+        }(n)
+    }
+    wg.Wait()
+    for want := int64(1); want <= broadcasts; want++ {
+        assert.Equal(t, want, receiveSeq(t, client))
+    }
+}
+
+func TestHubBroadcastDoesNotWaitForReplay(t *testing.T) {
+    replay := blockingReplay{MemoryReplay: NewMemoryReplay(100, time.Hour), release: make(chan struct{})}
+    hub := NewHubWithOptions(HubOptions{Replay: replay})
+    go hub.Run()
+    defer hub.Shutdown()
+    conversationID := uuid.New()
+    client := registerTestClient(t, hub, conversationID)
+
+    done := make(chan struct{})
+    go func() {
+        hub.BroadcastToConversation(conversationID, map[string]string{"type": "message"}, nil)
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("broadcast waited for the replay buffer")
+    }
+    close(replay.release)
+    assert.Equal(t, int64(1), receiveSeq(t, client))
+}
@@ -0,0 +1,317 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+)
+
+// MessageTypeAck is sent by clients to confirm a critical message by its
+// delivery_id
+const MessageTypeAck = "ack"
+
+const (
+    // DefaultInboxTTL is how long unacknowledged messages are kept
+    DefaultInboxTTL = 7 * 24 * time.Hour
+    // DefaultMaxAttempts is how many times a message is sent before it's
+    // left for the client to fetch from the inbox
+    DefaultMaxAttempts = 8
+    // retryBase and retryMax bound the backoff between redeliveries
+    retryBase = 2 * time.Second
+    retryMax  = 2 * time.Minute
+    // dueBatch bounds the redeliveries read for one user at a time
+    dueBatch = 50
+)
+
+// Delivery is a critical message waiting for the client's ack
+type Delivery struct {
+    ID             uuid.UUID       `json:"id"`
+    UserID         uuid.UUID       `json:"user_id"`
+    ConversationID uuid.UUID       `json:"conversation_id,omitempty"`
+    Type           string          `json:"type"`
+    Payload        json.RawMessage `json:"payload"` // the message, with delivery_id set
+    Attempts       int             `json:"attempts"`
+    CreatedAt      time.Time       `json:"created_at"`
+}
+
+// Inbox keeps critical messages per user until they're acknowledged, and
+// schedules their redelivery
+type Inbox interface {
+    // Add stores a delivery that was just sent, due for redelivery after the
+    // first backoff
+    Add(ctx context.Context, delivery *Delivery) error
+    // Ack removes a delivery, reporting whether it was pending
+    Ack(ctx context.Context, userID, deliveryID uuid.UUID) (bool, error)
+    // Pending returns a user's unacknowledged deliveries, oldest first
+    Pending(ctx context.Context, userID uuid.UUID) ([]*Delivery, error)
+    // Due returns a user's deliveries whose redelivery time has passed
+    Due(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Delivery, error)
+    // Reschedule records another attempt at a delivery and when the next is
+    // due. A zero next stops redelivery; the delivery stays pending.
+    Reschedule(ctx context.Context, delivery *Delivery, next time.Time) error
+}
+
+// ErrInboxDisabled is returned for acks and inbox reads when no inbox is
+// configured
+var ErrInboxDisabled = errors.New("websocket inbox disabled")
+
+// NewInbox returns the inbox cfg selects, or nil when critical messages are
+// sent once like any other. The memory inbox is per replica.
+func NewInbox(cfg config.WebSocketConfig, redisClient *redis.Client) (Inbox, error) {
+    switch cfg.Inbox {
+    case "":
+        return nil, nil
+    case "memory":
+        return NewMemoryInbox(), nil
+    case "redis":
+        return NewRedisInbox(redisClient, cfg.InboxTTL), nil
+    default:
+        return nil, fmt.Errorf("unknown websocket inbox %q", cfg.Inbox)
+    }
+}
+
+// retryDelay is the wait after a delivery's latest attempt before the next:
+// retryBase after the first, doubling up to retryMax
+func retryDelay(attempts int) time.Duration {
+    if attempts <= 1 {
+        return retryBase
+    }
+    if attempts > 8 {
+        return retryMax
+    }
+    return min(retryBase<<(attempts-1), retryMax)
+}
+
+// MemoryInbox keeps deliveries in process
+type MemoryInbox struct {
+    mu    sync.Mutex
+    users map[uuid.UUID]map[uuid.UUID]*memoryDelivery
+}
+
+type memoryDelivery struct {
+    delivery Delivery
+    due      time.Time
+    parked   bool // out of attempts
+}
+
+// NewMemoryInbox creates an in-process inbox
+func NewMemoryInbox() *MemoryInbox {
+    return &MemoryInbox{
+        users: make(map[uuid.UUID]map[uuid.UUID]*memoryDelivery),
+    }
+}
+
+// Add stores a delivery
+func (i *MemoryInbox) Add(ctx context.Context, delivery *Delivery) error {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.users[delivery.UserID] == nil {
+        i.users[delivery.UserID] = make(map[uuid.UUID]*memoryDelivery)
+    }
+    i.users[delivery.UserID][delivery.ID] = &memoryDelivery{delivery: *delivery, due: time.Now().Add(retryDelay(delivery.Attempts))}
+    return nil
+}
+
+// Ack removes a delivery
+func (i *MemoryInbox) Ack(ctx context.Context, userID, deliveryID uuid.UUID) (bool, error) {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if _, ok := i.users[userID][deliveryID]; !ok {
+        return false, nil
+    }
+    delete(i.users[userID], deliveryID)
+    if len(i.users[userID]) == 0 {
+        delete(i.users, userID)
+    }
+    return true, nil
+}
+
+// Pending returns a user's deliveries
+func (i *MemoryInbox) Pending(ctx context.Context, userID uuid.UUID) ([]*Delivery, error) {
+    return i.filter(userID, func(*memoryDelivery) bool { return true }), nil
+}
+
+// Due returns a user's deliveries due by now
+func (i *MemoryInbox) Due(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Delivery, error) {
+    return i.filter(userID, func(d *memoryDelivery) bool { return !d.parked && !d.due.After(now) }), nil
+}
+
+// Reschedule records an attempt
+func (i *MemoryInbox) Reschedule(ctx context.Context, delivery *Delivery, next time.Time) error {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if d, ok := i.users[delivery.UserID][delivery.ID]; ok {
+        d.delivery.Attempts++
+        d.due = next
+        d.parked = next.IsZero()
+        delivery.Attempts = d.delivery.Attempts
+    }
+    return nil
+}
+
+func (i *MemoryInbox) filter(userID uuid.UUID, keep func(*memoryDelivery) bool) []*Delivery {
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    var deliveries []*Delivery
+    for _, d := range i.users[userID] {
+        if keep(d) {
+            copied := d.delivery
+            deliveries = append(deliveries, &copied)
+        }
+    }
+    sort.Slice(deliveries, func(a, b int) bool { return deliveries[a].CreatedAt.Before(deliveries[b].CreatedAt) })
+    return deliveries
+}
+
+// RedisInbox keeps deliveries in a hash per user, with a sorted set of when
+// each is due, so every replica sees the same inbox
+type RedisInbox struct {
+    client *redis.Client
+    ttl    time.Duration
+}
+
+// NewRedisInbox keeps unacknowledged deliveries for ttl after a user's
+// latest one
+func NewRedisInbox(client *redis.Client, ttl time.Duration) *RedisInbox {
+    if ttl <= 0 {
+        ttl = DefaultInboxTTL
+    }
+    return &RedisInbox{
+        client: client,
+        ttl:    ttl,
+    }
+}
+
+func inboxKey(userID uuid.UUID) string {
+    return "ws_inbox:" + userID.String()
+}
+
+func inboxDueKey(userID uuid.UUID) string {
+    return "ws_inbox_due:" + userID.String()
+}
+
+// Add stores a delivery
+func (i *RedisInbox) Add(ctx context.Context, delivery *Delivery) error {
+    data, err := json.Marshal(delivery)
+    if err != nil {
+        return fmt.Errorf("failed to marshal delivery: %w", err)
+    }
+    due := time.Now().Add(retryDelay(delivery.Attempts))
+    _, err = i.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HSet(ctx, inboxKey(delivery.UserID), delivery.ID.String(), data)
+        pipe.ZAdd(ctx, inboxDueKey(delivery.UserID), redis.Z{Score: float64(due.UnixMilli()), Member: delivery.ID.String()})
+        pipe.Expire(ctx, inboxKey(delivery.UserID), i.ttl)
+        pipe.Expire(ctx, inboxDueKey(delivery.UserID), i.ttl)
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to add delivery: %w", err)
+    }
+    return nil
+}
+
+// Ack removes a delivery
+func (i *RedisInbox) Ack(ctx context.Context, userID, deliveryID uuid.UUID) (bool, error) {
+    var removed *redis.IntCmd
+    _, err := i.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        removed = pipe.HDel(ctx, inboxKey(userID), deliveryID.String())
+        pipe.ZRem(ctx, inboxDueKey(userID), deliveryID.String())
+        return nil
+    })
+    if err != nil {
+        return false, fmt.Errorf("failed to ack delivery: %w", err)
+    }
+    return removed.Val() > 0, nil
+}
+
+// Pending returns a user's deliveries
+func (i *RedisInbox) Pending(ctx context.Context, userID uuid.UUID) ([]*Delivery, error) {
+    values, err := i.client.HVals(ctx, inboxKey(userID)).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read inbox: %w", err)
+    }
+    deliveries := decodeDeliveries(values)
+    sort.Slice(deliveries, func(a, b int) bool { return deliveries[a].CreatedAt.Before(deliveries[b].CreatedAt) })
+    return deliveries, nil
+}
+
+// Due returns a user's deliveries due by now
+func (i *RedisInbox) Due(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Delivery, error) {
+    ids, err := i.client.ZRangeByScore(ctx, inboxDueKey(userID), &redis.ZRangeBy{
+        Min:   "-inf",
+        Max:   strconv.FormatInt(now.UnixMilli(), 10),
+        Count: dueBatch,
+    }).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read due deliveries: %w", err)
+    }
+    if len(ids) == 0 {
+        return nil, nil
+    }
+    values, err := i.client.HMGet(ctx, inboxKey(userID), ids...).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read due deliveries: %w", err)
+    }
+    var encoded []string
+    for n, value := range values {
+        if s, ok := value.(string); ok {
+            encoded = append(encoded, s)
+        } else {
+            // Acked on another replica between the two reads
+            i.client.ZRem(ctx, inboxDueKey(userID), ids[n])
+        }
+    }
+    return decodeDeliveries(encoded), nil
+}
+
+// Reschedule records an attempt
+func (i *RedisInbox) Reschedule(ctx context.Context, delivery *Delivery, next time.Time) error {
+    attempted := *delivery
+    attempted.Attempts++
+    data, err := json.Marshal(&attempted)
+    if err != nil {
+        return fmt.Errorf("failed to marshal delivery: %w", err)
+    }
+    score := "+inf"
+    if !next.IsZero() {
+        score = strconv.FormatInt(next.UnixMilli(), 10)
+    }
+    keys := []string{inboxKey(delivery.UserID), inboxDueKey(delivery.UserID)}
+    if err := rescheduleDelivery.Run(ctx, i.client, keys, delivery.ID.String(), data, score).Err(); err != nil {
+        return fmt.Errorf("failed to reschedule delivery: %w", err)
+    }
+    delivery.Attempts = attempted.Attempts
+    return nil
+}
+
+// rescheduleDelivery updates a delivery unless it was acked meanwhile
+var rescheduleDelivery = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+    return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+return 1
+`)
+
+func decodeDeliveries(values []string) []*Delivery {
+    deliveries := make([]*Delivery, 0, len(values))
+    for _, value := range values {
+        var delivery Delivery
+        if err := json.Unmarshal([]byte(value), &delivery); err != nil {
+            continue
+        }
+        deliveries = append(deliveries, &delivery)
+    }
+    return deliveries
+}
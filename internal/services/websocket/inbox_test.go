@@ -0,0 +1,302 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+    for attempts, want := range map[int]time.Duration{
+        -1: retryBase,
+        0:  retryBase,
+        1:  retryBase,
+        2:  4 * time.Second,
+        3:  8 * time.Second,
+        4:  16 * time.Second,
+        5:  32 * time.Second,
+        6:  64 * time.Second,
+        7:  retryMax,
+        8:  retryMax,
+        64: retryMax,
+    } {
+        assert.Equal(t, want, retryDelay(attempts), "attempts %d", attempts)
+    }
+}
+
+func newDelivery(userID uuid.UUID, created time.Time) *Delivery {
+    return &Delivery{
+        ID:        uuid.New(),
+        UserID:    userID,
+        Type:      "message_complete",
+        Payload:   json.RawMessage(`{"type":"message_complete"}`),
+        Attempts:  1,
+        CreatedAt: created,
+    }
+}
+
+func deliveryIDs(deliveries []*Delivery) []uuid.UUID {
+    ids := make([]uuid.UUID, len(deliveries))
+    for n, delivery := range deliveries {
+        ids[n] = delivery.ID
+    }
+    return ids
+}
+
+// testInbox checks the behavior every Inbox shares
+func testInbox(t *testing.T, newInbox func(t *testing.T) Inbox) {
+    ctx := context.Background()
+
+    t.Run("due after the first backoff", func(t *testing.T) {
+        inbox := newInbox(t)
+        userID := uuid.New()
+        delivery := newDelivery(userID, time.Now())
+        require.NoError(t, inbox.Add(ctx, delivery))
+
+        due, err := inbox.Due(ctx, userID, time.Now())
+        require.NoError(t, err)
+        assert.Empty(t, due)
+        due, err = inbox.Due(ctx, userID, time.Now().Add(retryBase+time.Second))
+        require.NoError(t, err)
+        require.Len(t, due, 1)
+        assert.Equal(t, delivery.ID, due[0].ID)
+        assert.JSONEq(t, string(delivery.Payload), string(due[0].Payload))
+
+        due, err = inbox.Due(ctx, uuid.New(), time.Now().Add(time.Hour))
+        require.NoError(t, err)
+        assert.Empty(t, due, "other users' deliveries")
+    })
+
+    t.Run("pending oldest first", func(t *testing.T) {
+        inbox := newInbox(t)
+        userID := uuid.New()
+        now := time.Now()
+        newest, oldest, middle := newDelivery(userID, now), newDelivery(userID, now.Add(-time.Hour)), newDelivery(userID, now.Add(-time.Minute))
+        for _, delivery := range []*Delivery{newest, oldest, middle} {
+            require.NoError(t, inbox.Add(ctx, delivery))
+        }
+        pending, err := inbox.Pending(ctx, userID)
+        require.NoError(t, err)
+        assert.Equal(t, []uuid.UUID{oldest.ID, middle.ID, newest.ID}, deliveryIDs(pending))
+    })
+
+    t.Run("reschedule", func(t *testing.T) {
+        inbox := newInbox(t)
+        userID := uuid.New()
+        delivery := newDelivery(userID, time.Now())
+        require.NoError(t, inbox.Add(ctx, delivery))
+
+        next := time.Now().Add(time.Minute)
+        require.NoError(t, inbox.Reschedule(ctx, delivery, next))
+        assert.Equal(t, 2, delivery.Attempts)
+        due, err := inbox.Due(ctx, userID, next.Add(-time.Second))
+        require.NoError(t, err)
+        assert.Empty(t, due)
+        due, err = inbox.Due(ctx, userID, next.Add(time.Second))
+        require.NoError(t, err)
+        require.Len(t, due, 1)
+        assert.Equal(t, 2, due[0].Attempts)
+    })
+
+    t.Run("parked deliveries stay pending", func(t *testing.T) {
+        inbox := newInbox(t)
+        userID := uuid.New()
+        delivery := newDelivery(userID, time.Now())
+        require.NoError(t, inbox.Add(ctx, delivery))
+
+        require.NoError(t, inbox.Reschedule(ctx, delivery, time.Time{}))
+        due, err := inbox.Due(ctx, userID, time.Now().Add(24*time.Hour))
+        require.NoError(t, err)
+        assert.Empty(t, due)
+        pending, err := inbox.Pending(ctx, userID)
+        require.NoError(t, err)
+        require.Len(t, pending, 1)
+        assert.Equal(t, 2, pending[0].Attempts)
+    })
+
+    t.Run("ack", func(t *testing.T) {
+        inbox := newInbox(t)
+        userID := uuid.New()
+        acked, kept := newDelivery(userID, time.Now()), newDelivery(userID, time.Now())
+        require.NoError(t, inbox.Add(ctx, acked))
+        require.NoError(t, inbox.Add(ctx, kept))
+
+        ok, err := inbox.Ack(ctx, uuid.New(), acked.ID)
+        require.NoError(t, err)
+        assert.False(t, ok, "only the recipient acks")
+        ok, err = inbox.Ack(ctx, userID, acked.ID)
+        require.NoError(t, err)
+        assert.True(t, ok)
+        ok, err = inbox.Ack(ctx, userID, acked.ID)
+        require.NoError(t, err)
+        assert.False(t, ok, "already acked")
+
+        // A redelivery racing the ack doesn't bring it back
+        require.NoError(t, inbox.Reschedule(ctx, acked, time.Now()))
+        pending, err := inbox.Pending(ctx, userID)
+        require.NoError(t, err)
+        assert.Equal(t, []uuid.UUID{kept.ID}, deliveryIDs(pending))
+        due, err := inbox.Due(ctx, userID, time.Now().Add(time.Hour))
+        require.NoError(t, err)
+        assert.Equal(t, []uuid.UUID{kept.ID}, deliveryIDs(due))
+    })
+}
+
+func TestMemoryInbox(t *testing.T) {
+    testInbox(t, func(t *testing.T) Inbox {
+        return NewMemoryInbox()
+    })
+}
+
+func newRedisInbox(t *testing.T) (*RedisInbox, *miniredis.Miniredis) {
+    server := miniredis.RunT(t)
+    client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+    t.Cleanup(func() { client.Close() })
+    return NewRedisInbox(client, time.Hour), server
+}
+
+func TestRedisInbox(t *testing.T) {
+    testInbox(t, func(t *testing.T) Inbox {
+        inbox, _ := newRedisInbox(t)
+        return inbox
+    })
+}
+
+func TestRedisInboxExpires(t *testing.T) {
+    ctx := context.Background()
+    inbox, server := newRedisInbox(t)
+    userID := uuid.New()
+    require.NoError(t, inbox.Add(ctx, newDelivery(userID, time.Now())))
+    assert.Equal(t, time.Hour, server.TTL(inboxKey(userID)))
+    assert.Equal(t, time.Hour, server.TTL(inboxDueKey(userID)))
+
+    server.FastForward(time.Hour + time.Second)
+    pending, err := inbox.Pending(ctx, userID)
+    require.NoError(t, err)
+    assert.Empty(t, pending)
+}
+
+func TestRedisInboxDropsDueEntriesOfAckedDeliveries(t *testing.T) {
+    ctx := context.Background()
+    inbox, server := newRedisInbox(t)
+    userID := uuid.New()
+    delivery := newDelivery(userID, time.Now())
+    require.NoError(t, inbox.Add(ctx, delivery))
+    // Acked on another replica after the due entry was read
+    server.HDel(inboxKey(userID), delivery.ID.String())
+
+    due, err := inbox.Due(ctx, userID, time.Now().Add(time.Hour))
+    require.NoError(t, err)
+    assert.Empty(t, due)
+    members, err := server.ZMembers(inboxDueKey(userID))
+    if err != miniredis.ErrKeyNotFound {
+        require.NoError(t, err)
+    }
+    assert.Empty(t, members)
+}
+
+// makeDue brings the next attempt of a user's unparked deliveries forward to now
+func makeDue(inbox *MemoryInbox, userID uuid.UUID) {
+    inbox.mu.Lock()
+    defer inbox.mu.Unlock()
+    for _, d := range inbox.users[userID] {
+        if !d.parked {
+            d.due = time.Now()
+        }
+    }
+}
+
+// receiveDeliveryID returns the delivery_id of the next critical message a
+// client gets
+func receiveDeliveryID(t *testing.T, client *Client) uuid.UUID {
+    t.Helper()
+    var frame struct {
+        DeliveryID uuid.UUID `json:"delivery_id"`
+    }
+    require.NoError(t, json.Unmarshal([]byte(receiveBroadcast(t, client)), &frame))
+    require.NotEqual(t, uuid.Nil, frame.DeliveryID)
+    return frame.DeliveryID
+}
+
+func TestHubParksCriticalMessagesAfterMaxAttempts(t *testing.T) {
+    ctx := context.Background()
+    inbox := NewMemoryInbox()
+    hub := NewHubWithOptions(HubOptions{Inbox: inbox, MaxAttempts: 3})
+    t.Cleanup(hub.Shutdown)
+    userID := uuid.New()
+    client := newTestClient(hub, uuid.New())
+    client.userID = userID
+    hub.registerClient(client)
+
+    hub.BroadcastCritical(userID, uuid.Nil, map[string]string{"type": "video_completed"})
+    deliveryID := receiveDeliveryID(t, client)
+
+    for attempt := 2; attempt <= 3; attempt++ {
+        makeDue(inbox, userID)
+        hub.redeliverTo(userID)
+        assert.Equal(t, deliveryID, receiveDeliveryID(t, client), "attempt %d", attempt)
+        pending, err := hub.Pending(ctx, userID)
+        require.NoError(t, err)
+        require.Len(t, pending, 1)
+        assert.Equal(t, attempt, pending[0].Attempts)
+        assert.Equal(t, "video_completed", pending[0].Type)
+    }
+
+    // Out of attempts: it waits in the inbox
+    makeDue(inbox, userID)
+    hub.redeliverTo(userID)
+    assertNoBroadcast(t, client)
+    pending, err := hub.Pending(ctx, userID)
+    require.NoError(t, err)
+    assert.Equal(t, []uuid.UUID{deliveryID}, deliveryIDs(pending))
+
+    require.NoError(t, client.handleIncomingMessage(&IncomingMessage{Type: MessageTypeAck, DeliveryID: deliveryID}))
+    pending, err = hub.Pending(ctx, userID)
+    require.NoError(t, err)
+    assert.Empty(t, pending)
+    acked, err := hub.Ack(ctx, userID, deliveryID)
+    require.NoError(t, err)
+    assert.False(t, acked)
+}
+
+func TestHubKeepsDueMessagesOfAbsentUsers(t *testing.T) {
+    ctx := context.Background()
+    inbox := NewMemoryInbox()
+    hub := NewHubWithOptions(HubOptions{Inbox: inbox})
+    t.Cleanup(hub.Shutdown)
+    userID := uuid.New()
+
+    hub.BroadcastCritical(userID, uuid.Nil, map[string]string{"type": "video_completed"})
+    makeDue(inbox, userID)
+    hub.redeliverTo(userID)
+    pending, err := hub.Pending(ctx, userID)
+    require.NoError(t, err)
+    require.Len(t, pending, 1)
+    assert.Equal(t, 1, pending[0].Attempts, "nobody was there to send it to")
+
+    // It goes out when the user connects
+    client := newTestClient(hub, uuid.New())
+    client.userID = userID
+    hub.registerClient(client)
+    assert.Equal(t, pending[0].ID, receiveDeliveryID(t, client))
+    require.Eventually(t, func() bool {
+        pending, err := hub.Pending(ctx, userID)
+        return err == nil && len(pending) == 1 && pending[0].Attempts == 2
+    }, time.Second, time.Millisecond)
+}
+
+func TestHubWithoutInbox(t *testing.T) {
+    hub := NewHubWithOptions(HubOptions{})
+    t.Cleanup(hub.Shutdown)
+    _, err := hub.Ack(context.Background(), uuid.New(), uuid.New())
+    assert.ErrorIs(t, err, ErrInboxDisabled)
+    _, err = hub.Pending(context.Background(), uuid.New())
+    assert.ErrorIs(t, err, ErrInboxDisabled)
+}
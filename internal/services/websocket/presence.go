@@ -0,0 +1,506 @@
+package websocket
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+    "github.com/rs/zerolog/log"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+    "github.com/D43M0N18/qilin_core/internal/models"
+)
+
+// MessageTypePresence tells the clients in a conversation a viewer joined,
+// left, went idle or became active again. Metadata carries "user_id" and
+// "event".
+const MessageTypePresence = "presence"
+
+// Presence events
+const (
+    PresenceJoined = "joined"
+    PresenceLeft   = "left"
+    PresenceIdle   = "idle"
+    PresenceActive = "active"
+)
+
+const (
+    // DefaultIdleAfter is how long a viewer sends nothing before going idle
+    DefaultIdleAfter = 2 * time.Minute
+    // presenceInterval is how often idleness is checked and heartbeats sent
+    presenceInterval = 15 * time.Second
+    // presenceTTL is how long a heartbeat counts, so viewers on a replica
+    // that died drop out after a few missed ones
+    presenceTTL = 3 * presenceInterval
+    // presenceSweepBatch bounds how many expired entries one sweep drops
+    presenceSweepBatch = 100
+)
+
+// Viewer is a user viewing a conversation, on any replica
+type Viewer struct {
+    UserID uuid.UUID `json:"user_id"`
+    State  string    `json:"state"` // active or idle
+}
+
+// ExpiredPresence is the state a user had on a replica that stopped
+// heartbeating it
+type ExpiredPresence struct {
+    ConversationID uuid.UUID
+    UserID         uuid.UUID
+    State          string
+}
+
+// PresenceStore shares who is viewing each conversation between replicas.
+// Each replica reports the state of its own connections per user, and
+// entries it stops refreshing expire.
+type PresenceStore interface {
+    // Set records a user's state in a conversation on a replica
+    Set(ctx context.Context, conversationID, userID uuid.UUID, nodeID, state string) error
+    // Remove drops a user from a conversation on a replica
+    Remove(ctx context.Context, conversationID, userID uuid.UUID, nodeID string) error
+    // Viewers returns the users viewing a conversation on any replica,
+    // active if they're active on any of them
+    Viewers(ctx context.Context, conversationID uuid.UUID) ([]Viewer, error)
+    // Expire drops entries that expired and returns them. Each entry is
+    // returned to one caller only, however many replicas sweep at once.
+    Expire(ctx context.Context) ([]ExpiredPresence, error)
+}
+
+// NewPresenceStore returns the presence store cfg selects, or nil when each
+// replica only knows its own viewers
+func NewPresenceStore(cfg config.WebSocketConfig, redisClient *redis.Client) (PresenceStore, error) {
+    switch cfg.Presence {
+    case "":
+        return nil, nil
+    case "redis":
+        return NewRedisPresence(redisClient), nil
+    default:
+        return nil, fmt.Errorf("unknown websocket presence store %q", cfg.Presence)
+    }
+}
+
+// presenceEvent is the event for a viewer going from one state to another,
+// an empty state being absent
+func presenceEvent(from, to string) string {
+    switch {
+    case from == to:
+        return ""
+    case to == "":
+        return PresenceLeft
+    case from == "":
+        return PresenceJoined
+    default:
+        return to
+    }
+}
+
+// mergePresence keeps the livelier of two states of one user
+func mergePresence(a, b string) string {
+    if a == PresenceActive || b == PresenceActive {
+        return PresenceActive
+    }
+    if a == PresenceIdle || b == PresenceIdle {
+        return PresenceIdle
+    }
+    return ""
+}
+
+// sortedViewers turns the merged states of users into viewers
+func sortedViewers(states map[uuid.UUID]string) []Viewer {
+    viewers := make([]Viewer, 0, len(states))
+    for userID, state := range states {
+        viewers = append(viewers, Viewer{UserID: userID, State: state})
+    }
+    sort.Slice(viewers, func(i, j int) bool { return viewers[i].UserID.String() < viewers[j].UserID.String() })
+    return viewers
+}
+
+// presenceKey identifies a user in a conversation
+type presenceKey struct {
+    conversationID uuid.UUID
+    userID         uuid.UUID
+}
+
+// ConversationViewers returns the users viewing a conversation, from the
+// presence store when there is one and from this replica's clients otherwise
+func (h *Hub) ConversationViewers(ctx context.Context, conversationID uuid.UUID) ([]Viewer, error) {
+    if h.presenceStore != nil {
+        return h.presenceStore.Viewers(ctx, conversationID)
+    }
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    states := make(map[uuid.UUID]string)
+    for client := range h.conversations[conversationID] {
+        states[client.userID] = mergePresence(states[client.userID], h.clientPresence(client, time.Now()))
+    }
+    return sortedViewers(states), nil
+}
+
+// clientPresence is the state of one client
+func (h *Hub) clientPresence(client *Client, now time.Time) string {
+    if now.Sub(client.GetLastInput()) > h.idleAfter {
+        return PresenceIdle
+    }
+    return PresenceActive
+}
+
+// localPresence is the state of a user's clients in a conversation on this
+// replica, empty when there are none
+func (h *Hub) localPresence(key presenceKey, now time.Time) string {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    state := ""
+    for client := range h.conversations[key.conversationID] {
+        if client.userID == key.userID {
+            state = mergePresence(state, h.clientPresence(client, now))
+        }
+    }
+    return state
+}
+
+// userPresence is the state of a user in a conversation across replicas
+func (h *Hub) userPresence(ctx context.Context, key presenceKey) (string, error) {
+    viewers, err := h.presenceStore.Viewers(ctx, key.conversationID)
+    if err != nil {
+        return "", err
+    }
+    for _, viewer := range viewers {
+        if viewer.UserID == key.userID {
+            return viewer.State, nil
+        }
+    }
+    return "", nil
+}
+
+// refreshPresence brings a user's presence in a conversation up to date
+// with this replica's clients, heartbeating it to the presence store, and
+// tells the conversation when the user's overall state changed
+func (h *Hub) refreshPresence(key presenceKey) {
+    h.presenceMu.Lock()
+    defer h.presenceMu.Unlock()
+    next := h.localPresence(key, time.Now())
+    prev := h.presence[key]
+    if next == "" {
+        delete(h.presence, key)
+    } else {
+        h.presence[key] = next
+    }
+    if h.presenceStore != nil {
+        ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+        defer cancel()
+        var err error
+        if prev, err = h.userPresence(ctx, key); err != nil {
+            log.Warn().Err(err).Str("conversation_id", key.conversationID.String()).Msg("Failed to read presence")
+            return
+        }
+        if next == "" {
+            err = h.presenceStore.Remove(ctx, key.conversationID, key.userID, h.nodeID)
+        } else {
+            err = h.presenceStore.Set(ctx, key.conversationID, key.userID, h.nodeID, next)
+        }
+        if err != nil {
+            log.Warn().Err(err).Str("conversation_id", key.conversationID.String()).Msg("Failed to update presence")
+            return
+        }
+        // Other replicas may keep the user present, or active
+        if next, err = h.userPresence(ctx, key); err != nil {
+            log.Warn().Err(err).Str("conversation_id", key.conversationID.String()).Msg("Failed to read presence")
+            return
+        }
+    }
+    h.announcePresence(key, presenceEvent(prev, next))
+}
+
+// announcePresence tells a conversation a user's state changed
+func (h *Hub) announcePresence(key presenceKey, event string) {
+    if event == "" {
+        return
+    }
+    msg := models.NewWebSocketMessage(MessageTypePresence, key.conversationID, uuid.Nil)
+    msg.Metadata = map[string]interface{}{
+        "user_id": key.userID.String(),
+        "event":   event,
+    }
+    h.BroadcastToConversation(key.conversationID, msg, nil)
+}
+
+// sweepPresence drops the viewers of replicas that stopped heartbeating,
+// such as one that crashed, and tells their conversations those users left,
+// or went idle, unless another replica keeps them there
+func (h *Hub) sweepPresence() {
+    if h.presenceStore == nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(h.ctx, publishTimeout)
+    defer cancel()
+    entries, err := h.presenceStore.Expire(ctx)
+    if err != nil {
+        log.Warn().Err(err).Msg("Failed to expire presence")
+        return
+    }
+    // A user can expire on several replicas at once
+    expired := make(map[presenceKey]string)
+    for _, entry := range entries {
+        key := presenceKey{conversationID: entry.ConversationID, userID: entry.UserID}
+        expired[key] = mergePresence(expired[key], entry.State)
+    }
+    for key, state := range expired {
+        next, err := h.userPresence(ctx, key)
+        if err != nil {
+            log.Warn().Err(err).Str("conversation_id", key.conversationID.String()).Msg("Failed to read presence")
+            continue
+        }
+        h.announcePresence(key, presenceEvent(mergePresence(state, next), next))
+    }
+}
+
+// presenceChanged refreshes the presence of a client's user in each
+// conversation it follows, after it joined or left them
+func (h *Hub) presenceChanged(client *Client, conversationIDs ...uuid.UUID) {
+    for _, conversationID := range conversationIDs {
+        h.refreshPresence(presenceKey{conversationID: conversationID, userID: client.userID})
+    }
+}
+
+// refreshAllPresence catches viewers going idle or active, heartbeats every
+// viewer on this replica and sweeps out those of dead replicas. A pass still
+// running when the next is due is left to finish.
+func (h *Hub) refreshAllPresence() {
+    if !h.refreshing.CompareAndSwap(false, true) {
+        return
+    }
+    defer h.refreshing.Store(false)
+    keys := make(map[presenceKey]bool)
+    h.mu.RLock()
+    for conversationID, clients := range h.conversations {
+        for client := range clients {
+            keys[presenceKey{conversationID: conversationID, userID: client.userID}] = true
+        }
+    }
+    h.mu.RUnlock()
+    // Including viewers whose clients have all gone since
+    h.presenceMu.Lock()
+    for key := range h.presence {
+        keys[key] = true
+    }
+    h.presenceMu.Unlock()
+    for key := range keys {
+        if h.ctx.Err() != nil {
+            return
+        }
+        h.refreshPresence(key)
+    }
+    h.sweepPresence()
+}
+
+// MemoryPresence keeps presence in process, standing in for Redis when
+// testing several replicas
+type MemoryPresence struct {
+    mu      sync.Mutex
+    entries map[uuid.UUID]map[string]presenceEntry // conversation, then user and node
+}
+
+type presenceEntry struct {
+    userID  uuid.UUID
+    state   string
+    expires time.Time
+}
+
+// NewMemoryPresence creates an in-process presence store
+func NewMemoryPresence() *MemoryPresence {
+    return &MemoryPresence{
+        entries: make(map[uuid.UUID]map[string]presenceEntry),
+    }
+}
+
+// Set records a user's state
+func (p *MemoryPresence) Set(ctx context.Context, conversationID, userID uuid.UUID, nodeID, state string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.entries[conversationID] == nil {
+        p.entries[conversationID] = make(map[string]presenceEntry)
+    }
+    p.entries[conversationID][presenceField(userID, nodeID)] = presenceEntry{userID: userID, state: state, expires: time.Now().Add(presenceTTL)}
+    return nil
+}
+
+// Remove drops a user
+func (p *MemoryPresence) Remove(ctx context.Context, conversationID, userID uuid.UUID, nodeID string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    delete(p.entries[conversationID], presenceField(userID, nodeID))
+    if len(p.entries[conversationID]) == 0 {
+        delete(p.entries, conversationID)
+    }
+    return nil
+}
+
+// Viewers returns the users viewing a conversation
+func (p *MemoryPresence) Viewers(ctx context.Context, conversationID uuid.UUID) ([]Viewer, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    now := time.Now()
+    states := make(map[uuid.UUID]string)
+    for _, entry := range p.entries[conversationID] {
+        // Left for Expire, which reports it
+        if now.After(entry.expires) {
+            continue
+        }
+        states[entry.userID] = mergePresence(states[entry.userID], entry.state)
+    }
+    return sortedViewers(states), nil
+}
+
+// Expire drops expired entries
+func (p *MemoryPresence) Expire(ctx context.Context) ([]ExpiredPresence, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    now := time.Now()
+    var expired []ExpiredPresence
+    for conversationID, entries := range p.entries {
+        for field, entry := range entries {
+            if !now.After(entry.expires) {
+                continue
+            }
+            expired = append(expired, ExpiredPresence{ConversationID: conversationID, UserID: entry.userID, State: entry.state})
+            delete(entries, field)
+        }
+        if len(entries) == 0 {
+            delete(p.entries, conversationID)
+        }
+    }
+    return expired, nil
+}
+
+// RedisPresence keeps a hash per conversation whose fields are a user on a
+// replica and whose values are the state and when it expires. Hash fields
+// can't expire by themselves, so readers skip stale ones, and a sorted set
+// of every entry scored by its expiry lets Expire find and drop them.
+type RedisPresence struct {
+    client *redis.Client
+}
+
+// NewRedisPresence creates a presence store in Redis
+func NewRedisPresence(client *redis.Client) *RedisPresence {
+    return &RedisPresence{
+        client: client,
+    }
+}
+
+// presenceExpiryKey is the sorted set of "<conversation>|<user>|<node>" entries
+const presenceExpiryKey = "ws_presence_expiry"
+
+// expirePresenceScript drops an entry if it's still expired, returning its
+// value, so a heartbeat racing the sweep keeps it and only one replica
+// claims it
+var expirePresenceScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+    return false
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+local value = redis.call('HGET', KEYS[2], ARGV[3])
+redis.call('HDEL', KEYS[2], ARGV[3])
+return value or ''
+`)
+
+func presenceHashKey(conversationID uuid.UUID) string {
+    return "ws_presence:" + conversationID.String()
+}
+
+func presenceField(userID uuid.UUID, nodeID string) string {
+    return userID.String() + "|" + nodeID
+}
+
+// Set records a user's state
+func (p *RedisPresence) Set(ctx context.Context, conversationID, userID uuid.UUID, nodeID, state string) error {
+    key := presenceHashKey(conversationID)
+    field := presenceField(userID, nodeID)
+    expires := time.Now().Add(presenceTTL).UnixMilli()
+    _, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HSet(ctx, key, field, state+"|"+strconv.FormatInt(expires, 10))
+        pipe.ZAdd(ctx, presenceExpiryKey, redis.Z{Score: float64(expires), Member: conversationID.String() + "|" + field})
+        // The whole hash goes once nobody heartbeats it, after the sweep
+        // had time to report its entries
+        pipe.PExpire(ctx, key, 2*presenceTTL)
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to set presence: %w", err)
+    }
+    return nil
+}
+
+// Remove drops a user
+func (p *RedisPresence) Remove(ctx context.Context, conversationID, userID uuid.UUID, nodeID string) error {
+    field := presenceField(userID, nodeID)
+    _, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HDel(ctx, presenceHashKey(conversationID), field)
+        pipe.ZRem(ctx, presenceExpiryKey, conversationID.String()+"|"+field)
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to remove presence: %w", err)
+    }
+    return nil
+}
+
+// Viewers returns the users viewing a conversation
+func (p *RedisPresence) Viewers(ctx context.Context, conversationID uuid.UUID) ([]Viewer, error) {
+    key := presenceHashKey(conversationID)
+    fields, err := p.client.HGetAll(ctx, key).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read presence: %w", err)
+    }
+    now := time.Now().UnixMilli()
+    states := make(map[uuid.UUID]string)
+    for field, value := range fields {
+        user, _, _ := strings.Cut(field, "|")
+        state, expiresAt, _ := strings.Cut(value, "|")
+        userID, err := uuid.Parse(user)
+        expires, _ := strconv.ParseInt(expiresAt, 10, 64)
+        // Stale entries are left for Expire, which reports them
+        if err != nil || expires < now {
+            continue
+        }
+        states[userID] = mergePresence(states[userID], state)
+    }
+    return sortedViewers(states), nil
+}
+
+// Expire drops a batch of expired entries
+func (p *RedisPresence) Expire(ctx context.Context) ([]ExpiredPresence, error) {
+    now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+    members, err := p.client.ZRangeByScore(ctx, presenceExpiryKey, &redis.ZRangeBy{Min: "-inf", Max: now, Count: presenceSweepBatch}).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to find expired presence: %w", err)
+    }
+    var expired []ExpiredPresence
+    for _, member := range members {
+        conversation, field, _ := strings.Cut(member, "|")
+        user, _, _ := strings.Cut(field, "|")
+        conversationID, conversationErr := uuid.Parse(conversation)
+        userID, userErr := uuid.Parse(user)
+        if conversationErr != nil || userErr != nil {
+            p.client.ZRem(ctx, presenceExpiryKey, member)
+            continue
+        }
+        value, err := expirePresenceScript.Run(ctx, p.client, []string{presenceExpiryKey, presenceHashKey(conversationID)}, member, now, field).Text()
+        if err == redis.Nil {
+            // Heartbeated since, or claimed by another replica
+            continue
+        }
+        if err != nil {
+            return expired, fmt.Errorf("failed to expire presence: %w", err)
+        }
+        state, _, _ := strings.Cut(value, "|")
+        expired = append(expired, ExpiredPresence{ConversationID: conversationID, UserID: userID, State: state})
+    }
+    return expired, nil
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// expirePresence backdates a replica's entry as if it stopped heartbeating
+func expirePresence(store *MemoryPresence, conversationID, userID uuid.UUID, nodeID string) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    field := presenceField(userID, nodeID)
+    entry := store.entries[conversationID][field]
+    entry.expires = time.Now().Add(-time.Second)
+    store.entries[conversationID][field] = entry
+}
+
+// receivePresence returns the next presence event as user ID and event
+func receivePresence(t *testing.T, client *Client) (string, string) {
+    select {
+    case data := <-client.send:
+        var msg struct {
+            Metadata struct {
+                UserID string `json:"user_id"`
+                Event  string `json:"event"`
+            } `json:"metadata"`
+        }
+        require.NoError(t, json.Unmarshal(data, &msg))
+        return msg.Metadata.UserID, msg.Metadata.Event
+    case <-time.After(2 * time.Second):
+        t.Fatal("no presence event received")
+        return "", ""
+    }
+}
+
+func TestMemoryPresenceExpire(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryPresence()
+    conversationID, userID := uuid.New(), uuid.New()
+    require.NoError(t, store.Set(ctx, conversationID, userID, "live", PresenceIdle))
+    require.NoError(t, store.Set(ctx, conversationID, userID, "dead", PresenceActive))
+    expirePresence(store, conversationID, userID, "dead")
+
+    viewers, err := store.Viewers(ctx, conversationID)
+    require.NoError(t, err)
+    assert.Equal(t, []Viewer{{UserID: userID, State: PresenceIdle}}, viewers)
+
+    expired, err := store.Expire(ctx)
+    require.NoError(t, err)
+    assert.Equal(t, []ExpiredPresence{{ConversationID: conversationID, UserID: userID, State: PresenceActive}}, expired)
+    expired, err = store.Expire(ctx)
+    require.NoError(t, err)
+    assert.Empty(t, expired)
+}
+
+func TestHubSweepsDeadReplicas(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryPresence()
+    hub := NewHubWithOptions(HubOptions{NodeID: "live", Presence: store})
+    go hub.Run()
+    defer hub.Shutdown()
+    conversationID := uuid.New()
+    client := registerTestClient(t, hub, conversationID)
+    user, event := receivePresence(t, client)
+    require.Equal(t, client.userID.String(), user)
+    require.Equal(t, PresenceJoined, event)
+
+    // One viewer was only on a replica that died, another is still idle on
+    // a live one
+    gone, stays := uuid.New(), uuid.New()
+    require.NoError(t, store.Set(ctx, conversationID, gone, "dead", PresenceActive))
+    require.NoError(t, store.Set(ctx, conversationID, stays, "dead", PresenceActive))
+    require.NoError(t, store.Set(ctx, conversationID, stays, "other", PresenceIdle))
+    expirePresence(store, conversationID, gone, "dead")
+    expirePresence(store, conversationID, stays, "dead")
+
+    hub.sweepPresence()
+    events := make(map[string]string)
+    for len(events) < 2 {
+        user, event := receivePresence(t, client)
+        events[user] = event
+    }
+    assert.Equal(t, map[string]string{gone.String(): PresenceLeft, stays.String(): PresenceIdle}, events)
+
+    // Swept entries aren't reported again
+    hub.sweepPresence()
+    select {
+    case data := <-client.send:
+        t.Fatalf("unexpected %s", data)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
@@ -0,0 +1,269 @@
+package websocket
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/redis/go-redis/v9"
+
+    "github.com/D43M0N18/qilin_core/internal/config"
+)
+
+const (
+    // DefaultReplaySize is how many frames of a conversation are kept by default
+    DefaultReplaySize = 1000
+    // DefaultReplayTTL is how long frames are kept after a conversation's last one
+    DefaultReplayTTL = time.Hour
+)
+
+// MessageTypeResync tells a reconnecting client that frames it missed are
+// no longer kept, so it must reload the conversation
+const MessageTypeResync = "resync_required"
+
+// ErrResyncRequired is returned by Since when frames after the requested
+// sequence number have been dropped from the buffer
+var ErrResyncRequired = errors.New("resync required")
+
+// ReplayBuffer numbers the frames sent to a conversation and keeps the
+// latest of them, so clients that reconnect can be sent what they missed
+type ReplayBuffer interface {
+    // Append stores a frame and returns its sequence number, one more than
+    // the previous frame of the conversation
+    Append(ctx context.Context, conversationID uuid.UUID, frame []byte) (int64, error)
+    // Since returns the frames after seq, stamped with their sequence numbers
+    Since(ctx context.Context, conversationID uuid.UUID, seq int64) ([]Frame, error)
+}
+
+// Frame is a sequenced message of a conversation
+type Frame struct {
+    Seq  int64
+    Data []byte // JSON with "seq" set
+}
+
+// NewReplayBuffer returns the replay buffer cfg selects, or nil when frames
+// aren't sequenced. The memory buffer numbers frames per replica, so it only
+// suits a single replica.
+func NewReplayBuffer(cfg config.WebSocketConfig, redisClient *redis.Client) (ReplayBuffer, error) {
+    switch cfg.Replay {
+    case "":
+        return nil, nil
+    case "memory":
+        return NewMemoryReplay(cfg.ReplaySize, cfg.ReplayTTL), nil
+    case "redis":
+        return NewRedisReplay(redisClient, cfg.ReplaySize, cfg.ReplayTTL), nil
+    default:
+        return nil, fmt.Errorf("unknown websocket replay buffer %q", cfg.Replay)
+    }
+}
+
+// stampSequence adds "seq" to a JSON object
+func stampSequence(data []byte, seq int64) []byte {
+    return stampField(data, "seq", strconv.AppendInt(nil, seq, 10))
+}
+
+// stampField adds a field, whose value is already JSON, at the start of a
+// JSON object
+func stampField(data []byte, name string, value []byte) []byte {
+    data = bytes.TrimSpace(data)
+    if len(data) < 2 || data[0] != '{' {
+        return data
+    }
+    stamped := make([]byte, 0, len(data)+len(name)+len(value)+4)
+    stamped = append(stamped, '{', '"')
+    stamped = append(stamped, name...)
+    stamped = append(stamped, '"', ':')
+    stamped = append(stamped, value...)
+    if rest := bytes.TrimSpace(data[1:]); len(rest) > 0 && rest[0] != '}' {
+        stamped = append(stamped, ',')
+    }
+    return append(stamped, data[1:]...)
+}
+
+// MemoryReplay keeps frames in process
+type MemoryReplay struct {
+    mu            sync.Mutex
+    size          int
+    ttl           time.Duration
+    conversations map[uuid.UUID]*replayLog
+    lastPrune     time.Time
+}
+
+// replayLog is a ring of the latest frames of one conversation
+type replayLog struct {
+    frames   []Frame
+    next     int // where the next frame goes
+    seq      int64
+    lastUsed time.Time
+}
+
+// NewMemoryReplay keeps the last size frames of each conversation, and
+// forgets conversations without frames for ttl
+func NewMemoryReplay(size int, ttl time.Duration) *MemoryReplay {
+    if size <= 0 {
+        size = DefaultReplaySize
+    }
+    if ttl <= 0 {
+        ttl = DefaultReplayTTL
+    }
+    return &MemoryReplay{
+        size:          size,
+        ttl:           ttl,
+        conversations: make(map[uuid.UUID]*replayLog),
+    }
+}
+
+// Append stores a frame
+func (r *MemoryReplay) Append(ctx context.Context, conversationID uuid.UUID, frame []byte) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    if now.Sub(r.lastPrune) > time.Minute {
+        r.prune(now)
+    }
+    l, ok := r.conversations[conversationID]
+    if !ok {
+        l = &replayLog{frames: make([]Frame, 0, min(r.size, 64))}
+        r.conversations[conversationID] = l
+    }
+    l.seq++
+    l.lastUsed = now
+    stamped := Frame{Seq: l.seq, Data: stampSequence(frame, l.seq)}
+    if len(l.frames) < r.size {
+        l.frames = append(l.frames, stamped)
+    } else {
+        l.frames[l.next] = stamped
+    }
+    l.next = (l.next + 1) % r.size
+    return l.seq, nil
+}
+
+// Since returns the frames after seq
+func (r *MemoryReplay) Since(ctx context.Context, conversationID uuid.UUID, seq int64) ([]Frame, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    l, ok := r.conversations[conversationID]
+    if !ok {
+        if seq > 0 {
+            return nil, ErrResyncRequired
+        }
+        return nil, nil
+    }
+    if seq > l.seq {
+        // The client saw frames this buffer doesn't know of, from before a restart
+        return nil, ErrResyncRequired
+    }
+    missed := int(l.seq - seq)
+    if missed > len(l.frames) {
+        return nil, ErrResyncRequired
+    }
+    frames := make([]Frame, 0, missed)
+    for n := len(l.frames) - missed; n < len(l.frames); n++ {
+        // The oldest frame sits at next once the ring is full
+        frames = append(frames, l.frames[(l.next+n)%len(l.frames)])
+    }
+    return frames, nil
+}
+
+func (r *MemoryReplay) prune(now time.Time) {
+    r.lastPrune = now
+    for id, l := range r.conversations {
+        if now.Sub(l.lastUsed) > r.ttl {
+            delete(r.conversations, id)
+        }
+    }
+}
+
+// appendFrame increments a conversation's counter and adds the frame to its
+// stream under the ID <seq>-0, atomically so frames from several replicas
+// are numbered in the order they're stored
+var appendFrame = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('XADD', KEYS[2], 'MAXLEN', ARGV[2], seq .. '-0', 'f', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return seq
+`)
+
+// RedisReplay keeps frames in a Redis stream per conversation, shared by
+// every replica
+type RedisReplay struct {
+    client *redis.Client
+    size   int
+    ttl    time.Duration
+}
+
+// NewRedisReplay keeps the last size frames of each conversation for ttl
+// after its last frame
+func NewRedisReplay(client *redis.Client, size int, ttl time.Duration) *RedisReplay {
+    if size <= 0 {
+        size = DefaultReplaySize
+    }
+    if ttl <= 0 {
+        ttl = DefaultReplayTTL
+    }
+    return &RedisReplay{
+        client: client,
+        size:   size,
+        ttl:    ttl,
+    }
+}
+
+func replaySeqKey(conversationID uuid.UUID) string {
+    return "ws_seq:" + conversationID.String()
+}
+
+func replayStreamKey(conversationID uuid.UUID) string {
+    return "ws_replay:" + conversationID.String()
+}
+
+// Append stores a frame
+func (r *RedisReplay) Append(ctx context.Context, conversationID uuid.UUID, frame []byte) (int64, error) {
+    keys := []string{replaySeqKey(conversationID), replayStreamKey(conversationID)}
+    seq, err := appendFrame.Run(ctx, r.client, keys, frame, r.size, r.ttl.Milliseconds()).Int64()
+    if err != nil {
+        return 0, fmt.Errorf("failed to append frame: %w", err)
+    }
+    return seq, nil
+}
+
+// Since returns the frames after seq
+func (r *RedisReplay) Since(ctx context.Context, conversationID uuid.UUID, seq int64) ([]Frame, error) {
+    current, err := r.client.Get(ctx, replaySeqKey(conversationID)).Int64()
+    if errors.Is(err, redis.Nil) {
+        current = 0
+    } else if err != nil {
+        return nil, fmt.Errorf("failed to read sequence: %w", err)
+    }
+    if seq > current {
+        return nil, ErrResyncRequired
+    }
+    if seq == current {
+        return nil, nil
+    }
+    entries, err := r.client.XRange(ctx, replayStreamKey(conversationID), "("+strconv.FormatInt(seq, 10)+"-0", "+").Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read frames: %w", err)
+    }
+    frames := make([]Frame, 0, len(entries))
+    for _, entry := range entries {
+        id, _, _ := strings.Cut(entry.ID, "-")
+        n, err := strconv.ParseInt(id, 10, 64)
+        if err != nil {
+            continue
+        }
+        data, _ := entry.Values["f"].(string)
+        frames = append(frames, Frame{Seq: n, Data: stampSequence([]byte(data), n)})
+    }
+    // Trimmed frames leave a gap between seq and the first one kept
+    if len(frames) == 0 || frames[0].Seq != seq+1 {
+        return nil, ErrResyncRequired
+    }
+    return frames, nil
+}
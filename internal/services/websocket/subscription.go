@@ -0,0 +1,170 @@
+package websocket
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    "github.com/google/uuid"
+
+    "github.com/D43M0N18/qilin_core/internal/models"
+)
+
+// Message types of a user socket, which follows any number of the user's
+// conversations over one connection
+const (
+    MessageTypeSubscribe    = "subscribe"
+    MessageTypeUnsubscribe  = "unsubscribe"
+    MessageTypeSubscribed   = "subscribed"
+    MessageTypeUnsubscribed = "unsubscribed"
+)
+
+// MaxSubscriptions bounds how many conversations one socket follows
+const MaxSubscriptions = 100
+
+var (
+    // ErrTooManySubscriptions is returned when a socket follows
+    // MaxSubscriptions conversations already
+    ErrTooManySubscriptions = errors.New("too many subscriptions")
+    // ErrNotSubscribed is returned for messages to a conversation the socket
+    // doesn't follow
+    ErrNotSubscribed = errors.New("not subscribed to conversation")
+    // ErrBoundConversation is returned when a conversation socket tries to
+    // leave the conversation it was opened for
+    ErrBoundConversation = errors.New("socket is bound to this conversation")
+)
+
+// Subscribe adds a client to a conversation's broadcasts. The caller checks
+// that the client's user may see the conversation. Critical messages of the
+// conversation that are due go out to it straight away.
+func (h *Hub) Subscribe(client *Client, conversationID uuid.UUID) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if err := client.addSubscription(conversationID); err != nil {
+        return err
+    }
+    // A client not registered yet is indexed when it is
+    if h.clients[client.userID][client] {
+        h.index(client, conversationID)
+        go h.presenceChanged(client, conversationID)
+    }
+    if h.inbox != nil {
+        go h.redeliverTo(client.userID)
+    }
+    return nil
+}
+
+// Unsubscribe removes a client from a conversation's broadcasts
+func (h *Hub) Unsubscribe(client *Client, conversationID uuid.UUID) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if err := client.removeSubscription(conversationID); err != nil {
+        return err
+    }
+    h.unindex(client, conversationID)
+    go h.presenceChanged(client, conversationID)
+    return nil
+}
+
+// index adds a client to a conversation's clients. h.mu must be held.
+func (h *Hub) index(client *Client, conversationID uuid.UUID) {
+    if h.conversations[conversationID] == nil {
+        h.conversations[conversationID] = make(map[*Client]bool)
+    }
+    h.conversations[conversationID][client] = true
+}
+
+// unindex removes a client from a conversation's clients. h.mu must be held.
+func (h *Hub) unindex(client *Client, conversationID uuid.UUID) {
+    if clients, ok := h.conversations[conversationID]; ok {
+        delete(clients, client)
+        if len(clients) == 0 {
+            delete(h.conversations, conversationID)
+        }
+    }
+}
+
+// Subscriptions returns the conversations the client follows, including the
+// one a conversation socket was opened for
+func (c *Client) Subscriptions() []uuid.UUID {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    ids := make([]uuid.UUID, 0, len(c.subscriptions))
+    for id := range c.subscriptions {
+        ids = append(ids, id)
+    }
+    return ids
+}
+
+// IsSubscribed reports whether the client follows a conversation
+func (c *Client) IsSubscribed(conversationID uuid.UUID) bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.subscriptions[conversationID]
+}
+
+func (c *Client) addSubscription(conversationID uuid.UUID) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.subscriptions[conversationID] {
+        return nil
+    }
+    if len(c.subscriptions) >= MaxSubscriptions {
+        return ErrTooManySubscriptions
+    }
+    c.subscriptions[conversationID] = true
+    return nil
+}
+
+func (c *Client) removeSubscription(conversationID uuid.UUID) error {
+    if conversationID == c.conversationID {
+        return ErrBoundConversation
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    delete(c.subscriptions, conversationID)
+    return nil
+}
+
+// subscribe follows a conversation once the message handler confirms the
+// client's user may see it
+func (c *Client) subscribe(ctx context.Context, conversationID uuid.UUID) error {
+    if conversationID == uuid.Nil {
+        return fmt.Errorf("subscribe without conversation_id")
+    }
+    if c.messageHandler == nil {
+        return fmt.Errorf("subscriptions not supported")
+    }
+    if err := c.messageHandler.AuthorizeSubscription(ctx, c, conversationID); err != nil {
+        return err
+    }
+    if err := c.hub.Subscribe(c, conversationID); err != nil {
+        return err
+    }
+    return c.SendMessage(models.NewWebSocketMessage(MessageTypeSubscribed, conversationID, uuid.Nil))
+}
+
+func (c *Client) unsubscribe(conversationID uuid.UUID) error {
+    if conversationID == uuid.Nil {
+        return fmt.Errorf("unsubscribe without conversation_id")
+    }
+    if err := c.hub.Unsubscribe(c, conversationID); err != nil {
+        return err
+    }
+    return c.SendMessage(models.NewWebSocketMessage(MessageTypeUnsubscribed, conversationID, uuid.Nil))
+}
+
+// route sets the conversation a message is for: the one it names, which the
+// client must follow, or else the conversation the socket was opened for
+func (c *Client) route(msg *IncomingMessage) error {
+    if msg.ConversationID == uuid.Nil {
+        msg.ConversationID = c.conversationID
+    }
+    if msg.ConversationID == uuid.Nil {
+        return fmt.Errorf("%s without conversation_id", msg.Type)
+    }
+    if !c.IsSubscribed(msg.ConversationID) {
+        return ErrNotSubscribed
+    }
+    return nil
+}